@@ -0,0 +1,313 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Eclipse Public License 2.0 which is available at
+// https://www.eclipse.org/legal/epl-2.0, or the Apache License, Version 2.0
+// which is available at https://www.apache.org/licenses/LICENSE-2.0.
+//
+// SPDX-License-Identifier: EPL-2.0 OR Apache-2.0
+
+// Package app runs the message router of the cloud connector. It is copied from the launcher of the Eclipse Kanto
+// Azure connector, github.com/eclipse-kanto/azure-connector/cmd/azure-connector/app, under its license and
+// additionally passes the Azure IoT Hub publisher to the message handlers that send messages on their own.
+package app
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/eclipse-kanto/suite-connector/config"
+	"github.com/eclipse-kanto/suite-connector/connector"
+	"github.com/eclipse-kanto/suite-connector/logger"
+	"github.com/eclipse-kanto/suite-connector/routing"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+	azurerouting "github.com/eclipse-kanto/azure-connector/routing"
+	routingbus "github.com/eclipse-kanto/azure-connector/routing/bus"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
+)
+
+// publishAckTimeout is the time to wait for the acknowledgement of a message sent through the offline buffer, a
+// message that is not acknowledged in time is stored in the offline buffer
+const publishAckTimeout = 10 * time.Second
+
+// CloudPublisherAware is implemented by the message handlers that send messages to the Azure IoT Hub outside of the
+// handling of an incoming message, e.g. when a command reply times out. The publisher is set before the router starts.
+type CloudPublisherAware interface {
+	SetCloudPublisher(publisher message.Publisher)
+}
+
+// BufferedTelemetryHandler is implemented by the telemetry handlers whose D2C messages are stored in the offline
+// buffer while the Azure IoT Hub is not reachable. The messages of the other telemetry handlers, e.g. the command
+// replies and the reported properties of the device twin, are sent to the Azure IoT Hub directly.
+type BufferedTelemetryHandler interface {
+	handlers.TelemetryHandler
+	BufferOffline() bool
+}
+
+// Flusher is implemented by the telemetry handlers that hold back D2C messages, e.g. to send them in batches. The held
+// back messages are flushed when the router closes the publisher of the handler.
+type Flusher interface {
+	Flush()
+}
+
+// flushingPublisher flushes the telemetry handlers before it closes the wrapped publisher, so their held back messages
+// are still sent, or stored in the offline buffer, when the router closes.
+type flushingPublisher struct {
+	message.Publisher
+	handlers []handlers.TelemetryHandler
+}
+
+func (p *flushingPublisher) Close() error {
+	for _, handler := range p.handlers {
+		if flusher, ok := handler.(Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	return p.Publisher.Close()
+}
+
+// splitTelemetryHandlers separates the telemetry handlers whose messages are stored in the offline buffer from the
+// other telemetry handlers.
+func splitTelemetryHandlers(telemetryHandlers []handlers.TelemetryHandler) ([]handlers.TelemetryHandler, []handlers.TelemetryHandler) {
+	buffered := []handlers.TelemetryHandler{}
+	direct := []handlers.TelemetryHandler{}
+	for _, handler := range telemetryHandlers {
+		if bufferedHandler, ok := handler.(BufferedTelemetryHandler); ok && bufferedHandler.BufferOffline() {
+			buffered = append(buffered, handler)
+		} else {
+			direct = append(direct, handler)
+		}
+	}
+	return buffered, direct
+}
+
+// setCloudPublisher passes the telemetry publisher, which stores the messages in the offline buffer if enabled, to the
+// buffered telemetry handlers and the Azure IoT Hub publisher to the other handlers.
+func setCloudPublisher(telemetryPublisher, publisher message.Publisher, bufferedHandlers, telemetryHandlers []handlers.TelemetryHandler, commandHandlers []handlers.CommandHandler, cloudHandlers []bus.CloudHandler) {
+	for _, handler := range bufferedHandlers {
+		if aware, ok := handler.(CloudPublisherAware); ok {
+			aware.SetCloudPublisher(telemetryPublisher)
+		}
+	}
+	for _, handler := range telemetryHandlers {
+		if aware, ok := handler.(CloudPublisherAware); ok {
+			aware.SetCloudPublisher(publisher)
+		}
+	}
+	for _, handler := range commandHandlers {
+		if aware, ok := handler.(CloudPublisherAware); ok {
+			aware.SetCloudPublisher(publisher)
+		}
+	}
+	for _, handler := range cloudHandlers {
+		if aware, ok := handler.(CloudPublisherAware); ok {
+			aware.SetCloudPublisher(publisher)
+		}
+	}
+}
+
+func startRouter(
+	localClient *connector.MQTTConnection,
+	settings *azurecfg.AzureSettings,
+	connSettings *azurecfg.AzureConnectionSettings,
+	statusPub message.Publisher,
+	telemetryHandlers []handlers.TelemetryHandler,
+	commandHandlers []handlers.CommandHandler,
+	cloudHandlers []bus.CloudHandler,
+	offlineQueue *store.Queue,
+	done chan bool,
+	logger logger.Logger,
+) (*message.Router, error) {
+	cloudClient, err := config.CreateCloudConnection(&settings.LocalConnectionSettings, false, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create mosquitto connection")
+	}
+
+	azureClient, err := azurecfg.CreateAzureHubConnection(settings, connSettings, logger)
+	if err != nil {
+		routing.SendStatus(routing.StatusConnectionError, statusPub, logger)
+		return nil, errors.Wrap(err, "cannot create Hub connection")
+	}
+
+	logger.Info("Starting messages router...", nil)
+	router, err := message.NewRouter(message.RouterConfig{}, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create router")
+	}
+
+	paramsPub := connector.NewPublisher(localClient, connector.QosAtMostOnce, logger, nil)
+	paramsSub := connector.NewSubscriber(cloudClient, connector.QosAtMostOnce, false, logger, nil)
+
+	gwParams := azurerouting.NewAzureGwParams(connSettings.DeviceID, settings.TenantID, connSettings.HubName)
+	routing.ParamsBus(router, gwParams, paramsPub, paramsSub, logger)
+	routing.SendGwParams(gwParams, false, paramsPub, logger)
+
+	azurePub := connector.NewPublisher(azureClient, connector.QosAtLeastOnce, logger, nil)
+	azureSub := connector.NewSubscriber(azureClient, connector.QosAtMostOnce, false, logger, nil)
+	mosquittoSub := connector.NewSubscriber(cloudClient, connector.QosAtLeastOnce, false, router.Logger(), nil)
+
+	var telemetryPub message.Publisher
+	var forwardingPub *store.ForwardingPublisher
+	if offlineQueue != nil {
+		onlinePub := connector.NewOnlinePublisher(azureClient, connector.QosAtLeastOnce, publishAckTimeout, logger, nil)
+		forwardingPub = store.NewForwardingPublisher(onlinePub, offlineQueue, logger)
+		azureClient.AddConnectionListener(forwardingPub)
+		telemetryPub = forwardingPub
+	} else {
+		// a publisher of its own, which is not closed by the other handlers before the buffered handlers are flushed
+		telemetryPub = connector.NewPublisher(azureClient, connector.QosAtLeastOnce, logger, nil)
+	}
+	bufferedHandlers, directHandlers := splitTelemetryHandlers(telemetryHandlers)
+	setCloudPublisher(telemetryPub, azurePub, bufferedHandlers, directHandlers, commandHandlers, cloudHandlers)
+	bufferedPub := &flushingPublisher{Publisher: telemetryPub, handlers: bufferedHandlers}
+	routingbus.TelemetryBus(router, bufferedPub, mosquittoSub, &connSettings.RemoteConnectionInfo, bufferedHandlers)
+	routingbus.TelemetryBus(router, azurePub, mosquittoSub, &connSettings.RemoteConnectionInfo, directHandlers)
+
+	cloudPub := connector.NewPublisher(cloudClient, connector.QosAtLeastOnce, router.Logger(), nil)
+	routingbus.CommandBus(router, cloudPub, azureSub, &connSettings.RemoteConnectionInfo, commandHandlers)
+	bus.CloudBus(router, cloudPub, azureSub, &connSettings.RemoteConnectionInfo, cloudHandlers)
+
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			defer func() {
+				done <- true
+			}()
+
+			<-router.Running()
+
+			statusHandler := &routing.ConnectionStatusHandler{
+				Pub:    statusPub,
+				Logger: logger,
+			}
+			cloudClient.AddConnectionListener(statusHandler)
+
+			reconnectHandler := &routing.ReconnectHandler{
+				Pub:    paramsPub,
+				Params: gwParams,
+				Logger: logger,
+			}
+			cloudClient.AddConnectionListener(reconnectHandler)
+
+			connHandler := &routing.CloudConnectionHandler{
+				CloudClient: cloudClient,
+				Logger:      logger,
+			}
+			azureClient.AddConnectionListener(connHandler)
+
+			errorsHandler := &routing.ErrorsHandler{
+				StatusPub: statusPub,
+				Logger:    logger,
+			}
+			azureClient.AddConnectionListener(errorsHandler)
+
+			if err := config.HonoConnect(nil, statusPub, azureClient, logger); err != nil {
+				router.Close()
+				return
+			}
+
+			if connSettings.SharedAccessKey != nil {
+				tokenRefreshPeriod := int64(connSettings.TokenValidity.Seconds() * azurecfg.SASTokenValidityFactor)
+				go func() {
+					for {
+						select {
+						case <-time.After(time.Duration(tokenRefreshPeriod) * time.Second):
+							logger.Debug("SAS token validity period is about to expire.", nil)
+							azureClient.Disconnect()
+							routing.SendStatus(azurerouting.StatusConnectionTokenExpired, statusPub, logger)
+
+							if err := config.HonoConnect(nil, statusPub, azureClient, logger); err != nil {
+								router.Close()
+								return
+							}
+						case <-ctx.Done():
+							return
+						}
+					}
+				}()
+			}
+
+			<-ctx.Done()
+
+			azureClient.RemoveConnectionListener(errorsHandler)
+			if forwardingPub != nil {
+				azureClient.RemoveConnectionListener(forwardingPub)
+			}
+			azureClient.RemoveConnectionListener(connHandler)
+			cloudClient.RemoveConnectionListener(reconnectHandler)
+			cloudClient.RemoveConnectionListener(statusHandler)
+
+			defer routing.SendStatus(routing.StatusConnectionClosed, statusPub, logger)
+
+			defer azureClient.Disconnect()
+
+			cloudClient.Disconnect()
+		}()
+
+		if err := router.Run(context.Background()); err != nil {
+			logger.Error("Failed to create cloud router", err, nil)
+		}
+
+		logger.Info("Messages router stopped", nil)
+	}()
+
+	return router, nil
+}
+
+// MainLoop is the main loop of the application, the cloud handlers receive the Azure IoT Hub messages on other topics
+// than the cloud-to-device messages, e.g. the direct method invocations. The telemetry messages are stored in the
+// offline queue while the Azure IoT Hub is not reachable, if it is not nil.
+func MainLoop(settings *azurecfg.AzureSettings, log logger.Logger, idScopeProvider azurecfg.IDScopeProvider, telemetryHandlers []handlers.TelemetryHandler, commandHandlers []handlers.CommandHandler, cloudHandlers []bus.CloudHandler, offlineQueue *store.Queue) error {
+	localClient, err := config.CreateLocalConnection(&settings.LocalConnectionSettings, log)
+	if err != nil {
+		return errors.Wrap(err, "cannot create mosquitto connection")
+	}
+	if err := config.LocalConnect(context.Background(), localClient, log); err != nil {
+		return errors.Wrap(err, "cannot connect to mosquitto")
+	}
+	defer localClient.Disconnect()
+
+	statusPub := connector.NewPublisher(localClient, connector.QosAtLeastOnce, log, nil)
+	defer statusPub.Close()
+
+	connSettings, err := azurecfg.PrepareAzureConnectionSettings(settings, idScopeProvider, log)
+	if err != nil {
+		return errors.Wrap(err, "cannot create Azure IoT Hub device connection settings")
+	}
+
+	done := make(chan bool, 1)
+	azureRouter, err := startRouter(localClient, settings, connSettings, statusPub, telemetryHandlers, commandHandlers, cloudHandlers, offlineQueue, done, log)
+	if err != nil {
+		log.Error("Failed to create message bus", err, nil)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	stopRouter(azureRouter, done)
+
+	return nil
+}
+
+func stopRouter(router *message.Router, done <-chan bool) {
+	if router != nil {
+		router.Close()
+		<-done
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package app
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/passthrough"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/command"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/telemetry"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/twin"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitTelemetryHandlers(t *testing.T) {
+	mapperConfig := &mapperconfig.MessageMapperConfig{}
+	counters, err := sequence.NewCounters("", sequence.DefaultWidth, 0, 0)
+	require.NoError(t, err)
+	snapshots := mapper.NewHolder(mapperConfig, nil, false)
+	thingsHandler := telemetry.CreateThingsTelemetryHandler(snapshots, counters, watermill.NopLogger{})
+	passthroughHandler := passthrough.CreateTelemetryHandler("e/#")
+	replyHandler := command.CreateThingsReplyHandler(snapshots, watermill.NopLogger{})
+	reportedHandler := twin.CreateReportedPropertiesHandler(snapshots)
+
+	buffered, direct := splitTelemetryHandlers([]handlers.TelemetryHandler{passthroughHandler, thingsHandler, replyHandler, reportedHandler})
+	assert.Equal(t, []handlers.TelemetryHandler{thingsHandler}, buffered)
+	assert.Equal(t, []handlers.TelemetryHandler{passthroughHandler, replyHandler, reportedHandler}, direct)
+}
+
+type flushRecorder struct {
+	handlers.TelemetryHandler
+	calls *[]string
+}
+
+func (r *flushRecorder) Flush() {
+	*r.calls = append(*r.calls, "flush")
+}
+
+type closeRecorder struct {
+	message.Publisher
+	calls *[]string
+}
+
+func (r *closeRecorder) Close() error {
+	*r.calls = append(*r.calls, "close")
+	return nil
+}
+
+func TestFlushingPublisherClose(t *testing.T) {
+	calls := []string{}
+	publisher := &flushingPublisher{
+		Publisher: &closeRecorder{calls: &calls},
+		handlers:  []handlers.TelemetryHandler{&flushRecorder{calls: &calls}, passthrough.CreateTelemetryHandler("e/#")},
+	}
+	require.NoError(t, publisher.Close())
+	assert.Equal(t, []string{"flush", "close"}, calls)
+}
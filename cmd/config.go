@@ -13,31 +13,129 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/eclipse-kanto/azure-connector/config"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
 )
 
 const (
 	defaultMessageMapperConfig = "message-mapper-config.json"
+	defaultOfflineMaxMessages  = 10000
+	defaultOfflineMaxSize      = 64 * 1024 * 1024
+
+	flagMessageMapperConfig       = "messageMapperConfig"
+	flagMessageMapperConfigReload = "messageMapperConfigReload"
+	flagPassthroughDeviceTopics   = "passthroughDeviceTopics"
+	flagPassthroughCommandNames   = "passthroughCommandNames"
+	flagCounterStateFile          = "counterStateFile"
+	flagCounterWidth              = "counterWidth"
+	flagCounterWrapValue          = "counterWrapValue"
+	flagCounterReserve            = "counterReserve"
+	flagProtoIncludePaths         = "protoIncludePaths"
+	flagProtoPreload              = "protoPreload"
+	flagOfflineBufferDir          = "offlineBufferDir"
+	flagOfflineMaxMessages        = "offlineBufferMaxMessages"
+	flagOfflineMaxSize            = "offlineBufferMaxSize"
+	flagOfflineMaxAge             = "offlineBufferMaxAge"
+	flagOfflineDropPolicy         = "offlineBufferDropPolicy"
 
-	flagMessageMapperConfig     = "messageMapperConfig"
-	flagPassthroughDeviceTopics = "passthroughDeviceTopics"
-	flagPassthroughCommandNames = "passthroughCommandNames"
+	protoPreloadStrict  = "strict"
+	protoPreloadDegrade = "degrade"
 )
 
 // AzureSettingsExt wraps the general configurable data of the Cloud Connector with with custom properties
 type AzureSettingsExt struct {
-	PassthroughDeviceTopics string
-	PassthroughCommandNames string
-	MessageMapperConfig     string
+	PassthroughDeviceTopics   string
+	PassthroughCommandNames   string
+	MessageMapperConfig       string
+	MessageMapperConfigReload bool
+	CounterStateFile          string
+	CounterWidth              uint
+	CounterWrapValue          uint64
+	CounterReserve            uint64
+	ProtoIncludePaths         string
+	ProtoPreload              string
+	OfflineBufferDir          string
+	OfflineBufferMaxMessages  int
+	OfflineBufferMaxSize      int64
+	OfflineBufferMaxAge       string
+	OfflineBufferDropPolicy   string
 	*config.AzureSettings
 }
 
 func defaultSettings() *AzureSettingsExt {
 	return &AzureSettingsExt{
-		MessageMapperConfig: defaultMessageMapperConfig,
-		AzureSettings:       config.DefaultSettings(),
+		MessageMapperConfig:      defaultMessageMapperConfig,
+		CounterWidth:             sequence.DefaultWidth,
+		CounterReserve:           sequence.DefaultReserve,
+		OfflineBufferMaxMessages: defaultOfflineMaxMessages,
+		OfflineBufferMaxSize:     defaultOfflineMaxSize,
+		OfflineBufferDropPolicy:  store.DropOldest,
+		AzureSettings:            config.DefaultSettings(),
+	}
+}
+
+// Validate checks the general settings and the custom properties
+func (settings *AzureSettingsExt) Validate() error {
+	if err := settings.AzureSettings.Validate(); err != nil {
+		return err
+	}
+	if settings.CounterWidth == 0 || settings.CounterWidth > sequence.MaxWidth {
+		return errors.New(fmt.Sprintf("counter width %d is not between 1 and %d", settings.CounterWidth, sequence.MaxWidth))
+	}
+	if settings.CounterWidth < sequence.MaxWidth && settings.CounterWrapValue >= uint64(1)<<settings.CounterWidth {
+		return errors.New(fmt.Sprintf("counter wrap value %d does not fit in %d bits", settings.CounterWrapValue, settings.CounterWidth))
+	}
+	switch settings.ProtoPreload {
+	case "", protoPreloadStrict, protoPreloadDegrade:
+	default:
+		return errors.New(fmt.Sprintf("unsupported proto preload mode '%s'", settings.ProtoPreload))
+	}
+	for _, includePath := range parseProtoIncludePaths(settings.ProtoIncludePaths) {
+		if info, err := os.Stat(includePath); err != nil || !info.IsDir() {
+			return errors.New(fmt.Sprintf("proto include path '%s' is not a directory", includePath))
+		}
+	}
+	if _, err := settings.offlineBufferLimits(); err != nil {
+		return errors.Wrap(err, "invalid offline buffer settings")
 	}
+	return nil
+}
+
+// offlineBufferLimits returns the limits of the offline buffer, an empty maximal age is no limit.
+func (settings *AzureSettingsExt) offlineBufferLimits() (store.Limits, error) {
+	limits := store.Limits{
+		MaxMessages: settings.OfflineBufferMaxMessages,
+		MaxSize:     settings.OfflineBufferMaxSize,
+		DropPolicy:  settings.OfflineBufferDropPolicy,
+	}
+	if settings.OfflineBufferMaxAge != "" {
+		maxAge, err := time.ParseDuration(settings.OfflineBufferMaxAge)
+		if err != nil {
+			return limits, errors.Wrap(err, fmt.Sprintf("invalid maximal age '%s'", settings.OfflineBufferMaxAge))
+		}
+		limits.MaxAge = maxAge
+	}
+	return limits, limits.Validate()
+}
+
+// parseProtoIncludePaths splits the comma separated list of proto include paths.
+func parseProtoIncludePaths(includePaths string) []string {
+	paths := []string{}
+	for _, includePath := range strings.Split(includePaths, ",") {
+		if includePath = strings.TrimSpace(includePath); includePath != "" {
+			paths = append(paths, includePath)
+		}
+	}
+	return paths
 }
 
 func addMessageHandlers(f *flag.FlagSet, settings *AzureSettingsExt) {
@@ -48,6 +146,11 @@ func addMessageHandlers(f *flag.FlagSet, settings *AzureSettingsExt) {
 		"The path to the configuration file for the message mappings",
 	)
 
+	f.BoolVar(&settings.MessageMapperConfigReload,
+		flagMessageMapperConfigReload, def.MessageMapperConfigReload,
+		"Watch the configuration file for the message mappings and apply the changes without restarting the cloud connector",
+	)
+
 	f.StringVar(&settings.PassthroughDeviceTopics,
 		flagPassthroughDeviceTopics, def.PassthroughDeviceTopics,
 		"List of passthrough device topics that the cloud connector subscribes for and forwards messages to the Azure IoT Hub",
@@ -57,4 +160,59 @@ func addMessageHandlers(f *flag.FlagSet, settings *AzureSettingsExt) {
 		flagPassthroughCommandNames, def.PassthroughCommandNames,
 		"List of passthrough command names that the cloud connector filters and forwards inside the device",
 	)
+
+	f.StringVar(&settings.CounterStateFile,
+		flagCounterStateFile, def.CounterStateFile,
+		"The path to the file where the sequence counters of the message mappings are persisted, empty value keeps them in memory only",
+	)
+
+	f.UintVar(&settings.CounterWidth,
+		flagCounterWidth, def.CounterWidth,
+		"The width in bits of the sequence counters of the message mappings, a counter wraps around after its maximal value",
+	)
+
+	f.Uint64Var(&settings.CounterWrapValue,
+		flagCounterWrapValue, def.CounterWrapValue,
+		"The value a sequence counter of the message mappings restarts at after its maximal value",
+	)
+
+	f.Uint64Var(&settings.CounterReserve,
+		flagCounterReserve, def.CounterReserve,
+		"The number of values of a sequence counter reserved with each write of the counter state file, a restarted counter continues after its reserved values",
+	)
+
+	f.StringVar(&settings.ProtoIncludePaths,
+		flagProtoIncludePaths, def.ProtoIncludePaths,
+		"Comma separated list of directories where the imports of the proto files of the message mappings are searched",
+	)
+
+	f.StringVar(&settings.ProtoPreload,
+		flagProtoPreload, def.ProtoPreload,
+		"Load the proto messages of all message mappings at startup, 'strict' refuses to start and 'degrade' disables the mappings with proto messages that cannot be loaded, empty value loads them on first use",
+	)
+
+	f.StringVar(&settings.OfflineBufferDir,
+		flagOfflineBufferDir, def.OfflineBufferDir,
+		"The directory where the telemetry messages are stored while the Azure IoT Hub is not reachable and sent when it is reachable again, empty value disables the offline buffer",
+	)
+
+	f.IntVar(&settings.OfflineBufferMaxMessages,
+		flagOfflineMaxMessages, def.OfflineBufferMaxMessages,
+		"The maximal number of messages in the offline buffer, 0 is no limit",
+	)
+
+	f.Int64Var(&settings.OfflineBufferMaxSize,
+		flagOfflineMaxSize, def.OfflineBufferMaxSize,
+		"The maximal total size in bytes of the messages in the offline buffer, 0 is no limit",
+	)
+
+	f.StringVar(&settings.OfflineBufferMaxAge,
+		flagOfflineMaxAge, def.OfflineBufferMaxAge,
+		"The maximal age of the messages in the offline buffer, e.g. 24h, older messages are dropped, empty value is no limit",
+	)
+
+	f.StringVar(&settings.OfflineBufferDropPolicy,
+		flagOfflineDropPolicy, def.OfflineBufferDropPolicy,
+		"The messages dropped when the offline buffer is full, 'oldest' drops the oldest messages and 'priority' the oldest messages with the lowest priority",
+	)
 }
@@ -16,21 +16,28 @@ import (
 	"log"
 	"os"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/imdario/mergo"
 	"github.com/pkg/errors"
 
 	kantocfg "github.com/eclipse-kanto/suite-connector/config"
 	"github.com/eclipse-kanto/suite-connector/logger"
 
-	"github.com/eclipse-kanto/azure-connector/cmd/azure-connector/app"
 	azureflags "github.com/eclipse-kanto/azure-connector/flags"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers/passthrough"
 
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/cmd/app"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
 	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/command"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/telemetry"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/twin"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
 
 	azurecfg "github.com/eclipse-kanto/azure-connector/config"
 )
@@ -40,6 +47,10 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == mapperTestCommand {
+		mapperTestMain()
+	}
+
 	f := flag.NewFlagSet("azure-connector", flag.ContinueOnError)
 
 	cmd := &AzureSettingsExt{
@@ -77,15 +88,71 @@ func main() {
 	logger.Infof("Starting azure connector %s", version)
 	azureflags.ConfigCheck(logger, *fConfigFile)
 
+	descriptor.IncludePaths = parseProtoIncludePaths(settings.ProtoIncludePaths)
 	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(settings.MessageMapperConfig)
 	if err != nil {
 		logger.Error("cannot load message mapper config", err, nil)
+		if !os.IsNotExist(errors.Cause(err)) {
+			loggerOut.Close()
+			os.Exit(1)
+		}
+	} else if err := validateMapperConfig(settings, mapperConfig); err != nil {
+		logger.Error("message mapper config validation error", err, nil)
+		loggerOut.Close()
+		os.Exit(1)
+	} else {
+		mapperConfig.LogSkippedTelemetryMappings(logger)
+		mapperConfig.LogTelemetryMappingOverlaps(logger)
+	}
+	counters, err := sequence.NewCounters(settings.CounterStateFile, settings.CounterWidth, settings.CounterWrapValue, settings.CounterReserve)
+	if err != nil {
+		logger.Error("cannot restore sequence counters", err, nil)
+		loggerOut.Close()
+		os.Exit(1)
+	}
+	marshaller, err := createMarshaller(settings, mapperConfig, logger)
+	if err != nil {
+		logger.Error("cannot load the proto messages of the message mappings", err, nil)
+		loggerOut.Close()
+		os.Exit(1)
+	}
+	snapshots := mapper.NewHolder(mapperConfig, marshaller, settings.ProtoPreload != "")
+	if mapperConfig != nil {
+		if err := snapshots.Load().Codecs.Validate(mapperConfig); err != nil {
+			logger.Error("message mapper config validation error", err, nil)
+			loggerOut.Close()
+			os.Exit(1)
+		}
+	}
+	var replies command.ReplyHandler
+	if mapperConfig != nil {
+		replies = command.CreateThingsReplyHandler(snapshots, logger)
+	}
+	telemetryHandlers := createTelemetryHandlers(settings, mapperConfig, snapshots, counters, replies, logger)
+	commandHandlers := createCommandHandlers(settings, mapperConfig, snapshots, replies)
+	cloudHandlers := createCloudHandlers(mapperConfig, snapshots, replies)
+
+	if settings.MessageMapperConfigReload && mapperConfig != nil {
+		// all handlers share the snapshots, a reload switches them to the new configuration at once
+		watcher, err := mapperconfig.NewMessageMapperConfigWatcher(settings.MessageMapperConfig, logger, snapshots)
+		if err != nil {
+			logger.Error("cannot watch message mapper config", err, nil)
+		} else {
+			defer watcher.Close()
+		}
 	}
-	marshaller := protobuf.NewProtobufJSONMarshaller(mapperConfig)
-	telemetryHandlers := createTelemetryHandlers(settings, mapperConfig, marshaller)
-	commandHandlers := createCommandHandlers(settings, mapperConfig, marshaller)
 
-	if err := app.MainLoop(settings.AzureSettings, logger, nil, telemetryHandlers, commandHandlers); err != nil {
+	offlineQueue, err := createOfflineQueue(settings)
+	if err != nil {
+		logger.Error("cannot open the offline buffer", err, nil)
+		loggerOut.Close()
+		os.Exit(1)
+	}
+	if offlineQueue != nil {
+		defer offlineQueue.Close()
+	}
+
+	if err := app.MainLoop(settings.AzureSettings, logger, nil, telemetryHandlers, commandHandlers, cloudHandlers, offlineQueue); err != nil {
 		logger.Error("Init failure", err, nil)
 
 		loggerOut.Close()
@@ -94,24 +161,75 @@ func main() {
 	}
 }
 
-func createTelemetryHandlers(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig, marshaller protobuf.Marshaller) []handlers.TelemetryHandler {
+// validateMapperConfig leaves the proto messages to the marshaller, if the mappings with broken proto messages are
+// disabled instead of failing the startup.
+func validateMapperConfig(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig) error {
+	if settings.ProtoPreload == protoPreloadDegrade {
+		return mapperConfig.ValidateWithoutDescriptors()
+	}
+	return mapperConfig.Validate()
+}
+
+func createMarshaller(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig, logger watermill.LoggerAdapter) (protobuf.Marshaller, error) {
+	if settings.ProtoPreload == "" || mapperConfig == nil {
+		return protobuf.NewProtobufJSONMarshaller(mapperConfig), nil
+	}
+	marshaller, err := protobuf.NewPreloadedProtobufJSONMarshaller(mapperConfig)
+	if err != nil {
+		if settings.ProtoPreload == protoPreloadStrict {
+			return nil, err
+		}
+		logger.Error("the message mappings with proto messages that cannot be loaded are disabled", err, nil)
+	}
+	return marshaller, nil
+}
+
+// createOfflineQueue opens the queue of the offline buffer, nil if the offline buffer is disabled.
+func createOfflineQueue(settings *AzureSettingsExt) (*store.Queue, error) {
+	if settings.OfflineBufferDir == "" {
+		return nil, nil
+	}
+	limits, err := settings.offlineBufferLimits()
+	if err != nil {
+		return nil, err
+	}
+	return store.NewQueue(settings.OfflineBufferDir, limits)
+}
+
+func createTelemetryHandlers(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig, snapshots *mapper.Holder, counters *sequence.Counters, replies command.ReplyHandler, logger watermill.LoggerAdapter) []handlers.TelemetryHandler {
 	handlers := []handlers.TelemetryHandler{}
 	passthroughHandler := passthrough.CreateTelemetryHandler(settings.PassthroughDeviceTopics)
 	handlers = append(handlers, passthroughHandler)
 	if mapperConfig != nil {
-		thingsHandler := telemetry.CreateThingsTelemetryHandler(mapperConfig, marshaller)
+		thingsHandler := telemetry.CreateThingsTelemetryHandler(snapshots, counters, logger)
 		handlers = append(handlers, thingsHandler)
 	}
+	if replies != nil {
+		handlers = append(handlers, replies)
+	}
+	if mapperConfig != nil {
+		handlers = append(handlers, twin.CreateReportedPropertiesHandler(snapshots))
+	}
 	return handlers
 }
 
-func createCommandHandlers(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig, marshaller protobuf.Marshaller) []handlers.CommandHandler {
+func createCommandHandlers(settings *AzureSettingsExt, mapperConfig *mapperconfig.MessageMapperConfig, snapshots *mapper.Holder, replies command.ReplyTracker) []handlers.CommandHandler {
 	handlers := []handlers.CommandHandler{}
 	passthroughHandler := command.CreatePassthroughCommandHandler(settings.PassthroughCommandNames)
 	handlers = append(handlers, passthroughHandler)
 	if mapperConfig != nil {
-		thingsHandler := command.CreateThingsCommandHandler(mapperConfig, marshaller)
+		thingsHandler := command.CreateThingsCommandHandler(snapshots, replies)
 		handlers = append(handlers, thingsHandler)
 	}
 	return handlers
 }
+
+// createCloudHandlers returns the handlers of the direct methods and the desired property patches of the device twin,
+// the direct methods are forwarded by a command handler of their own, which does not track the command replies.
+func createCloudHandlers(mapperConfig *mapperconfig.MessageMapperConfig, snapshots *mapper.Holder, replies command.ReplyHandler) []bus.CloudHandler {
+	if mapperConfig == nil {
+		return nil
+	}
+	methodHandler := command.CreateDirectMethodHandler(snapshots, command.CreateThingsCommandHandler(snapshots, nil), replies)
+	return []bus.CloudHandler{methodHandler, twin.CreateDesiredPropertiesHandler(snapshots)}
+}
@@ -0,0 +1,407 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	azurecfg "github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/cmd/app"
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/command"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/handlers/telemetry"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+)
+
+const (
+	mapperTestCommand = "mapper-test"
+
+	directionTelemetry = "telemetry"
+	directionCommand   = "command"
+
+	serializationProtobufJSON = "protobufJSON"
+
+	propertyContentEncoding = "$.ce"
+	contentEncodingGzip     = "gzip"
+	contentEncodingDeflate  = "deflate"
+)
+
+type mapperTestResult struct {
+	Index     int                 `json:"index"`
+	Direction string              `json:"direction,omitempty"`
+	Flushed   bool                `json:"flushed,omitempty"`
+	Messages  []mapperTestMessage `json:"messages"`
+	Error     string              `json:"error,omitempty"`
+}
+
+type mapperTestMessage struct {
+	Topic          string          `json:"topic"`
+	Serialization  string          `json:"serialization,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	DecodedPayload json.RawMessage `json:"decodedPayload,omitempty"`
+}
+
+type mapperTest struct {
+	mapperConfig     *mapperconfig.MessageMapperConfig
+	codecs           *codec.Registry
+	telemetryHandler handlers.TelemetryHandler
+	commandHandler   handlers.CommandHandler
+	published        *capturePublisher
+}
+
+// capturePublisher collects the D2C messages the telemetry handler sends on its own, i.e. the batches and aggregates.
+type capturePublisher struct {
+	lock     sync.Mutex
+	messages []*message.Message
+}
+
+func (p *capturePublisher) Publish(topic string, messages ...*message.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *capturePublisher) Close() error {
+	return nil
+}
+
+func (p *capturePublisher) take() []*message.Message {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	messages := p.messages
+	p.messages = nil
+	return messages
+}
+
+// runMapperTest maps the Ditto envelopes and cloud messages from an input file with the configured message mappings
+// and prints the resulting outgoing messages without connecting to the local broker or to the cloud.
+func runMapperTest(args []string, stdin io.Reader, out io.Writer) error {
+	f := flag.NewFlagSet(mapperTestCommand, flag.ContinueOnError)
+	f.SetOutput(out)
+	mapperConfigFile := f.String(flagMessageMapperConfig, defaultMessageMapperConfig, "The path to the configuration file for the message mappings")
+	inputFile := f.String("input", "-", "The path to a file with Ditto envelopes and/or cloud messages, either as a JSON array or as a sequence of JSON objects, '-' reads from the standard input")
+	deviceID := f.String("deviceId", "device", "The device ID used for the outgoing messages")
+	hubName := f.String("hubName", "hub", "The Azure IoT Hub name used for the outgoing messages")
+	protoIncludePaths := f.String(flagProtoIncludePaths, "", "Comma separated list of directories where the imports of the proto files of the message mappings are searched")
+	if err := f.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	descriptor.IncludePaths = parseProtoIncludePaths(*protoIncludePaths)
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(*mapperConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := mapperConfig.Validate(); err != nil {
+		return err
+	}
+	snapshots := mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false)
+	if err := snapshots.Load().Codecs.Validate(mapperConfig); err != nil {
+		return err
+	}
+
+	var input []byte
+	if *inputFile == "-" {
+		input, err = ioutil.ReadAll(stdin)
+	} else {
+		input, err = ioutil.ReadFile(*inputFile)
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot read the input messages")
+	}
+	messages, err := parseMapperTestInput(input)
+	if err != nil {
+		return err
+	}
+
+	connInfo := &azurecfg.RemoteConnectionInfo{DeviceID: *deviceID, HubName: *hubName}
+	test := newMapperTest(snapshots, connInfo)
+
+	failed := 0
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	for i, msg := range messages {
+		result := test.run(i, msg)
+		if result.Error != "" {
+			failed++
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	flushed := test.flush(len(messages))
+	if flushed != nil {
+		if err := encoder.Encode(flushed); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages cannot be mapped", failed, len(messages))
+	}
+	if flushed != nil && flushed.Error != "" {
+		return errors.New("the batched or aggregated messages cannot be mapped")
+	}
+	return nil
+}
+
+func newMapperTest(snapshots *mapper.Holder, connInfo *azurecfg.RemoteConnectionInfo) *mapperTest {
+	// the dry run keeps the counters in memory and never changes the persisted ones
+	counters, _ := sequence.NewCounters("", sequence.DefaultWidth, 0, 0)
+	test := &mapperTest{
+		mapperConfig:     snapshots.Load().Config,
+		codecs:           snapshots.Load().Codecs,
+		telemetryHandler: telemetry.CreateThingsTelemetryHandler(snapshots, counters, watermill.NopLogger{}),
+		commandHandler:   command.CreateThingsCommandHandler(snapshots, nil),
+		published:        &capturePublisher{},
+	}
+	if aware, ok := test.telemetryHandler.(app.CloudPublisherAware); ok {
+		aware.SetCloudPublisher(test.published)
+	}
+	test.telemetryHandler.Init(connInfo)
+	test.commandHandler.Init(connInfo)
+	return test
+}
+
+func parseMapperTestInput(input []byte) ([]json.RawMessage, error) {
+	messages := []json.RawMessage{}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err == io.EOF {
+			return messages, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "cannot parse the input messages")
+		}
+		if trimmed := bytes.TrimSpace(value); len(trimmed) > 0 && trimmed[0] == '[' {
+			array := []json.RawMessage{}
+			if err := json.Unmarshal(value, &array); err != nil {
+				return nil, errors.Wrap(err, "cannot parse the input messages")
+			}
+			messages = append(messages, array...)
+		} else {
+			messages = append(messages, value)
+		}
+	}
+}
+
+func (t *mapperTest) run(index int, input json.RawMessage) (result *mapperTestResult) {
+	result = &mapperTestResult{Index: index, Messages: []mapperTestMessage{}}
+	// a message that crashes a handler is reported as not mapped, so that the remaining messages are still tried out
+	defer func() {
+		if r := recover(); r != nil {
+			result.Messages = []mapperTestMessage{}
+			result.Error = fmt.Sprintf("cannot map the input: %v", r)
+		}
+	}()
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(input, &fields); err != nil {
+		result.Error = errors.Wrap(err, "the input is neither a Ditto envelope nor a cloud message").Error()
+		return result
+	}
+
+	var (
+		outgoing []*message.Message
+		err      error
+	)
+	msg := message.NewMessage(watermill.NewUUID(), message.Payload(input))
+	if _, ok := fields["topic"]; ok {
+		result.Direction = directionTelemetry
+		outgoing, err = t.telemetryHandler.HandleMessage(msg)
+	} else if _, ok := fields["cmdName"]; ok {
+		result.Direction = directionCommand
+		outgoing, err = t.commandHandler.HandleMessage(msg)
+	} else {
+		err = errors.New("the input is neither a Ditto envelope nor a cloud message")
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for _, outgoingMessage := range outgoing {
+		topic, _ := connector.TopicFromCtx(outgoingMessage.Context())
+		mapped := mapperTestMessage{
+			Topic:   topic,
+			Payload: json.RawMessage(outgoingMessage.Payload),
+		}
+		if result.Direction == directionTelemetry {
+			if err = t.decodeTelemetryMessage(outgoingMessage.Payload, &mapped); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		result.Messages = append(result.Messages, mapped)
+	}
+	return result
+}
+
+// flush sends the batches and aggregates the telemetry handler holds back, as it does on shutdown, and returns them
+// with the ones sent at the end of their windows during the run, nil if there are none.
+func (t *mapperTest) flush(index int) *mapperTestResult {
+	if flusher, ok := t.telemetryHandler.(app.Flusher); ok {
+		flusher.Flush()
+	}
+	published := t.published.take()
+	if len(published) == 0 {
+		return nil
+	}
+	result := &mapperTestResult{Index: index, Direction: directionTelemetry, Flushed: true, Messages: []mapperTestMessage{}}
+	for _, outgoingMessage := range published {
+		topic, _ := connector.TopicFromCtx(outgoingMessage.Context())
+		mapped := mapperTestMessage{Topic: topic}
+		if err := t.decodeFlushedMessage(topic, outgoingMessage.Payload, &mapped); err != nil {
+			result.Error = err.Error()
+		}
+		result.Messages = append(result.Messages, mapped)
+	}
+	return result
+}
+
+// decodeFlushedMessage sets the payload of a batch or an aggregate. A compressed batch is shown base64 encoded and
+// decompressed in the decoded payload, while an aggregate is decoded like the other D2C messages.
+func (t *mapperTest) decodeFlushedMessage(topic string, payload []byte, mapped *mapperTestMessage) error {
+	var contentEncoding string
+	if i := strings.LastIndex(topic, "/"); i >= 0 {
+		if properties, err := url.ParseQuery(topic[i+1:]); err == nil {
+			contentEncoding = properties.Get(propertyContentEncoding)
+		}
+	}
+	var err error
+	switch contentEncoding {
+	case contentEncodingGzip, contentEncodingDeflate:
+		if mapped.Payload, err = json.Marshal(payload); err != nil {
+			return err
+		}
+		if payload, err = decompress(contentEncoding, payload); err != nil {
+			return errors.Wrap(err, "cannot decompress telemetry batch")
+		}
+		mapped.DecodedPayload = json.RawMessage(payload)
+		return nil
+	}
+	if !json.Valid(payload) {
+		mapped.Payload, err = json.Marshal(payload)
+		return err
+	}
+	mapped.Payload = json.RawMessage(payload)
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		return nil
+	}
+	return t.decodeTelemetryMessage(payload, mapped)
+}
+
+func decompress(contentEncoding string, payload []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	if contentEncoding == contentEncodingGzip {
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	} else {
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(decompressed) {
+		return nil, errors.New("the decompressed payload is not JSON")
+	}
+	return decompressed, nil
+}
+
+// decodeTelemetryMessage decodes the payload of a D2C message back to JSON with the codec of its mapping, so it can be
+// reviewed. A D2C message serialized as protobuf envelope is shown as JSON with the base64 encoded payload.
+func (t *mapperTest) decodeTelemetryMessage(payload []byte, mapped *mapperTestMessage) error {
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	if err := json.Unmarshal(payload, d2cMessage); err != nil {
+		if envelopeErr := d2cMessage.UnmarshalProtobuf(payload); envelopeErr != nil {
+			return errors.Wrap(err, "cannot deserialize D2C message")
+		}
+		if mapped.Payload, err = json.Marshal(d2cMessage); err != nil {
+			return err
+		}
+	}
+	telemetryMapping, err := t.mapperConfig.GetTelemetryMessageMapping(d2cMessage.MessageType, d2cMessage.MessageSubType)
+	if err != nil {
+		return err
+	}
+	mapped.Serialization = telemetryMapping.Serialization
+	codecName := telemetryMapping.CodecName()
+	if codecName == "" || telemetryMapping.Serialization == serializationProtobufJSON {
+		return nil
+	}
+	var encodedPayload []byte
+	switch payload := d2cMessage.Payload.(type) {
+	case []byte:
+		encodedPayload = payload
+	case string:
+		if encodedPayload, err = base64.StdEncoding.DecodeString(payload); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("cannot decode %s payload", codecName))
+		}
+	default:
+		return fmt.Errorf("unexpected %s payload '%v'", codecName, d2cMessage.Payload)
+	}
+	payloadCodec, err := t.codecs.Get(codecName)
+	if err != nil {
+		return err
+	}
+	target := &codec.Target{
+		MessageType:    d2cMessage.MessageType,
+		MessageSubType: d2cMessage.MessageSubType,
+		SchemaFile:     telemetryMapping.SchemaFile,
+	}
+	mapped.DecodedPayload, err = payloadCodec.Decode(target, encodedPayload)
+	return err
+}
+
+func mapperTestMain() {
+	if err := runMapperTest(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testMapperConfig = "testdata/mapper-test-config.json"
+	testMapperInput  = "testdata/mapper-test-input.json"
+)
+
+func TestMapperTest(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := runMapperTest([]string{"-messageMapperConfig", testMapperConfig, "-input", testMapperInput, "-deviceId", "dev", "-hubName", "hub"}, nil, out)
+	require.EqualError(t, err, "1 of 3 messages cannot be mapped")
+
+	results := decodeMapperTestResults(t, out)
+	require.Len(t, results, 3)
+
+	telemetryResult := results[0]
+	assert.Equal(t, directionTelemetry, telemetryResult.Direction)
+	assert.Empty(t, telemetryResult.Error)
+	require.Len(t, telemetryResult.Messages, 1)
+	assert.True(t, strings.HasPrefix(telemetryResult.Messages[0].Topic, "devices/dev/messages/events/"))
+	assert.JSONEq(t, `{"messageId":"some-message-id-1234","text":"simple text added","version":"1.0.8"}`, string(telemetryResult.Messages[0].DecodedPayload))
+
+	commandResult := results[1]
+	assert.Equal(t, directionCommand, commandResult.Direction)
+	assert.Empty(t, commandResult.Error)
+	require.Len(t, commandResult.Messages, 1)
+	assert.Equal(t, "command//azure.edge:hub:dev:edge:containers/req/C2D-msg-correlation-id/send", commandResult.Messages[0].Topic)
+	assert.Empty(t, commandResult.Messages[0].DecodedPayload)
+
+	unknownResult := results[2]
+	assert.Equal(t, directionTelemetry, unknownResult.Direction)
+	assert.NotEmpty(t, unknownResult.Error)
+	assert.Empty(t, unknownResult.Messages)
+}
+
+func TestMapperTestStdin(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdin := strings.NewReader(`{"appId":"app1","cmdName":"simple.message","cId":"id","p":"payload"} {"unknown":true}`)
+	err := runMapperTest([]string{"-messageMapperConfig", testMapperConfig}, stdin, out)
+	require.EqualError(t, err, "1 of 2 messages cannot be mapped")
+
+	results := decodeMapperTestResults(t, out)
+	require.Len(t, results, 2)
+	assert.Empty(t, results[0].Error)
+	assert.Empty(t, results[1].Direction)
+	assert.Contains(t, results[1].Error, "neither a Ditto envelope nor a cloud message")
+}
+
+func TestMapperTestCodec(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdin := strings.NewReader(`{
+		"topic": "tenant/dev:edge:containers/things/live/messages/cborSend",
+		"path": "/features/ContainerOrchestrator/outbox/messages/cborSend",
+		"headers": {"correlation-id": "cbor-id"},
+		"value": {"speed": 12.5, "gear": 3}
+	}`)
+	require.NoError(t, runMapperTest([]string{"-messageMapperConfig", testMapperConfig}, stdin, out))
+
+	results := decodeMapperTestResults(t, out)
+	require.Len(t, results, 1)
+	require.Len(t, results[0].Messages, 1)
+	d2cMessage := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(results[0].Messages[0].Payload, &d2cMessage))
+	assert.Equal(t, "omRnZWFyA2VzcGVlZPlKQA==", d2cMessage["p"])
+	assert.JSONEq(t, `{"gear":3,"speed":12.5}`, string(results[0].Messages[0].DecodedPayload))
+}
+
+func TestMapperTestFlush(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdin := strings.NewReader(`[
+		{"topic": "tenant/dev:edge:containers/things/live/messages/batchSend", "path": "/outbox/messages/batchSend", "value": {"speed": 1}},
+		{"topic": "tenant/dev:edge:containers/things/live/messages/batchSend", "path": "/outbox/messages/batchSend", "value": {"speed": 2}},
+		{"topic": "tenant/dev:edge:containers/things/live/messages/aggregateSend", "path": "/outbox/messages/aggregateSend", "value": {"speed": 3}},
+		{"topic": "tenant/dev:edge:containers/things/live/messages/aggregateSend", "path": "/outbox/messages/aggregateSend", "value": {"speed": 5}}
+	]`)
+	require.NoError(t, runMapperTest([]string{"-messageMapperConfig", testMapperConfig}, stdin, out))
+
+	results := decodeMapperTestResults(t, out)
+	require.Len(t, results, 5)
+	for _, result := range results[:4] {
+		assert.Empty(t, result.Error)
+		assert.Empty(t, result.Messages)
+	}
+	flushed := results[4]
+	assert.True(t, flushed.Flushed)
+	assert.Equal(t, 4, flushed.Index)
+	assert.Empty(t, flushed.Error)
+	require.Len(t, flushed.Messages, 2)
+
+	var batch, aggregate mapperTestMessage
+	for _, mapped := range flushed.Messages {
+		if strings.Contains(mapped.Topic, "%24.ce=gzip") {
+			batch = mapped
+		} else {
+			aggregate = mapped
+		}
+	}
+	var compressed []byte
+	require.NoError(t, json.Unmarshal(batch.Payload, &compressed), "compressed batch must be base64 encoded")
+	d2cMessages := []map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(batch.DecodedPayload, &d2cMessages))
+	require.Len(t, d2cMessages, 2)
+	assert.Equal(t, map[string]interface{}{"speed": float64(2)}, d2cMessages[1]["p"])
+
+	d2cMessage := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(aggregate.Payload, &d2cMessage))
+	assert.Equal(t, map[string]interface{}{"speed": map[string]interface{}{"min": float64(3), "max": float64(5)}}, d2cMessage["p"])
+}
+
+func TestMapperTestWithoutHeaders(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdin := strings.NewReader(`
+		{"topic": "x/edge:update/things/twin/commands/modify", "path": "/features/status/properties/state", "value": "on"}
+		{"topic": "tenant/dev:edge:containers/things/live/messages/jsonSend", "path": "/outbox/messages/jsonSend", "value": {"speed": 7}}
+	`)
+	err := runMapperTest([]string{"-messageMapperConfig", testMapperConfig}, stdin, out)
+	require.EqualError(t, err, "1 of 2 messages cannot be mapped")
+
+	results := decodeMapperTestResults(t, out)
+	require.Len(t, results, 2)
+	assert.NotEmpty(t, results[0].Error)
+	assert.Empty(t, results[1].Error)
+	require.Len(t, results[1].Messages, 1)
+}
+
+func TestMapperTestInvalidConfig(t *testing.T) {
+	err := runMapperTest([]string{"-messageMapperConfig", "testdata/non-existing-config.json"}, strings.NewReader("[]"), io.Discard)
+	assert.Error(t, err)
+}
+
+func TestMapperTestInvalidInput(t *testing.T) {
+	err := runMapperTest([]string{"-messageMapperConfig", testMapperConfig}, strings.NewReader("{invalid"), io.Discard)
+	assert.Error(t, err)
+}
+
+func decodeMapperTestResults(t *testing.T, out *bytes.Buffer) []*mapperTestResult {
+	results := []*mapperTestResult{}
+	decoder := json.NewDecoder(out)
+	for decoder.More() {
+		result := &mapperTestResult{}
+		require.NoError(t, decoder.Decode(result))
+		results = append(results, result)
+	}
+	return results
+}
@@ -7,10 +7,14 @@ require (
 	github.com/eclipse-kanto/azure-connector v0.0.0-20221014134114-1e7fa096a9e2
 	github.com/eclipse-kanto/suite-connector v0.1.0-M2
 	github.com/eclipse/ditto-clients-golang v0.0.0-20220225085802-cf3b306280d3
+	github.com/fsnotify/fsnotify v1.5.1
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/imdario/mergo v0.3.12
 	github.com/jhump/protoreflect v1.8.2
+	github.com/linkedin/goavro/v2 v2.12.0
 	github.com/pkg/errors v0.9.1
-	github.com/stretchr/testify v1.7.0
+	github.com/stretchr/testify v1.7.5
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 )
 
 require (
@@ -18,8 +22,8 @@ require (
 	github.com/cenkalti/backoff/v3 v3.0.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/eclipse/paho.mqtt.golang v1.4.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
-	github.com/golang/protobuf v1.4.2 // indirect
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/go-tpm v0.3.2 // indirect
 	github.com/google/uuid v1.1.1 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
@@ -29,12 +33,14 @@ require (
 	github.com/oklog/ulid v1.3.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tevino/abool/v2 v2.0.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
-	google.golang.org/protobuf v1.25.1-0.20200805231151-a709e31e5d12 // indirect
+	google.golang.org/protobuf v1.25.1-0.20200805231151-a709e31e5d12
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
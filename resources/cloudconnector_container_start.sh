@@ -28,6 +28,27 @@
 # The file for the message mappings configuration, configure with parameter -messageMapperConfig (default "message-mapper-config.json").
 [ -n "${MESSAGE_MAPPER_CONFIG+x}" ] && ARGUMENTS="$ARGUMENTS -messageMapperConfig=$MESSAGE_MAPPER_CONFIG"
 
+# Watch the file for the message mappings configuration and apply the changes at runtime, configure with parameter -messageMapperConfigReload (default false).
+[ -n "${MESSAGE_MAPPER_CONFIG_RELOAD+x}" ] && ARGUMENTS="$ARGUMENTS -messageMapperConfigReload=$MESSAGE_MAPPER_CONFIG_RELOAD"
+
+# The file where the sequence counters of the message mappings are persisted, configure with parameter -counterStateFile (default "", the counters are kept in memory only).
+[ -n "${COUNTER_STATE_FILE+x}" ] && ARGUMENTS="$ARGUMENTS -counterStateFile=$COUNTER_STATE_FILE"
+
+# The width in bits of the sequence counters of the message mappings, configure with parameter -counterWidth (default 32).
+[ -n "${COUNTER_WIDTH+x}" ] && ARGUMENTS="$ARGUMENTS -counterWidth=$COUNTER_WIDTH"
+
+# The value the sequence counters of the message mappings restart at after their maximal value, configure with parameter -counterWrapValue (default 0).
+[ -n "${COUNTER_WRAP_VALUE+x}" ] && ARGUMENTS="$ARGUMENTS -counterWrapValue=$COUNTER_WRAP_VALUE"
+
+# The number of values of a sequence counter reserved with each write of the counter state file, configure with parameter -counterReserve (default 100).
+[ -n "${COUNTER_RESERVE+x}" ] && ARGUMENTS="$ARGUMENTS -counterReserve=$COUNTER_RESERVE"
+
+# Comma separated list of directories where the imports of the proto files of the message mappings are searched, configure with parameter -protoIncludePaths.
+[ -n "${PROTO_INCLUDE_PATHS+x}" ] && ARGUMENTS="$ARGUMENTS -protoIncludePaths=$PROTO_INCLUDE_PATHS"
+
+# Load the proto messages of all message mappings at startup, 'strict' or 'degrade', configure with parameter -protoPreload.
+[ -n "${PROTO_PRELOAD+x}" ] && ARGUMENTS="$ARGUMENTS -protoPreload=$PROTO_PRELOAD"
+
 # List of passthrough device topics, configure with parameter -passthroughDeviceTopics.
 [ -n "${PASSTHROUGH_DEVICE_TOPICS+x}" ] && ARGUMENTS="$ARGUMENTS -passthroughDeviceTopics=$PASSTHROUGH_DEVICE_TOPICS"
 
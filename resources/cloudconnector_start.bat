@@ -29,6 +29,27 @@ if defined ID_SCOPE set "ARGUMENTS=%ARGUMENTS% -idScope=%ID_SCOPE%"
 rem The file for the message mappings configuration, configure with parameter -messageMapperConfig ("message-mapper-config.json").
 if defined MESSAGE_MAPPER_CONFIG set "ARGUMENTS=%ARGUMENTS% -messageMapperConfig=%MESSAGE_MAPPER_CONFIG%"
 
+rem Watch the file for the message mappings configuration and apply the changes at runtime, configure with parameter -messageMapperConfigReload (false).
+if defined MESSAGE_MAPPER_CONFIG_RELOAD set "ARGUMENTS=%ARGUMENTS% -messageMapperConfigReload=%MESSAGE_MAPPER_CONFIG_RELOAD%"
+
+rem The file where the sequence counters of the message mappings are persisted, configure with parameter -counterStateFile ("", the counters are kept in memory only).
+if defined COUNTER_STATE_FILE set "ARGUMENTS=%ARGUMENTS% -counterStateFile=%COUNTER_STATE_FILE%"
+
+rem The width in bits of the sequence counters of the message mappings, configure with parameter -counterWidth (32).
+if defined COUNTER_WIDTH set "ARGUMENTS=%ARGUMENTS% -counterWidth=%COUNTER_WIDTH%"
+
+rem The value the sequence counters of the message mappings restart at after their maximal value, configure with parameter -counterWrapValue (0).
+if defined COUNTER_WRAP_VALUE set "ARGUMENTS=%ARGUMENTS% -counterWrapValue=%COUNTER_WRAP_VALUE%"
+
+rem The number of values of a sequence counter reserved with each write of the counter state file, configure with parameter -counterReserve (100).
+if defined COUNTER_RESERVE set "ARGUMENTS=%ARGUMENTS% -counterReserve=%COUNTER_RESERVE%"
+
+rem Comma separated list of directories where the imports of the proto files of the message mappings are searched, configure with parameter -protoIncludePaths.
+if defined PROTO_INCLUDE_PATHS set "ARGUMENTS=%ARGUMENTS% -protoIncludePaths=%PROTO_INCLUDE_PATHS%"
+
+rem Load the proto messages of all message mappings at startup, 'strict' or 'degrade', configure with parameter -protoPreload.
+if defined PROTO_PRELOAD set "ARGUMENTS=%ARGUMENTS% -protoPreload=%PROTO_PRELOAD%"
+
 rem List of passthrough device topics, configure with parameter -passthroughDeviceTopics.
 if defined PASSTHROUGH_DEVICE_TOPICS set "ARGUMENTS=%ARGUMENTS% -passthroughDeviceTopics=%PASSTHROUGH_DEVICE_TOPICS%"
 
@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bus registers the message flows of the cloud connector that are not covered by the buses of the Azure
+// connector.
+package bus
+
+import (
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+)
+
+// CloudHandler handles the messages of the Azure IoT Hub on other topics than the cloud-to-device messages, e.g. the
+// direct method invocations. Topics are the comma separated Azure IoT Hub topics of the handler.
+type CloudHandler interface {
+	handlers.CommandHandler
+	Topics() string
+}
+
+// CloudBus routes the messages of the cloud handlers from the Azure IoT Hub to the local mosquitto broker, each
+// handler receives the messages of its own topics.
+func CloudBus(router *message.Router,
+	mosquittoPub message.Publisher,
+	azureSub message.Subscriber,
+	connInfo *config.RemoteConnectionInfo,
+	cloudHandlers []CloudHandler,
+) {
+	//Azure IoT Hub -> Message bus -> Mosquitto Broker -> Gateway
+	for _, cloudHandler := range cloudHandlers {
+		logFields := watermill.LogFields{"handler_name": cloudHandler.Name()}
+		if err := cloudHandler.Init(connInfo); err != nil {
+			router.Logger().Error("skipping cloud handler that cannot be initialized", err, logFields)
+			continue
+		}
+		handlerTopics := cloudHandler.Topics()
+		if len(handlerTopics) == 0 {
+			router.Logger().Error("skipping cloud handler without any topics", nil, logFields)
+			continue
+		}
+		router.AddHandler(cloudHandler.Name(),
+			handlerTopics,
+			azureSub,
+			connector.TopicEmpty,
+			mosquittoPub,
+			cloudHandler.HandleMessage,
+		)
+	}
+}
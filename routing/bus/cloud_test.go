@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package bus_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHub delivers the messages sent to it as if they were received on the subscribed topics of the Azure IoT Hub.
+type fakeHub struct {
+	topics   chan string
+	messages chan *message.Message
+}
+
+func (h *fakeHub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	h.topics <- topic
+	subscription := make(chan *message.Message)
+	go func() {
+		defer close(subscription)
+		for {
+			select {
+			case msg := <-h.messages:
+				subscription <- msg
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return subscription, nil
+}
+
+func (h *fakeHub) Close() error {
+	return nil
+}
+
+func (h *fakeHub) send(payload, topic string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	h.messages <- msg
+	return msg
+}
+
+type fakeMosquitto struct {
+	messages chan *message.Message
+}
+
+func (p *fakeMosquitto) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.messages <- msg
+	}
+	return nil
+}
+
+func (p *fakeMosquitto) Close() error {
+	return nil
+}
+
+type echoCloudHandler struct {
+	name    string
+	topics  string
+	initErr error
+}
+
+func (h *echoCloudHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	return h.initErr
+}
+
+func (h *echoCloudHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	if topic == "$iothub/methods/POST/fail/?$rid=2" {
+		return nil, errors.New("cannot handle method")
+	}
+	outgoingMessage := message.NewMessage(watermill.NewUUID(), msg.Payload)
+	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), "command//req/"+topic))
+	return []*message.Message{outgoingMessage}, nil
+}
+
+func (h *echoCloudHandler) Name() string {
+	return h.name
+}
+
+func (h *echoCloudHandler) Topics() string {
+	return h.topics
+}
+
+func TestCloudBus(t *testing.T) {
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	hub := &fakeHub{topics: make(chan string, 1), messages: make(chan *message.Message)}
+	mosquitto := &fakeMosquitto{messages: make(chan *message.Message, 1)}
+	bus.CloudBus(router, mosquitto, hub, &config.RemoteConnectionInfo{DeviceID: "dummy-device"}, []bus.CloudHandler{
+		&echoCloudHandler{name: "method_handler", topics: "$iothub/methods/POST/#"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.Run(ctx)
+	<-router.Running()
+	defer router.Close()
+	assert.Equal(t, "$iothub/methods/POST/#", <-hub.topics)
+
+	invocation := hub.send(`{"a": 1}`, "$iothub/methods/POST/getState/?$rid=1")
+	select {
+	case msg := <-mosquitto.messages:
+		topic, _ := connector.TopicFromCtx(msg.Context())
+		assert.Equal(t, "command//req/$iothub/methods/POST/getState/?$rid=1", topic)
+		assert.Equal(t, `{"a": 1}`, string(msg.Payload))
+	case <-time.After(time.Second):
+		require.Fail(t, "method invocation not forwarded")
+	}
+	<-invocation.Acked()
+
+	invocation = hub.send(`{}`, "$iothub/methods/POST/fail/?$rid=2")
+	<-invocation.Nacked()
+}
+
+func TestCloudBusSkippedHandlers(t *testing.T) {
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	require.NoError(t, err)
+	bus.CloudBus(router, &fakeMosquitto{}, &fakeHub{}, &config.RemoteConnectionInfo{}, []bus.CloudHandler{
+		&echoCloudHandler{name: "init_error_handler", topics: "$iothub/methods/POST/#", initErr: errors.New("no init")},
+		&echoCloudHandler{name: "no_topics_handler"},
+		&echoCloudHandler{name: "twin_handler", topics: "$iothub/twin/PATCH/properties/desired/#"},
+	})
+	refHandlers := reflect.Indirect(reflect.ValueOf(router)).FieldByName("handlers")
+	require.Equal(t, 1, refHandlers.Len())
+	assert.Equal(t, "twin_handler", refHandlers.MapKeys()[0].String())
+}
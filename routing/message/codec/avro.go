@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+)
+
+// avroCodec encodes the values as Avro binary datums with the schema file of the mapping, without the object
+// container header, since the receiver is expected to know the schema of the mapping. The values are in the JSON
+// encoding of the Avro specification, i.e. the non-null union values are wrapped in an object with the name of their
+// branch, e.g. {"int": 3}, and the bytes and fixed values are strings with a code point per byte.
+type avroCodec struct {
+	lock    sync.Mutex
+	schemas map[string]*goavro.Codec
+}
+
+func newAvroCodec() *avroCodec {
+	return &avroCodec{schemas: map[string]*goavro.Codec{}}
+}
+
+func (c *avroCodec) Encode(target *Target, jsonPayload []byte) ([]byte, error) {
+	schema, err := c.loadSchema(target.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	value, rest, err := schema.NativeFromTextual(jsonPayload)
+	if err == nil && len(bytes.TrimSpace(rest)) > 0 {
+		err = errors.New(fmt.Sprintf("%d trailing bytes", len(bytes.TrimSpace(rest))))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot encode value with Avro schema '%s'", target.SchemaFile))
+	}
+	payload, err := schema.BinaryFromNative(nil, value)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot encode value with Avro schema '%s'", target.SchemaFile))
+	}
+	return payload, nil
+}
+
+func (c *avroCodec) Decode(target *Target, payload []byte) ([]byte, error) {
+	schema, err := c.loadSchema(target.SchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	value, rest, err := schema.NativeFromBinary(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode Avro payload")
+	}
+	if len(rest) > 0 {
+		return nil, errors.New(fmt.Sprintf("cannot decode Avro payload: %d trailing bytes", len(rest)))
+	}
+	jsonPayload, err := schema.TextualFromNative(nil, value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize decoded value to JSON")
+	}
+	return jsonPayload, nil
+}
+
+// ValidateTarget checks that the mapping has a schema file that can be parsed.
+func (c *avroCodec) ValidateTarget(target *Target) error {
+	if target.SchemaFile == "" {
+		return errors.New("the Avro codec requires a schema file")
+	}
+	_, err := c.loadSchema(target.SchemaFile)
+	return err
+}
+
+// ValidateValueMapping checks that the top level keys of the value mapping are fields of the record of the schema.
+func (c *avroCodec) ValidateValueMapping(target *Target, valueMapping map[string]interface{}) []string {
+	schema, err := c.loadSchema(target.SchemaFile)
+	if err != nil {
+		return nil
+	}
+	record := struct {
+		Type      string `json:"type"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Fields    []struct {
+			Name string `json:"name"`
+		} `json:"fields"`
+	}{}
+	if err := json.Unmarshal([]byte(schema.Schema()), &record); err != nil || record.Type != "record" {
+		return nil
+	}
+	name := record.Name
+	if record.Namespace != "" && !strings.Contains(name, ".") {
+		name = record.Namespace + "." + name
+	}
+	fields := map[string]bool{}
+	for _, field := range record.Fields {
+		fields[field.Name] = true
+	}
+	keys := make([]string, 0, len(valueMapping))
+	for key := range valueMapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	problems := []string{}
+	for _, key := range keys {
+		if !fields[key] {
+			problems = append(problems, fmt.Sprintf("[%q]: no field '%s' in Avro record '%s'", key, key, name))
+		}
+	}
+	return problems
+}
+
+// Reload drops the cached schemas, so the changed schema files are parsed again.
+func (c *avroCodec) Reload(mapperConfig *config.MessageMapperConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.schemas = map[string]*goavro.Codec{}
+}
+
+func (c *avroCodec) loadSchema(schemaFile string) (*goavro.Codec, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if schema, ok := c.schemas[schemaFile]; ok {
+		return schema, nil
+	}
+	if schemaFile == "" {
+		return nil, errors.New("no Avro schema file")
+	}
+	content, err := ioutil.ReadFile(schemaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot read Avro schema file '%s'", schemaFile))
+	}
+	schema, err := goavro.NewCodec(string(content))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid Avro schema file '%s'", schemaFile))
+	}
+	c.schemas[schemaFile] = schema
+	return schema, nil
+}
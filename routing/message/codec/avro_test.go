@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec_test
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var readingTarget = &codec.Target{MessageType: 1, MessageSubType: "avro.reading", SchemaFile: "testdata/reading.avsc"}
+
+func TestAvroEncode(t *testing.T) {
+	avroCodec := getCodec(t, codec.Avro)
+	payload, err := avroCodec.Encode(readingTarget, []byte(`{"id": 1, "name": "a", "value": {"int": 3}, "unit": "KPH"}`))
+	require.NoError(t, err)
+	// id, name, int branch of value, unit, default accuracy, empty tags and attributes, default hash, null raw and previous
+	assert.Equal(t, "02"+"0261"+"0206"+"04"+"0000c03f"+"00"+"00"+"00000000"+"00"+"00", hex.EncodeToString(payload))
+
+	payload, err = avroCodec.Encode(readingTarget, []byte(`{
+		"id": -2,
+		"name": "",
+		"value": {"double": 2.5},
+		"accuracy": 0.5,
+		"tags": ["x"],
+		"attributes": {"a": true},
+		"hash": "\u0001\u0002\u0003\u0004",
+		"raw": {"bytes": "\u00ff"},
+		"previous": {"vehicle.signals.Reading": {"id": 0, "name": "", "value": null}}
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, "03"+"00"+"040000000000000440"+"00"+"0000003f"+"02027800"+"0202610100"+"01020304"+"0202ff"+
+		"02"+"00"+"00"+"00"+"00"+"0000c03f"+"00"+"00"+"00000000"+"00"+"00", hex.EncodeToString(payload))
+}
+
+func TestAvroEncodeInvalid(t *testing.T) {
+	avroCodec := getCodec(t, codec.Avro)
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"name": "a", "value": null}`, "only found 9 of 10 fields"},
+		{`{"id": 1.5, "name": "a", "value": null}`, "expected ',' or '}'; received: '.'"},
+		{`{"id": 1, "name": "a", "value": 3}`, "cannot decode textual union: expected: '{'; actual: '3' for key: \"value\""},
+		{`{"id": 1, "name": "a", "value": null, "unit": "MPH"}`, "value ought to be member of symbols: [NONE CELSIUS KPH]; \"MPH\" for key: \"unit\""},
+		{`{"id": 1, "name": "a", "value": null, "hash": "ab"}`, "datum size ought to equal schema size: 2 != 4 for key: \"hash\""},
+		{`[1]`, "cannot decode textual record \"vehicle.signals.Reading\": expected: '{'; actual: '['"},
+		{`{"id": 1, "name": "a", "value": null} {}`, "2 trailing bytes"},
+	}
+	for _, test := range tests {
+		_, err := avroCodec.Encode(readingTarget, []byte(test.json))
+		require.Error(t, err, test.json)
+		assert.True(t, strings.HasPrefix(err.Error(), "cannot encode value with Avro schema 'testdata/reading.avsc': "), err.Error())
+		assert.Contains(t, err.Error(), test.err, test.json)
+	}
+}
+
+func TestAvroDecode(t *testing.T) {
+	avroCodec := getCodec(t, codec.Avro)
+	value := `{
+		"id": 1234567890123,
+		"name": "speed",
+		"value": {"string": "n/a"},
+		"unit": "CELSIUS",
+		"accuracy": 0.25,
+		"tags": ["x", "y"],
+		"attributes": {"calibrated": true},
+		"hash": "\u0001\u0002\u0003\u0004",
+		"raw": null,
+		"previous": {"vehicle.signals.Reading": {"id": 1, "name": "speed", "value": {"int": 12}, "unit": "NONE", "accuracy": 1.5, "tags": [], "attributes": {}, "hash": "\u0000\u0000\u0000\u0000", "raw": {"bytes": "\u0001"}, "previous": null}}
+	}`
+	payload, err := avroCodec.Encode(readingTarget, []byte(value))
+	require.NoError(t, err)
+	decoded, err := avroCodec.Decode(readingTarget, payload)
+	require.NoError(t, err)
+	assert.JSONEq(t, value, string(decoded))
+
+	// the arrays can be split in blocks with negative counts followed by the block size in bytes
+	blocks, err := hex.DecodeString("02" + "0261" + "00" + "00" + "0000c03f" + "0308027802790000" + "00000000" + "00" + "00")
+	require.NoError(t, err)
+	decoded, err = avroCodec.Decode(readingTarget, blocks)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":1,"name":"a","value":null,"unit":"NONE","accuracy":1.5,"tags":["x","y"],"attributes":{},"hash":"\u0000\u0000\u0000\u0000","raw":null,"previous":null}`, string(decoded))
+}
+
+func TestAvroDecodeInvalid(t *testing.T) {
+	avroCodec := getCodec(t, codec.Avro)
+	tests := []struct {
+		avro string
+		err  string
+	}{
+		{"", "cannot decode binary record \"vehicle.signals.Reading\" field \"id\": short buffer"},
+		{"020a61", "cannot decode binary record \"vehicle.signals.Reading\" field \"name\": cannot decode binary string: cannot decode binary bytes: short buffer"},
+		{"0200" + "08", "cannot decode binary union: index ought to be between 0 and 3; read index: 4"},
+		{"0200" + "00" + "06", "cannot decode binary enum \"vehicle.signals.Unit\": index ought to be between 0 and 2; read index: 3"},
+		{"0200" + "00" + "00" + "0000c03f" + "00" + "00" + "00000000" + "00" + "00" + "00", "1 trailing bytes"},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.avro)
+		require.NoError(t, err)
+		_, err = avroCodec.Decode(readingTarget, payload)
+		require.Error(t, err, test.avro)
+		assert.True(t, strings.HasPrefix(err.Error(), "cannot decode Avro payload: "), err.Error())
+		assert.Contains(t, err.Error(), test.err, test.avro)
+	}
+}
+
+func TestAvroSchemas(t *testing.T) {
+	avroCodec := getCodec(t, codec.Avro)
+	validator, ok := avroCodec.(codec.TargetValidator)
+	require.True(t, ok)
+	tests := []struct {
+		schema string
+		err    string
+	}{
+		{`"long"`, ""},
+		{`{"type": "string", "logicalType": "uuid"}`, ""},
+		{`["null", {"type": "map", "values": {"type": "array", "items": "double"}}]`, ""},
+		{`{"type": "record", "name": "a.b.Outer", "fields": [{"name": "inner", "type": {"type": "record", "name": "Inner", "fields": []}}, {"name": "other", "type": "a.b.Inner"}]}`, ""},
+		{`{"type": "record", "name": "Outer", "namespace": "a", "fields": [{"name": "e", "type": {"type": "enum", "name": "x.E", "symbols": ["A"]}}, {"name": "f", "type": "x.E"}]}`, ""},
+		{`{"name": "missing"}`, "missing type"},
+		{`[]`, "Union ought to have one or more members"},
+		{`{"type": "record", "fields": []}`, "Record ought to have valid name"},
+		{`{"type": "record", "name": "R"}`, `Record "R" ought to have fields key`},
+		{`{"type": "enum", "name": "E", "symbols": [1]}`, `Enum "E" symbol 1 ought to be non-empty string`},
+		{`{"type": "fixed", "name": "F", "size": -1}`, `Fixed "F" size ought to be number greater than zero: -1`},
+		{`{"type": "array", "items": "Unknown"}`, `unknown type name: "Unknown"`},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		schemaFile := filepath.Join(dir, "schema"+string(rune('a'+i))+".avsc")
+		require.NoError(t, ioutil.WriteFile(schemaFile, []byte(test.schema), 0644))
+		err := validator.ValidateTarget(&codec.Target{SchemaFile: schemaFile})
+		if test.err == "" {
+			assert.NoError(t, err, test.schema)
+		} else {
+			require.Error(t, err, test.schema)
+			assert.True(t, strings.HasPrefix(err.Error(), "invalid Avro schema file '"+schemaFile+"': "), err.Error())
+			assert.Contains(t, err.Error(), test.err, test.schema)
+		}
+	}
+
+	err := validator.ValidateTarget(&codec.Target{SchemaFile: filepath.Join(dir, "missing.avsc")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot read Avro schema file")
+}
+
+func TestAvroReload(t *testing.T) {
+	registry := codec.NewRegistry(nil)
+	avroCodec, err := registry.Get(codec.Avro)
+	require.NoError(t, err)
+	schemaFile := filepath.Join(t.TempDir(), "value.avsc")
+	target := &codec.Target{SchemaFile: schemaFile}
+
+	require.NoError(t, ioutil.WriteFile(schemaFile, []byte(`"int"`), 0644))
+	payload, err := avroCodec.Encode(target, []byte(`5`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x0a}, payload)
+
+	// the cached schema is used until the configuration is reloaded
+	require.NoError(t, ioutil.WriteFile(schemaFile, []byte(`"string"`), 0644))
+	_, err = avroCodec.Encode(target, []byte(`"five"`))
+	require.Error(t, err)
+
+	registry.Reload(&config.MessageMapperConfig{})
+	payload, err = avroCodec.Encode(target, []byte(`"five"`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 'f', 'i', 'v', 'e'}, payload)
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec
+
+import (
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+const cborMaxDepth = 64
+
+// cborCodec encodes the values as CBOR, RFC 8949, with the core deterministic encoding, i.e. the map keys are sorted
+// and the floating point numbers are encoded with the fewest bits that do not lose precision. The decoded tags are
+// replaced by their content and the byte strings are represented as base64 encoded strings in JSON.
+type cborCodec struct {
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+}
+
+func newCBORCodec() *cborCodec {
+	encMode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	decMode, err := cbor.DecOptions{MaxNestedLevels: cborMaxDepth}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return &cborCodec{encMode: encMode, decMode: decMode}
+}
+
+func (c *cborCodec) Encode(target *Target, jsonPayload []byte) ([]byte, error) {
+	value, err := parseJSON(jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = toNative(value); err != nil {
+		return nil, err
+	}
+	payload, err := c.encMode.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode CBOR payload")
+	}
+	return payload, nil
+}
+
+func (c *cborCodec) Decode(target *Target, payload []byte) ([]byte, error) {
+	var value interface{}
+	if err := c.decMode.Unmarshal(payload, &value); err != nil {
+		return nil, errors.Wrap(err, "cannot decode CBOR payload")
+	}
+	return toJSON(fromNative(value))
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getCodec(t *testing.T, name string) codec.Codec {
+	payloadCodec, err := codec.NewRegistry(nil).Get(name)
+	require.NoError(t, err)
+	return payloadCodec
+}
+
+func TestCBOREncode(t *testing.T) {
+	cborCodec := getCodec(t, codec.CBOR)
+	tests := []struct {
+		json string
+		cbor string
+	}{
+		{`0`, "00"},
+		{`23`, "17"},
+		{`24`, "1818"},
+		{`1000`, "1903e8"},
+		{`1000000`, "1a000f4240"},
+		{`18446744073709551615`, "1bffffffffffffffff"},
+		{`-1`, "20"},
+		{`-1000`, "3903e7"},
+		{`1.5`, "f93e00"},
+		{`100000.5`, "fa47c35040"},
+		{`1.1`, "fb3ff199999999999a"},
+		{`true`, "f5"},
+		{`false`, "f4"},
+		{`null`, "f6"},
+		{`"IETF"`, "6449455446"},
+		{`[1, [2, 3]]`, "8201820203"},
+		{`{"b": 1, "aa": 2, "a": [true]}`, "a3616181f561620162616102"},
+	}
+	for _, test := range tests {
+		payload, err := cborCodec.Encode(&codec.Target{}, []byte(test.json))
+		require.NoError(t, err, test.json)
+		assert.Equal(t, test.cbor, hex.EncodeToString(payload), test.json)
+	}
+
+	_, err := cborCodec.Encode(&codec.Target{}, []byte(`{"a": `))
+	assert.Error(t, err)
+}
+
+func TestCBORDecode(t *testing.T) {
+	cborCodec := getCodec(t, codec.CBOR)
+	tests := []struct {
+		cbor string
+		json string
+	}{
+		{"1bffffffffffffffff", `18446744073709551615`},
+		{"3903e7", `-1000`},
+		{"f93e00", `1.5`},
+		{"f98001", `-5.960464477539063e-8`},
+		{"fa3fc00000", `1.5`},
+		{"f7", `null`},
+		{"4401020304", `"AQIDBA=="`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"9f018202039f0405ffff", `[1,[2,3],[4,5]]`},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.cbor)
+		require.NoError(t, err)
+		decoded, err := cborCodec.Decode(&codec.Target{}, payload)
+		require.NoError(t, err, test.cbor)
+		assert.JSONEq(t, test.json, string(decoded), test.cbor)
+	}
+}
+
+func TestCBORDecodeInvalid(t *testing.T) {
+	cborCodec := getCodec(t, codec.CBOR)
+	tests := []struct {
+		cbor string
+		err  string
+	}{
+		{"", "cannot decode CBOR payload: EOF"},
+		{"1a0001", "cannot decode CBOR payload: unexpected EOF"},
+		{"0000", "cannot decode CBOR payload: cbor: 1 bytes of extraneous data starting at index 1"},
+		{"ff", "cannot decode CBOR payload: cbor: unexpected \"break\" code"},
+		{"1c", "cannot decode CBOR payload: cbor: invalid additional information 28 for type positive integer"},
+		{"62c328", "cannot decode CBOR payload: cbor: invalid UTF-8 string"},
+		{"7f6161416161ff", "cannot decode CBOR payload: cbor: wrong element type byte string for indefinite-length UTF-8 text string"},
+		{"fa7fc00000", "cannot serialize decoded value to JSON: json: unsupported value: NaN"},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.cbor)
+		require.NoError(t, err)
+		_, err = cborCodec.Decode(&codec.Target{}, payload)
+		require.Error(t, err, test.cbor)
+		assert.Equal(t, test.err, err.Error(), test.cbor)
+	}
+
+	nested := make([]byte, 100)
+	for i := range nested {
+		nested[i] = 0x81
+	}
+	_, err := cborCodec.Decode(&codec.Target{}, nested)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeded max nested level 64")
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	cborCodec := getCodec(t, codec.CBOR)
+	value := `{"id":7,"name":"speed","value":-12.75,"tags":["a","b"],"valid":true,"unit":null,"nested":{"min":0,"max":300}}`
+	payload, err := cborCodec.Encode(&codec.Target{}, []byte(value))
+	require.NoError(t, err)
+	decoded, err := cborCodec.Decode(&codec.Target{}, payload)
+	require.NoError(t, err)
+	assert.JSONEq(t, value, string(decoded))
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package codec implements the payload codecs that a telemetry mapping selects by name to encode its mapped value.
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+)
+
+const (
+	// CBOR is the name of the codec for the Concise Binary Object Representation, RFC 8949.
+	CBOR = "cbor"
+	// MessagePack is the name of the MessagePack codec.
+	MessagePack = "msgpack"
+	// Avro is the name of the Apache Avro codec, which encodes the values with the schema file of the mapping.
+	Avro = "avro"
+	// Protobuf is the name of the protobuf codec, which encodes the values with the proto message of the mapping.
+	Protobuf = config.CodecProtobuf
+)
+
+// Target identifies the telemetry mapping a value is encoded for.
+type Target struct {
+	MessageType    int
+	MessageSubType string
+	SchemaFile     string
+}
+
+// Codec encodes the JSON value of a telemetry mapping to the payload of the D2C message and decodes it back to JSON.
+type Codec interface {
+	Encode(target *Target, jsonPayload []byte) ([]byte, error)
+	Decode(target *Target, payload []byte) ([]byte, error)
+}
+
+// TargetValidator is implemented by the codecs that check at startup if they can encode the values of a mapping,
+// e.g. that its schema file can be loaded.
+type TargetValidator interface {
+	ValidateTarget(target *Target) error
+}
+
+// ValueMappingValidator is implemented by the codecs that check at startup if the value mapping of a mapping fits
+// its schema. The problems are prefixed with the JSON path of the faulty element within the value mapping.
+type ValueMappingValidator interface {
+	ValidateValueMapping(target *Target, valueMapping map[string]interface{}) []string
+}
+
+// Registry contains the codecs by name. It is safe for concurrent use.
+type Registry struct {
+	lock   sync.RWMutex
+	codecs map[string]Codec
+}
+
+// NewRegistry creates a registry with the built-in codecs, the protobuf one uses the provided marshaller.
+func NewRegistry(marshaller protobuf.Marshaller) *Registry {
+	registry := &Registry{codecs: map[string]Codec{}}
+	registry.Register(Protobuf, &protobufCodec{marshaller: marshaller})
+	registry.Register(CBOR, newCBORCodec())
+	registry.Register(MessagePack, &msgpackCodec{})
+	registry.Register(Avro, newAvroCodec())
+	return registry
+}
+
+// Register adds a codec to the registry, replacing the codec with the same name.
+func (r *Registry) Register(name string, codec Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.codecs[name] = codec
+}
+
+// Get returns the codec with the provided name.
+func (r *Registry) Get(name string) (Codec, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	codec, ok := r.codecs[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported codec '%s', the supported codecs are '%s'", name, strings.Join(r.names(), "', '")))
+	}
+	return codec, nil
+}
+
+func (r *Registry) names() []string {
+	names := make([]string, 0, len(r.codecs))
+	for name := range r.codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that the codecs of the telemetry mappings are registered and can encode the values of the mappings.
+// All problems are reported at once in a config.ValidationError, each one prefixed with the JSON path of the mapping.
+func (r *Registry) Validate(mapperConfig *config.MessageMapperConfig) error {
+	if mapperConfig.MessageMappings == nil {
+		return nil
+	}
+	problems := []string{}
+	for messageType, telemetryMappings := range mapperConfig.MessageMappings.Telemetry {
+		for messageSubType, mapping := range telemetryMappings {
+			if mapping == nil || mapping.Codec == "" {
+				continue
+			}
+			path := fmt.Sprintf("messageMappings.telemetry[\"%d\"][%q]", messageType, messageSubType)
+			codec, err := r.Get(mapping.Codec)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s.codec: %v", path, err))
+				continue
+			}
+			if validator, ok := codec.(TargetValidator); ok {
+				target := &Target{MessageType: messageType, MessageSubType: messageSubType, SchemaFile: mapping.SchemaFile}
+				if err := validator.ValidateTarget(target); err != nil {
+					problems = append(problems, fmt.Sprintf("%s.schemaFile: %v", path, err))
+					continue
+				}
+			}
+			if validator, ok := codec.(ValueMappingValidator); ok && mapping.ValueMapping != nil {
+				target := &Target{MessageType: messageType, MessageSubType: messageSubType, SchemaFile: mapping.SchemaFile}
+				for _, problem := range validator.ValidateValueMapping(target, mapping.ValueMapping) {
+					problems = append(problems, fmt.Sprintf("%s.valueMapping%s", path, problem))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &config.ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Reload passes a new message mapper configuration to the codecs that depend on it, e.g. to drop their cached schemas.
+func (r *Registry) Reload(mapperConfig *config.MessageMapperConfig) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, codec := range r.codecs {
+		if reloadable, ok := codec.(config.Reloadable); ok {
+			reloadable.Reload(mapperConfig)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type identityCodec struct{}
+
+func (c *identityCodec) Encode(target *codec.Target, jsonPayload []byte) ([]byte, error) {
+	return jsonPayload, nil
+}
+
+func (c *identityCodec) Decode(target *codec.Target, payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+func TestRegistryGet(t *testing.T) {
+	registry := codec.NewRegistry(nil)
+	for _, name := range []string{codec.Protobuf, codec.CBOR, codec.MessagePack, codec.Avro} {
+		payloadCodec, err := registry.Get(name)
+		require.NoError(t, err, name)
+		assert.NotNil(t, payloadCodec, name)
+	}
+
+	_, err := registry.Get("xml")
+	require.Error(t, err)
+	assert.Equal(t, "unsupported codec 'xml', the supported codecs are 'avro', 'cbor', 'msgpack', 'protobuf'", err.Error())
+
+	registry.Register("identity", &identityCodec{})
+	payloadCodec, err := registry.Get("identity")
+	require.NoError(t, err)
+	payload, err := payloadCodec.Encode(&codec.Target{}, []byte(`{"a":1}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(payload))
+}
+
+func TestRegistryValidate(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/mappings.json")
+	require.NoError(t, err)
+
+	registry := codec.NewRegistry(nil)
+	err = registry.Validate(mapperConfig)
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+	problems := validationErr.Problems
+	require.Equal(t, 4, len(problems), problems)
+	assert.Equal(t, `messageMappings.telemetry["1"]["avro.invalid.schema"].schemaFile: invalid Avro schema file 'testdata/invalid.avsc': Record "Invalid" field 1 ought to be valid Avro named type: unknown type name: "Missing"`, problems[0])
+	assert.Equal(t, `messageMappings.telemetry["1"]["avro.missing.schema"].schemaFile: the Avro codec requires a schema file`, problems[1])
+	assert.Equal(t, `messageMappings.telemetry["1"]["avro.unknown.field"].valueMapping["level"]: no field 'level' in Avro record 'vehicle.signals.Reading'`, problems[2])
+	assert.Equal(t, `messageMappings.telemetry["1"]["unknown.codec"].codec: unsupported codec 'xml', the supported codecs are 'avro', 'cbor', 'msgpack', 'protobuf'`, problems[3])
+
+	assert.NoError(t, registry.Validate(&config.MessageMapperConfig{}))
+}
+
+func TestProtobufCodec(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/mappings.json")
+	require.NoError(t, err)
+	registry := codec.NewRegistry(protobuf.NewProtobufJSONMarshaller(mapperConfig))
+	protobufCodec, err := registry.Get(codec.Protobuf)
+	require.NoError(t, err)
+
+	target := &codec.Target{MessageType: 1, MessageSubType: "protobuf.reading"}
+	payload, err := protobufCodec.Encode(target, []byte(`{"id":"7","name":"speed","value":12.5}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x08, 0x07, 0x12, 0x05, 's', 'p', 'e', 'e', 'd', 0x19, 0, 0, 0, 0, 0, 0, 0x29, 0x40}, payload)
+	decoded, err := protobufCodec.Decode(target, payload)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"7","name":"speed","value":12.5}`, string(decoded))
+}
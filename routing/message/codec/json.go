@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// parseJSON parses a JSON value, keeping the numbers as json.Number, so the integers are encoded as integers.
+func parseJSON(jsonPayload []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonPayload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, errors.Wrap(err, "cannot parse JSON value")
+	}
+	return value, nil
+}
+
+// toNative converts the numbers of a parsed JSON value to int64, uint64 or float64, so the integers are encoded as
+// integers by the codec libraries.
+func toNative(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case json.Number:
+		if intVal, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return intVal, nil
+		}
+		if uintVal, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return uintVal, nil
+		}
+		float, err := value.Float64()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid number '%s'", value))
+		}
+		return float, nil
+	case []interface{}:
+		for i, item := range value {
+			nativeItem, err := toNative(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = nativeItem
+		}
+	case map[string]interface{}:
+		for key, field := range value {
+			nativeField, err := toNative(field)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = nativeField
+		}
+	}
+	return value, nil
+}
+
+// fromNative converts a value decoded by a codec library to a value that can be serialized to JSON. The map keys are
+// converted to strings and the tags are replaced by their content, the byte strings are serialized base64 encoded.
+func fromNative(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		for i, item := range value {
+			value[i] = fromNative(item)
+		}
+	case map[string]interface{}:
+		for key, field := range value {
+			value[key] = fromNative(field)
+		}
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, field := range value {
+			object[fmt.Sprint(key)] = fromNative(field)
+		}
+		return object
+	case cbor.Tag:
+		return fromNative(value.Content)
+	}
+	return value
+}
+
+// toJSON serializes a decoded value to JSON. The floating point numbers that are not finite cannot be represented
+// in JSON and fail the serialization.
+func toJSON(value interface{}) ([]byte, error) {
+	jsonPayload, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize decoded value to JSON")
+	}
+	return jsonPayload, nil
+}
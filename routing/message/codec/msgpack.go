@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackCodec encodes the values as MessagePack, with the smallest format that fits each integer. The map keys are
+// sorted, so the same value is always encoded the same way. The decoded binary values are represented as base64
+// encoded strings in JSON, the extension types are not supported.
+type msgpackCodec struct{}
+
+func (c *msgpackCodec) Encode(target *Target, jsonPayload []byte) ([]byte, error) {
+	value, err := parseJSON(jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = toNative(value); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(value); err != nil {
+		return nil, errors.Wrap(err, "cannot encode MessagePack payload")
+	}
+	return buffer.Bytes(), nil
+}
+
+func (c *msgpackCodec) Decode(target *Target, payload []byte) ([]byte, error) {
+	reader := bytes.NewReader(payload)
+	decoder := msgpack.NewDecoder(reader)
+	decoder.SetMapDecoder(func(decoder *msgpack.Decoder) (interface{}, error) {
+		return decoder.DecodeUntypedMap()
+	})
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode MessagePack payload")
+	}
+	if reader.Len() > 0 {
+		return nil, errors.New(fmt.Sprintf("cannot decode MessagePack payload: %d trailing bytes", reader.Len()))
+	}
+	return toJSON(fromNative(value))
+}
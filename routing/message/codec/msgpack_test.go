@@ -0,0 +1,111 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessagePackEncode(t *testing.T) {
+	msgpackCodec := getCodec(t, codec.MessagePack)
+	tests := []struct {
+		json    string
+		msgpack string
+	}{
+		{`0`, "00"},
+		{`127`, "7f"},
+		{`128`, "cc80"},
+		{`65535`, "cdffff"},
+		{`4294967296`, "cf0000000100000000"},
+		{`18446744073709551615`, "cfffffffffffffffff"},
+		{`-32`, "e0"},
+		{`-33`, "d0df"},
+		{`-32769`, "d2ffff7fff"},
+		{`-9223372036854775808`, "d38000000000000000"},
+		{`1.5`, "cb3ff8000000000000"},
+		{`1.1`, "cb3ff199999999999a"},
+		{`true`, "c3"},
+		{`false`, "c2"},
+		{`null`, "c0"},
+		{`"abc"`, "a3616263"},
+		{`"` + strings.Repeat("a", 32) + `"`, "d920" + strings.Repeat("61", 32)},
+		{`[1, [2, 3]]`, "92019202 03"},
+		{`{"b": 1, "a": [true]}`, "82a16191c3a16201"},
+	}
+	for _, test := range tests {
+		payload, err := msgpackCodec.Encode(&codec.Target{}, []byte(test.json))
+		require.NoError(t, err, test.json)
+		assert.Equal(t, strings.ReplaceAll(test.msgpack, " ", ""), hex.EncodeToString(payload), test.json)
+	}
+}
+
+func TestMessagePackDecode(t *testing.T) {
+	msgpackCodec := getCodec(t, codec.MessagePack)
+	tests := []struct {
+		msgpack string
+		json    string
+	}{
+		{"d0df", `-33`},
+		{"d1ff7f", `-129`},
+		{"cfffffffffffffffff", `18446744073709551615`},
+		{"ca3fc00000", `1.5`},
+		{"c403010203", `"AQID"`},
+		{"da0003616263", `"abc"`},
+		{"dc0002c0c3", `[null,true]`},
+		{"de0001a161c2", `{"a":false}`},
+		{"8101a3616263", `{"1":"abc"}`},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.msgpack)
+		require.NoError(t, err)
+		decoded, err := msgpackCodec.Decode(&codec.Target{}, payload)
+		require.NoError(t, err, test.msgpack)
+		assert.JSONEq(t, test.json, string(decoded), test.msgpack)
+	}
+}
+
+func TestMessagePackDecodeInvalid(t *testing.T) {
+	msgpackCodec := getCodec(t, codec.MessagePack)
+	tests := []struct {
+		msgpack string
+		err     string
+	}{
+		{"", "cannot decode MessagePack payload: EOF"},
+		{"cd01", "cannot decode MessagePack payload: unexpected EOF"},
+		{"a3616263c0", "cannot decode MessagePack payload: 1 trailing bytes"},
+		{"c1", "cannot decode MessagePack payload: msgpack: unknown code c1 decoding interface{}"},
+		{"d40102", "cannot decode MessagePack payload: msgpack: unknown ext id=1"},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.msgpack)
+		require.NoError(t, err)
+		_, err = msgpackCodec.Decode(&codec.Target{}, payload)
+		require.Error(t, err, test.msgpack)
+		assert.Equal(t, test.err, err.Error(), test.msgpack)
+	}
+}
+
+func TestMessagePackRoundTrip(t *testing.T) {
+	msgpackCodec := getCodec(t, codec.MessagePack)
+	value := `{"id":7,"name":"speed","value":-12.75,"tags":["a","b"],"valid":true,"unit":null,"nested":{"min":-1,"max":70000}}`
+	payload, err := msgpackCodec.Encode(&codec.Target{}, []byte(value))
+	require.NoError(t, err)
+	decoded, err := msgpackCodec.Decode(&codec.Target{}, payload)
+	require.NoError(t, err)
+	assert.JSONEq(t, value, string(decoded))
+}
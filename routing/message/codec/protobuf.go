@@ -0,0 +1,29 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package codec
+
+import (
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+)
+
+// protobufCodec encodes the values with the proto messages of the mappings, the marshaller caches their descriptors.
+type protobufCodec struct {
+	marshaller protobuf.Marshaller
+}
+
+func (c *protobufCodec) Encode(target *Target, jsonPayload []byte) ([]byte, error) {
+	return c.marshaller.Marshal(target.MessageType, target.MessageSubType, jsonPayload)
+}
+
+func (c *protobufCodec) Decode(target *Target, payload []byte) ([]byte, error) {
+	return c.marshaller.UnmarshalTelemetry(target.MessageType, target.MessageSubType, payload)
+}
@@ -15,37 +15,136 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"sync"
+	"time"
 
+	"github.com/jhump/protoreflect/desc"
 	"github.com/pkg/errors"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+)
+
+const (
+	// CodecProtobuf is the name of the codec that encodes the mapped values with the proto messages of the mappings.
+	CodecProtobuf = "protobuf"
+	// DeliveryAtMostOnce sends the telemetry messages with QoS 0 and drops them if they cannot be sent.
+	DeliveryAtMostOnce = "atMostOnce"
+	// DeliveryAtLeastOnce sends the telemetry messages with QoS 1 and buffers them if they cannot be sent.
+	DeliveryAtLeastOnce = "atLeastOnce"
+	// CompressionGzip compresses the batches of telemetry messages with gzip (RFC 1952).
+	CompressionGzip = "gzip"
+	// CompressionDeflate compresses the batches of telemetry messages with deflate in the zlib format (RFC 1950).
+	CompressionDeflate = "deflate"
+	// AggregateMin is the minimal value of an aggregated field within the window.
+	AggregateMin = "min"
+	// AggregateMax is the maximal value of an aggregated field within the window.
+	AggregateMax = "max"
+	// AggregateAvg is the average value of an aggregated field within the window.
+	AggregateAvg = "avg"
+	// AggregateLast is the last value of an aggregated field within the window.
+	AggregateLast = "last"
+	// AggregateCount is the number of values of an aggregated field within the window.
+	AggregateCount = "count"
 )
 
 // MessageMapperConfig represents the configuration data for the message mappings.
 type MessageMapperConfig struct {
+	DescriptorSets  []string         `json:"descriptorSets,omitempty"`
 	MessageMappings *MessageMappings `json:"messageMappings,omitempty"`
+
+	telemetryOrder   sync.Once
+	orderedTelemetry []*telemetryMappingEntry
+	skippedTelemetry map[string]error
 }
 
 // MessageMappings represents the message mappings.
 type MessageMappings struct {
 	Command   map[string]*CommandMessageMapping           `json:"command,omitempty"`
 	Telemetry map[int]map[string]*TelemetryMessageMapping `json:"telemetry,omitempty"`
+	Twin      *TwinMappings                               `json:"twin,omitempty"`
+}
+
+// TwinMappings represents the mappings of the top level properties of the Azure IoT Hub device twin to the properties
+// of the Ditto twins, by the name of the device twin property.
+type TwinMappings struct {
+	Desired  map[string]*TwinPropertyMapping `json:"desired,omitempty"`
+	Reported map[string]*TwinPropertyMapping `json:"reported,omitempty"`
 }
 
 // CommandMessageMapping contains the configuration data for a command message mapping.
 type CommandMessageMapping struct {
 	ProtoFile           string                    `json:"protoFile,omitempty"`
+	DescriptorSet       string                    `json:"descriptorSet,omitempty"`
 	ProtoMessage        string                    `json:"protoMessage,omitempty"`
+	ReplyProtoMessage   string                    `json:"replyProtoMessage,omitempty"`
 	RetainCorrelationID bool                      `json:"retainCorrelationId,omitempty"`
+	ReplyTimeout        string                    `json:"replyTimeout,omitempty"`
 	MappingProperties   *CommandMappingProperties `json:"dittoMapping,omitempty"`
 }
 
 // TelemetryMessageMapping contains the configuration data for a telemetry message mapping.
 type TelemetryMessageMapping struct {
-	Serialization     string                            `json:"serialization,omitempty"`
-	ProtoFile         string                            `json:"protoFile,omitempty"`
-	ProtoMessage      string                            `json:"protoMessage,omitempty"`
-	MappingProperties *TelemetryMappingProperties       `json:"dittoMapping,omitempty"`
-	ValueMapping      map[string]interface{}            `json:"valueMapping,omitempty"`
-	FieldMappings     map[string]map[string]interface{} `json:"fieldMappings,omitempty"`
+	Priority            int                               `json:"priority,omitempty"`
+	FanOut              bool                              `json:"fanOut,omitempty"`
+	Serialization       string                            `json:"serialization,omitempty"`
+	ProtoFile           string                            `json:"protoFile,omitempty"`
+	DescriptorSet       string                            `json:"descriptorSet,omitempty"`
+	ProtoMessage        string                            `json:"protoMessage,omitempty"`
+	ProtoJSONFieldNames string                            `json:"protoJSONFieldNames,omitempty"`
+	Codec               string                            `json:"codec,omitempty"`
+	SchemaFile          string                            `json:"schemaFile,omitempty"`
+	Delivery            string                            `json:"delivery,omitempty"`
+	DeliveryPriority    int                               `json:"deliveryPriority,omitempty"`
+	TTL                 string                            `json:"ttl,omitempty"`
+	Batch               *TelemetryBatch                   `json:"batch,omitempty"`
+	RateLimit           *TelemetryRateLimit               `json:"rateLimit,omitempty"`
+	Sampling            *TelemetrySampling                `json:"sampling,omitempty"`
+	ChangeOnly          bool                              `json:"changeOnly,omitempty"`
+	Deadband            map[string]float64                `json:"deadband,omitempty"`
+	Aggregation         *TelemetryAggregation             `json:"aggregation,omitempty"`
+	MappingProperties   *TelemetryMappingProperties       `json:"dittoMapping,omitempty"`
+	ValueMapping        map[string]interface{}            `json:"valueMapping,omitempty"`
+	FieldMappings       map[string]map[string]interface{} `json:"fieldMappings,omitempty"`
+}
+
+// TelemetryBatch defines the batching of the telemetry messages of a mapping, the messages are collected within the
+// window into a single D2C message, which is sent earlier when the maximal number of messages or the maximal size in
+// bytes is reached.
+type TelemetryBatch struct {
+	Window      string `json:"window,omitempty"`
+	MaxMessages int    `json:"maxMessages,omitempty"`
+	MaxSize     int    `json:"maxSize,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// TelemetryRateLimit defines the throttling of the telemetry messages of a mapping with a token bucket, which allows
+// bursts of up to burst messages and is refilled with the given number of messages per interval.
+type TelemetryRateLimit struct {
+	Messages int    `json:"messages,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Burst    int    `json:"burst,omitempty"`
+}
+
+// TelemetrySampling defines the downsampling of the telemetry messages of a mapping per thing, only every Nth message
+// is sent or the first message after the interval since the last sent one, or the first one for which both hold.
+type TelemetrySampling struct {
+	Every    int    `json:"every,omitempty"`
+	Interval string `json:"interval,omitempty"`
+}
+
+// TelemetryAggregation defines the aggregation of numeric fields of the mapped value of a mapping over tumbling
+// windows, the aggregate functions of each field are applied to its values within the window and a single telemetry
+// message is sent at the end of the window.
+type TelemetryAggregation struct {
+	Window string              `json:"window,omitempty"`
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+// TwinPropertyMapping contains the configuration data for a device twin property mapping. The Ditto twin events of
+// a reported property are sent as telemetry too, only if telemetry is set.
+type TwinPropertyMapping struct {
+	Telemetry         bool                   `json:"telemetry,omitempty"`
+	MappingProperties *TwinMappingProperties `json:"dittoMapping,omitempty"`
 }
 
 // CommandMappingProperties defines the mapping properties for a command message mapping.
@@ -56,12 +155,140 @@ type CommandMappingProperties struct {
 	Value  string `json:"value,omitempty"`
 }
 
+// TwinMappingProperties defines the Ditto twin property of a device twin property mapping, i.e. the thing and the path
+// of the property, e.g. /features/UpdateOrchestrator/properties/status.
+type TwinMappingProperties struct {
+	Thing string `json:"thing,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
 // TelemetryMappingProperties defines the mapping properties for a telemetry message mapping.
+// The topic and the path are matched as substrings, unless another match mode is set.
 type TelemetryMappingProperties struct {
+	Match string `json:"match,omitempty"`
 	Topic string `json:"topic,omitempty"`
 	Path  string `json:"path,omitempty"`
 }
 
+// IsProtobuf returns true if the payload of the command is a protobuf message.
+func (mapping *CommandMessageMapping) IsProtobuf() bool {
+	return mapping.ProtoFile != "" || mapping.DescriptorSet != "" || mapping.ProtoMessage != ""
+}
+
+// GetReplyTimeout returns how long the reply of the device to the command is awaited, zero if no reply is expected.
+func (mapping *CommandMessageMapping) GetReplyTimeout() (time.Duration, error) {
+	if mapping.ReplyTimeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(mapping.ReplyTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid reply timeout '%s', expected a positive duration like '30s'", mapping.ReplyTimeout))
+	}
+	return timeout, nil
+}
+
+// IsProtobuf returns true if the mapped value of the telemetry is serialized as a protobuf message.
+func (mapping *TelemetryMessageMapping) IsProtobuf() bool {
+	return mapping.ProtoFile != "" || mapping.DescriptorSet != "" || mapping.ProtoMessage != ""
+}
+
+// GetTTL returns how long the telemetry messages of the mapping are sent before they are discarded as stale, zero if
+// they are sent regardless of their age.
+func (mapping *TelemetryMessageMapping) GetTTL() (time.Duration, error) {
+	if mapping.TTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(mapping.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid time to live '%s', expected a positive duration like '10m'", mapping.TTL))
+	}
+	return ttl, nil
+}
+
+// GetWindow returns the time window the telemetry messages are collected in.
+func (batch *TelemetryBatch) GetWindow() (time.Duration, error) {
+	window, err := time.ParseDuration(batch.Window)
+	if err != nil || window <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid batch window '%s', expected a positive duration like '5s'", batch.Window))
+	}
+	return window, nil
+}
+
+// GetWindow returns the duration of the tumbling windows the values are aggregated in.
+func (aggregation *TelemetryAggregation) GetWindow() (time.Duration, error) {
+	window, err := time.ParseDuration(aggregation.Window)
+	if err != nil || window <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid aggregation window '%s', expected a positive duration like '1m'", aggregation.Window))
+	}
+	return window, nil
+}
+
+// IsChangeFiltered returns true if the telemetry messages of the mapping are sent only when their mapped value changes.
+func (mapping *TelemetryMessageMapping) IsChangeFiltered() bool {
+	return mapping.ChangeOnly || len(mapping.Deadband) > 0
+}
+
+// GetRate returns the number of telemetry messages per second the token bucket is refilled with.
+func (rateLimit *TelemetryRateLimit) GetRate() (float64, error) {
+	if rateLimit.Messages <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid number of messages %d, expected a positive number", rateLimit.Messages))
+	}
+	interval := time.Second
+	if rateLimit.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(rateLimit.Interval); err != nil || interval <= 0 {
+			return 0, errors.New(fmt.Sprintf("invalid rate limit interval '%s', expected a positive duration like '1m'", rateLimit.Interval))
+		}
+	}
+	return float64(rateLimit.Messages) / interval.Seconds(), nil
+}
+
+// GetBurst returns the maximal number of telemetry messages sent at once, the number of messages per interval by
+// default.
+func (rateLimit *TelemetryRateLimit) GetBurst() int {
+	if rateLimit.Burst > 0 {
+		return rateLimit.Burst
+	}
+	return rateLimit.Messages
+}
+
+// GetInterval returns the minimal time between two sampled telemetry messages, zero if the sampling is not timed.
+func (sampling *TelemetrySampling) GetInterval() (time.Duration, error) {
+	if sampling.Interval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(sampling.Interval)
+	if err != nil || interval <= 0 {
+		return 0, errors.New(fmt.Sprintf("invalid sampling interval '%s', expected a positive duration like '10s'", sampling.Interval))
+	}
+	return interval, nil
+}
+
+// CodecName returns the name of the codec that encodes the mapped value of the telemetry. The mappings with a proto
+// message use the protobuf codec by default, the mappings without a codec are serialized as JSON.
+func (mapping *TelemetryMessageMapping) CodecName() string {
+	if mapping.Codec != "" {
+		return mapping.Codec
+	}
+	if mapping.IsProtobuf() {
+		return CodecProtobuf
+	}
+	return ""
+}
+
+// LoadMessageDescriptor returns the descriptor of the proto message of a mapping. The descriptor is parsed from the
+// proto file of the mapping, if set, or looked up by its fully qualified name in the descriptor set of the mapping,
+// falling back to the global descriptor sets.
+func (config *MessageMapperConfig) LoadMessageDescriptor(protoFile, descriptorSet, protoMessage string) (*desc.MessageDescriptor, error) {
+	if protoFile != "" {
+		return descriptor.LoadMessageDescriptor(protoMessage, protoFile)
+	}
+	if descriptorSet != "" {
+		return descriptor.LoadMessageDescriptorFromSets(protoMessage, descriptorSet)
+	}
+	return descriptor.LoadMessageDescriptorFromSets(protoMessage, config.DescriptorSets...)
+}
+
 // GetCommandMessageMapping returns the command message mapping for a specific command name.
 func (config *MessageMapperConfig) GetCommandMessageMapping(messageType string) (*CommandMessageMapping, error) {
 	commandMappings, err := config.GetCommandMessageMappings()
@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The supported modes for matching the Ditto topic and path of a telemetry mapping.
+const (
+	MatchContains = ""
+	MatchExact    = "exact"
+	MatchGlob     = "glob"
+	MatchRegex    = "regex"
+)
+
+// pattern matches a Ditto topic or path, an empty pattern matches any value.
+type pattern struct {
+	mode  string
+	text  string
+	regex *regexp.Regexp
+}
+
+func compilePattern(mode, text string) (*pattern, error) {
+	p := &pattern{mode: mode, text: text}
+	if text == "" {
+		return p, nil
+	}
+	switch mode {
+	case MatchContains, MatchExact:
+	case MatchGlob:
+		if _, err := path.Match(text, ""); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid glob pattern '%s'", text))
+		}
+	case MatchRegex:
+		regex, err := regexp.Compile(text)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid regular expression '%s'", text))
+		}
+		p.regex = regex
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported match mode '%s'", mode))
+	}
+	return p, nil
+}
+
+// match reports whether the value matches the pattern and adds the named capture groups of a regular expression to the captures.
+func (p *pattern) match(value string, captures map[string]string) bool {
+	if p.text == "" {
+		return true
+	}
+	switch p.mode {
+	case MatchExact:
+		return value == p.text
+	case MatchGlob:
+		matched, _ := path.Match(p.text, value)
+		return matched
+	case MatchRegex:
+		submatches := p.regex.FindStringSubmatch(value)
+		if submatches == nil {
+			return false
+		}
+		for i, name := range p.regex.SubexpNames() {
+			if name != "" && captures != nil {
+				captures[name] = submatches[i]
+			}
+		}
+		return true
+	default:
+		return strings.Contains(value, p.text)
+	}
+}
+
+func (p *pattern) captureNames() []string {
+	names := []string{}
+	if p.regex != nil {
+		for _, name := range p.regex.SubexpNames() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// overlaps reports whether both patterns can match the same value. An exact pattern is matched against the other
+// pattern, two globs are matched against each other's text as sample values and any other non-empty patterns are
+// treated as possibly overlapping, e.g. the substrings 'foo' and 'bar' are both contained in 'foobar'.
+func (p *pattern) overlaps(other *pattern) bool {
+	switch {
+	case p.text == "" || other.text == "":
+		return true
+	case p.mode == MatchExact:
+		return other.match(p.text, nil)
+	case other.mode == MatchExact:
+		return p.match(other.text, nil)
+	case p.mode == MatchGlob && other.mode == MatchGlob:
+		return p.match(other.text, nil) || other.match(p.text, nil)
+	default:
+		return true
+	}
+}
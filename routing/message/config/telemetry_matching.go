@@ -0,0 +1,245 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/pkg/errors"
+)
+
+type warnLogger interface {
+	Warn(msg string, err error, fields watermill.LogFields)
+}
+
+// TelemetryMappingMatch is a telemetry message mapping selected for a Ditto message.
+// Captures contains the named capture groups of the regular expressions matched against the Ditto topic and path.
+type TelemetryMappingMatch struct {
+	MessageType    int
+	MessageSubType string
+	Mapping        *TelemetryMessageMapping
+	Captures       map[string]string
+}
+
+type telemetryMappingEntry struct {
+	TelemetryMappingMatch
+	topic *pattern
+	path  *pattern
+}
+
+func (m *TelemetryMappingMatch) String() string {
+	return fmt.Sprintf("messageMappings.telemetry[\"%d\"][%q]", m.MessageType, m.MessageSubType)
+}
+
+// MatchTelemetryMessageMapping returns the telemetry message mapping for a Ditto topic and path.
+// If several mappings match, the one with the highest priority wins, then the most specific one, i.e. the one
+// matching both the topic and the path, an exact match or the one with the longest topic and path, and finally
+// the one with the lowest message type and sub type. Fan-out mappings are not considered.
+func (config *MessageMapperConfig) MatchTelemetryMessageMapping(topic, path string) (*TelemetryMappingMatch, error) {
+	telemetryMappings, err := config.orderedTelemetryMappings()
+	if err != nil {
+		return nil, err
+	}
+	for _, telemetryMapping := range telemetryMappings {
+		if telemetryMapping.Mapping.FanOut {
+			continue
+		}
+		if match := telemetryMapping.match(topic, path); match != nil {
+			return match, nil
+		}
+	}
+	return nil, noTelemetryMappingError(topic, path)
+}
+
+// MatchTelemetryMessageMappings returns all telemetry message mappings for a Ditto topic and path, i.e. the one
+// selected by MatchTelemetryMessageMapping followed by all matching fan-out mappings in the mapping order.
+func (config *MessageMapperConfig) MatchTelemetryMessageMappings(topic, path string) ([]*TelemetryMappingMatch, error) {
+	telemetryMappings, err := config.orderedTelemetryMappings()
+	if err != nil {
+		return nil, err
+	}
+	matches := []*TelemetryMappingMatch{}
+	selected := false
+	for _, telemetryMapping := range telemetryMappings {
+		if !telemetryMapping.Mapping.FanOut && selected {
+			continue
+		}
+		if match := telemetryMapping.match(topic, path); match != nil {
+			if telemetryMapping.Mapping.FanOut {
+				matches = append(matches, match)
+			} else {
+				matches = append([]*TelemetryMappingMatch{match}, matches...)
+				selected = true
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, noTelemetryMappingError(topic, path)
+	}
+	return matches, nil
+}
+
+func noTelemetryMappingError(topic, path string) error {
+	return errors.New(fmt.Sprintf("no telemetry message mapping configuration for Ditto topic '%s' & Ditto path '%s'", topic, path))
+}
+
+// TelemetryMappingOverlaps lists the telemetry message mappings with the same priority that can match the same Ditto message.
+// Each overlap is resolved by the mapping order, but a priority should be set to make the choice explicit.
+// Fan-out mappings do not overlap, as they are applied in addition to the selected mapping.
+func (config *MessageMapperConfig) TelemetryMappingOverlaps() []string {
+	telemetryMappings, err := config.orderedTelemetryMappings()
+	if err != nil {
+		return nil
+	}
+	overlaps := []string{}
+	for i, preferred := range telemetryMappings {
+		for _, other := range telemetryMappings[i+1:] {
+			if preferred.Mapping.FanOut || other.Mapping.FanOut {
+				continue
+			}
+			if preferred.Mapping.Priority == other.Mapping.Priority && preferred.overlaps(other) {
+				overlaps = append(overlaps, fmt.Sprintf("%s and %s can match the same Ditto message, %s takes precedence",
+					&preferred.TelemetryMappingMatch, &other.TelemetryMappingMatch, &preferred.TelemetryMappingMatch))
+			}
+		}
+	}
+	return overlaps
+}
+
+// LogTelemetryMappingOverlaps reports the telemetry message mapping overlaps, if any.
+func (config *MessageMapperConfig) LogTelemetryMappingOverlaps(logger watermill.LoggerAdapter) {
+	for _, overlap := range config.TelemetryMappingOverlaps() {
+		if warnLogger, ok := logger.(warnLogger); ok {
+			warnLogger.Warn("ambiguous telemetry message mappings", nil, watermill.LogFields{"overlap": overlap})
+		} else {
+			logger.Info("ambiguous telemetry message mappings", watermill.LogFields{"overlap": overlap})
+		}
+	}
+}
+
+// LogSkippedTelemetryMappings reports the telemetry message mappings that never match, as their Ditto topic or path
+// pattern cannot be compiled, if any.
+func (config *MessageMapperConfig) LogSkippedTelemetryMappings(logger watermill.LoggerAdapter) {
+	if _, err := config.orderedTelemetryMappings(); err != nil {
+		return
+	}
+	mappings := make([]string, 0, len(config.skippedTelemetry))
+	for mapping := range config.skippedTelemetry {
+		mappings = append(mappings, mapping)
+	}
+	sort.Strings(mappings)
+	for _, mapping := range mappings {
+		logger.Error("skipping telemetry message mapping", config.skippedTelemetry[mapping], watermill.LogFields{"mapping": mapping})
+	}
+}
+
+func (config *MessageMapperConfig) orderedTelemetryMappings() ([]*telemetryMappingEntry, error) {
+	telemetryMappings, err := config.GetTelemetryMessageMappings()
+	if err != nil {
+		return nil, err
+	}
+	config.telemetryOrder.Do(func() {
+		ordered := []*telemetryMappingEntry{}
+		skipped := map[string]error{}
+		for messageType, telemetryMessageTypeMappings := range telemetryMappings {
+			for messageSubType, messageMapping := range telemetryMessageTypeMappings {
+				if messageMapping == nil || messageMapping.MappingProperties == nil {
+					continue
+				}
+				entry, err := newTelemetryMappingEntry(messageType, messageSubType, messageMapping)
+				if err != nil {
+					skipped[(&TelemetryMappingMatch{MessageType: messageType, MessageSubType: messageSubType}).String()] = err
+					continue
+				}
+				ordered = append(ordered, entry)
+			}
+		}
+		sort.Slice(ordered, func(i, j int) bool {
+			return ordered[i].precedes(ordered[j])
+		})
+		config.orderedTelemetry = ordered
+		config.skippedTelemetry = skipped
+	})
+	return config.orderedTelemetry, nil
+}
+
+func newTelemetryMappingEntry(messageType int, messageSubType string, messageMapping *TelemetryMessageMapping) (*telemetryMappingEntry, error) {
+	mappingProperties := messageMapping.MappingProperties
+	topic, err := compilePattern(mappingProperties.Match, mappingProperties.Topic)
+	if err != nil {
+		return nil, err
+	}
+	path, err := compilePattern(mappingProperties.Match, mappingProperties.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &telemetryMappingEntry{
+		TelemetryMappingMatch: TelemetryMappingMatch{
+			MessageType:    messageType,
+			MessageSubType: messageSubType,
+			Mapping:        messageMapping,
+		},
+		topic: topic,
+		path:  path,
+	}, nil
+}
+
+func (e *telemetryMappingEntry) match(topic, path string) *TelemetryMappingMatch {
+	if e.topic.text == "" && e.path.text == "" {
+		return nil
+	}
+	captures := map[string]string{}
+	if !e.topic.match(topic, captures) || !e.path.match(path, captures) {
+		return nil
+	}
+	match := e.TelemetryMappingMatch
+	match.Captures = captures
+	return &match
+}
+
+func (e *telemetryMappingEntry) overlaps(other *telemetryMappingEntry) bool {
+	return e.topic.overlaps(other.topic) && e.path.overlaps(other.path)
+}
+
+func (e *telemetryMappingEntry) precedes(other *telemetryMappingEntry) bool {
+	if e.Mapping.Priority != other.Mapping.Priority {
+		return e.Mapping.Priority > other.Mapping.Priority
+	}
+	criteria, exact, length := e.specificity()
+	otherCriteria, otherExact, otherLength := other.specificity()
+	if criteria != otherCriteria {
+		return criteria > otherCriteria
+	}
+	if exact != otherExact {
+		return exact
+	}
+	if length != otherLength {
+		return length > otherLength
+	}
+	if e.MessageType != other.MessageType {
+		return e.MessageType < other.MessageType
+	}
+	return e.MessageSubType < other.MessageSubType
+}
+
+func (e *telemetryMappingEntry) specificity() (int, bool, int) {
+	criteria := 0
+	if e.topic.text != "" {
+		criteria++
+	}
+	if e.path.text != "" {
+		criteria++
+	}
+	return criteria, e.topic.mode == MatchExact, len(e.topic.text) + len(e.path.text)
+}
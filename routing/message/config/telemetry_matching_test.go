@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTelemetryMessageMapping(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/overlapping-telemetry-mappings.json")
+	require.NoError(t, err)
+
+	tests := []struct {
+		topic          string
+		path           string
+		messageType    int
+		messageSubType string
+	}{
+		{"ns/dev/things/live/messages/state", "/features/Container/properties/status/state", 1, "state"},
+		{"ns/dev/things/live/messages/state", "/features/Container/properties/status/stateDetails", 1, "stateDetails"},
+		{"ns/dev/things/twin/events/modified", "/features/Container/properties/status/state", 1, "containerState"},
+		{"ns/dev/things/live/messages/status", "/features/Container/properties/status/any", 2, "anyStatus"},
+		{"ns/dev/things/live/messages/metrics", "/features/Metrics/outbox/messages/metrics", 2, "metrics"},
+	}
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			telemetryMatch, err := mapperConfig.MatchTelemetryMessageMapping(test.topic, test.path)
+			require.NoError(t, err)
+			assert.Equal(t, test.messageType, telemetryMatch.MessageType, test.path)
+			assert.Equal(t, test.messageSubType, telemetryMatch.MessageSubType, test.path)
+		}
+	}
+
+	_, err = mapperConfig.MatchTelemetryMessageMapping("ns/dev/things/live/messages/unknown", "/features/Unknown")
+	assert.Error(t, err)
+}
+
+func TestMatchTelemetryMessageMappingsFanOut(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/overlapping-telemetry-mappings.json")
+	require.NoError(t, err)
+
+	tests := []struct {
+		path            string
+		messageSubTypes []string
+	}{
+		{"/features/Container/properties/status/state", []string{"state", "stateAudit"}},
+		{"/features/Container/properties/status/stateDetails", []string{"stateDetails", "stateAudit"}},
+		{"/features/Container/properties/audit", []string{"audit"}},
+		{"/features/Metrics/outbox/messages/metrics", []string{"metrics"}},
+	}
+	for _, test := range tests {
+		telemetryMatches, err := mapperConfig.MatchTelemetryMessageMappings("ns/dev/things/live/messages/state", test.path)
+		require.NoError(t, err)
+		messageSubTypes := []string{}
+		for _, telemetryMatch := range telemetryMatches {
+			messageSubTypes = append(messageSubTypes, telemetryMatch.MessageSubType)
+		}
+		assert.Equal(t, test.messageSubTypes, messageSubTypes, test.path)
+	}
+
+	_, err = mapperConfig.MatchTelemetryMessageMapping("ns/dev/things/live/messages/audit", "/features/Container/properties/audit")
+	assert.Error(t, err)
+	_, err = mapperConfig.MatchTelemetryMessageMappings("ns/dev/things/live/messages/unknown", "/features/Unknown")
+	assert.Error(t, err)
+}
+
+func TestMatchTelemetryMessageMappingNoMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/missing-telemetry-mappings.json")
+	require.NoError(t, err)
+	_, err = mapperConfig.MatchTelemetryMessageMapping("ns/dev/things/live/messages/state", "/status/state")
+	assert.Error(t, err)
+}
+
+func TestMatchTelemetryMessageMappingPatterns(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/pattern-telemetry-mappings.json")
+	require.NoError(t, err)
+	require.NoError(t, mapperConfig.Validate())
+
+	tests := []struct {
+		topic          string
+		path           string
+		messageSubType string
+		captures       map[string]string
+	}{
+		{"ns/dev/things/live/messages/status", "/features/Status/properties/status", "exact.status", map[string]string{}},
+		{"ns/dev/things/live/messages/status", "/features/Container/properties/status", "feature.status", map[string]string{}},
+		{"ns/dev/things/twin/events/modified", "/features/Container/properties/status", "feature.property", map[string]string{
+			"namespace": "ns", "device": "dev", "feature": "Container", "property": "status",
+		}},
+		{"ns/dev/things/twin/events/modified", "/features/Container/properties/state", "feature.property", map[string]string{
+			"namespace": "ns", "device": "dev", "feature": "Container", "property": "state",
+		}},
+	}
+	for _, test := range tests {
+		telemetryMatch, err := mapperConfig.MatchTelemetryMessageMapping(test.topic, test.path)
+		require.NoError(t, err)
+		assert.Equal(t, test.messageSubType, telemetryMatch.MessageSubType, test.path)
+		assert.Equal(t, test.captures, telemetryMatch.Captures, test.path)
+	}
+
+	for _, path := range []string{"/features/Status/properties/status/details", "/features/Container/properties/state", "/prefix/features/Status/properties/status"} {
+		_, err = mapperConfig.MatchTelemetryMessageMapping("ns/dev/things/live/messages/status", path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestTelemetryMappingPatternOverlaps(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/pattern-telemetry-mappings.json")
+	require.NoError(t, err)
+
+	expectedOverlaps := []string{
+		`messageMappings.telemetry["1"]["feature.property"] and messageMappings.telemetry["1"]["exact.status"] can match the same Ditto message, messageMappings.telemetry["1"]["feature.property"] takes precedence`,
+		`messageMappings.telemetry["1"]["feature.property"] and messageMappings.telemetry["1"]["feature.status"] can match the same Ditto message, messageMappings.telemetry["1"]["feature.property"] takes precedence`,
+		`messageMappings.telemetry["1"]["exact.status"] and messageMappings.telemetry["1"]["feature.status"] can match the same Ditto message, messageMappings.telemetry["1"]["exact.status"] takes precedence`,
+	}
+	assert.Equal(t, expectedOverlaps, mapperConfig.TelemetryMappingOverlaps())
+}
+
+func TestTelemetryMappingOverlaps(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/overlapping-telemetry-mappings.json")
+	require.NoError(t, err)
+
+	// the substrings of different paths, e.g. '/status/state' and '/metrics', can be contained in the same path
+	expectedOverlaps := []string{
+		`messageMappings.telemetry["1"]["containerState"] and messageMappings.telemetry["1"]["stateDetails"] can match the same Ditto message, messageMappings.telemetry["1"]["containerState"] takes precedence`,
+		`messageMappings.telemetry["1"]["containerState"] and messageMappings.telemetry["1"]["state"] can match the same Ditto message, messageMappings.telemetry["1"]["containerState"] takes precedence`,
+		`messageMappings.telemetry["1"]["containerState"] and messageMappings.telemetry["2"]["status"] can match the same Ditto message, messageMappings.telemetry["1"]["containerState"] takes precedence`,
+		`messageMappings.telemetry["1"]["containerState"] and messageMappings.telemetry["2"]["metrics"] can match the same Ditto message, messageMappings.telemetry["1"]["containerState"] takes precedence`,
+		`messageMappings.telemetry["1"]["stateDetails"] and messageMappings.telemetry["1"]["state"] can match the same Ditto message, messageMappings.telemetry["1"]["stateDetails"] takes precedence`,
+		`messageMappings.telemetry["1"]["stateDetails"] and messageMappings.telemetry["2"]["status"] can match the same Ditto message, messageMappings.telemetry["1"]["stateDetails"] takes precedence`,
+		`messageMappings.telemetry["1"]["stateDetails"] and messageMappings.telemetry["2"]["metrics"] can match the same Ditto message, messageMappings.telemetry["1"]["stateDetails"] takes precedence`,
+		`messageMappings.telemetry["1"]["state"] and messageMappings.telemetry["2"]["status"] can match the same Ditto message, messageMappings.telemetry["1"]["state"] takes precedence`,
+		`messageMappings.telemetry["1"]["state"] and messageMappings.telemetry["2"]["metrics"] can match the same Ditto message, messageMappings.telemetry["1"]["state"] takes precedence`,
+		`messageMappings.telemetry["2"]["status"] and messageMappings.telemetry["2"]["metrics"] can match the same Ditto message, messageMappings.telemetry["2"]["status"] takes precedence`,
+	}
+	assert.Equal(t, expectedOverlaps, mapperConfig.TelemetryMappingOverlaps())
+
+	mapperConfig, err = config.LoadMessageMapperConfig("testdata/valid-message-mappings.json")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`messageMappings.telemetry["1"]["status"] and messageMappings.telemetry["1"]["counter"] can match the same Ditto message, messageMappings.telemetry["1"]["status"] takes precedence`,
+	}, mapperConfig.TelemetryMappingOverlaps())
+}
+
+func TestLogSkippedTelemetryMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/invalid-message-mappings.json")
+	require.NoError(t, err)
+
+	logger := watermill.NewCaptureLogger()
+	mapperConfig.LogSkippedTelemetryMappings(logger)
+	errorLogs := logger.Captured()[watermill.ErrorLogLevel]
+	require.Len(t, errorLogs, 2)
+	assert.Equal(t, watermill.LogFields{"mapping": `messageMappings.telemetry["1"]["invalid.match.mode"]`}, errorLogs[0].Fields)
+	assert.Equal(t, watermill.LogFields{"mapping": `messageMappings.telemetry["1"]["invalid.regex"]`}, errorLogs[1].Fields)
+	assert.Contains(t, errorLogs[1].Err.Error(), "invalid regular expression")
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReportedPropertyMatch is a reported property of the device twin that is updated by a Ditto twin event.
+// ValuePath are the keys of the property value within the value of an event on a parent path of the property and
+// PatchPath are the keys of the value of an event on a path below the property within the property value.
+type ReportedPropertyMatch struct {
+	Property  string
+	Mapping   *TwinPropertyMapping
+	ValuePath []string
+	PatchPath []string
+}
+
+// MatchReportedProperties returns the reported properties updated by a Ditto twin event, sorted by the property name.
+// An event of the thing of a property mapping matches if its path is the path of the property, one of its parents or
+// below it.
+func (config *MessageMapperConfig) MatchReportedProperties(topic, path string) []*ReportedPropertyMatch {
+	if config.MessageMappings == nil || config.MessageMappings.Twin == nil {
+		return nil
+	}
+	thingID, ok := parseTwinEventTopic(topic)
+	if !ok {
+		return nil
+	}
+	reportedMappings := config.MessageMappings.Twin.Reported
+	properties := make([]string, 0, len(reportedMappings))
+	for property := range reportedMappings {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	eventPath := strings.TrimSuffix(path, "/")
+	var matches []*ReportedPropertyMatch
+	for _, property := range properties {
+		mapping := reportedMappings[property]
+		if mapping == nil || mapping.MappingProperties == nil || !matchesThing(thingID, mapping.MappingProperties.Thing) {
+			continue
+		}
+		propertyPath := strings.TrimSuffix(mapping.MappingProperties.Path, "/")
+		if propertyPath == "" {
+			continue
+		}
+		match := &ReportedPropertyMatch{Property: property, Mapping: mapping}
+		switch {
+		case propertyPath == eventPath:
+		case strings.HasPrefix(propertyPath, eventPath+"/"):
+			match.ValuePath = strings.Split(propertyPath[len(eventPath)+1:], "/")
+		case strings.HasPrefix(eventPath, propertyPath+"/"):
+			match.PatchPath = strings.Split(eventPath[len(propertyPath)+1:], "/")
+		default:
+			continue
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// IsReportedOnly returns true if a Ditto twin event updates reported properties of the device twin and none of their
+// mappings sends it as telemetry.
+func (config *MessageMapperConfig) IsReportedOnly(topic, path string) bool {
+	matches := config.MatchReportedProperties(topic, path)
+	for _, match := range matches {
+		if match.Mapping.Telemetry {
+			return false
+		}
+	}
+	return len(matches) > 0
+}
+
+// parseTwinEventTopic returns the thing ID of a Ditto twin event topic, e.g. {namespace}/{name}/things/twin/events/modified.
+func parseTwinEventTopic(topic string) (string, bool) {
+	elements := strings.Split(topic, "/")
+	if len(elements) < 5 || elements[2] != "things" || elements[3] != "twin" || elements[4] != "events" {
+		return "", false
+	}
+	return elements[0] + ":" + elements[1], true
+}
+
+// matchesThing returns true if a thing ID ends with the thing of a mapping, any thing matches a mapping without thing.
+func matchesThing(thingID, thing string) bool {
+	return thing == "" || thingID == thing || strings.HasSuffix(thingID, ":"+thing)
+}
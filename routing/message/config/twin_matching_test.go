@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const updateEventTopic = "azure.edge/hub:device:edge:update/things/twin/events/modified"
+
+func TestValidateTwinMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/twin-mappings.json")
+	require.NoError(t, err)
+	err = mapperConfig.Validate()
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+
+	assert.Equal(t, []string{
+		`messageMappings.twin.desired["desired.telemetry"].telemetry: telemetry is only supported for reported properties`,
+		`messageMappings.twin.desired["missing.thing"].dittoMapping.thing: missing Ditto thing`,
+		`messageMappings.twin.reported["invalid.path"].dittoMapping.path: invalid Ditto path '/', expected a path like '/features/{feature}/properties/{property}'`,
+		`messageMappings.twin.reported["missing.ditto.mapping"].dittoMapping: missing Ditto mapping`,
+	}, validationErr.Problems)
+}
+
+func TestMatchReportedProperties(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/twin-mappings.json")
+	require.NoError(t, err)
+
+	tests := []struct {
+		topic      string
+		path       string
+		properties []string
+		valuePaths [][]string
+		patchPaths [][]string
+	}{
+		{updateEventTopic, "/features/UpdateOrchestrator/properties/status",
+			[]string{"updateStatus", "updateStatusTelemetry"}, [][]string{nil, {"state"}}, [][]string{nil, nil}},
+		{updateEventTopic, "/features/UpdateOrchestrator/properties/status/state/",
+			[]string{"updateStatus", "updateStatusTelemetry"}, [][]string{nil, nil}, [][]string{{"state"}, nil}},
+		{updateEventTopic, "/features/UpdateOrchestrator",
+			[]string{"updateStatus", "updateStatusTelemetry"}, [][]string{{"properties", "status"}, {"properties", "status", "state"}}, [][]string{nil, nil}},
+		// the mappings without thing match the events of all things
+		{updateEventTopic, "/",
+			[]string{"containers", "updateStatus", "updateStatusTelemetry"},
+			[][]string{{"features", "ContainerOrchestrator", "properties"}, {"features", "UpdateOrchestrator", "properties", "status"}, {"features", "UpdateOrchestrator", "properties", "status", "state"}},
+			[][]string{nil, nil, nil}},
+		{"azure.edge/hub:device:edge:containers/things/twin/events/merged", "/features/ContainerOrchestrator/properties/containers/c1",
+			[]string{"containers"}, [][]string{nil}, [][]string{{"containers", "c1"}}},
+		{updateEventTopic, "/features/UpdateOrchestrator/properties/statusCode", nil, nil, nil},
+		{"azure.edge/hub:device:edge:other/things/twin/events/modified", "/features/UpdateOrchestrator/properties/status", nil, nil, nil},
+		{"azure.edge/hub:device:edge:update/things/live/messages/status", "/features/UpdateOrchestrator/properties/status", nil, nil, nil},
+	}
+	for _, test := range tests {
+		matches := mapperConfig.MatchReportedProperties(test.topic, test.path)
+		require.Equal(t, len(test.properties), len(matches), test.path)
+		for i, match := range matches {
+			assert.Equal(t, test.properties[i], match.Property, test.path)
+			assert.Equal(t, test.valuePaths[i], match.ValuePath, test.path)
+			assert.Equal(t, test.patchPaths[i], match.PatchPath, test.path)
+		}
+	}
+
+	assert.False(t, mapperConfig.IsReportedOnly(updateEventTopic, "/features/UpdateOrchestrator/properties/status"))
+	assert.True(t, mapperConfig.IsReportedOnly(updateEventTopic, "/features/UpdateOrchestrator/properties/status/progress"))
+	assert.False(t, mapperConfig.IsReportedOnly(updateEventTopic, "/features/UpdateOrchestrator/properties/statusCode"))
+	assert.Empty(t, (&config.MessageMapperConfig{}).MatchReportedProperties(updateEventTopic, "/"))
+}
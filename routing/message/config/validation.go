@@ -0,0 +1,521 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/expression"
+)
+
+const (
+	refPrefix                     = "$"
+	refMatchPrefix                = "$match."
+	incrementPrefix               = "++"
+	templateEach                  = "$each"
+	templateValue                 = "$template"
+	serializationJSON             = ""
+	serializationString           = "jsonString"
+	serializationProtobufBase64   = "protobufBase64"
+	serializationProtobufEnvelope = "protobufEnvelope"
+	serializationProtobufJSON     = "protobufJSON"
+	wellKnownTypesPackage         = "google.protobuf."
+	protoJSONFieldNamesCamelCase  = "lowerCamelCase"
+	protoJSONFieldNamesProto      = "protoName"
+)
+
+// ValidationError contains all problems found in a message mapper configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid message mapper config: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(path, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the message mapper configuration for problems that would make the mappings fail at message time.
+// All problems are reported at once in a ValidationError, each one prefixed with the JSON path of the faulty element.
+func (config *MessageMapperConfig) Validate() error {
+	return config.validate(true)
+}
+
+// ValidateWithoutDescriptors checks the message mapper configuration like Validate, except that the proto messages of
+// the mappings are not loaded. It is used when the proto messages are preloaded separately.
+func (config *MessageMapperConfig) ValidateWithoutDescriptors() error {
+	return config.validate(false)
+}
+
+func (config *MessageMapperConfig) validate(loadDescriptors bool) error {
+	validationErr := &ValidationError{}
+	if config.MessageMappings == nil {
+		validationErr.add("messageMappings", "missing message mappings")
+		return validationErr
+	}
+	commandNames := make([]string, 0, len(config.MessageMappings.Command))
+	for commandName := range config.MessageMappings.Command {
+		commandNames = append(commandNames, commandName)
+	}
+	sort.Strings(commandNames)
+	for _, commandName := range commandNames {
+		path := fmt.Sprintf("messageMappings.command[%q]", commandName)
+		validateCommandMapping(validationErr, path, config, loadDescriptors, config.MessageMappings.Command[commandName])
+	}
+	messageTypes := make([]int, 0, len(config.MessageMappings.Telemetry))
+	for messageType := range config.MessageMappings.Telemetry {
+		messageTypes = append(messageTypes, messageType)
+	}
+	sort.Ints(messageTypes)
+	for _, messageType := range messageTypes {
+		telemetryMappings := config.MessageMappings.Telemetry[messageType]
+		messageSubTypes := make([]string, 0, len(telemetryMappings))
+		for messageSubType := range telemetryMappings {
+			messageSubTypes = append(messageSubTypes, messageSubType)
+		}
+		sort.Strings(messageSubTypes)
+		for _, messageSubType := range messageSubTypes {
+			path := fmt.Sprintf("messageMappings.telemetry[\"%d\"][%q]", messageType, messageSubType)
+			validateTelemetryMapping(validationErr, path, config, loadDescriptors, telemetryMappings[messageSubType])
+		}
+	}
+	if twinMappings := config.MessageMappings.Twin; twinMappings != nil {
+		validateTwinMappings(validationErr, "messageMappings.twin.desired", twinMappings.Desired, false)
+		validateTwinMappings(validationErr, "messageMappings.twin.reported", twinMappings.Reported, true)
+	}
+	if len(validationErr.Problems) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+func validateCommandMapping(validationErr *ValidationError, path string, config *MessageMapperConfig, loadDescriptors bool, mapping *CommandMessageMapping) {
+	if mapping == nil {
+		validationErr.add(path, "missing command mapping")
+		return
+	}
+	if mapping.MappingProperties == nil {
+		validationErr.add(path+".dittoMapping", "missing Ditto mapping")
+	} else if mapping.MappingProperties.Action == "" {
+		validationErr.add(path+".dittoMapping.action", "missing Ditto message action")
+	}
+	if _, err := mapping.GetReplyTimeout(); err != nil {
+		validationErr.add(path+".replyTimeout", "%v", err)
+	}
+	validateProtoMessage(validationErr, path, config, loadDescriptors, mapping.ProtoFile, mapping.DescriptorSet, mapping.ProtoMessage)
+	if mapping.ReplyProtoMessage != "" && loadDescriptors {
+		if _, err := config.LoadMessageDescriptor(mapping.ProtoFile, mapping.DescriptorSet, mapping.ReplyProtoMessage); err != nil {
+			validationErr.add(path+".replyProtoMessage", "%v", err)
+		}
+	}
+}
+
+func validateTelemetryMapping(validationErr *ValidationError, path string, config *MessageMapperConfig, loadDescriptors bool, mapping *TelemetryMessageMapping) {
+	if mapping == nil {
+		validationErr.add(path, "missing telemetry mapping")
+		return
+	}
+	captures := map[string]bool{}
+	if mapping.MappingProperties == nil {
+		validationErr.add(path+".dittoMapping", "missing Ditto mapping")
+	} else {
+		validateTelemetryMappingProperties(validationErr, path+".dittoMapping", mapping.MappingProperties, captures)
+	}
+	switch mapping.Serialization {
+	case serializationJSON:
+	case serializationString:
+		if mapping.CodecName() != "" {
+			validationErr.add(path+".serialization", "serialization '%s' is not supported with codec '%s'", mapping.Serialization, mapping.CodecName())
+		}
+	case serializationProtobufBase64, serializationProtobufEnvelope:
+		if mapping.CodecName() == "" {
+			validationErr.add(path+".serialization", "serialization '%s' requires a proto file, descriptor set or codec", mapping.Serialization)
+		}
+	case serializationProtobufJSON:
+		if !mapping.IsProtobuf() {
+			validationErr.add(path+".serialization", "serialization '%s' requires a proto file or descriptor set", mapping.Serialization)
+		}
+	default:
+		validationErr.add(path+".serialization", "unsupported serialization '%s'", mapping.Serialization)
+	}
+	validateCodec(validationErr, path, mapping)
+	switch mapping.Delivery {
+	case "", DeliveryAtMostOnce, DeliveryAtLeastOnce:
+	default:
+		validationErr.add(path+".delivery", "unsupported delivery '%s'", mapping.Delivery)
+	}
+	if _, err := mapping.GetTTL(); err != nil {
+		validationErr.add(path+".ttl", "%v", err)
+	}
+	if mapping.Batch != nil {
+		validateBatch(validationErr, path+".batch", mapping)
+	}
+	if mapping.RateLimit != nil {
+		validateRateLimit(validationErr, path+".rateLimit", mapping.RateLimit)
+	}
+	if mapping.Sampling != nil {
+		validateSampling(validationErr, path+".sampling", mapping.Sampling)
+	}
+	validateDeadband(validationErr, path+".deadband", mapping.Deadband)
+	if mapping.Aggregation != nil {
+		validateAggregation(validationErr, path+".aggregation", mapping)
+	}
+	switch mapping.ProtoJSONFieldNames {
+	case "":
+	case protoJSONFieldNamesCamelCase, protoJSONFieldNamesProto:
+		if mapping.Serialization != serializationProtobufJSON {
+			validationErr.add(path+".protoJSONFieldNames", "field names are only supported with serialization '%s'", serializationProtobufJSON)
+		}
+	default:
+		validationErr.add(path+".protoJSONFieldNames", "unsupported field names '%s'", mapping.ProtoJSONFieldNames)
+	}
+	validateProtoMessage(validationErr, path, config, loadDescriptors, mapping.ProtoFile, mapping.DescriptorSet, mapping.ProtoMessage)
+
+	refs := map[string]bool{}
+	validateValueMapping(validationErr, path+".valueMapping", mapping.ValueMapping, captures, refs)
+	if loadDescriptors && mapping.IsProtobuf() && mapping.ValueMapping != nil {
+		// a proto message that cannot be loaded is already reported above
+		if messageDescriptor, err := config.LoadMessageDescriptor(mapping.ProtoFile, mapping.DescriptorSet, mapping.ProtoMessage); err == nil {
+			validateProtoFields(validationErr, path+".valueMapping", messageDescriptor, mapping.ValueMapping)
+		}
+	}
+	fieldKeys := make([]string, 0, len(mapping.FieldMappings))
+	for fieldKey := range mapping.FieldMappings {
+		fieldKeys = append(fieldKeys, fieldKey)
+	}
+	sort.Strings(fieldKeys)
+	for _, fieldKey := range fieldKeys {
+		if !refs[fieldKey] {
+			validationErr.add(fmt.Sprintf("%s.fieldMappings[%q]", path, fieldKey), "field mapping is not referenced in the value mapping")
+		}
+	}
+}
+
+func validateBatch(validationErr *ValidationError, path string, mapping *TelemetryMessageMapping) {
+	if _, err := mapping.Batch.GetWindow(); err != nil {
+		validationErr.add(path+".window", "%v", err)
+	}
+	if mapping.Batch.MaxMessages < 0 {
+		validationErr.add(path+".maxMessages", "negative maximal number of messages %d", mapping.Batch.MaxMessages)
+	}
+	if mapping.Batch.MaxSize < 0 {
+		validationErr.add(path+".maxSize", "negative maximal size %d", mapping.Batch.MaxSize)
+	}
+	switch mapping.Batch.Compression {
+	case "", CompressionGzip, CompressionDeflate:
+	default:
+		validationErr.add(path+".compression", "unsupported compression '%s'", mapping.Batch.Compression)
+	}
+	if mapping.Serialization == serializationProtobufEnvelope {
+		validationErr.add(path, "batching is not supported with serialization '%s'", mapping.Serialization)
+	}
+}
+
+func validateRateLimit(validationErr *ValidationError, path string, rateLimit *TelemetryRateLimit) {
+	if rateLimit.Messages <= 0 {
+		validationErr.add(path+".messages", "invalid number of messages %d, expected a positive number", rateLimit.Messages)
+	} else if _, err := rateLimit.GetRate(); err != nil {
+		validationErr.add(path+".interval", "%v", err)
+	}
+	if rateLimit.Burst < 0 {
+		validationErr.add(path+".burst", "negative burst %d", rateLimit.Burst)
+	}
+}
+
+func validateSampling(validationErr *ValidationError, path string, sampling *TelemetrySampling) {
+	if sampling.Every == 0 && sampling.Interval == "" {
+		validationErr.add(path, "either every or interval must be set")
+	}
+	if sampling.Every < 0 {
+		validationErr.add(path+".every", "invalid number of messages %d, expected a positive number", sampling.Every)
+	}
+	if _, err := sampling.GetInterval(); err != nil {
+		validationErr.add(path+".interval", "%v", err)
+	}
+}
+
+func validateDeadband(validationErr *ValidationError, path string, deadband map[string]float64) {
+	fields := make([]string, 0, len(deadband))
+	for field := range deadband {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fieldPath := fmt.Sprintf("%s[%q]", path, field)
+		validateField(validationErr, fieldPath, field)
+		if deadband[field] <= 0 {
+			validationErr.add(fieldPath, "invalid deadband %v, expected a positive number", deadband[field])
+		}
+	}
+}
+
+func validateAggregation(validationErr *ValidationError, path string, mapping *TelemetryMessageMapping) {
+	if _, err := mapping.Aggregation.GetWindow(); err != nil {
+		validationErr.add(path+".window", "%v", err)
+	}
+	if len(mapping.Aggregation.Fields) == 0 {
+		validationErr.add(path+".fields", "missing aggregated fields")
+	}
+	fields := make([]string, 0, len(mapping.Aggregation.Fields))
+	for field := range mapping.Aggregation.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fieldPath := fmt.Sprintf("%s.fields[%q]", path, field)
+		validateField(validationErr, fieldPath, field)
+		functions := mapping.Aggregation.Fields[field]
+		if len(functions) == 0 {
+			validationErr.add(fieldPath, "missing aggregate functions")
+		}
+		for _, function := range functions {
+			switch function {
+			case AggregateMin, AggregateMax, AggregateAvg, AggregateLast, AggregateCount:
+			default:
+				validationErr.add(fieldPath, "unsupported aggregate function '%s'", function)
+			}
+		}
+	}
+	if mapping.Batch != nil {
+		validationErr.add(path, "aggregation is not supported with batch")
+	}
+	// the objects of the aggregate functions replace the numeric fields, which do not fit a proto message or a schema
+	if mapping.IsProtobuf() || mapping.SchemaFile != "" {
+		validationErr.add(path, "aggregation is not supported with proto messages or schema files")
+	}
+}
+
+// validateField validates a field of the mapped value, which is a dot separated path of the field, e.g. battery.level.
+func validateField(validationErr *ValidationError, path string, field string) {
+	for _, name := range strings.Split(field, ".") {
+		if name == "" {
+			validationErr.add(path, "invalid field '%s', expected a field of the mapped value like 'battery.level'", field)
+			return
+		}
+	}
+}
+
+func validateTwinMappings(validationErr *ValidationError, path string, mappings map[string]*TwinPropertyMapping, reported bool) {
+	properties := make([]string, 0, len(mappings))
+	for property := range mappings {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	for _, property := range properties {
+		propertyPath := fmt.Sprintf("%s[%q]", path, property)
+		mapping := mappings[property]
+		if mapping == nil {
+			validationErr.add(propertyPath, "missing twin property mapping")
+			continue
+		}
+		if mapping.Telemetry && !reported {
+			validationErr.add(propertyPath+".telemetry", "telemetry is only supported for reported properties")
+		}
+		if mapping.MappingProperties == nil {
+			validationErr.add(propertyPath+".dittoMapping", "missing Ditto mapping")
+			continue
+		}
+		// the twin commands of the desired properties are sent to a single thing
+		if mapping.MappingProperties.Thing == "" && !reported {
+			validationErr.add(propertyPath+".dittoMapping.thing", "missing Ditto thing")
+		}
+		if dittoPath := mapping.MappingProperties.Path; !strings.HasPrefix(dittoPath, "/") || len(strings.Trim(dittoPath, "/")) == 0 {
+			validationErr.add(propertyPath+".dittoMapping.path", "invalid Ditto path '%s', expected a path like '/features/{feature}/properties/{property}'", dittoPath)
+		}
+	}
+}
+
+// validateCodec checks that the codec of a mapping fits its proto message. The codec names and schema files are
+// checked by the codec registry, which knows the available codecs.
+func validateCodec(validationErr *ValidationError, path string, mapping *TelemetryMessageMapping) {
+	switch {
+	case mapping.Codec == CodecProtobuf && !mapping.IsProtobuf():
+		validationErr.add(path+".codec", "codec '%s' requires a proto file or descriptor set", mapping.Codec)
+	case mapping.Codec != "" && mapping.Codec != CodecProtobuf && mapping.IsProtobuf():
+		validationErr.add(path+".codec", "codec '%s' cannot be combined with a proto message", mapping.Codec)
+	}
+	if mapping.SchemaFile != "" && mapping.Codec == "" {
+		validationErr.add(path+".schemaFile", "schema file requires a codec")
+	}
+}
+
+func validateTelemetryMappingProperties(validationErr *ValidationError, path string, mappingProperties *TelemetryMappingProperties, captures map[string]bool) {
+	if mappingProperties.Topic == "" && mappingProperties.Path == "" {
+		validationErr.add(path, "either Ditto topic or Ditto path must be set")
+	}
+	switch mappingProperties.Match {
+	case MatchContains, MatchExact, MatchGlob, MatchRegex:
+	default:
+		validationErr.add(path+".match", "unsupported match mode '%s'", mappingProperties.Match)
+		return
+	}
+	patterns := []struct {
+		path string
+		text string
+	}{
+		{path + ".topic", mappingProperties.Topic},
+		{path + ".path", mappingProperties.Path},
+	}
+	for _, patternToCheck := range patterns {
+		compiled, err := compilePattern(mappingProperties.Match, patternToCheck.text)
+		if err != nil {
+			validationErr.add(patternToCheck.path, "%v", err)
+			continue
+		}
+		for _, name := range compiled.captureNames() {
+			captures[name] = true
+		}
+	}
+}
+
+func validateValueMapping(validationErr *ValidationError, path string, valueMapping map[string]interface{}, captures, refs map[string]bool) {
+	if _, ok := valueMapping[templateEach]; ok {
+		validationErr.add(path, "template is not supported at the top level of the value mapping")
+		return
+	}
+	validateValue(validationErr, path, valueMapping, captures, refs)
+}
+
+func validateValue(validationErr *ValidationError, path string, value interface{}, captures, refs map[string]bool) {
+	switch value := value.(type) {
+	case string:
+		if expression.IsExpression(value) {
+			refs[value] = true
+			compiled, err := expression.Compile(value)
+			if err != nil {
+				validationErr.add(path, "%v", err)
+				break
+			}
+			for _, name := range compiled.Captures() {
+				if !captures[name] {
+					validationErr.add(path, "reference '%s%s' cannot be resolved, no named capture group '%s' in the Ditto topic or path", refMatchPrefix, name, name)
+				}
+			}
+		} else if strings.HasPrefix(value, refMatchPrefix) {
+			refs[value] = true
+			if name := value[len(refMatchPrefix):]; !captures[name] {
+				validationErr.add(path, "reference '%s' cannot be resolved, no named capture group '%s' in the Ditto topic or path", value, name)
+			}
+		} else if strings.HasPrefix(value, refPrefix) {
+			refs[value] = true
+			if _, err := expression.ParseReference(value); err != nil {
+				validationErr.add(path, "reference '%s' cannot be resolved", value)
+			}
+		} else if strings.HasPrefix(value, incrementPrefix) && len(value) == len(incrementPrefix) {
+			validationErr.add(path, "missing incrementor name")
+		}
+	case map[string]interface{}:
+		if each, ok := value[templateEach]; ok {
+			validateTemplate(validationErr, path, each, value, captures, refs)
+			break
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			validateValue(validationErr, fmt.Sprintf("%s[%q]", path, key), value[key], captures, refs)
+		}
+	case []interface{}:
+		for i, element := range value {
+			validateValue(validationErr, fmt.Sprintf("%s[%d]", path, i), element, captures, refs)
+		}
+	}
+}
+
+func validateTemplate(validationErr *ValidationError, path string, each interface{}, template map[string]interface{}, captures, refs map[string]bool) {
+	eachPath := fmt.Sprintf("%s[%q]", path, templateEach)
+	if source, ok := each.(string); !ok || !strings.HasPrefix(source, refPrefix) || strings.HasPrefix(source, refMatchPrefix) {
+		validationErr.add(eachPath, "'%s' must be a reference or an expression resolving to an array", templateEach)
+	} else {
+		validateValue(validationErr, eachPath, source, captures, refs)
+	}
+	for key := range template {
+		if key != templateEach && key != templateValue {
+			validationErr.add(fmt.Sprintf("%s[%q]", path, key), "unsupported template key, only '%s' and '%s' are allowed", templateEach, templateValue)
+		}
+	}
+	if value, ok := template[templateValue]; !ok {
+		validationErr.add(path, "missing '%s' for '%s'", templateValue, templateEach)
+	} else {
+		validateValue(validationErr, fmt.Sprintf("%s[%q]", path, templateValue), value, captures, refs)
+	}
+}
+
+// validateProtoFields checks that the keys of the value mapping are fields of the proto message of the mapping, since
+// the mapped value cannot be encoded with the proto message otherwise. The objects set to message fields are checked
+// against the messages of the fields, while the values of the map fields and the well-known types are not.
+func validateProtoFields(validationErr *ValidationError, path string, messageDescriptor *desc.MessageDescriptor, valueMapping map[string]interface{}) {
+	keys := make([]string, 0, len(valueMapping))
+	for key := range valueMapping {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fieldPath := fmt.Sprintf("%s[%q]", path, key)
+		field := messageDescriptor.FindFieldByName(key)
+		if field == nil {
+			field = messageDescriptor.FindFieldByJSONName(key)
+		}
+		if field == nil {
+			validationErr.add(fieldPath, "no field '%s' in proto message '%s'", key, messageDescriptor.GetFullyQualifiedName())
+			continue
+		}
+		fieldMessage := field.GetMessageType()
+		if fieldMessage == nil || field.IsMap() || strings.HasPrefix(fieldMessage.GetFullyQualifiedName(), wellKnownTypesPackage) {
+			continue
+		}
+		switch value := valueMapping[key].(type) {
+		case map[string]interface{}:
+			if _, ok := value[templateEach]; !ok {
+				validateProtoFields(validationErr, fieldPath, fieldMessage, value)
+			} else if template, ok := value[templateValue].(map[string]interface{}); ok {
+				validateProtoFields(validationErr, fmt.Sprintf("%s[%q]", fieldPath, templateValue), fieldMessage, template)
+			}
+		case []interface{}:
+			for i, element := range value {
+				if object, ok := element.(map[string]interface{}); ok {
+					validateProtoFields(validationErr, fmt.Sprintf("%s[%d]", fieldPath, i), fieldMessage, object)
+				}
+			}
+		}
+	}
+}
+
+func validateProtoMessage(validationErr *ValidationError, path string, config *MessageMapperConfig, loadDescriptors bool, protoFile, descriptorSet, protoMessage string) {
+	if protoFile != "" && descriptorSet != "" {
+		validationErr.add(path+".descriptorSet", "either proto file or descriptor set can be set")
+		return
+	}
+	if !loadDescriptors || protoFile == "" && descriptorSet == "" && protoMessage == "" {
+		return
+	}
+	if _, err := config.LoadMessageDescriptor(protoFile, descriptorSet, protoMessage); err != nil {
+		switch {
+		case protoFile != "":
+			validationErr.add(path+".protoFile", "%v", err)
+		case descriptorSet != "":
+			validationErr.add(path+".descriptorSet", "%v", err)
+		case len(config.DescriptorSets) == 0:
+			validationErr.add(path+".protoFile", "missing proto file or descriptor set for proto message '%s'", protoMessage)
+		default:
+			validationErr.add(path+".protoMessage", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateValidMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/valid-message-mappings.json")
+	require.NoError(t, err)
+	require.NoError(t, mapperConfig.Validate())
+}
+
+func TestValidateMissingMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/empty-mappings-config.json")
+	require.NoError(t, err)
+	err = mapperConfig.Validate()
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+	assert.Equal(t, []string{"messageMappings: missing message mappings"}, validationErr.Problems)
+}
+
+func TestValidateEmptyMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/empty-telemetry-message-types.json")
+	require.NoError(t, err)
+	require.NoError(t, mapperConfig.Validate())
+}
+
+func TestValidateDescriptorSetMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/descriptor-set-mappings.json")
+	require.NoError(t, err)
+	err = mapperConfig.Validate()
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+	problems := validationErr.Problems
+	require.Equal(t, 3, len(problems), problems)
+	assert.Equal(t, `messageMappings.telemetry["1"]["both.proto.file.and.descriptor.set"].descriptorSet: either proto file or descriptor set can be set`, problems[0])
+	assert.Contains(t, problems[1], `messageMappings.telemetry["1"]["missing.descriptor.set"].descriptorSet: cannot read descriptor set file 'testdata/proto/missing.protoset'`)
+	assert.Equal(t, `messageMappings.telemetry["1"]["missing.global.message"].protoMessage: no proto message 'test.Missing' in descriptor sets 'testdata/proto/status.protoset'`, problems[2])
+
+	err = mapperConfig.ValidateWithoutDescriptors()
+	require.Error(t, err)
+	validationErr, ok = err.(*config.ValidationError)
+	require.True(t, ok)
+	assert.Equal(t, []string{`messageMappings.telemetry["1"]["both.proto.file.and.descriptor.set"].descriptorSet: either proto file or descriptor set can be set`}, validationErr.Problems)
+}
+
+func TestValidateCodecMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/codec-mappings.json")
+	require.NoError(t, err)
+	err = mapperConfig.Validate()
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+
+	assert.Equal(t, []string{
+		`messageMappings.telemetry["1"]["cbor.json.string"].serialization: serialization 'jsonString' is not supported with codec 'cbor'`,
+		`messageMappings.telemetry["1"]["cbor.with.proto.message"].codec: codec 'cbor' cannot be combined with a proto message`,
+		`messageMappings.telemetry["1"]["protobuf.without.proto.message"].codec: codec 'protobuf' requires a proto file or descriptor set`,
+		`messageMappings.telemetry["1"]["schema.file.without.codec"].schemaFile: schema file requires a codec`,
+	}, validationErr.Problems)
+
+	mapping, err := mapperConfig.GetTelemetryMessageMapping(1, "cbor.envelope")
+	require.NoError(t, err)
+	assert.Equal(t, "cbor", mapping.CodecName())
+	mapping, err = mapperConfig.GetTelemetryMessageMapping(1, "schema.file.without.codec")
+	require.NoError(t, err)
+	assert.Equal(t, "", mapping.CodecName())
+}
+
+func TestValidateInvalidMappings(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/invalid-message-mappings.json")
+	require.NoError(t, err)
+	err = mapperConfig.Validate()
+	require.Error(t, err)
+	validationErr, ok := err.(*config.ValidationError)
+	require.True(t, ok)
+
+	problems := validationErr.Problems
+	require.Equal(t, 47, len(problems), problems)
+	assert.Equal(t, `messageMappings.command["invalid.reply"].replyProtoMessage: no proto message 'Missing' in proto file 'testdata/proto/status.proto'`, problems[0])
+	assert.Equal(t, `messageMappings.command["invalid.reply.timeout"].replyTimeout: invalid reply timeout 'soon', expected a positive duration like '30s'`, problems[1])
+	assert.Equal(t, `messageMappings.command["missing.action"].dittoMapping.action: missing Ditto message action`, problems[2])
+	assert.Equal(t, `messageMappings.command["missing.ditto.mapping"].dittoMapping: missing Ditto mapping`, problems[3])
+	assert.Equal(t, `messageMappings.telemetry["1"]["empty.ditto.mapping"].dittoMapping: either Ditto topic or Ditto path must be set`, problems[4])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation"].aggregation.window: invalid aggregation window '1y', expected a positive duration like '1m'`, problems[5])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation"].aggregation.fields["temperature"]: unsupported aggregate function 'median'`, problems[6])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation"].aggregation.fields["voltage"]: missing aggregate functions`, problems[7])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation"].aggregation: aggregation is not supported with batch`, problems[8])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation.protobuf"].aggregation: aggregation is not supported with proto messages or schema files`, problems[9])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.aggregation.schema"].aggregation: aggregation is not supported with proto messages or schema files`, problems[10])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.batch"].batch.window: invalid batch window '0s', expected a positive duration like '5s'`, problems[11])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.batch"].batch.maxSize: negative maximal size -1`, problems[12])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.batch"].batch.compression: unsupported compression 'brotli'`, problems[13])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.delivery"].delivery: unsupported delivery 'always'`, problems[14])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.delivery"].ttl: invalid time to live '-1m', expected a positive duration like '10m'`, problems[15])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.field.names"].protoJSONFieldNames: unsupported field names 'snake'`, problems[16])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.filter"].rateLimit.interval: invalid rate limit interval 'soon', expected a positive duration like '1m'`, problems[17])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.filter"].rateLimit.burst: negative burst -1`, problems[18])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.filter"].deadband["battery..level"]: invalid field 'battery..level', expected a field of the mapped value like 'battery.level'`, problems[19])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.filter"].deadband["temperature"]: invalid deadband 0, expected a positive number`, problems[20])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.match.mode"].dittoMapping.match: unsupported match mode 'fuzzy'`, problems[21])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.proto.fields"].valueMapping["history"]["$template"]["level"]: no field 'level' in proto message 'test.Status'`, problems[22])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.proto.fields"].valueMapping["owner"]: no field 'owner' in proto message 'test.Device'`, problems[23])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.proto.fields"].valueMapping["status"]["code"]: no field 'code' in proto message 'test.Status'`, problems[24])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.references"].valueMapping["empty"]: reference '$' cannot be resolved`, problems[25])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.references"].valueMapping["expression"]: invalid expression '${$temperature * }': syntax error at position 16: unexpected end of expression`, problems[26])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.references"].valueMapping["nested"]["counter"]: missing incrementor name`, problems[27])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.references"].valueMapping["nested"]["path"]: reference '$status..name' cannot be resolved`, problems[28])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.references"].fieldMappings["$state"]: field mapping is not referenced in the value mapping`, problems[29])
+	assert.Contains(t, problems[30], `messageMappings.telemetry["1"]["invalid.regex"].dittoMapping.path: invalid regular expression '^/features/(?P<feature>[^/]+/properties/status$'`)
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.sampling"].sampling.every: invalid number of messages -1, expected a positive number`, problems[31])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.sampling"].sampling.interval: invalid sampling interval 'soon', expected a positive duration like '10s'`, problems[32])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.templates"].valueMapping["index"]: reference '$containers[x].id' cannot be resolved`, problems[33])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.templates"].valueMapping["missingTemplate"]: missing '$template' for '$each'`, problems[34])
+	assert.Equal(t, `messageMappings.telemetry["1"]["invalid.templates"].valueMapping["notArray"]["$each"]: '$each' must be a reference or an expression resolving to an array`, problems[35])
+	assert.Equal(t, `messageMappings.telemetry["1"]["missing.ditto.mapping"].dittoMapping: missing Ditto mapping`, problems[36])
+	assert.Equal(t, `messageMappings.telemetry["1"]["missing.proto.file"].protoFile: missing proto file or descriptor set for proto message 'Status'`, problems[37])
+	assert.Contains(t, problems[39], `messageMappings.telemetry["1"]["non.existing.proto.file"].protoFile: `)
+	assert.Equal(t, `messageMappings.telemetry["1"]["non.existing.proto.message"].protoFile: no proto message 'NonExisting' in proto file 'testdata/proto/status.proto'`, problems[40])
+	assert.Equal(t, `messageMappings.telemetry["1"]["protobuf.envelope.without.proto.file"].serialization: serialization 'protobufEnvelope' requires a proto file, descriptor set or codec`, problems[41])
+	assert.Equal(t, `messageMappings.telemetry["1"]["top.level.template"].valueMapping: template is not supported at the top level of the value mapping`, problems[42])
+	assert.Equal(t, `messageMappings.telemetry["1"]["unresolved.capture"].valueMapping["name"]: reference '$match.name' cannot be resolved, no named capture group 'name' in the Ditto topic or path`, problems[43])
+	assert.Equal(t, `messageMappings.telemetry["1"]["unresolved.capture"].valueMapping["path"]: reference '$match.property' cannot be resolved, no named capture group 'property' in the Ditto topic or path`, problems[44])
+	assert.Equal(t, `messageMappings.telemetry["1"]["unsupported.serialization"].serialization: unsupported serialization 'xml'`, problems[45])
+	assert.Equal(t, `messageMappings.telemetry["1"]["unused.field.names"].protoJSONFieldNames: field names are only supported with serialization 'protobufJSON'`, problems[46])
+	assert.Contains(t, err.Error(), "invalid message mapper config: ")
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const (
+	watchOps = fsnotify.Create | fsnotify.Write | fsnotify.Rename
+	// dataDir is the symbolic link to the current data directory of a mounted Kubernetes ConfigMap, it is swapped atomically
+	// when the ConfigMap changes.
+	dataDir = "..data"
+)
+
+// ReloadDelay is the time the watcher waits for the file system events to settle down before reloading the configuration.
+var ReloadDelay = 2 * time.Second
+
+// Reloadable is implemented by the components that depend on the message mapper configuration and can switch to a new one at runtime.
+type Reloadable interface {
+	Reload(mapperConfig *MessageMapperConfig)
+}
+
+// Validator is implemented by the reloadable components that check a new message mapper configuration beyond its own
+// validation before any component is switched to it, e.g. that the codecs of the mappings are available.
+type Validator interface {
+	Validate(mapperConfig *MessageMapperConfig) error
+}
+
+// MessageMapperConfigWatcher watches a message mapper configuration file and reloads the registered components on change.
+// A configuration file that is a symbolic link, e.g. in a mounted Kubernetes ConfigMap, is reloaded when the link or its
+// target changes, the directory of the target is watched as well.
+type MessageMapperConfigWatcher struct {
+	mapperConfigFile string
+	target           string
+	targetDir        string
+	watcher          *fsnotify.Watcher
+	reloadables      []Reloadable
+	logger           watermill.LoggerAdapter
+	done             chan struct{}
+	closeOnce        sync.Once
+	wg               sync.WaitGroup
+}
+
+// NewMessageMapperConfigWatcher starts watching the provided message mapper configuration file.
+// A changed file that cannot be loaded or validated is reported and the components keep using their current configuration.
+func NewMessageMapperConfigWatcher(mapperConfigFile string, logger watermill.LoggerAdapter, reloadables ...Reloadable) (*MessageMapperConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create message mapper config watcher")
+	}
+	if err := watcher.Add(filepath.Dir(mapperConfigFile)); err != nil {
+		watcher.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot watch message mapper config file '%s'", mapperConfigFile))
+	}
+	w := &MessageMapperConfigWatcher{
+		mapperConfigFile: mapperConfigFile,
+		watcher:          watcher,
+		reloadables:      reloadables,
+		logger:           logger,
+		done:             make(chan struct{}),
+	}
+	w.resolveTarget()
+	w.wg.Add(1)
+	go w.watch()
+	return w, nil
+}
+
+// Close stops watching the message mapper configuration file, it can be called more than once.
+func (w *MessageMapperConfigWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.watcher.Close()
+		w.wg.Wait()
+	})
+	return err
+}
+
+func (w *MessageMapperConfigWatcher) watch() {
+	defer w.wg.Done()
+
+	fileName := filepath.Base(w.mapperConfigFile)
+	timer := time.NewTimer(ReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&watchOps == 0 {
+				continue
+			}
+			eventName := filepath.Base(event.Name)
+			// the symbolic links are resolved again after each event, a changed target means a swapped configuration
+			if w.resolveTarget() || eventName == fileName || eventName == dataDir || filepath.Clean(event.Name) == w.target {
+				timer.Reset(ReloadDelay)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Error("message mapper config watch error", err, nil)
+		case <-timer.C:
+			w.reload()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// resolveTarget resolves the symbolic links of the configuration file and watches the directory of its target, if
+// the target is in another directory than the configuration file. It returns true if the target has changed.
+func (w *MessageMapperConfigWatcher) resolveTarget() bool {
+	target, err := filepath.EvalSymlinks(w.mapperConfigFile)
+	if err != nil {
+		// e.g. while the file is replaced, it is resolved again on the next event
+		return false
+	}
+	if target, err = filepath.Abs(target); err != nil || target == w.target {
+		return false
+	}
+	changed := w.target != ""
+	w.target = target
+
+	targetDir := filepath.Dir(target)
+	configDir, _ := filepath.EvalSymlinks(filepath.Dir(w.mapperConfigFile))
+	configDir, _ = filepath.Abs(configDir)
+	if targetDir == w.targetDir {
+		return changed
+	}
+	if w.targetDir != "" {
+		// the directory of the previous target might be already deleted
+		_ = w.watcher.Remove(w.targetDir)
+		w.targetDir = ""
+	}
+	if targetDir != configDir {
+		if err := w.watcher.Add(targetDir); err != nil {
+			w.logger.Error("cannot watch message mapper config target", err, watermill.LogFields{"file": target})
+		} else {
+			w.targetDir = targetDir
+		}
+	}
+	return changed
+}
+
+func (w *MessageMapperConfigWatcher) reload() {
+	logFields := watermill.LogFields{"file": w.mapperConfigFile}
+	mapperConfig, err := LoadMessageMapperConfig(w.mapperConfigFile)
+	if err != nil {
+		w.logger.Error("cannot reload message mapper config, keeping the current one", err, logFields)
+		return
+	}
+	if err := mapperConfig.Validate(); err != nil {
+		w.logger.Error("cannot reload message mapper config, keeping the current one", err, logFields)
+		return
+	}
+	for _, reloadable := range w.reloadables {
+		if validator, ok := reloadable.(Validator); ok {
+			if err := validator.Validate(mapperConfig); err != nil {
+				w.logger.Error("cannot reload message mapper config, keeping the current one", err, logFields)
+				return
+			}
+		}
+	}
+	mapperConfig.LogSkippedTelemetryMappings(w.logger)
+	mapperConfig.LogTelemetryMappingOverlaps(w.logger)
+	for _, reloadable := range w.reloadables {
+		reloadable.Reload(mapperConfig)
+	}
+	w.logger.Info("message mapper config reloaded", logFields)
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package config_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reloadableMock struct {
+	configs chan *config.MessageMapperConfig
+}
+
+func (r *reloadableMock) Reload(mapperConfig *config.MessageMapperConfig) {
+	r.configs <- mapperConfig
+}
+
+type validatingReloadableMock struct {
+	reloadableMock
+	err error
+}
+
+func (r *validatingReloadableMock) Validate(mapperConfig *config.MessageMapperConfig) error {
+	return r.err
+}
+
+func TestWatcherInvalidPath(t *testing.T) {
+	_, err := config.NewMessageMapperConfigWatcher("non-existing-dir/message-mappings.json", watermill.NopLogger{})
+	require.Error(t, err)
+}
+
+func TestWatcherCloseTwice(t *testing.T) {
+	watcher, err := config.NewMessageMapperConfigWatcher(filepath.Join(t.TempDir(), "message-mapper-config.json"), watermill.NopLogger{})
+	require.NoError(t, err)
+	assert.NoError(t, watcher.Close())
+	assert.NoError(t, watcher.Close())
+}
+
+func TestWatcherReloadsChangedConfig(t *testing.T) {
+	mapperConfigFile, reloadable := startWatcher(t)
+
+	writeConfig(t, mapperConfigFile, "testdata/valid-message-mappings.json")
+	mapperConfig := awaitReload(t, reloadable)
+	require.NotNil(t, mapperConfig)
+	_, err := mapperConfig.GetTelemetryMessageMapping(1, "status")
+	require.NoError(t, err)
+}
+
+func TestWatcherKeepsConfigOnInvalidChange(t *testing.T) {
+	mapperConfigFile, reloadable := startWatcher(t)
+
+	writeConfig(t, mapperConfigFile, "testdata/invalid-json-config.json")
+	assert.Nil(t, awaitReload(t, reloadable))
+
+	writeConfig(t, mapperConfigFile, "testdata/empty-mappings-config.json")
+	assert.Nil(t, awaitReload(t, reloadable))
+
+	writeConfig(t, mapperConfigFile, "testdata/valid-message-mappings.json")
+	assert.NotNil(t, awaitReload(t, reloadable))
+}
+
+func TestWatcherKeepsConfigOnRejectedChange(t *testing.T) {
+	mapperConfigFile, reloadable := startWatcher(t)
+	validating := &validatingReloadableMock{
+		reloadableMock: reloadableMock{configs: make(chan *config.MessageMapperConfig, 1)},
+		err:            errors.New("unsupported codec"),
+	}
+	watcher, err := config.NewMessageMapperConfigWatcher(mapperConfigFile, watermill.NopLogger{}, reloadable, validating)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	writeConfig(t, mapperConfigFile, "testdata/valid-message-mappings.json")
+	// the first watcher has no validator and reloads the change
+	assert.NotNil(t, awaitReload(t, reloadable))
+	assert.Nil(t, awaitReload(t, &validating.reloadableMock))
+}
+
+func TestWatcherReloadsSwappedConfigMap(t *testing.T) {
+	setReloadDelay(t)
+	// the layout of a mounted Kubernetes ConfigMap, whose data directory link is swapped on change
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..2022_1"), 0755))
+	writeConfig(t, filepath.Join(dir, "..2022_1", "message-mapper-config.json"), "testdata/empty-mappings-config.json")
+	require.NoError(t, os.Symlink("..2022_1", filepath.Join(dir, "..data")))
+	mapperConfigFile := filepath.Join(dir, "message-mapper-config.json")
+	require.NoError(t, os.Symlink(filepath.Join("..data", "message-mapper-config.json"), mapperConfigFile))
+
+	reloadable := &reloadableMock{configs: make(chan *config.MessageMapperConfig, 1)}
+	watcher, err := config.NewMessageMapperConfigWatcher(mapperConfigFile, watermill.NopLogger{}, reloadable)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "..2022_2"), 0755))
+	writeConfig(t, filepath.Join(dir, "..2022_2", "message-mapper-config.json"), "testdata/valid-message-mappings.json")
+	require.NoError(t, os.Symlink("..2022_2", filepath.Join(dir, "..data_tmp")))
+	require.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "..2022_1")))
+
+	mapperConfig := awaitReload(t, reloadable)
+	require.NotNil(t, mapperConfig)
+	_, err = mapperConfig.GetTelemetryMessageMapping(1, "status")
+	require.NoError(t, err)
+}
+
+func TestWatcherReloadsChangedSymlinkTarget(t *testing.T) {
+	setReloadDelay(t)
+	targetFile := filepath.Join(t.TempDir(), "target.json")
+	writeConfig(t, targetFile, "testdata/empty-mappings-config.json")
+	mapperConfigFile := filepath.Join(t.TempDir(), "message-mapper-config.json")
+	require.NoError(t, os.Symlink(targetFile, mapperConfigFile))
+
+	reloadable := &reloadableMock{configs: make(chan *config.MessageMapperConfig, 1)}
+	watcher, err := config.NewMessageMapperConfigWatcher(mapperConfigFile, watermill.NopLogger{}, reloadable)
+	require.NoError(t, err)
+	defer watcher.Close()
+
+	// the target is in another directory, which is watched as well
+	writeConfig(t, targetFile, "testdata/valid-message-mappings.json")
+	assert.NotNil(t, awaitReload(t, reloadable))
+}
+
+func setReloadDelay(t *testing.T) {
+	reloadDelay := config.ReloadDelay
+	config.ReloadDelay = 50 * time.Millisecond
+	t.Cleanup(func() {
+		config.ReloadDelay = reloadDelay
+	})
+}
+
+func startWatcher(t *testing.T) (string, *reloadableMock) {
+	setReloadDelay(t)
+
+	mapperConfigFile := filepath.Join(t.TempDir(), "message-mapper-config.json")
+	writeConfig(t, mapperConfigFile, "testdata/empty-mappings-config.json")
+
+	reloadable := &reloadableMock{configs: make(chan *config.MessageMapperConfig, 1)}
+	watcher, err := config.NewMessageMapperConfigWatcher(mapperConfigFile, watermill.NopLogger{}, reloadable)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		watcher.Close()
+	})
+	return mapperConfigFile, reloadable
+}
+
+func writeConfig(t *testing.T, mapperConfigFile, sourceFile string) {
+	content, err := ioutil.ReadFile(sourceFile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(mapperConfigFile, content, 0644))
+}
+
+func awaitReload(t *testing.T, reloadable *reloadableMock) *config.MessageMapperConfig {
+	select {
+	case mapperConfig := <-reloadable.configs:
+		return mapperConfig
+	case <-time.After(time.Second):
+		return nil
+	}
+}
@@ -33,3 +33,17 @@ type TelemetryMessage struct {
 	Payload         interface{} `json:"p"`
 	PayloadVersion  string      `json:"pVer"`
 }
+
+// CommandReplyMessage represents the envelope for the replies of the device to the cloud-to-device messages.
+// A reply that did not arrive in time has the status 408 and the error set instead of the payload.
+type CommandReplyMessage struct {
+	CommandName     string      `json:"cmdName"`
+	ApplicationID   string      `json:"appId"`
+	CorrelationID   string      `json:"cId"`
+	Status          int         `json:"status"`
+	Timestamp       int64       `json:"ts"`
+	EnvelopeVersion string      `json:"eVer"`
+	Payload         interface{} `json:"p,omitempty"`
+	PayloadVersion  string      `json:"pVer"`
+	Error           string      `json:"err,omitempty"`
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package message
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field numbers of the D2CEnvelope message defined in resources/protobuf/messages/d2c_envelope.proto.
+const (
+	envelopeFieldMessageType     protowire.Number = 1
+	envelopeFieldMessageSubType  protowire.Number = 2
+	envelopeFieldApplicationID   protowire.Number = 3
+	envelopeFieldCorrelationID   protowire.Number = 4
+	envelopeFieldTimestamp       protowire.Number = 5
+	envelopeFieldEnvelopeVersion protowire.Number = 6
+	envelopeFieldPayloadVersion  protowire.Number = 7
+	envelopeFieldPayload         protowire.Number = 8
+)
+
+// MarshalProtobuf serializes the telemetry message to a D2CEnvelope protobuf message.
+// The payload has to be the already serialized protobuf payload.
+func (m *TelemetryMessage) MarshalProtobuf() ([]byte, error) {
+	payload, ok := m.Payload.([]byte)
+	if !ok && m.Payload != nil {
+		return nil, fmt.Errorf("protobuf envelope payload must be serialized protobuf, not %T", m.Payload)
+	}
+	var b []byte
+	if m.MessageType != 0 {
+		b = protowire.AppendTag(b, envelopeFieldMessageType, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int32(m.MessageType)))
+	}
+	b = appendString(b, envelopeFieldMessageSubType, m.MessageSubType)
+	b = appendString(b, envelopeFieldApplicationID, m.ApplicationID)
+	b = appendString(b, envelopeFieldCorrelationID, m.CorrelationID)
+	if m.Timestamp != 0 {
+		b = protowire.AppendTag(b, envelopeFieldTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Timestamp))
+	}
+	b = appendString(b, envelopeFieldEnvelopeVersion, m.EnvelopeVersion)
+	b = appendString(b, envelopeFieldPayloadVersion, m.PayloadVersion)
+	if len(payload) > 0 {
+		b = protowire.AppendTag(b, envelopeFieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, payload)
+	}
+	return b, nil
+}
+
+// UnmarshalProtobuf deserializes a D2CEnvelope protobuf message, the payload is set to the serialized protobuf payload.
+// Unknown fields are skipped.
+func (m *TelemetryMessage) UnmarshalProtobuf(b []byte) error {
+	*m = TelemetryMessage{Payload: []byte{}}
+	for len(b) > 0 {
+		number, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "cannot deserialize protobuf envelope")
+		}
+		b = b[n:]
+		switch {
+		case wireType == protowire.VarintType && (number == envelopeFieldMessageType || number == envelopeFieldTimestamp):
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return errors.Wrap(protowire.ParseError(n), "cannot deserialize protobuf envelope")
+			}
+			if number == envelopeFieldMessageType {
+				m.MessageType = int(int32(value))
+			} else {
+				m.Timestamp = int64(value)
+			}
+			b = b[n:]
+		case wireType == protowire.BytesType && number >= envelopeFieldMessageSubType && number <= envelopeFieldPayload && number != envelopeFieldTimestamp:
+			value, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return errors.Wrap(protowire.ParseError(n), "cannot deserialize protobuf envelope")
+			}
+			m.setBytesField(number, value)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(number, wireType, b)
+			if n < 0 {
+				return errors.Wrap(protowire.ParseError(n), "cannot deserialize protobuf envelope")
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+func (m *TelemetryMessage) setBytesField(number protowire.Number, value []byte) {
+	switch number {
+	case envelopeFieldMessageSubType:
+		m.MessageSubType = string(value)
+	case envelopeFieldApplicationID:
+		m.ApplicationID = string(value)
+	case envelopeFieldCorrelationID:
+		m.CorrelationID = string(value)
+	case envelopeFieldEnvelopeVersion:
+		m.EnvelopeVersion = string(value)
+	case envelopeFieldPayloadVersion:
+		m.PayloadVersion = string(value)
+	case envelopeFieldPayload:
+		m.Payload = append([]byte{}, value...)
+	}
+}
+
+func appendString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
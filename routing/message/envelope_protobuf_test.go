@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package message_test
+
+import (
+	"testing"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const envelopeProtoFile = "../../resources/protobuf/messages/d2c_envelope.proto"
+
+func TestMarshalProtobufEnvelope(t *testing.T) {
+	d2cMessage := &routingmessage.TelemetryMessage{
+		MessageType:     7,
+		MessageSubType:  "container.state",
+		ApplicationID:   "app1",
+		CorrelationID:   "correlation-id",
+		Timestamp:       1666000000000,
+		EnvelopeVersion: "2.0",
+		PayloadVersion:  "1.0",
+		Payload:         []byte{0x0a, 0x02, 0x69, 0x64},
+	}
+	envelope, err := d2cMessage.MarshalProtobuf()
+	require.NoError(t, err)
+
+	// the envelope can be read with the published proto file
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("D2CEnvelope", envelopeProtoFile)
+	require.NoError(t, err)
+	dynamicMessage := dynamic.NewMessage(messageDescriptor)
+	require.NoError(t, dynamicMessage.Unmarshal(envelope))
+	assert.Equal(t, int32(7), dynamicMessage.GetFieldByName("message_type"))
+	assert.Equal(t, "container.state", dynamicMessage.GetFieldByName("message_sub_type"))
+	assert.Equal(t, "app1", dynamicMessage.GetFieldByName("application_id"))
+	assert.Equal(t, "correlation-id", dynamicMessage.GetFieldByName("correlation_id"))
+	assert.Equal(t, int64(1666000000000), dynamicMessage.GetFieldByName("timestamp"))
+	assert.Equal(t, "2.0", dynamicMessage.GetFieldByName("envelope_version"))
+	assert.Equal(t, "1.0", dynamicMessage.GetFieldByName("payload_version"))
+	assert.Equal(t, []byte{0x0a, 0x02, 0x69, 0x64}, dynamicMessage.GetFieldByName("payload"))
+
+	decoded := &routingmessage.TelemetryMessage{}
+	require.NoError(t, decoded.UnmarshalProtobuf(envelope))
+	assert.Equal(t, d2cMessage, decoded)
+}
+
+func TestUnmarshalProtobufEnvelope(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("D2CEnvelope", envelopeProtoFile)
+	require.NoError(t, err)
+	dynamicMessage := dynamic.NewMessage(messageDescriptor)
+	dynamicMessage.SetFieldByName("message_type", int32(-1))
+	dynamicMessage.SetFieldByName("message_sub_type", "sub.type")
+	envelope, err := dynamicMessage.Marshal()
+	require.NoError(t, err)
+	// unknown fields of newer envelope versions are skipped
+	envelope = append(envelope, 0x48, 0x01, 0x52, 0x01, 0x78)
+
+	decoded := &routingmessage.TelemetryMessage{}
+	require.NoError(t, decoded.UnmarshalProtobuf(envelope))
+	assert.Equal(t, -1, decoded.MessageType)
+	assert.Equal(t, "sub.type", decoded.MessageSubType)
+	assert.Equal(t, []byte{}, decoded.Payload)
+}
+
+func TestProtobufEnvelopeErrors(t *testing.T) {
+	_, err := (&routingmessage.TelemetryMessage{Payload: map[string]interface{}{}}).MarshalProtobuf()
+	assert.EqualError(t, err, "protobuf envelope payload must be serialized protobuf, not map[string]interface {}")
+
+	decoded := &routingmessage.TelemetryMessage{}
+	assert.Error(t, decoded.UnmarshalProtobuf([]byte{0x12, 0x05, 0x61}))
+	assert.Error(t, decoded.UnmarshalProtobuf([]byte{0x08}))
+}
@@ -0,0 +1,485 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package expression implements the expressions that can be used as values in the telemetry value mappings.
+//
+// An expression is written as "${...}" and can reference the Ditto value with "$field.nested[0]" and the named
+// capture groups of the matched Ditto topic and path with "$match.name". It supports number, string, boolean and
+// null literals, the arithmetic operators + - * / %, string concatenation with +, the comparison operators
+// == != < <= > >=, the logical operators && || !, the conditional operator "condition ? then : otherwise",
+// "value ?? default" for values that are missing or null, and a fixed set of side effect free functions.
+package expression
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	prefix   = "${"
+	suffix   = "}"
+	refMatch = "match"
+)
+
+// Expression is a compiled value mapping expression.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Environment contains the data an expression is evaluated against.
+type Environment struct {
+	Value    interface{}
+	Captures map[string]string
+}
+
+// IsExpression reports whether a value mapping value is an expression, i.e. it is enclosed in "${" and "}".
+func IsExpression(value string) bool {
+	return strings.HasPrefix(value, prefix) && strings.HasSuffix(value, suffix) && len(value) >= len(prefix)+len(suffix)
+}
+
+// Compile parses an expression enclosed in "${" and "}".
+func Compile(value string) (*Expression, error) {
+	if !IsExpression(value) {
+		return nil, fmt.Errorf("expression '%s' must be enclosed in '%s' and '%s'", value, prefix, suffix)
+	}
+	root, err := parse(value[len(prefix) : len(value)-len(suffix)])
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression '%s': %v", value, err)
+	}
+	return &Expression{source: value, root: root}, nil
+}
+
+// Evaluate evaluates the expression. A missing reference evaluates to nil, while the operators and functions
+// return an error if they are applied to values of unsupported types.
+func (e *Expression) Evaluate(env *Environment) (interface{}, error) {
+	result, err := e.root.evaluate(env)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate expression '%s': %v", e.source, err)
+	}
+	return result, nil
+}
+
+// Captures returns the names of the capture groups referenced with "$match.name".
+func (e *Expression) Captures() []string {
+	names := []string{}
+	walk(e.root, func(n node) {
+		if field, ok := n.(*fieldNode); ok {
+			if _, ok := field.target.(*matchNode); ok {
+				names = append(names, field.field)
+			}
+		}
+	})
+	return names
+}
+
+// UsesTimestamp reports whether the expression calls timestamp(), i.e. its result changes with every evaluation.
+func (e *Expression) UsesTimestamp() bool {
+	uses := false
+	walk(e.root, func(n node) {
+		if call, ok := n.(*callNode); ok && call.name == "timestamp" {
+			uses = true
+		}
+	})
+	return uses
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+type node interface {
+	evaluate(env *Environment) (interface{}, error)
+	children() []node
+}
+
+func walk(n node, visit func(node)) {
+	visit(n)
+	for _, child := range n.children() {
+		walk(child, visit)
+	}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) evaluate(env *Environment) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *literalNode) children() []node {
+	return nil
+}
+
+type refNode struct {
+	pos int
+}
+
+func (n *refNode) evaluate(env *Environment) (interface{}, error) {
+	return env.Value, nil
+}
+
+func (n *refNode) children() []node {
+	return nil
+}
+
+type matchNode struct {
+	pos int
+}
+
+func (n *matchNode) evaluate(env *Environment) (interface{}, error) {
+	captures := make(map[string]interface{}, len(env.Captures))
+	for name, value := range env.Captures {
+		captures[name] = value
+	}
+	return captures, nil
+}
+
+func (n *matchNode) children() []node {
+	return nil
+}
+
+type fieldNode struct {
+	pos    int
+	target node
+	field  string
+}
+
+func (n *fieldNode) evaluate(env *Environment) (interface{}, error) {
+	target, err := n.target.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	switch value := target.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return value[n.field], nil
+	default:
+		return nil, evaluationError(n.pos, "cannot access field '%s' of %s", n.field, typeName(target))
+	}
+}
+
+func (n *fieldNode) children() []node {
+	return []node{n.target}
+}
+
+type indexNode struct {
+	pos    int
+	target node
+	index  node
+}
+
+func (n *indexNode) evaluate(env *Environment) (interface{}, error) {
+	target, err := n.target.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	switch value := target.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		i, ok := toNumber(index)
+		if !ok || i != math.Trunc(i) {
+			return nil, evaluationError(n.pos, "cannot index array with %s", typeName(index))
+		}
+		if i < 0 {
+			i += float64(len(value))
+		}
+		// compared as floats, as a whole number too big for an int overflows the conversion
+		if i < 0 || i >= float64(len(value)) {
+			return nil, nil
+		}
+		return value[int(i)], nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, evaluationError(n.pos, "cannot index object with %s", typeName(index))
+		}
+		return value[key], nil
+	default:
+		return nil, evaluationError(n.pos, "cannot index %s", typeName(target))
+	}
+}
+
+func (n *indexNode) children() []node {
+	return []node{n.target, n.index}
+}
+
+type unaryNode struct {
+	pos      int
+	operator string
+	operand  node
+}
+
+func (n *unaryNode) evaluate(env *Environment) (interface{}, error) {
+	operand, err := n.operand.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "!":
+		if value, ok := operand.(bool); ok {
+			return !value, nil
+		}
+	case "-":
+		if value, ok := toNumber(operand); ok {
+			return -value, nil
+		}
+	}
+	return nil, evaluationError(n.pos, "cannot apply '%s' to %s", n.operator, typeName(operand))
+}
+
+func (n *unaryNode) children() []node {
+	return []node{n.operand}
+}
+
+type binaryNode struct {
+	pos      int
+	operator string
+	left     node
+	right    node
+}
+
+func (n *binaryNode) evaluate(env *Environment) (interface{}, error) {
+	left, err := n.left.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "??":
+		if left != nil {
+			return left, nil
+		}
+		return n.right.evaluate(env)
+	case "&&", "||":
+		leftValue, ok := left.(bool)
+		if !ok {
+			return nil, evaluationError(n.pos, "cannot apply '%s' to %s", n.operator, typeName(left))
+		}
+		if (n.operator == "&&") != leftValue {
+			return leftValue, nil
+		}
+		right, err := n.right.evaluate(env)
+		if err != nil {
+			return nil, err
+		}
+		rightValue, ok := right.(bool)
+		if !ok {
+			return nil, evaluationError(n.pos, "cannot apply '%s' to %s", n.operator, typeName(right))
+		}
+		return rightValue, nil
+	}
+
+	right, err := n.right.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "+":
+		if leftString, ok := left.(string); ok {
+			if rightString, ok := toString(right); ok {
+				return leftString + rightString, nil
+			}
+		} else if rightString, ok := right.(string); ok {
+			if leftString, ok := toString(left); ok {
+				return leftString + rightString, nil
+			}
+		}
+	case "<", "<=", ">", ">=":
+		if leftString, ok := left.(string); ok {
+			if rightString, ok := right.(string); ok {
+				return compare(n.operator, strings.Compare(leftString, rightString)), nil
+			}
+		}
+	}
+
+	leftNumber, leftOk := toNumber(left)
+	rightNumber, rightOk := toNumber(right)
+	if !leftOk || !rightOk {
+		return nil, evaluationError(n.pos, "cannot apply '%s' to %s and %s", n.operator, typeName(left), typeName(right))
+	}
+	switch n.operator {
+	case "+":
+		return leftNumber + rightNumber, nil
+	case "-":
+		return leftNumber - rightNumber, nil
+	case "*":
+		return leftNumber * rightNumber, nil
+	case "/":
+		if rightNumber == 0 {
+			return nil, evaluationError(n.pos, "division by zero")
+		}
+		return leftNumber / rightNumber, nil
+	case "%":
+		if rightNumber == 0 {
+			return nil, evaluationError(n.pos, "division by zero")
+		}
+		return math.Mod(leftNumber, rightNumber), nil
+	default:
+		result := 0
+		if leftNumber < rightNumber {
+			result = -1
+		} else if leftNumber > rightNumber {
+			result = 1
+		}
+		return compare(n.operator, result), nil
+	}
+}
+
+func (n *binaryNode) children() []node {
+	return []node{n.left, n.right}
+}
+
+type conditionalNode struct {
+	pos       int
+	condition node
+	then      node
+	otherwise node
+}
+
+func (n *conditionalNode) evaluate(env *Environment) (interface{}, error) {
+	condition, err := n.condition.evaluate(env)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := condition.(bool)
+	if !ok {
+		return nil, evaluationError(n.pos, "condition must be a boolean, not %s", typeName(condition))
+	}
+	if value {
+		return n.then.evaluate(env)
+	}
+	return n.otherwise.evaluate(env)
+}
+
+func (n *conditionalNode) children() []node {
+	return []node{n.condition, n.then, n.otherwise}
+}
+
+type callNode struct {
+	pos      int
+	name     string
+	function *function
+	args     []node
+}
+
+func (n *callNode) evaluate(env *Environment) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.evaluate(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	result, err := n.function.call(args)
+	if err != nil {
+		return nil, evaluationError(n.pos, "%s(): %v", n.name, err)
+	}
+	return result, nil
+}
+
+func (n *callNode) children() []node {
+	return n.args
+}
+
+func compare(operator string, result int) bool {
+	switch operator {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	default:
+		return result >= 0
+	}
+}
+
+func equal(left, right interface{}) bool {
+	leftNumber, leftOk := toNumber(left)
+	rightNumber, rightOk := toNumber(right)
+	if leftOk && rightOk {
+		return leftNumber == rightNumber
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case json.Number:
+		f, err := number.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toString(value interface{}) (string, bool) {
+	if number, ok := toNumber(value); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64), true
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	if _, ok := toNumber(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func evaluationError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("at position %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
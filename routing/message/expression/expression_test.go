@@ -0,0 +1,224 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/expression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testValue = `{
+	"temperature": 21.5,
+	"name": "container",
+	"running": true,
+	"status": {
+		"state": "RUNNING",
+		"exitCode": 0
+	},
+	"ports": [8080, 8443],
+	"containers": [
+		{"id": "c1", "state": "RUNNING"},
+		{"id": "c2", "state": "STOPPED"}
+	],
+	"key-with-dash": "dash"
+}`
+
+func newEnvironment(t *testing.T) *expression.Environment {
+	value := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(testValue), &value))
+	return &expression.Environment{
+		Value:    value,
+		Captures: map[string]string{"feature": "Container"},
+	}
+}
+
+func TestIsExpression(t *testing.T) {
+	assert.True(t, expression.IsExpression("${$temperature}"))
+	assert.True(t, expression.IsExpression("${}"))
+	assert.False(t, expression.IsExpression("$temperature"))
+	assert.False(t, expression.IsExpression("${$temperature"))
+	assert.False(t, expression.IsExpression("timestamp()"))
+}
+
+func TestEvaluate(t *testing.T) {
+	env := newEnvironment(t)
+	tests := []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"${$temperature}", 21.5},
+		{"${$temperature * 9 / 5 + 32}", 70.7},
+		{"${($temperature - 1) * 2}", 41.0},
+		{"${-$temperature}", -21.5},
+		{"${7 % 4}", 3.0},
+		{"${$name + '-' + $status.state}", "container-RUNNING"},
+		{"${'exit code ' + $status.exitCode}", "exit code 0"},
+		{"${$name + true}", "containertrue"},
+		{"${$missing ?? 'default'}", "default"},
+		{"${$status.missing.deep ?? 42}", 42.0},
+		{"${$status.exitCode ?? 42}", 0.0},
+		{"${$missing}", nil},
+		{"${$running ? 'on' : 'off'}", "on"},
+		{"${$status.exitCode == 0 && $status.state != 'STOPPED'}", true},
+		{"${$temperature > 30 || !$running}", false},
+		{"${$temperature >= 21.5 ? 'warm' : $temperature < 10 ? 'cold' : 'mild'}", "warm"},
+		{"${'abc' < 'abd'}", true},
+		{"${$ports[1]}", 8443.0},
+		{"${$ports[-1]}", 8443.0},
+		{"${$ports[5]}", nil},
+		{"${$ports[1e300]}", nil},
+		{"${$ports[-1e300]}", nil},
+		{"${$containers[1].state}", "STOPPED"},
+		{"${$containers[len($containers) - 1].id}", "c2"},
+		{`${$["key-with-dash"]}`, "dash"},
+		{"${$status['state']}", "RUNNING"},
+		{"${$match.feature}", "Container"},
+		{"${$match.missing ?? 'none'}", "none"},
+		{"${lower($status.state)}", "running"},
+		{"${upper(trim('  x  '))}", "X"},
+		{"${len($name)}", 9.0},
+		{"${contains($name, 'tain')}", true},
+		{"${startsWith($name, 'con') && endsWith($name, 'er')}", true},
+		{"${substring($name, 0, 3)}", "con"},
+		{"${substring($name, -3)}", "ner"},
+		{"${substring($name, 1e300)}", ""},
+		{"${substring($name, -1e300, 3)}", "con"},
+		{"${string($temperature)}", "21.5"},
+		{"${number('12.5') + 1}", 13.5},
+		{"${round(21.456, 2)}", 21.46},
+		{"${round($temperature)}", 22.0},
+		{"${floor(-1.5)}", -2.0},
+		{"${ceil(1.2)}", 2.0},
+		{"${abs(-3)}", 3.0},
+		{"${min(3, $temperature, 8)}", 3.0},
+		{"${max($ports[0], $ports[1])}", 8443.0},
+		{"${null == $missing}", true},
+		{"${1 == 1.0}", true},
+		{"${\"double \\\"quoted\\\"\"}", `double "quoted"`},
+	}
+	for _, test := range tests {
+		compiled, err := expression.Compile(test.expression)
+		require.NoError(t, err, test.expression)
+		result, err := compiled.Evaluate(env)
+		require.NoError(t, err, test.expression)
+		if expected, ok := test.expected.(float64); ok {
+			assert.InDelta(t, expected, result, 1e-9, test.expression)
+		} else {
+			assert.Equal(t, test.expected, result, test.expression)
+		}
+	}
+}
+
+func TestEvaluateTimestamp(t *testing.T) {
+	compiled, err := expression.Compile("${timestamp()}")
+	require.NoError(t, err)
+	result, err := compiled.Evaluate(newEnvironment(t))
+	require.NoError(t, err)
+	assert.IsType(t, int64(0), result)
+}
+
+func TestUsesTimestamp(t *testing.T) {
+	for source, expected := range map[string]bool{
+		"${timestamp()}":                      true,
+		"${$state + string(timestamp())}":     true,
+		"${$ts ?? round(timestamp() / 1000)}": true,
+		"${round($temperature, 1)}":           false,
+		"${'timestamp()'}":                    false,
+	} {
+		compiled, err := expression.Compile(source)
+		require.NoError(t, err)
+		assert.Equal(t, expected, compiled.UsesTimestamp(), source)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"$temperature", "must be enclosed in '${' and '}'"},
+		{"${}", "syntax error at position 1: unexpected end of expression"},
+		{"${$temperature +}", "syntax error at position 15: unexpected end of expression"},
+		{"${$temperature $name}", "syntax error at position 14: unexpected '$'"},
+		{"${($temperature}", "syntax error at position 14: missing ')'"},
+		{"${$ports[0}", "syntax error at position 9: missing ']'"},
+		{"${$running ? 1}", "syntax error at position 13: missing ':'"},
+		{"${$status.}", "syntax error at position 8: missing field name after '.'"},
+		{"${'unterminated}", "syntax error at position 1: unterminated string"},
+		{"${1.2.3}", "syntax error at position 1: invalid number '1.2.3'"},
+		{"${$a # 1}", "syntax error at position 4: unexpected character '#'"},
+		{"${unknown(1)}", "syntax error at position 1: unknown function or identifier 'unknown'"},
+		{"${temperature}", "syntax error at position 1: unknown function or identifier 'temperature'"},
+		{"${lower()}", "syntax error at position 1: wrong number of arguments for function 'lower': 0"},
+		{"${" + strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100) + "}", "expression is nested too deeply"},
+		{"${" + strings.Repeat("-", 100) + "1}", "expression is nested too deeply"},
+	}
+	for _, test := range tests {
+		_, err := expression.Compile(test.expression)
+		require.Error(t, err, test.expression)
+		assert.Contains(t, err.Error(), test.err, test.expression)
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	env := newEnvironment(t)
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"${$missing * 10}", "at position 10: cannot apply '*' to null and number"},
+		{"${$name - 1}", "cannot apply '-' to string and number"},
+		{"${$temperature / 0}", "division by zero"},
+		{"${$temperature % 0}", "division by zero"},
+		{"${-$name}", "cannot apply '-' to string"},
+		{"${!$name}", "cannot apply '!' to string"},
+		{"${$name && true}", "cannot apply '&&' to string"},
+		{"${true || $name}", ""},
+		{"${false || $name}", "cannot apply '||' to string"},
+		{"${$name ? 1 : 2}", "condition must be a boolean, not string"},
+		{"${$name.field}", "cannot access field 'field' of string"},
+		{"${$ports['x']}", "cannot index array with string"},
+		{"${$ports[0.5]}", "cannot index array with number"},
+		{"${$status[0]}", "cannot index object with number"},
+		{"${$temperature[0]}", "cannot index number"},
+		{"${$status < 1}", "cannot apply '<' to object and number"},
+		{"${lower($temperature)}", "lower(): unsupported argument of type number"},
+		{"${number('abc')}", "number(): 'abc' is not a number"},
+	}
+	for _, test := range tests {
+		compiled, err := expression.Compile(test.expression)
+		require.NoError(t, err, test.expression)
+		_, err = compiled.Evaluate(env)
+		if test.err == "" {
+			assert.NoError(t, err, test.expression)
+			continue
+		}
+		require.Error(t, err, test.expression)
+		assert.Contains(t, err.Error(), test.err, test.expression)
+		assert.Contains(t, err.Error(), "cannot evaluate expression '"+test.expression+"'", test.expression)
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	compiled, err := expression.Compile("${$match.feature + '/' + ($match.property ?? $match)}")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"feature", "property"}, compiled.Captures())
+
+	compiled, err = expression.Compile("${$temperature}")
+	require.NoError(t, err)
+	assert.Empty(t, compiled.Captures())
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type function struct {
+	minArgs int
+	maxArgs int
+	call    func(args []interface{}) (interface{}, error)
+}
+
+// functions are the only functions available to the expressions, none of them has access to the environment.
+var functions = map[string]*function{
+	"timestamp": {0, 0, func(args []interface{}) (interface{}, error) {
+		return time.Now().UnixNano() / int64(time.Millisecond), nil
+	}},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		switch value := args[0].(type) {
+		case string:
+			return float64(len([]rune(value))), nil
+		case []interface{}:
+			return float64(len(value)), nil
+		case map[string]interface{}:
+			return float64(len(value)), nil
+		}
+		return nil, argumentError(args[0])
+	}},
+	"lower":      stringFunction(strings.ToLower),
+	"upper":      stringFunction(strings.ToUpper),
+	"trim":       stringFunction(strings.TrimSpace),
+	"contains":   stringPredicate(strings.Contains),
+	"startsWith": stringPredicate(strings.HasPrefix),
+	"endsWith":   stringPredicate(strings.HasSuffix),
+	"substring": {2, 3, func(args []interface{}) (interface{}, error) {
+		value, ok := args[0].(string)
+		if !ok {
+			return nil, argumentError(args[0])
+		}
+		runes := []rune(value)
+		start, err := intArgument(args[1], len(runes))
+		if err != nil {
+			return nil, err
+		}
+		end := len(runes)
+		if len(args) == 3 {
+			if end, err = intArgument(args[2], len(runes)); err != nil {
+				return nil, err
+			}
+		}
+		if start > end {
+			return "", nil
+		}
+		return string(runes[start:end]), nil
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		if value, ok := toString(args[0]); ok {
+			return value, nil
+		}
+		return nil, argumentError(args[0])
+	}},
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		if value, ok := toNumber(args[0]); ok {
+			return value, nil
+		}
+		switch value := args[0].(type) {
+		case string:
+			number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return nil, fmt.Errorf("'%s' is not a number", value)
+			}
+			return number, nil
+		case bool:
+			if value {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+		return nil, argumentError(args[0])
+	}},
+	"round": {1, 2, func(args []interface{}) (interface{}, error) {
+		value, ok := toNumber(args[0])
+		if !ok {
+			return nil, argumentError(args[0])
+		}
+		scale := 1.0
+		if len(args) == 2 {
+			digits, ok := toNumber(args[1])
+			if !ok {
+				return nil, argumentError(args[1])
+			}
+			scale = math.Pow(10, math.Trunc(digits))
+		}
+		return math.Round(value*scale) / scale, nil
+	}},
+	"floor": numberFunction(math.Floor),
+	"ceil":  numberFunction(math.Ceil),
+	"abs":   numberFunction(math.Abs),
+	"min":   numberAggregate(math.Min),
+	"max":   numberAggregate(math.Max),
+}
+
+func stringFunction(f func(string) string) *function {
+	return &function{1, 1, func(args []interface{}) (interface{}, error) {
+		value, ok := args[0].(string)
+		if !ok {
+			return nil, argumentError(args[0])
+		}
+		return f(value), nil
+	}}
+}
+
+func stringPredicate(f func(string, string) bool) *function {
+	return &function{2, 2, func(args []interface{}) (interface{}, error) {
+		value, ok := args[0].(string)
+		if !ok {
+			return nil, argumentError(args[0])
+		}
+		other, ok := args[1].(string)
+		if !ok {
+			return nil, argumentError(args[1])
+		}
+		return f(value, other), nil
+	}}
+}
+
+func numberFunction(f func(float64) float64) *function {
+	return &function{1, 1, func(args []interface{}) (interface{}, error) {
+		value, ok := toNumber(args[0])
+		if !ok {
+			return nil, argumentError(args[0])
+		}
+		return f(value), nil
+	}}
+}
+
+func numberAggregate(f func(float64, float64) float64) *function {
+	return &function{1, -1, func(args []interface{}) (interface{}, error) {
+		var result float64
+		for i, arg := range args {
+			value, ok := toNumber(arg)
+			if !ok {
+				return nil, argumentError(arg)
+			}
+			if i == 0 {
+				result = value
+			} else {
+				result = f(result, value)
+			}
+		}
+		return result, nil
+	}}
+}
+
+func intArgument(arg interface{}, length int) (int, error) {
+	value, ok := toNumber(arg)
+	if !ok || value != math.Trunc(value) {
+		return 0, argumentError(arg)
+	}
+	// clamped as a float before the conversion, as a whole number too big for an int overflows it
+	if value < 0 {
+		value += float64(length)
+	}
+	if value < 0 {
+		return 0, nil
+	} else if value > float64(length) {
+		return length, nil
+	}
+	return int(value), nil
+}
+
+func argumentError(arg interface{}) error {
+	return fmt.Errorf("unsupported argument of type %s", typeName(arg))
+}
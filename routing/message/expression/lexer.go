@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenRef
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// operators are ordered so that the longer ones are tried first.
+var operators = []string{"??", "==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", "[", "]", ".", ","}
+
+func tokenize(source string) ([]token, error) {
+	tokens := []token{}
+	for pos := 0; pos < len(source); {
+		c := rune(source[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c >= '0' && c <= '9':
+			end := pos
+			for end < len(source) && (isDigit(source[end]) || source[end] == '.' || source[end] == 'e' || source[end] == 'E' ||
+				((source[end] == '+' || source[end] == '-') && (source[end-1] == 'e' || source[end-1] == 'E'))) {
+				end++
+			}
+			number, err := strconv.ParseFloat(source[pos:end], 64)
+			if err != nil {
+				return nil, syntaxError(pos, "invalid number '%s'", source[pos:end])
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[pos:end], value: number, pos: pos})
+			pos = end
+		case c == '"' || c == '\'':
+			text, end, err := scanString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[pos:end], value: text, pos: pos})
+			pos = end
+		case c == '$':
+			tokens = append(tokens, token{kind: tokenRef, text: "$", pos: pos})
+			pos++
+			// the first field of a reference follows the $ without a dot, e.g. $status.state
+			if pos < len(source) && isIdentStart(source[pos]) {
+				end := scanIdent(source, pos)
+				tokens = append(tokens, token{kind: tokenIdent, text: source[pos:end], pos: pos})
+				pos = end
+			}
+		case isIdentStart(source[pos]):
+			end := scanIdent(source, pos)
+			tokens = append(tokens, token{kind: tokenIdent, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			operator := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(source[pos:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, syntaxError(pos, "unexpected character '%c'", c)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+func scanString(source string, start int) (string, int, error) {
+	quote := source[start]
+	var text strings.Builder
+	for pos := start + 1; pos < len(source); pos++ {
+		switch source[pos] {
+		case quote:
+			return text.String(), pos + 1, nil
+		case '\\':
+			pos++
+			if pos == len(source) {
+				break
+			}
+			switch source[pos] {
+			case 'n':
+				text.WriteByte('\n')
+			case 't':
+				text.WriteByte('\t')
+			default:
+				text.WriteByte(source[pos])
+			}
+		default:
+			text.WriteByte(source[pos])
+		}
+	}
+	return "", 0, syntaxError(start, "unterminated string")
+}
+
+func scanIdent(source string, start int) int {
+	end := start
+	for end < len(source) && (isIdentStart(source[end]) || isDigit(source[end])) {
+		end++
+	}
+	return end
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
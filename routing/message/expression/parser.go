@@ -0,0 +1,257 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression
+
+import "fmt"
+
+const maxDepth = 64
+
+// binaryPrecedence defines the binary operators from the lowest to the highest precedence.
+var binaryPrecedence = [][]string{
+	{"??"},
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+}
+
+func parse(source string) (node, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, syntaxError(next.pos, "unexpected '%s'", next.text)
+	}
+	return root, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOperator(operators ...string) bool {
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return false
+	}
+	for _, operator := range operators {
+		if t.text == operator {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(operator string) error {
+	if !p.isOperator(operator) {
+		t := p.peek()
+		if t.kind == tokenEOF {
+			return syntaxError(t.pos, "missing '%s'", operator)
+		}
+		return syntaxError(t.pos, "expected '%s' instead of '%s'", operator, t.text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseExpression() (node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, syntaxError(p.peek().pos, "expression is nested too deeply")
+	}
+
+	condition, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOperator("?") {
+		return condition, nil
+	}
+	pos := p.next().pos
+	then, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalNode{pos: pos, condition: condition, then: then, otherwise: otherwise}, nil
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(binaryPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(binaryPrecedence[level]...) {
+		operator := p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{pos: operator.pos, operator: operator.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOperator("!", "-") {
+		operator := p.next()
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxDepth {
+			return nil, syntaxError(operator.pos, "expression is nested too deeply")
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{pos: operator.pos, operator: operator.text, operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOperator("."):
+			dot := p.next()
+			field := p.next()
+			if field.kind != tokenIdent {
+				return nil, syntaxError(dot.pos, "missing field name after '.'")
+			}
+			n = &fieldNode{pos: field.pos, target: n, field: field.text}
+		case p.isOperator("["):
+			bracket := p.next()
+			index, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = &indexNode{pos: bracket.pos, target: n, index: index}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literalNode{value: t.value}, nil
+	case tokenRef:
+		var n node = &refNode{pos: t.pos}
+		// the first field of a reference is not preceded by a dot
+		if field := p.peek(); field.kind == tokenIdent && field.pos == t.pos+1 {
+			p.next()
+			if field.text == refMatch && p.isOperator(".") {
+				n = &matchNode{pos: t.pos}
+			} else {
+				n = &fieldNode{pos: field.pos, target: n, field: field.text}
+			}
+		}
+		return n, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		return p.parseCall(t)
+	case tokenOperator:
+		if t.text == "(" {
+			n, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+		return nil, syntaxError(t.pos, "unexpected '%s'", t.text)
+	default:
+		return nil, syntaxError(t.pos, "unexpected end of expression")
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	f, ok := functions[name.text]
+	if !ok {
+		return nil, syntaxError(name.pos, "unknown function or identifier '%s'", name.text)
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := []node{}
+	for !p.isOperator(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if len(args) < f.minArgs || (f.maxArgs >= 0 && len(args) > f.maxArgs) {
+		return nil, syntaxError(name.pos, "wrong number of arguments for function '%s': %d", name.text, len(args))
+	}
+	return &callNode{pos: name.pos, name: name.text, function: f, args: args}, nil
+}
+
+func syntaxError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
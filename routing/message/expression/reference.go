@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	refPrefix = "$"
+	indexAll  = "*"
+)
+
+// Reference is a path to a part of the Ditto value, e.g. "$status.state", "$containers[0].name" or "$containers[*].id".
+type Reference struct {
+	source   string
+	segments []segment
+}
+
+type segment struct {
+	field   string
+	indexes []int
+}
+
+// allIndexes marks the [*] index, which selects all elements of an array.
+const allIndexes = -1
+
+// ParseReference parses a reference starting with "$".
+func ParseReference(ref string) (*Reference, error) {
+	if !strings.HasPrefix(ref, refPrefix) {
+		return nil, fmt.Errorf("reference '%s' must start with '%s'", ref, refPrefix)
+	}
+	reference := &Reference{source: ref}
+	for _, part := range strings.Split(ref[len(refPrefix):], ".") {
+		field := part
+		indexes := []int{}
+		if bracket := strings.IndexByte(part, '['); bracket >= 0 {
+			field = part[:bracket]
+			for rest := part[bracket:]; rest != ""; {
+				end := strings.IndexByte(rest, ']')
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("reference '%s' has an invalid index '%s'", ref, rest)
+				}
+				index, err := parseIndex(rest[1:end])
+				if err != nil {
+					return nil, fmt.Errorf("reference '%s' has an invalid index '%s'", ref, rest[:end+1])
+				}
+				indexes = append(indexes, index)
+				rest = rest[end+1:]
+			}
+		}
+		if field == "" {
+			return nil, fmt.Errorf("reference '%s' has an empty field name", ref)
+		}
+		reference.segments = append(reference.segments, segment{field: field, indexes: indexes})
+	}
+	return reference, nil
+}
+
+func parseIndex(index string) (int, error) {
+	if index == indexAll {
+		return allIndexes, nil
+	}
+	value, err := strconv.Atoi(index)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid index '%s'", index)
+	}
+	return value, nil
+}
+
+// Resolve returns the referenced part of the value or nil, if it is missing. A reference with a [*] index resolves to
+// an array with the rest of the reference resolved for each element, where the missing ones are left out.
+func (r *Reference) Resolve(value interface{}) interface{} {
+	steps := []interface{}{}
+	for _, segment := range r.segments {
+		steps = append(steps, segment.field)
+		for _, index := range segment.indexes {
+			steps = append(steps, index)
+		}
+	}
+	return resolve(value, steps)
+}
+
+func resolve(value interface{}, steps []interface{}) interface{} {
+	if len(steps) == 0 {
+		return value
+	}
+	switch step := steps[0].(type) {
+	case string:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		return resolve(object[step], steps[1:])
+	default:
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		index := step.(int)
+		if index != allIndexes {
+			if index >= len(array) {
+				return nil
+			}
+			return resolve(array[index], steps[1:])
+		}
+		result := []interface{}{}
+		for _, element := range array {
+			if resolved := resolve(element, steps[1:]); resolved != nil {
+				result = append(result, resolved)
+			}
+		}
+		return result
+	}
+}
+
+func (r *Reference) String() string {
+	return r.source
+}
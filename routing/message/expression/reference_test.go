@@ -0,0 +1,81 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package expression_test
+
+import (
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/expression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveReference(t *testing.T) {
+	value := newEnvironment(t).Value
+	tests := []struct {
+		reference string
+		expected  interface{}
+	}{
+		{"$name", "container"},
+		{"$status.state", "RUNNING"},
+		{"$ports[1]", 8443.0},
+		{"$ports[2]", nil},
+		{"$ports[*]", []interface{}{8080.0, 8443.0}},
+		{"$containers[0].id", "c1"},
+		{"$containers[*].id", []interface{}{"c1", "c2"}},
+		{"$containers[*].missing", []interface{}{}},
+		{"$containers.id", nil},
+		{"$status[0]", nil},
+		{"$missing[0].id", nil},
+		{"$key-with-dash", "dash"},
+	}
+	for _, test := range tests {
+		reference, err := expression.ParseReference(test.reference)
+		require.NoError(t, err, test.reference)
+		assert.Equal(t, test.expected, reference.Resolve(value), test.reference)
+		assert.Equal(t, test.reference, reference.String())
+	}
+}
+
+func TestResolveNestedArrays(t *testing.T) {
+	reference, err := expression.ParseReference("$matrix[*][1]")
+	require.NoError(t, err)
+	value := map[string]interface{}{
+		"matrix": []interface{}{
+			[]interface{}{1.0, 2.0},
+			[]interface{}{3.0},
+			[]interface{}{5.0, 6.0},
+		},
+	}
+	assert.Equal(t, []interface{}{2.0, 6.0}, reference.Resolve(value))
+}
+
+func TestParseReferenceErrors(t *testing.T) {
+	tests := []struct {
+		reference string
+		err       string
+	}{
+		{"status", "must start with '$'"},
+		{"$", "empty field name"},
+		{"$status..state", "empty field name"},
+		{"$[0]", "empty field name"},
+		{"$ports[x]", "invalid index '[x]'"},
+		{"$ports[-1]", "invalid index '[-1]'"},
+		{"$ports[0", "invalid index '[0'"},
+		{"$ports[0]x", "invalid index 'x'"},
+	}
+	for _, test := range tests {
+		_, err := expression.ParseReference(test.reference)
+		require.Error(t, err, test.reference)
+		assert.Contains(t, err.Error(), test.err, test.reference)
+	}
+}
@@ -14,6 +14,12 @@ package command
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
 
 	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
 
@@ -26,15 +32,81 @@ const (
 	commandMessageContextKey contextKey = 4 + iota //the rest of the context keys are defined in the connector package
 )
 
+const (
+	// cloudTopicPropertiesSeparator precedes the URL encoded message properties in the devicebound topic of the
+	// Azure IoT Hub, e.g. devices/{deviceId}/messages/devicebound/$.ct=application%2Fx-protobuf&cmdName=...
+	cloudTopicPropertiesSeparator = "/messages/devicebound/"
+
+	propertyContentType   = "$.ct"
+	propertyCorrelationID = "$.cid"
+	propertyCommandName   = "cmdName"
+	propertyAppID         = "appId"
+	propertyCID           = "cId"
+)
+
+// binaryContentTypes are the content types of the C2D messages that carry a raw protobuf payload instead of
+// a JSON cloud message.
+var binaryContentTypes = []string{
+	"application/x-protobuf",
+	"application/protobuf",
+	"application/vnd.google.protobuf",
+	"application/octet-stream",
+}
+
+// parseCommandMessage returns the cloud message of a C2D message. A C2D message with a binary content type carries
+// the raw protobuf payload and the command name, application ID and correlation ID are taken from its properties,
+// otherwise the C2D message is a JSON cloud message with a base64 encoded protobuf payload.
 func parseCommandMessage(msg *message.Message) (*routingmessage.CloudMessage, error) {
 	value, ok := msg.Context().Value(commandMessageContextKey).(*routingmessage.CloudMessage)
 	if ok {
 		return value, nil
 	}
+	properties := parseMessageProperties(msg)
 	cloudMessage := &routingmessage.CloudMessage{}
-	if err := json.Unmarshal(msg.Payload, cloudMessage); err != nil {
+	if isBinaryContentType(properties.Get(propertyContentType)) {
+		cloudMessage.CommandName = properties.Get(propertyCommandName)
+		if cloudMessage.CommandName == "" {
+			return nil, fmt.Errorf("missing property '%s' of binary C2D message", propertyCommandName)
+		}
+		cloudMessage.ApplicationID = properties.Get(propertyAppID)
+		cloudMessage.CorrelationID = properties.Get(propertyCID)
+		if cloudMessage.CorrelationID == "" {
+			cloudMessage.CorrelationID = properties.Get(propertyCorrelationID)
+		}
+		cloudMessage.Payload = []byte(msg.Payload)
+	} else if err := json.Unmarshal(msg.Payload, cloudMessage); err != nil {
 		return nil, err
 	}
 	msg.SetContext(context.WithValue(msg.Context(), commandMessageContextKey, cloudMessage))
 	return cloudMessage, nil
 }
+
+func parseMessageProperties(msg *message.Message) url.Values {
+	topic, ok := connector.TopicFromCtx(msg.Context())
+	if !ok {
+		return url.Values{}
+	}
+	index := strings.Index(topic, cloudTopicPropertiesSeparator)
+	if index < 0 {
+		return url.Values{}
+	}
+	// the properties that cannot be parsed are skipped
+	properties, _ := url.ParseQuery(topic[index+len(cloudTopicPropertiesSeparator):])
+	return properties
+}
+
+func isBinaryContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, binaryContentType := range binaryContentTypes {
+		if mediaType == binaryContentType {
+			return true
+		}
+	}
+	return false
+}
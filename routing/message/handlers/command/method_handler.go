@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	directMethodHandlerName = "direct_method_handler"
+	methodTopics            = "$iothub/methods/POST/#"
+
+	// methodTopicPrefix precedes the method name and the request ID in the topic of a direct method invocation, e.g.
+	// $iothub/methods/POST/{method name}/?$rid={request id}
+	methodTopicPrefix   = "$iothub/methods/POST/"
+	methodResponseTopic = "$iothub/methods/res/%d/?$rid=%s"
+	propertyRequestID   = "$rid"
+
+	// defaultMethodTimeout is the default response timeout of the direct methods of the Azure IoT Hub.
+	defaultMethodTimeout = 30 * time.Second
+)
+
+// MethodReplyTracker is notified about the direct method invocations forwarded to the device, which are answered with
+// the response of the device or with an error after the timeout.
+type MethodReplyTracker interface {
+	TrackMethod(cloudMessage *routingmessage.CloudMessage, requestID string, timeout time.Duration)
+}
+
+// methodErrorPayload is the payload of the direct method responses that are not sent by the device.
+type methodErrorPayload struct {
+	Error string `json:"error"`
+}
+
+// directMethodHandler is safe for concurrent use, the lock guards the cloud publisher.
+type directMethodHandler struct {
+	connInfo  *config.RemoteConnectionInfo
+	snapshots *mapper.Holder
+	commands  handlers.CommandHandler
+	replies   MethodReplyTracker
+
+	lock      sync.Mutex
+	publisher message.Publisher
+}
+
+// CreateDirectMethodHandler instantiates a direct method handler, which converts the method invocations to commands of
+// the provided command handler and passes them to the provided reply tracker. The method name is the command name and
+// the method payload is the command payload.
+func CreateDirectMethodHandler(snapshots *mapper.Holder, commands handlers.CommandHandler, replies MethodReplyTracker) bus.CloudHandler {
+	return &directMethodHandler{
+		snapshots: snapshots,
+		commands:  commands,
+		replies:   replies,
+	}
+}
+
+func (h *directMethodHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	h.connInfo = connInfo
+	return h.commands.Init(connInfo)
+}
+
+// SetCloudPublisher sets the publisher of the error responses of the method invocations that cannot be forwarded.
+func (h *directMethodHandler) SetCloudPublisher(publisher message.Publisher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.publisher = publisher
+}
+
+// HandleMessage forwards a method invocation to the device. The invocations that cannot be forwarded are answered
+// right away, so that the caller does not wait for the timeout of the method.
+func (h *directMethodHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	methodName, requestID, err := parseMethodTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	outgoingMessages, status, err := h.forward(msg, methodName, requestID)
+	if err != nil {
+		if respondErr := h.respondError(requestID, status, err); respondErr != nil {
+			return nil, errors.Wrap(respondErr, err.Error())
+		}
+		return nil, nil
+	}
+	return outgoingMessages, nil
+}
+
+func (h *directMethodHandler) forward(msg *message.Message, methodName, requestID string) ([]*message.Message, int, error) {
+	mapperConfig := h.snapshots.Load().Config
+	if mapperConfig == nil {
+		return nil, http.StatusNotFound, errors.New("no message mapper config")
+	}
+	messageMapping, err := mapperConfig.GetCommandMessageMapping(methodName)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	timeout, err := messageMapping.GetReplyTimeout()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if timeout == 0 {
+		timeout = defaultMethodTimeout
+	}
+
+	cloudMessage := &routingmessage.CloudMessage{
+		CommandName: methodName,
+		// the request IDs are only unique per connection to the Azure IoT Hub
+		CorrelationID: watermill.NewUUID(),
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &cloudMessage.Payload); err != nil {
+			return nil, http.StatusBadRequest, errors.Wrap(err, fmt.Sprintf("cannot deserialize payload of method '%s'", methodName))
+		}
+	}
+	commandMessage := message.NewMessage(msg.UUID, msg.Payload)
+	commandMessage.SetContext(context.WithValue(msg.Context(), commandMessageContextKey, cloudMessage))
+	outgoingMessages, err := h.commands.HandleMessage(commandMessage)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	// the command handler might track the command with the same correlation ID, which is replaced here
+	h.replies.TrackMethod(cloudMessage, requestID, timeout)
+	return outgoingMessages, http.StatusOK, nil
+}
+
+func (h *directMethodHandler) respondError(requestID string, status int, err error) error {
+	h.lock.Lock()
+	publisher := h.publisher
+	h.lock.Unlock()
+
+	if publisher == nil {
+		return errors.New("no cloud publisher")
+	}
+	response, responseErr := createMethodResponse(requestID, status, &methodErrorPayload{Error: err.Error()})
+	if responseErr != nil {
+		return responseErr
+	}
+	return publisher.Publish(connector.TopicEmpty, response)
+}
+
+// parseMethodTopic returns the method name and the request ID of a direct method invocation topic.
+func parseMethodTopic(topic string) (string, string, error) {
+	if !strings.HasPrefix(topic, methodTopicPrefix) {
+		return "", "", fmt.Errorf("invalid direct method topic '%s'", topic)
+	}
+	methodName := topic[len(methodTopicPrefix):]
+	var properties url.Values
+	if index := strings.Index(methodName, "/"); index >= 0 {
+		properties, _ = url.ParseQuery(strings.TrimPrefix(methodName[index+1:], "?"))
+		methodName = methodName[:index]
+	}
+	requestID := properties.Get(propertyRequestID)
+	if methodName == "" || requestID == "" {
+		return "", "", fmt.Errorf("missing method name or request ID in direct method topic '%s'", topic)
+	}
+	return methodName, requestID, nil
+}
+
+// createMethodResponse returns the response to a direct method invocation, its payload is sent as JSON.
+func createMethodResponse(requestID string, status int, payload interface{}) (*message.Message, error) {
+	responsePayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize direct method response")
+	}
+	response := message.NewMessage(watermill.NewUUID(), responsePayload)
+	responseTopic := fmt.Sprintf(methodResponseTopic, status, url.QueryEscape(requestID))
+	response.SetContext(connector.SetTopicToCtx(response.Context(), responseTopic))
+	return response, nil
+}
+
+func (h *directMethodHandler) Name() string {
+	return directMethodHandlerName
+}
+
+func (h *directMethodHandler) Topics() string {
+	return methodTopics
+}
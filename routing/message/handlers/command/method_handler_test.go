@@ -0,0 +1,167 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMethodTopic(t *testing.T) {
+	methodName, requestID, err := parseMethodTopic("$iothub/methods/POST/getState/?$rid=1f")
+	require.NoError(t, err)
+	assert.Equal(t, "getState", methodName)
+	assert.Equal(t, "1f", requestID)
+
+	for _, topic := range []string{
+		"devices/dummy-device/messages/devicebound/",
+		"$iothub/methods/POST/getState",
+		"$iothub/methods/POST/getState/",
+		"$iothub/methods/POST//?$rid=1",
+	} {
+		_, _, err := parseMethodTopic(topic)
+		assert.Error(t, err, topic)
+	}
+}
+
+func TestDirectMethod(t *testing.T) {
+	handler, replies, publisher := createDirectMethodHandler(t)
+
+	dittoMessages, err := handler.HandleMessage(createMethodInvocation(`{"text": "state"}`, "$iothub/methods/POST/message.no.proto.file/?$rid=1"))
+	require.NoError(t, err)
+	require.Len(t, dittoMessages, 1)
+	dittoMessage := &protocol.Envelope{}
+	require.NoError(t, json.Unmarshal(dittoMessages[0].Payload, dittoMessage))
+	assert.Equal(t, map[string]interface{}{"text": "state"}, dittoMessage.Value)
+	correlationID := dittoMessage.Headers.CorrelationID()
+	require.NotEmpty(t, correlationID)
+	dittoTopic, _ := connector.TopicFromCtx(dittoMessages[0].Context())
+	assert.Equal(t, "command//azure.edge:dummy-hub:dummy-device:edge:containers/req/"+correlationID+"/action", dittoTopic)
+
+	responses, err := replies.HandleMessage(createDittoResponse(`{
+		"headers": {"correlation-id": "`+correlationID+`"},
+		"value": {"state": "running"},
+		"status": 200
+	}`, ""))
+	require.NoError(t, err)
+	require.Len(t, responses, 1)
+	responseTopic, _ := connector.TopicFromCtx(responses[0].Context())
+	assert.Equal(t, "$iothub/methods/res/200/?$rid=1", responseTopic)
+	assert.JSONEq(t, `{"state": "running"}`, string(responses[0].Payload))
+	assertNoMethodResponse(t, publisher)
+}
+
+func TestDirectMethodWithoutPayload(t *testing.T) {
+	handler, replies, _ := createDirectMethodHandler(t)
+
+	dittoMessages, err := handler.HandleMessage(createMethodInvocation("", "$iothub/methods/POST/message.no.proto.file/?$rid=2"))
+	require.NoError(t, err)
+	dittoMessage := &protocol.Envelope{}
+	require.NoError(t, json.Unmarshal(dittoMessages[0].Payload, dittoMessage))
+	assert.Nil(t, dittoMessage.Value)
+
+	responses, err := replies.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "`+
+		dittoMessage.Headers.CorrelationID()+`"}}`, "command//azure.edge:dummy-hub:dummy-device/res/x/204"))
+	require.NoError(t, err)
+	responseTopic, _ := connector.TopicFromCtx(responses[0].Context())
+	assert.Equal(t, "$iothub/methods/res/204/?$rid=2", responseTopic)
+	assert.Equal(t, "null", string(responses[0].Payload))
+}
+
+func TestDirectMethodErrors(t *testing.T) {
+	handler, _, publisher := createDirectMethodHandler(t)
+	tests := []struct {
+		payload string
+		topic   string
+		status  string
+	}{
+		{`{}`, "$iothub/methods/POST/unknown/?$rid=3", "404"},
+		{`{"text": `, "$iothub/methods/POST/message.no.proto.file/?$rid=4", "400"},
+		{`{"text": "a"}`, "$iothub/methods/POST/simple.message/?$rid=5", "400"},
+	}
+	for _, test := range tests {
+		dittoMessages, err := handler.HandleMessage(createMethodInvocation(test.payload, test.topic))
+		require.NoError(t, err, test.topic)
+		assert.Empty(t, dittoMessages, test.topic)
+
+		response := <-publisher.messages
+		responseTopic, _ := connector.TopicFromCtx(response.Context())
+		assert.Equal(t, "$iothub/methods/res/"+test.status+"/?$rid="+test.topic[len(test.topic)-1:], responseTopic)
+		errorPayload := &methodErrorPayload{}
+		require.NoError(t, json.Unmarshal(response.Payload, errorPayload))
+		assert.NotEmpty(t, errorPayload.Error)
+	}
+
+	_, err := handler.HandleMessage(createMethodInvocation(`{}`, "$iothub/methods/POST/unknown"))
+	assert.Error(t, err)
+}
+
+func TestDirectMethodTimeout(t *testing.T) {
+	handler, _, publisher := createDirectMethodHandler(t)
+
+	// the reply timeout of the command mapping is the timeout of the method
+	_, err := handler.HandleMessage(createMethodInvocation(`"EgFh"`, "$iothub/methods/POST/message.with.reply/?$rid=6"))
+	require.NoError(t, err)
+	select {
+	case response := <-publisher.messages:
+		responseTopic, _ := connector.TopicFromCtx(response.Context())
+		assert.Equal(t, "$iothub/methods/res/408/?$rid=6", responseTopic)
+		assert.JSONEq(t, `{"error": "no reply from the device within 50ms"}`, string(response.Payload))
+	case <-time.After(time.Second):
+		require.Fail(t, "no timeout response")
+	}
+}
+
+func assertNoMethodResponse(t *testing.T, publisher *replyPublisher) {
+	select {
+	case response := <-publisher.messages:
+		assert.Fail(t, "unexpected method response", string(response.Payload))
+	default:
+	}
+}
+
+func createMethodInvocation(payload, topic string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func createDirectMethodHandler(t *testing.T) (*directMethodHandler, ReplyHandler, *replyPublisher) {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
+	require.NoError(t, err)
+	publisher := &replyPublisher{messages: make(chan *message.Message, 1)}
+	replies := createThingsReplyHandler(t)
+	replies.SetCloudPublisher(publisher)
+	snapshots := mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false)
+	commands := CreateThingsCommandHandler(snapshots, nil)
+	handler := CreateDirectMethodHandler(snapshots, commands, replies).(*directMethodHandler)
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+	handler.SetCloudPublisher(publisher)
+	return handler, replies, publisher
+}
@@ -14,6 +14,7 @@ package command
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -21,7 +22,9 @@ import (
 	"github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
 	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
 
 	"github.com/eclipse-kanto/suite-connector/connector"
@@ -43,17 +46,23 @@ const (
 	keyPayload       = "payload"
 )
 
+// ReplyTracker is notified about the commands forwarded to the device that expect a reply within a timeout.
+type ReplyTracker interface {
+	Track(cloudMessage *routingmessage.CloudMessage, timeout time.Duration)
+}
+
 type thingsCommandHandler struct {
-	connInfo     *config.RemoteConnectionInfo
-	mapperConfig *mapperconfig.MessageMapperConfig
-	marshaller   protobuf.Marshaller
+	connInfo  *config.RemoteConnectionInfo
+	snapshots *mapper.Holder
+	replies   ReplyTracker
 }
 
-// CreateThingsCommandHandler instantiates a things command message handler
-func CreateThingsCommandHandler(mapperConfig *mapperconfig.MessageMapperConfig, marshaller protobuf.Marshaller) handlers.CommandHandler {
+// CreateThingsCommandHandler instantiates a things command message handler, which passes the commands with a reply
+// timeout to the provided reply tracker, if any
+func CreateThingsCommandHandler(snapshots *mapper.Holder, replies ReplyTracker) handlers.CommandHandler {
 	return &thingsCommandHandler{
-		mapperConfig: mapperConfig,
-		marshaller:   marshaller,
+		snapshots: snapshots,
+		replies:   replies,
 	}
 }
 
@@ -67,11 +76,19 @@ func (h *thingsCommandHandler) HandleMessage(msg *message.Message) ([]*message.M
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot deserialize cloud message")
 	}
-	messageMapping, err := h.mapperConfig.GetCommandMessageMapping(cloudMessage.CommandName)
+	snapshot := h.snapshots.Load()
+	mapperConfig := snapshot.Config
+	if mapperConfig == nil {
+		return nil, errors.New("no message mapper config")
+	}
+	messageMapping, err := mapperConfig.GetCommandMessageMapping(cloudMessage.CommandName)
 	if err != nil {
 		return nil, err
 	}
 	mappingProperties := messageMapping.MappingProperties
+	if mappingProperties == nil {
+		return nil, fmt.Errorf("no Ditto mapping for command '%s'", cloudMessage.CommandName)
+	}
 
 	deviceID := h.connInfo.HubName + ":" + h.connInfo.DeviceID
 	topicStr := fmt.Sprintf(dittoTopicPatternWithThing, dittoNamespace, deviceID, mappingProperties.Thing, mappingProperties.Action)
@@ -83,7 +100,10 @@ func (h *thingsCommandHandler) HandleMessage(msg *message.Message) ([]*message.M
 	headers := protocol.NewHeaders(protocol.WithContentType("application/json"), protocol.WithCorrelationID(cloudMessage.CorrelationID))
 
 	var dittoValue interface{}
-	if messageMapping.ProtoFile == "" {
+	if !messageMapping.IsProtobuf() {
+		if _, ok := cloudMessage.Payload.([]byte); ok {
+			return nil, fmt.Errorf("binary payload of command '%s' requires a proto file", cloudMessage.CommandName)
+		}
 		wrappedPayload := wrapDittoPayload(mappingProperties, cloudMessage.Payload)
 		if messageMapping.RetainCorrelationID {
 			dittoValue = map[string]interface{}{
@@ -95,7 +115,7 @@ func (h *thingsCommandHandler) HandleMessage(msg *message.Message) ([]*message.M
 		}
 	} else {
 		var bytePayload []byte
-		bytePayload, err = h.marshaller.Unmarshal(cloudMessage.CommandName, cloudMessage.Payload.(string))
+		bytePayload, err = unmarshalProtobufPayload(snapshot.Marshaller, cloudMessage)
 		if err == nil {
 			mapValue := map[string]interface{}{}
 			if err = json.Unmarshal(bytePayload, &mapValue); err == nil {
@@ -122,9 +142,33 @@ func (h *thingsCommandHandler) HandleMessage(msg *message.Message) ([]*message.M
 	outgoingTopic := createMessageTopic(mappingProperties, deviceID, cloudMessage.CorrelationID)
 	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
 
+	replyTimeout, err := messageMapping.GetReplyTimeout()
+	if err != nil {
+		return nil, err
+	}
+	// a reply without correlation ID cannot be matched with its command, so such commands are not tracked
+	if h.replies != nil && replyTimeout > 0 && cloudMessage.CorrelationID != "" {
+		h.replies.Track(cloudMessage, replyTimeout)
+	}
 	return []*message.Message{outgoingMessage}, nil
 }
 
+// unmarshalProtobufPayload converts the protobuf payload of a cloud message to JSON. The payload is either the raw
+// protobuf of a binary C2D message or a base64 encoded string of a JSON cloud message, a missing payload is
+// an empty protobuf message.
+func unmarshalProtobufPayload(marshaller protobuf.Marshaller, cloudMessage *routingmessage.CloudMessage) ([]byte, error) {
+	switch payload := cloudMessage.Payload.(type) {
+	case []byte:
+		return marshaller.UnmarshalBinary(cloudMessage.CommandName, payload)
+	case string:
+		return marshaller.Unmarshal(cloudMessage.CommandName, payload)
+	case nil:
+		return marshaller.UnmarshalBinary(cloudMessage.CommandName, []byte{})
+	default:
+		return nil, fmt.Errorf("unsupported payload of type %T for protobuf command '%s', expected a base64 encoded string", payload, cloudMessage.CommandName)
+	}
+}
+
 func createMessageTopic(mappingProperties *mapperconfig.CommandMappingProperties, deviceID, reqID string) string {
 	if mappingProperties.Thing == "" {
 		return fmt.Sprintf(messageTopicPattern, reqID, mappingProperties.Action)
@@ -12,15 +12,20 @@
 package command
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"testing"
 
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
 	"github.com/eclipse-kanto/suite-connector/connector"
 
 	"github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 
 	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
 
 	"github.com/eclipse/ditto-clients-golang/protocol"
@@ -381,9 +386,124 @@ func TestInvalidJSONC2DMessageType(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestBinaryC2DMessage(t *testing.T) {
+	handler := createThingsCommandHandler(t)
+	payload, err := base64.StdEncoding.DecodeString("ChRzb21lLW1lc3NhZ2UtaWQtMTIzNBIRc2ltcGxlIHRleHQgYWRkZWQaBTEuMC44")
+	require.NoError(t, err)
+	for _, contentType := range []string{"application%2Fx-protobuf", "application%2Foctet-stream", "application%2Fprotobuf%3B+charset%3Dbinary"} {
+		t.Run(contentType, func(t *testing.T) {
+			properties := "%24.mid=msg-id&%24.ct=" + contentType + "&%24.cid=C2D-msg-correlation-id&cmdName=simple.message&appId=app1"
+			azureMessages, err := handler.HandleMessage(createBinaryWatermillMessageForC2D(payload, properties))
+			require.NoError(t, err)
+
+			azureMsgTopic, _ := connector.TopicFromCtx(azureMessages[0].Context())
+			assert.Equal(t, "command//azure.edge:dummy-hub:dummy-device:edge:containers/req/C2D-msg-correlation-id/send", azureMsgTopic)
+
+			c2dMessage := &protocol.Envelope{}
+			require.NoError(t, json.Unmarshal(azureMessages[0].Payload, c2dMessage))
+			assert.Equal(t, "C2D-msg-correlation-id", c2dMessage.Headers.CorrelationID())
+			assert.Equal(t, map[string]interface{}{
+				"messageId": "some-message-id-1234",
+				"text":      "simple text added",
+				"version":   "1.0.8",
+			}, c2dMessage.Value)
+		})
+	}
+}
+
+func TestBinaryC2DMessageCorrelationIDProperty(t *testing.T) {
+	handler := createThingsCommandHandler(t)
+	properties := "%24.ct=application%2Fx-protobuf&%24.cid=system-correlation-id&cId=app-correlation-id&cmdName=simple.message"
+	azureMessages, err := handler.HandleMessage(createBinaryWatermillMessageForC2D([]byte{}, properties))
+	require.NoError(t, err)
+
+	c2dMessage := &protocol.Envelope{}
+	require.NoError(t, json.Unmarshal(azureMessages[0].Payload, c2dMessage))
+	assert.Equal(t, "app-correlation-id", c2dMessage.Headers.CorrelationID())
+	assert.Equal(t, map[string]interface{}{}, c2dMessage.Value)
+}
+
+func TestInvalidBinaryC2DMessage(t *testing.T) {
+	handler := createThingsCommandHandler(t)
+	var testData = []struct {
+		name       string
+		payload    []byte
+		properties string
+		err        string
+	}{
+		{
+			"missing.command.name",
+			[]byte{0x0a, 0x01, 0x78},
+			"%24.ct=application%2Fx-protobuf&appId=app1",
+			"missing property 'cmdName' of binary C2D message",
+		},
+		{
+			"no.proto.file",
+			[]byte{0x0a, 0x01, 0x78},
+			"%24.ct=application%2Fx-protobuf&cmdName=message.no.proto.file",
+			"binary payload of command 'message.no.proto.file' requires a proto file",
+		},
+		{
+			"malformed.protobuf",
+			[]byte{0x0a, 0x7f, 0x78},
+			"%24.ct=application%2Fx-protobuf&cmdName=simple.message",
+			"Cannot deserialize C2D message protobuf payload format to JSON for message type 'simple.message'!",
+		},
+	}
+	for _, testValues := range testData {
+		t.Run(testValues.name, func(t *testing.T) {
+			_, err := handler.HandleMessage(createBinaryWatermillMessageForC2D(testValues.payload, testValues.properties))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), testValues.err)
+		})
+	}
+}
+
+func TestUnsupportedPayloadTypeC2DMessage(t *testing.T) {
+	handler := createThingsCommandHandler(t)
+	for _, payload := range []string{`{"messageId": "id"}`, `42`, `true`, `["ChRzb21l"]`} {
+		t.Run(payload, func(t *testing.T) {
+			jsonPayload := `{
+				"appId": "app1",
+				"cmdName": "simple.message",
+				"cId": "C2D-msg-correlation-id",
+				"p": ` + payload + `
+			}`
+			var err error
+			assert.NotPanics(t, func() {
+				_, err = handler.HandleMessage(createWatermillMessageForC2D([]byte(jsonPayload)))
+			})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "unsupported payload of type")
+			assert.Contains(t, err.Error(), "for protobuf command 'simple.message', expected a base64 encoded string")
+		})
+	}
+}
+
+func TestJSONC2DMessageWithJSONContentType(t *testing.T) {
+	handler := createThingsCommandHandler(t)
+	jsonPayload := `{
+		"appId": "app1",
+		"cmdName": "simple.message",
+		"cId": "C2D-msg-correlation-id",
+		"p": "ChRzb21lLW1lc3NhZ2UtaWQtMTIzNBIRc2ltcGxlIHRleHQgYWRkZWQaBTEuMC44"
+	}`
+	azureMessages, err := handler.HandleMessage(createBinaryWatermillMessageForC2D([]byte(jsonPayload), "%24.ct=application%2Fjson&cmdName=other"))
+	require.NoError(t, err)
+	c2dMessage := &protocol.Envelope{}
+	require.NoError(t, json.Unmarshal(azureMessages[0].Payload, c2dMessage))
+	assert.Equal(t, "simple text added", c2dMessage.Value.(map[string]interface{})["text"])
+}
+
+func createBinaryWatermillMessageForC2D(payload []byte, properties string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), "devices/dummy-device/messages/devicebound/"+properties))
+	return msg
+}
+
 func createThingsCommandHandler(t *testing.T) handlers.CommandHandler {
 	mapperConfig, _ := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
-	messageHandler := CreateThingsCommandHandler(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig))
+	messageHandler := CreateThingsCommandHandler(mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false), nil)
 	messageHandler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"})
 	return messageHandler
 }
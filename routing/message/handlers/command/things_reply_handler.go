@@ -0,0 +1,274 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+	"github.com/pkg/errors"
+)
+
+const (
+	commandReplyHandlerName = "command_reply_handler"
+	// responseTopics are the local topics of the Ditto live message responses, e.g. command//{thing}/res/{cId}/{status}
+	responseTopics = "command//+/res/#"
+
+	replyEnvelopeVersion = "2.0"
+	replyPayloadVersion  = "1.0"
+)
+
+// ReplyHandler forwards the responses of the device to the commands as D2C reply messages and to the direct methods as
+// method responses. The commands are correlated with the responses by their correlation ID, a command without response
+// within its reply timeout gets an error reply.
+type ReplyHandler interface {
+	handlers.TelemetryHandler
+	ReplyTracker
+	MethodReplyTracker
+	SetCloudPublisher(publisher message.Publisher)
+}
+
+// pendingCommand is a command or, if it has a request ID, a direct method awaiting the response of the device.
+type pendingCommand struct {
+	cloudMessage *routingmessage.CloudMessage
+	requestID    string
+	timeout      time.Duration
+	timer        *time.Timer
+}
+
+// thingsReplyHandler is safe for concurrent use, the lock guards the pending commands and the cloud publisher.
+type thingsReplyHandler struct {
+	connInfo  *config.RemoteConnectionInfo
+	snapshots *mapper.Holder
+	logger    watermill.LoggerAdapter
+
+	lock      sync.Mutex
+	pending   map[string]*pendingCommand
+	publisher message.Publisher
+}
+
+// CreateThingsReplyHandler instantiates a command reply handler, which logs the error replies that cannot be sent
+// with the provided logger
+func CreateThingsReplyHandler(snapshots *mapper.Holder, logger watermill.LoggerAdapter) ReplyHandler {
+	return &thingsReplyHandler{
+		snapshots: snapshots,
+		logger:    logger,
+		pending:   map[string]*pendingCommand{},
+	}
+}
+
+func (h *thingsReplyHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	h.connInfo = connInfo
+	return nil
+}
+
+// SetCloudPublisher sets the publisher of the error replies of the commands that timed out.
+func (h *thingsReplyHandler) SetCloudPublisher(publisher message.Publisher) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.publisher = publisher
+}
+
+// Track awaits the response to a command forwarded to the device. A command that is sent again with the same
+// correlation ID restarts the timeout.
+func (h *thingsReplyHandler) Track(cloudMessage *routingmessage.CloudMessage, timeout time.Duration) {
+	h.track(cloudMessage, "", timeout)
+}
+
+// TrackMethod awaits the response to a direct method invocation forwarded to the device.
+func (h *thingsReplyHandler) TrackMethod(cloudMessage *routingmessage.CloudMessage, requestID string, timeout time.Duration) {
+	h.track(cloudMessage, requestID, timeout)
+}
+
+func (h *thingsReplyHandler) track(cloudMessage *routingmessage.CloudMessage, requestID string, timeout time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	correlationID := cloudMessage.CorrelationID
+	if previous, ok := h.pending[correlationID]; ok {
+		previous.timer.Stop()
+	}
+	command := &pendingCommand{cloudMessage: cloudMessage, requestID: requestID, timeout: timeout}
+	command.timer = time.AfterFunc(timeout, func() {
+		h.expire(correlationID, command)
+	})
+	h.pending[correlationID] = command
+}
+
+func (h *thingsReplyHandler) take(correlationID string) *pendingCommand {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	command, ok := h.pending[correlationID]
+	if !ok {
+		return nil
+	}
+	command.timer.Stop()
+	delete(h.pending, correlationID)
+	return command
+}
+
+func (h *thingsReplyHandler) expire(correlationID string, command *pendingCommand) {
+	h.lock.Lock()
+	if h.pending[correlationID] != command {
+		// the response arrived or the command was sent again meanwhile
+		h.lock.Unlock()
+		return
+	}
+	delete(h.pending, correlationID)
+	publisher := h.publisher
+	h.lock.Unlock()
+
+	logFields := watermill.LogFields{"command": command.cloudMessage.CommandName, "correlation_id": correlationID}
+	if publisher == nil {
+		h.logger.Error("cannot send command reply timeout", errors.New("no cloud publisher"), logFields)
+		return
+	}
+	errorMessage := fmt.Sprintf("no reply from the device within %s", command.timeout)
+	var outgoingMessage *message.Message
+	var err error
+	if command.requestID != "" {
+		outgoingMessage, err = createMethodResponse(command.requestID, http.StatusRequestTimeout, &methodErrorPayload{Error: errorMessage})
+	} else {
+		replyMessage := h.newReplyMessage(command.cloudMessage, http.StatusRequestTimeout)
+		replyMessage.Error = errorMessage
+		outgoingMessage, err = h.createOutgoingMessage(replyMessage)
+	}
+	if err == nil {
+		err = publisher.Publish(connector.TopicEmpty, outgoingMessage)
+	}
+	if err != nil {
+		h.logger.Error("cannot send command reply timeout", err, logFields)
+	}
+}
+
+func (h *thingsReplyHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	dittoMessage := &protocol.Envelope{}
+	if err := json.Unmarshal(msg.Payload, dittoMessage); err != nil {
+		return nil, errors.Wrap(err, "cannot deserialize Ditto response")
+	}
+	var correlationID string
+	if dittoMessage.Headers != nil {
+		correlationID = dittoMessage.Headers.CorrelationID()
+	}
+	if correlationID == "" {
+		return nil, errors.New("missing correlation ID of Ditto response")
+	}
+	command := h.take(correlationID)
+	if command == nil {
+		// e.g. a response to a command without reply timeout or a late response, which is not an error of the device
+		h.logger.Debug("dropping Ditto response without command awaiting a reply", watermill.LogFields{"correlation_id": correlationID})
+		return nil, nil
+	}
+	status := dittoMessage.Status
+	if status == 0 {
+		status = parseResponseStatus(msg)
+	}
+	var payload interface{}
+	var err error
+	if dittoMessage.Value != nil {
+		if payload, err = h.convertReplyPayload(command.cloudMessage.CommandName, dittoMessage.Value); err != nil {
+			return nil, err
+		}
+	}
+	var outgoingMessage *message.Message
+	if command.requestID != "" {
+		outgoingMessage, err = createMethodResponse(command.requestID, status, payload)
+	} else {
+		replyMessage := h.newReplyMessage(command.cloudMessage, status)
+		replyMessage.Payload = payload
+		outgoingMessage, err = h.createOutgoingMessage(replyMessage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*message.Message{outgoingMessage}, nil
+}
+
+// convertReplyPayload encodes the response value with the reply proto message of the command mapping, if set.
+func (h *thingsReplyHandler) convertReplyPayload(commandName string, value interface{}) (interface{}, error) {
+	snapshot := h.snapshots.Load()
+	mapperConfig := snapshot.Config
+	if mapperConfig == nil {
+		return value, nil
+	}
+	messageMapping, err := mapperConfig.GetCommandMessageMapping(commandName)
+	if err != nil || messageMapping.ReplyProtoMessage == "" {
+		return value, nil
+	}
+	jsonPayload, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize Ditto response value")
+	}
+	return snapshot.Marshaller.MarshalCommandReply(commandName, jsonPayload)
+}
+
+func (h *thingsReplyHandler) newReplyMessage(cloudMessage *routingmessage.CloudMessage, status int) *routingmessage.CommandReplyMessage {
+	return &routingmessage.CommandReplyMessage{
+		CommandName:     cloudMessage.CommandName,
+		ApplicationID:   cloudMessage.ApplicationID,
+		CorrelationID:   cloudMessage.CorrelationID,
+		Status:          status,
+		Timestamp:       time.Now().UnixNano() / int64(time.Millisecond),
+		EnvelopeVersion: replyEnvelopeVersion,
+		PayloadVersion:  replyPayloadVersion,
+	}
+}
+
+func (h *thingsReplyHandler) createOutgoingMessage(replyMessage *routingmessage.CommandReplyMessage) (*message.Message, error) {
+	outgoingPayload, err := json.Marshal(replyMessage)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize command reply")
+	}
+	msgID := watermill.NewUUID()
+	outgoingMessage := message.NewMessage(msgID, outgoingPayload)
+	outgoingTopic := routing.CreateTelemetryTopic(h.connInfo.DeviceID, msgID)
+	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
+	return outgoingMessage, nil
+}
+
+// parseResponseStatus returns the status from the local topic of a Ditto response, i.e. its last level, or 200 if
+// the topic does not end with a status.
+func parseResponseStatus(msg *message.Message) int {
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	if status, err := strconv.Atoi(topic[strings.LastIndex(topic, "/")+1:]); err == nil {
+		return status
+	}
+	return http.StatusOK
+}
+
+func (h *thingsReplyHandler) Name() string {
+	return commandReplyHandlerName
+}
+
+func (h *thingsReplyHandler) Topics() string {
+	return responseTopics
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package command
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type replyPublisher struct {
+	messages chan *message.Message
+}
+
+func (p *replyPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.messages <- msg
+	}
+	return nil
+}
+
+func (p *replyPublisher) Close() error {
+	return nil
+}
+
+func TestThingsReplyHandler(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	assert.Equal(t, commandReplyHandlerName, handler.Name())
+	assert.Equal(t, "command//+/res/#", handler.Topics())
+}
+
+func TestCommandReply(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	handler.Track(&routingmessage.CloudMessage{CommandName: "simple.message", ApplicationID: "app1", CorrelationID: "cId-1"}, time.Minute)
+
+	replies, err := handler.HandleMessage(createDittoResponse(`{
+		"topic": "azure.edge/hub:dummy-device:edge:containers/things/live/messages/send",
+		"headers": {"correlation-id": "cId-1"},
+		"path": "/features/ContainerOrchestrator/outbox/messages/send",
+		"value": {"text": "done"},
+		"status": 200
+	}`, "command//azure.edge:hub:dummy-device:edge:containers/res/cId-1/200"))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+
+	topic, _ := connector.TopicFromCtx(replies[0].Context())
+	assert.Equal(t, "devices/dummy-device/messages/events/%24.ce=utf-8&%24.ct=application%2Fjson&%24.mid="+replies[0].UUID, topic)
+	reply := &routingmessage.CommandReplyMessage{}
+	require.NoError(t, json.Unmarshal(replies[0].Payload, reply))
+	assert.Equal(t, "simple.message", reply.CommandName)
+	assert.Equal(t, "app1", reply.ApplicationID)
+	assert.Equal(t, "cId-1", reply.CorrelationID)
+	assert.Equal(t, 200, reply.Status)
+	assert.Equal(t, "2.0", reply.EnvelopeVersion)
+	assert.Equal(t, map[string]interface{}{"text": "done"}, reply.Payload)
+	assert.Empty(t, reply.Error)
+
+	// the command is replied only once
+	replies, err = handler.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "cId-1"}, "status": 200}`, ""))
+	assert.NoError(t, err)
+	assert.Empty(t, replies)
+}
+
+func TestCommandReplyStatusFromTopic(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	handler.Track(&routingmessage.CloudMessage{CommandName: "simple.message", CorrelationID: "cId-2"}, time.Minute)
+
+	replies, err := handler.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "cId-2"}}`,
+		"command//azure.edge:hub:dummy-device:edge:containers/res/cId-2/204"))
+	require.NoError(t, err)
+	reply := &routingmessage.CommandReplyMessage{}
+	require.NoError(t, json.Unmarshal(replies[0].Payload, reply))
+	assert.Equal(t, 204, reply.Status)
+	assert.Nil(t, reply.Payload)
+}
+
+func TestCommandReplyProtobuf(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	handler.Track(&routingmessage.CloudMessage{CommandName: "message.with.reply", CorrelationID: "cId-3"}, time.Minute)
+
+	replies, err := handler.HandleMessage(createDittoResponse(`{
+		"headers": {"correlation-id": "cId-3"},
+		"value": {"message_id": "1", "text": "done"},
+		"status": 200
+	}`, ""))
+	require.NoError(t, err)
+	reply := &routingmessage.CommandReplyMessage{}
+	require.NoError(t, json.Unmarshal(replies[0].Payload, reply))
+	protobufPayload, err := base64.StdEncoding.DecodeString(reply.Payload.(string))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x0a, 0x01, '1', 0x12, 0x04, 'd', 'o', 'n', 'e'}, protobufPayload)
+}
+
+func TestInvalidCommandReply(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	tests := []struct {
+		payload string
+		err     string
+	}{
+		{`{"headers": `, "cannot deserialize Ditto response: unexpected end of JSON input"},
+		{`{"headers": {}, "status": 200}`, "missing correlation ID of Ditto response"},
+		{`{"status": 200}`, "missing correlation ID of Ditto response"},
+	}
+	for _, test := range tests {
+		_, err := handler.HandleMessage(createDittoResponse(test.payload, ""))
+		assert.EqualError(t, err, test.err, test.payload)
+	}
+}
+
+func TestUnawaitedCommandReply(t *testing.T) {
+	logger := watermill.NewCaptureLogger()
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
+	require.NoError(t, err)
+	handler := CreateThingsReplyHandler(mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false), logger)
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+
+	replies, err := handler.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "unknown"}, "status": 200}`, ""))
+	require.NoError(t, err)
+	assert.Empty(t, replies)
+	assert.True(t, logger.Has(watermill.CapturedMessage{
+		Level:  watermill.DebugLogLevel,
+		Fields: watermill.LogFields{"correlation_id": "unknown"},
+		Msg:    "dropping Ditto response without command awaiting a reply",
+	}))
+}
+
+func TestCommandReplyTimeout(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	publisher := &replyPublisher{messages: make(chan *message.Message, 1)}
+	handler.SetCloudPublisher(publisher)
+	handler.Track(&routingmessage.CloudMessage{CommandName: "simple.message", ApplicationID: "app1", CorrelationID: "cId-4"}, 10*time.Millisecond)
+
+	select {
+	case msg := <-publisher.messages:
+		reply := &routingmessage.CommandReplyMessage{}
+		require.NoError(t, json.Unmarshal(msg.Payload, reply))
+		assert.Equal(t, "cId-4", reply.CorrelationID)
+		assert.Equal(t, 408, reply.Status)
+		assert.Equal(t, "no reply from the device within 10ms", reply.Error)
+	case <-time.After(time.Second):
+		require.Fail(t, "no timeout reply")
+	}
+
+	// a late response is not forwarded after the timeout reply
+	replies, err := handler.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "cId-4"}, "status": 200}`, ""))
+	assert.NoError(t, err)
+	assert.Empty(t, replies)
+}
+
+func TestCommandReplyBeforeTimeout(t *testing.T) {
+	handler := createThingsReplyHandler(t)
+	publisher := &replyPublisher{messages: make(chan *message.Message, 1)}
+	handler.SetCloudPublisher(publisher)
+	handler.Track(&routingmessage.CloudMessage{CommandName: "simple.message", CorrelationID: "cId-5"}, 20*time.Millisecond)
+
+	_, err := handler.HandleMessage(createDittoResponse(`{"headers": {"correlation-id": "cId-5"}, "status": 200}`, ""))
+	require.NoError(t, err)
+	select {
+	case <-publisher.messages:
+		assert.Fail(t, "unexpected timeout reply")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCommandTrackedForReply(t *testing.T) {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
+	require.NoError(t, err)
+	replies := createThingsReplyHandler(t)
+	publisher := &replyPublisher{messages: make(chan *message.Message, 1)}
+	replies.SetCloudPublisher(publisher)
+	handler := CreateThingsCommandHandler(mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false), replies)
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+
+	// only the commands with reply timeout and correlation ID are tracked
+	_, err = handler.HandleMessage(createWatermillMessageForC2D([]byte(`{"appId": "app1", "cmdName": "message.with.reply", "eVer": "2.0", "p": "EgFh"}`)))
+	require.NoError(t, err)
+	_, err = handler.HandleMessage(createWatermillMessageForC2D([]byte(`{"appId": "app1", "cmdName": "message.no.proto.file", "cId": "cId-6", "eVer": "2.0", "p": {"text": "a"}}`)))
+	require.NoError(t, err)
+	_, err = handler.HandleMessage(createWatermillMessageForC2D([]byte(`{"appId": "app1", "cmdName": "message.with.reply", "cId": "cId-7", "eVer": "2.0", "p": "EgFh"}`)))
+	require.NoError(t, err)
+
+	select {
+	case msg := <-publisher.messages:
+		reply := &routingmessage.CommandReplyMessage{}
+		require.NoError(t, json.Unmarshal(msg.Payload, reply))
+		assert.Equal(t, "message.with.reply", reply.CommandName)
+		assert.Equal(t, "cId-7", reply.CorrelationID)
+		assert.Equal(t, 408, reply.Status)
+	case <-time.After(time.Second):
+		require.Fail(t, "no timeout reply")
+	}
+	select {
+	case msg := <-publisher.messages:
+		assert.Fail(t, "unexpected timeout reply", string(msg.Payload))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func createDittoResponse(payload, topic string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+	return msg
+}
+
+func createThingsReplyHandler(t *testing.T) ReplyHandler {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
+	require.NoError(t, err)
+	handler := CreateThingsReplyHandler(mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false), watermill.NopLogger{})
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+	return handler
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+)
+
+// serializeFunc creates the D2C message of a mapping with the mapped value.
+type serializeFunc func(telemetryMatch *mapperconfig.TelemetryMappingMatch, dittoValue []byte, isConverted bool, value interface{}, correlationID string) (*message.Message, error)
+
+// fieldAggregate is the aggregate of the numeric values of a field within a window.
+type fieldAggregate struct {
+	min, max, sum, last float64
+	count               int
+}
+
+// aggregateWindow is a tumbling window of a mapping and a thing, the timer sends the aggregate when the window ends.
+type aggregateWindow struct {
+	telemetryMatch *mapperconfig.TelemetryMappingMatch
+	value          interface{}
+	correlationID  string
+	fields         map[string]*fieldAggregate
+	timer          *time.Timer
+}
+
+// aggregator aggregates the mapped values of the aggregated telemetry mappings, there is a window per message type,
+// sub type and thing. It is safe for concurrent use, the lock guards the windows and the publisher of the aggregates.
+type aggregator struct {
+	logger    watermill.LoggerAdapter
+	serialize serializeFunc
+
+	lock      sync.Mutex
+	windows   map[string]*aggregateWindow
+	publisher message.Publisher
+}
+
+func newAggregator(logger watermill.LoggerAdapter, serialize serializeFunc) *aggregator {
+	return &aggregator{
+		logger:    logger,
+		serialize: serialize,
+		windows:   map[string]*aggregateWindow{},
+	}
+}
+
+func (a *aggregator) setPublisher(publisher message.Publisher) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.publisher = publisher
+}
+
+// add aggregates the mapped value of a telemetry message of the thing in the current window of its mapping, the window
+// starts with its first value. The last mapped value and correlation ID of the window are sent with the aggregate.
+func (a *aggregator) add(thingID string, telemetryMatch *mapperconfig.TelemetryMappingMatch, mappedValue []byte, correlationID string) error {
+	aggregation := telemetryMatch.Mapping.Aggregation
+	window, err := aggregation.GetWindow()
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(mappedValue, &value); err != nil {
+		return errors.Wrap(err, "cannot aggregate mapped value")
+	}
+	key := fmt.Sprintf("%d/%s/%s", telemetryMatch.MessageType, telemetryMatch.MessageSubType, thingID)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	current := a.windows[key]
+	if current == nil {
+		current = &aggregateWindow{telemetryMatch: telemetryMatch, fields: map[string]*fieldAggregate{}}
+		a.windows[key] = current
+		current.timer = time.AfterFunc(window, func() {
+			a.flush(key, current)
+		})
+	}
+	current.value = value
+	current.correlationID = correlationID
+	for field := range aggregation.Fields {
+		if parent, name := lookupField(value, field, false); parent != nil {
+			if number, ok := parent[name].(float64); ok {
+				current.aggregate(field, number)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *aggregateWindow) aggregate(field string, number float64) {
+	fieldValues, ok := w.fields[field]
+	if !ok {
+		w.fields[field] = &fieldAggregate{min: number, max: number, sum: number, last: number, count: 1}
+		return
+	}
+	fieldValues.min = math.Min(fieldValues.min, number)
+	fieldValues.max = math.Max(fieldValues.max, number)
+	fieldValues.sum += number
+	fieldValues.last = number
+	fieldValues.count++
+}
+
+// flushAll sends the aggregates of the open windows right away, e.g. before the publisher is closed on shutdown.
+func (a *aggregator) flushAll() {
+	a.lock.Lock()
+	windows := make(map[string]*aggregateWindow, len(a.windows))
+	for key, window := range a.windows {
+		window.timer.Stop()
+		windows[key] = window
+	}
+	a.lock.Unlock()
+
+	for key, window := range windows {
+		a.flush(key, window)
+	}
+}
+
+// flush sends the aggregate of a window when it ends.
+func (a *aggregator) flush(key string, window *aggregateWindow) {
+	a.lock.Lock()
+	if a.windows[key] != window {
+		a.lock.Unlock()
+		return
+	}
+	delete(a.windows, key)
+	publisher := a.publisher
+	a.lock.Unlock()
+
+	logFields := watermill.LogFields{
+		"message_type":     window.telemetryMatch.MessageType,
+		"message_sub_type": window.telemetryMatch.MessageSubType,
+	}
+	if publisher == nil {
+		a.logger.Error("cannot send telemetry aggregate", errors.New("no cloud publisher"), logFields)
+		return
+	}
+	outgoingMessage, err := a.createAggregateMessage(window)
+	if err == nil {
+		err = publisher.Publish(connector.TopicEmpty, outgoingMessage)
+	}
+	if err != nil {
+		a.logger.Error("cannot send telemetry aggregate", err, logFields)
+	}
+}
+
+// createAggregateMessage returns the D2C message with the last mapped value of the window, in which each aggregated
+// field is replaced with an object of the aggregate functions of the field, e.g. {"min": 1, "max": 3}.
+// The aggregated fields without numeric values within the window are left out.
+func (a *aggregator) createAggregateMessage(window *aggregateWindow) (*message.Message, error) {
+	value := window.value
+	for field, functions := range window.telemetryMatch.Mapping.Aggregation.Fields {
+		fieldValues, ok := window.fields[field]
+		parent, name := lookupField(value, field, ok)
+		if parent == nil {
+			continue
+		}
+		if !ok {
+			delete(parent, name)
+			continue
+		}
+		aggregates := map[string]interface{}{}
+		for _, function := range functions {
+			switch function {
+			case mapperconfig.AggregateMin:
+				aggregates[function] = fieldValues.min
+			case mapperconfig.AggregateMax:
+				aggregates[function] = fieldValues.max
+			case mapperconfig.AggregateAvg:
+				aggregates[function] = fieldValues.sum / float64(fieldValues.count)
+			case mapperconfig.AggregateLast:
+				aggregates[function] = fieldValues.last
+			case mapperconfig.AggregateCount:
+				aggregates[function] = fieldValues.count
+			}
+		}
+		parent[name] = aggregates
+	}
+	aggregatedValue, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize telemetry aggregate")
+	}
+	return a.serialize(window.telemetryMatch, aggregatedValue, false, value, window.correlationID)
+}
+
+// lookupField returns the object that contains a dot separated field of the mapped value and the name of the field in
+// it, nil if the field cannot be found. The missing objects on the path of the field are added if create is set.
+func lookupField(value interface{}, field string, create bool) (map[string]interface{}, string) {
+	names := strings.Split(field, ".")
+	parent, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ""
+	}
+	for _, name := range names[:len(names)-1] {
+		child, ok := parent[name].(map[string]interface{})
+		if !ok {
+			if !create || parent[name] != nil {
+				return nil, ""
+			}
+			child = map[string]interface{}{}
+			parent[name] = child
+		}
+		parent = child
+	}
+	return parent, names[len(names)-1]
+}
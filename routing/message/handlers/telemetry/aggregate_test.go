@@ -0,0 +1,91 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateWindow(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	publisher := &batchPublisher{messages: make(chan *message.Message, 2)}
+	handler.(*thingsTelemetryHandler).SetCloudPublisher(publisher)
+
+	values := []string{
+		`{"temperature": 20, "voltage": 12.1, "state": "starting", "correlationId": "1"}`,
+		`{"temperature": 22, "state": "running", "correlationId": "2"}`,
+		`{"temperature": 27, "voltage": 11.9, "state": "running", "correlationId": "3"}`,
+	}
+	for _, value := range values {
+		outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage("dummy-device", "aggregate.window", value))
+		require.NoError(t, err)
+		assert.Empty(t, outgoingMessages)
+	}
+	outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage("other-device", "aggregate.window", `{"voltage": 5}`))
+	require.NoError(t, err)
+	assert.Empty(t, outgoingMessages)
+
+	aggregates := map[string]*routingmessage.TelemetryMessage{}
+	for len(aggregates) < 2 {
+		select {
+		case outgoingMessage := <-publisher.messages:
+			d2cMessage := &routingmessage.TelemetryMessage{}
+			require.NoError(t, json.Unmarshal(outgoingMessage.Payload, d2cMessage))
+			aggregates[d2cMessage.CorrelationID] = d2cMessage
+		case <-time.After(time.Second):
+			require.FailNow(t, "no aggregate sent at the end of the window")
+		}
+	}
+
+	require.Contains(t, aggregates, "3")
+	assert.Equal(t, "aggregate.window", aggregates["3"].MessageSubType)
+	assert.Equal(t, map[string]interface{}{
+		"temperature": map[string]interface{}{"min": float64(20), "max": float64(27), "avg": float64(23), "count": float64(3)},
+		"state":       "running",
+		"status":      map[string]interface{}{"voltage": map[string]interface{}{"last": 11.9}},
+	}, aggregates["3"].Payload)
+
+	// the aggregated fields without values are left out
+	require.Contains(t, aggregates, "filter")
+	assert.Equal(t, map[string]interface{}{
+		"status": map[string]interface{}{"voltage": map[string]interface{}{"last": float64(5)}},
+	}, aggregates["filter"].Payload)
+}
+
+func TestAggregateFlush(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	publisher := &batchPublisher{messages: make(chan *message.Message, 1)}
+	handler.(*thingsTelemetryHandler).SetCloudPublisher(publisher)
+
+	outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage("dummy-device", "aggregate.window", `{"temperature": 20}`))
+	require.NoError(t, err)
+	assert.Empty(t, outgoingMessages)
+
+	// the open window is sent right away and not again at its end
+	handler.(*thingsTelemetryHandler).Flush()
+	require.Len(t, publisher.messages, 1)
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal((<-publisher.messages).Payload, d2cMessage))
+	assert.Equal(t, "aggregate.window", d2cMessage.MessageSubType)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, publisher.messages)
+}
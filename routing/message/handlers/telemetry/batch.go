@@ -0,0 +1,229 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+)
+
+const (
+	propertyContentEncoding = "$.ce"
+	contentTypeJSON         = "application/json"
+	contentEncodingUTF8     = "utf-8"
+	contentEncodingGzip     = "gzip"
+	contentEncodingDeflate  = "deflate"
+)
+
+// telemetryBatch is a batch of serialized D2C messages of a mapping, the timer sends the batch when its window ends.
+type telemetryBatch struct {
+	deviceID       string
+	telemetryMatch *mapperconfig.TelemetryMappingMatch
+	messages       []json.RawMessage
+	size           int
+	timer          *time.Timer
+}
+
+// batcher collects the D2C messages of the batched telemetry mappings, there is a batch per message type and sub type.
+// It is safe for concurrent use, the lock guards the batches and the publisher of the batches whose window ended.
+type batcher struct {
+	logger watermill.LoggerAdapter
+
+	lock      sync.Mutex
+	batches   map[string]*telemetryBatch
+	publisher message.Publisher
+}
+
+func newBatcher(logger watermill.LoggerAdapter) *batcher {
+	return &batcher{
+		logger:  logger,
+		batches: map[string]*telemetryBatch{},
+	}
+}
+
+func (b *batcher) setPublisher(publisher message.Publisher) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.publisher = publisher
+}
+
+// add adds a serialized D2C message to the batch of its mapping and returns the batches that are ready to be sent,
+// i.e. the current batch if the message exceeds its maximal size and the batch with the message if it is full.
+func (b *batcher) add(deviceID string, telemetryMatch *mapperconfig.TelemetryMappingMatch, d2cMessage []byte) ([]*message.Message, error) {
+	batchMapping := telemetryMatch.Mapping.Batch
+	window, err := batchMapping.GetWindow()
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%d/%s", telemetryMatch.MessageType, telemetryMatch.MessageSubType)
+	// the size of the JSON array of the D2C messages, with the separating comma of the message
+	size := len(d2cMessage) + 1
+
+	b.lock.Lock()
+	var ready []*telemetryBatch
+	batch := b.batches[key]
+	if batch != nil && batchMapping.MaxSize > 0 && batch.size+size > batchMapping.MaxSize {
+		ready = append(ready, b.take(key))
+		batch = nil
+	}
+	if batch == nil {
+		batch = &telemetryBatch{deviceID: deviceID, telemetryMatch: telemetryMatch, size: 1}
+		b.batches[key] = batch
+		batch.timer = time.AfterFunc(window, func() {
+			b.flush(key, batch)
+		})
+	}
+	batch.messages = append(batch.messages, d2cMessage)
+	batch.size += size
+	if (batchMapping.MaxMessages > 0 && len(batch.messages) >= batchMapping.MaxMessages) ||
+		(batchMapping.MaxSize > 0 && batch.size >= batchMapping.MaxSize) {
+		ready = append(ready, b.take(key))
+	}
+	b.lock.Unlock()
+
+	var outgoingMessages []*message.Message
+	for _, readyBatch := range ready {
+		outgoingMessage, err := createBatchMessage(readyBatch)
+		if err != nil {
+			return nil, err
+		}
+		outgoingMessages = append(outgoingMessages, outgoingMessage)
+	}
+	return outgoingMessages, nil
+}
+
+// take removes the batch of a mapping and stops its timer, the lock has to be held.
+func (b *batcher) take(key string) *telemetryBatch {
+	batch := b.batches[key]
+	delete(b.batches, key)
+	batch.timer.Stop()
+	return batch
+}
+
+// flushAll sends the open batches right away, e.g. before the publisher is closed on shutdown.
+func (b *batcher) flushAll() {
+	b.lock.Lock()
+	batches := make(map[string]*telemetryBatch, len(b.batches))
+	for key, batch := range b.batches {
+		batch.timer.Stop()
+		batches[key] = batch
+	}
+	b.lock.Unlock()
+
+	for key, batch := range batches {
+		b.flush(key, batch)
+	}
+}
+
+// flush sends a batch when its window ends, unless it was already sent because it was full.
+func (b *batcher) flush(key string, batch *telemetryBatch) {
+	b.lock.Lock()
+	if b.batches[key] != batch {
+		b.lock.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	publisher := b.publisher
+	b.lock.Unlock()
+
+	logFields := watermill.LogFields{
+		"message_type":     batch.telemetryMatch.MessageType,
+		"message_sub_type": batch.telemetryMatch.MessageSubType,
+		"messages":         len(batch.messages),
+	}
+	if publisher == nil {
+		b.logger.Error("cannot send telemetry batch", errors.New("no cloud publisher"), logFields)
+		return
+	}
+	outgoingMessage, err := createBatchMessage(batch)
+	if err == nil {
+		err = publisher.Publish(connector.TopicEmpty, outgoingMessage)
+	}
+	if err != nil {
+		b.logger.Error("cannot send telemetry batch", err, logFields)
+	}
+}
+
+// createBatchMessage returns the D2C message with the JSON array of the D2C messages of a batch, compressed with the
+// compression of the mapping, which determines the content type of the message.
+func createBatchMessage(batch *telemetryBatch) (*message.Message, error) {
+	payload, err := json.Marshal(batch.messages)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize telemetry batch")
+	}
+	compression := batch.telemetryMatch.Mapping.Batch.Compression
+	if compression != "" {
+		if payload, err = compress(compression, payload); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cannot compress telemetry batch with %s", compression))
+		}
+	}
+	msgID := watermill.NewUUID()
+	outgoingMessage := message.NewMessage(msgID, payload)
+	outgoingTopic := createBatchTelemetryTopic(batch.deviceID, msgID, compression)
+	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
+	setDeliveryToCtx(outgoingMessage, batch.telemetryMatch.Mapping)
+	return outgoingMessage, nil
+}
+
+func compress(compression string, payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	if compression == mapperconfig.CompressionGzip {
+		writer = gzip.NewWriter(&buffer)
+	} else if compression == mapperconfig.CompressionDeflate {
+		writer = zlib.NewWriter(&buffer)
+	} else {
+		return nil, errors.New(fmt.Sprintf("unsupported compression '%s'", compression))
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// createBatchTelemetryTopic constructs the MQTT topic for sending a batch of D2C messages to an Azure IoT Hub device.
+// The batch is JSON, its content encoding is its compression, if compressed, and UTF-8 otherwise.
+func createBatchTelemetryTopic(deviceID, msgID, compression string) string {
+	msgProps := url.Values{}
+	msgProps.Set(propertyContentType, contentTypeJSON)
+	switch compression {
+	case mapperconfig.CompressionGzip:
+		msgProps.Set(propertyContentEncoding, contentEncodingGzip)
+	case mapperconfig.CompressionDeflate:
+		msgProps.Set(propertyContentEncoding, contentEncodingDeflate)
+	default:
+		msgProps.Set(propertyContentEncoding, contentEncodingUTF8)
+	}
+	if msgID != "" {
+		msgProps.Set(propertyMessageID, msgID)
+	}
+	return fmt.Sprintf(remoteTelemetryTopicFmt, deviceID, msgProps.Encode())
+}
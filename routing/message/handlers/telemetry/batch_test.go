@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const batchDittoMessage = `{
+	"topic": "tenant1/dummy-device:edge:containers/things/live/messages/%[1]s",
+	"path": "/features/ContainerOrchestator/outbox/messages/%[1]s",
+	"headers": {
+		"content-type": "application/json",
+		"correlation-id": "%[2]d"
+	},
+	"value": {
+		"index": %[2]d
+	}
+}`
+
+type batchPublisher struct {
+	messages chan *message.Message
+}
+
+func (p *batchPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.messages <- msg
+	}
+	return nil
+}
+
+func (p *batchPublisher) Close() error {
+	return nil
+}
+
+func TestBatchMaxMessages(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+
+	batchMessages, err := handler.HandleMessage(createBatchDittoMessage("batch.count", 1))
+	require.NoError(t, err)
+	assert.Empty(t, batchMessages)
+
+	batchMessages, err = handler.HandleMessage(createBatchDittoMessage("batch.count", 2))
+	require.NoError(t, err)
+	require.Len(t, batchMessages, 1)
+	d2cMessages := parseBatch(t, batchMessages[0].Payload)
+	require.Len(t, d2cMessages, 2)
+	for i, d2cMessage := range d2cMessages {
+		assert.Equal(t, "batch.count", d2cMessage.MessageSubType)
+		assert.Equal(t, fmt.Sprint(i+1), d2cMessage.CorrelationID)
+		assert.Equal(t, map[string]interface{}{"index": float64(i + 1)}, d2cMessage.Payload)
+	}
+	topic, _ := connector.TopicFromCtx(batchMessages[0].Context())
+	assert.Equal(t, "devices/dummy-device/messages/events/%24.ce=utf-8&%24.ct=application%2Fjson&%24.mid="+batchMessages[0].UUID, topic)
+
+	batchMessages, err = handler.HandleMessage(createBatchDittoMessage("batch.count", 3))
+	require.NoError(t, err)
+	assert.Empty(t, batchMessages)
+}
+
+func TestBatchWindow(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	publisher := &batchPublisher{messages: make(chan *message.Message, 1)}
+	handler.(*thingsTelemetryHandler).SetCloudPublisher(publisher)
+
+	for i := 1; i <= 3; i++ {
+		batchMessages, err := handler.HandleMessage(createBatchDittoMessage("batch.window", i))
+		require.NoError(t, err)
+		assert.Empty(t, batchMessages)
+	}
+
+	select {
+	case batchMessage := <-publisher.messages:
+		reader, err := gzip.NewReader(bytes.NewReader(batchMessage.Payload))
+		require.NoError(t, err)
+		payload, err := ioutil.ReadAll(reader)
+		require.NoError(t, err)
+		d2cMessages := parseBatch(t, payload)
+		require.Len(t, d2cMessages, 3)
+		assert.Equal(t, "3", d2cMessages[2].CorrelationID)
+		topic, _ := connector.TopicFromCtx(batchMessage.Context())
+		assert.Equal(t, "devices/dummy-device/messages/events/%24.ce=gzip&%24.ct=application%2Fjson&%24.mid="+batchMessage.UUID, topic)
+	case <-time.After(time.Second):
+		require.Fail(t, "no batch sent at the end of the window")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	publisher := &batchPublisher{messages: make(chan *message.Message, 1)}
+	handler.(*thingsTelemetryHandler).SetCloudPublisher(publisher)
+
+	outgoingMessages, err := handler.HandleMessage(createBatchDittoMessage("batch.count", 1))
+	require.NoError(t, err)
+	assert.Empty(t, outgoingMessages)
+
+	// the open batch is sent right away and not again at the end of its window
+	handler.(*thingsTelemetryHandler).Flush()
+	require.Len(t, publisher.messages, 1)
+	d2cMessages := parseBatch(t, (<-publisher.messages).Payload)
+	require.Len(t, d2cMessages, 1)
+	assert.Equal(t, "batch.count", d2cMessages[0].MessageSubType)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, publisher.messages)
+}
+
+func TestBatchMaxSize(t *testing.T) {
+	batches := newBatcher(watermill.NopLogger{})
+	telemetryMatch := &mapperconfig.TelemetryMappingMatch{
+		MessageType:    1,
+		MessageSubType: "size",
+		Mapping: &mapperconfig.TelemetryMessageMapping{
+			Batch: &mapperconfig.TelemetryBatch{Window: "1h", MaxSize: 16, Compression: mapperconfig.CompressionDeflate},
+		},
+	}
+
+	// each message takes its size and a separator of the array
+	batchMessages, err := batches.add("dummy-device", telemetryMatch, []byte(`"abc"`))
+	require.NoError(t, err)
+	assert.Empty(t, batchMessages)
+	batchMessages, err = batches.add("dummy-device", telemetryMatch, []byte(`"defgh"`))
+	require.NoError(t, err)
+	assert.Empty(t, batchMessages)
+	batchMessages, err = batches.add("dummy-device", telemetryMatch, []byte(`"ijk"`))
+	require.NoError(t, err)
+	require.Len(t, batchMessages, 1)
+	assert.Equal(t, `["abc","defgh"]`, inflate(t, batchMessages[0].Payload))
+
+	batchMessages, err = batches.add("dummy-device", telemetryMatch, []byte(`"lmnopq"`))
+	require.NoError(t, err)
+	require.Len(t, batchMessages, 1)
+	assert.Equal(t, `["ijk","lmnopq"]`, inflate(t, batchMessages[0].Payload))
+}
+
+func createBatchDittoMessage(subType string, index int) *message.Message {
+	return createWatermillMessageForD2C([]byte(fmt.Sprintf(batchDittoMessage, subType, index)))
+}
+
+func parseBatch(t *testing.T, payload []byte) []*routingmessage.TelemetryMessage {
+	d2cMessages := []*routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(payload, &d2cMessages))
+	return d2cMessages
+}
+
+func inflate(t *testing.T, payload []byte) string {
+	reader, err := zlib.NewReader(bytes.NewReader(payload))
+	require.NoError(t, err)
+	inflated, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return string(inflated)
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+)
+
+// tokenBucket is the state of the rate limit of a mapping, the tokens are refilled on each use.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// sample is the state of the sampling of a mapping and thing, i.e. the messages skipped since the last sample and
+// the time the last sample was taken.
+type sample struct {
+	skipped int
+	taken   time.Time
+}
+
+// filter suppresses the telemetry messages of the mappings with sampling, a rate limit, a change-only or a deadband
+// filter. The rate limits are per mapping, the samples and the last sent values are per mapping and thing. It is safe
+// for concurrent use.
+type filter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	samples map[string]*sample
+	values  map[string]interface{}
+}
+
+func newFilter() *filter {
+	return &filter{
+		buckets: map[string]*tokenBucket{},
+		samples: map[string]*sample{},
+		values:  map[string]interface{}{},
+	}
+}
+
+// allow returns true if the mapped value of a telemetry message of the thing has to be sent. The message is suppressed
+// if it is not taken as a sample of the thing, the value is suppressed if it did not change since the last sent value of
+// the thing, or if the rate limit of the mapping is exceeded, in which case the value is not remembered as sent.
+func (f *filter) allow(thingID string, telemetryMatch *mapperconfig.TelemetryMappingMatch, mappedValue []byte) (bool, error) {
+	telemetryMapping := telemetryMatch.Mapping
+	if !telemetryMapping.IsChangeFiltered() && telemetryMapping.RateLimit == nil && telemetryMapping.Sampling == nil {
+		return true, nil
+	}
+	mappingKey := fmt.Sprintf("%d/%s", telemetryMatch.MessageType, telemetryMatch.MessageSubType)
+	valueKey := mappingKey + "/" + thingID
+
+	var value interface{}
+	if telemetryMapping.IsChangeFiltered() {
+		if err := json.Unmarshal(mappedValue, &value); err != nil {
+			return false, errors.Wrap(err, "cannot compare mapped value")
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if telemetryMapping.Sampling != nil {
+		interval, err := telemetryMapping.Sampling.GetInterval()
+		if err != nil {
+			return false, err
+		}
+		if !f.sample(valueKey, telemetryMapping.Sampling.Every, interval) {
+			return false, nil
+		}
+	}
+	if telemetryMapping.IsChangeFiltered() {
+		if last, ok := f.values[valueKey]; ok && !changed(last, value, "", telemetryMapping.Deadband) {
+			return false, nil
+		}
+	}
+	if telemetryMapping.RateLimit != nil {
+		rate, err := telemetryMapping.RateLimit.GetRate()
+		if err != nil {
+			return false, err
+		}
+		if !f.take(mappingKey, rate, float64(telemetryMapping.RateLimit.GetBurst())) {
+			return false, nil
+		}
+	}
+	if telemetryMapping.IsChangeFiltered() {
+		f.values[valueKey] = value
+	}
+	return true, nil
+}
+
+// sample returns true if the message of a mapping and thing is taken as a sample. The first message is a sample, then
+// the first one after at least every-1 skipped messages and the interval since the last sample.
+func (f *filter) sample(valueKey string, every int, interval time.Duration) bool {
+	now := time.Now()
+	state, ok := f.samples[valueKey]
+	if !ok {
+		f.samples[valueKey] = &sample{taken: now}
+		return true
+	}
+	state.skipped++
+	if state.skipped < every || now.Sub(state.taken) < interval {
+		return false
+	}
+	state.skipped = 0
+	state.taken = now
+	return true
+}
+
+// take takes a token from the bucket of a mapping, which is refilled with the rate per second up to the burst.
+func (f *filter) take(mappingKey string, rate, burst float64) bool {
+	now := time.Now()
+	bucket, ok := f.buckets[mappingKey]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		f.buckets[mappingKey] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// changed compares the mapped values field by field, the numeric fields with a deadband are changed only if they
+// differ by at least their deadband.
+func changed(last, value interface{}, path string, deadband map[string]float64) bool {
+	if band, ok := deadband[path]; ok {
+		lastNumber, lastOk := last.(float64)
+		number, numberOk := value.(float64)
+		if lastOk && numberOk {
+			return math.Abs(number-lastNumber) >= band
+		}
+	}
+	lastMap, lastOk := last.(map[string]interface{})
+	valueMap, valueOk := value.(map[string]interface{})
+	if !lastOk || !valueOk {
+		return !reflect.DeepEqual(last, value)
+	}
+	if len(lastMap) != len(valueMap) {
+		return true
+	}
+	for key, lastField := range lastMap {
+		field, ok := valueMap[key]
+		if !ok || changed(lastField, field, strings.TrimPrefix(path+"."+key, "."), deadband) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const filterDittoMessage = `{
+	"topic": "tenant1/%[1]s:edge:containers/things/live/messages/%[2]s",
+	"path": "/features/ContainerOrchestator/outbox/messages/%[2]s",
+	"headers": {
+		"content-type": "application/json",
+		"correlation-id": "filter"
+	},
+	"value": %[3]s
+}`
+
+func TestChangeOnlyAndDeadband(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+
+	sent := func(thing, value string) bool {
+		outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage(thing, "filter.changes", value))
+		require.NoError(t, err)
+		return len(outgoingMessages) == 1
+	}
+	assert.True(t, sent("dummy-device", `{"state": "running", "level": 50}`))
+	assert.False(t, sent("dummy-device", `{"state": "running", "level": 50}`), "unchanged value")
+	assert.False(t, sent("dummy-device", `{"state": "running", "level": 54}`), "within the deadband")
+	assert.True(t, sent("dummy-device", `{"state": "running", "level": 55}`))
+	assert.True(t, sent("dummy-device", `{"state": "stopped", "level": 56}`), "changed field without deadband")
+	assert.True(t, sent("dummy-device", `{"state": "stopped"}`), "removed field")
+	assert.True(t, sent("other-device", `{"state": "stopped"}`), "another thing")
+	assert.False(t, sent("other-device", `{"state": "stopped"}`))
+}
+
+func TestChangeOnlyWithGeneratedValues(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+
+	send := func(value string) map[string]interface{} {
+		outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage("dummy-device", "filter.generated", value))
+		require.NoError(t, err)
+		if len(outgoingMessages) == 0 {
+			return nil
+		}
+		require.Len(t, outgoingMessages, 1)
+		d2cMessage := &routingmessage.TelemetryMessage{}
+		require.NoError(t, json.Unmarshal(outgoingMessages[0].Payload, d2cMessage))
+		return d2cMessage.Payload.(map[string]interface{})
+	}
+
+	first := send(`{"state": "running"}`)
+	require.NotNil(t, first)
+	assert.Contains(t, first, "ts")
+	assert.Contains(t, first, "sent")
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		assert.Nil(t, send(`{"state": "running"}`), "unchanged value with new timestamp")
+	}
+	second := send(`{"state": "stopped"}`)
+	require.NotNil(t, second)
+	assert.Equal(t, first["seq"].(float64)+1, second["seq"], "the suppressed messages must not take sequence numbers")
+}
+
+func TestRateLimit(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+
+	for i := 0; i < 4; i++ {
+		outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage("dummy-device", "filter.rate", fmt.Sprint(i)))
+		require.NoError(t, err)
+		if i < 2 {
+			require.Len(t, outgoingMessages, 1)
+			d2cMessage := &routingmessage.TelemetryMessage{}
+			require.NoError(t, json.Unmarshal(outgoingMessages[0].Payload, d2cMessage))
+			assert.Equal(t, float64(i), d2cMessage.Payload)
+		} else {
+			assert.Empty(t, outgoingMessages, "message %d exceeds the rate limit", i)
+		}
+	}
+}
+
+func TestSamplingEvery(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+
+	sampled := map[string][]map[string]interface{}{}
+	for i := 0; i < 7; i++ {
+		for _, thing := range []string{"dummy-device", "other-device"} {
+			if thing == "other-device" && i%2 == 1 {
+				continue
+			}
+			value := fmt.Sprintf(`{"value": %d}`, i)
+			outgoingMessages, err := handler.HandleMessage(createFilterDittoMessage(thing, "filter.sampling", value))
+			require.NoError(t, err)
+			for _, outgoingMessage := range outgoingMessages {
+				d2cMessage := &routingmessage.TelemetryMessage{}
+				require.NoError(t, json.Unmarshal(outgoingMessage.Payload, d2cMessage))
+				sampled[thing] = append(sampled[thing], d2cMessage.Payload.(map[string]interface{}))
+			}
+		}
+	}
+	// every third message of each thing is sent, the skipped messages take no sequence numbers
+	require.Len(t, sampled["dummy-device"], 3)
+	for i, payload := range sampled["dummy-device"] {
+		assert.Equal(t, float64(i*3), payload["value"])
+	}
+	require.Len(t, sampled["other-device"], 2)
+	assert.Equal(t, float64(0), sampled["other-device"][0]["value"])
+	assert.Equal(t, float64(6), sampled["other-device"][1]["value"])
+	assert.Equal(t, sampled["dummy-device"][0]["seq"].(float64)+1, sampled["other-device"][0]["seq"])
+}
+
+func TestSamplingInterval(t *testing.T) {
+	filters := newFilter()
+	telemetryMatch := &mapperconfig.TelemetryMappingMatch{
+		MessageType:    1,
+		MessageSubType: "sampling",
+		Mapping: &mapperconfig.TelemetryMessageMapping{
+			Sampling: &mapperconfig.TelemetrySampling{Every: 2, Interval: "20ms"},
+		},
+	}
+
+	ok, err := filters.allow("thing", telemetryMatch, []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, ok, "the first message is a sample")
+	ok, err = filters.allow("other-thing", telemetryMatch, []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, ok, "the samples are taken per thing")
+	for i := 0; i < 3; i++ {
+		ok, err = filters.allow("thing", telemetryMatch, []byte("1"))
+		require.NoError(t, err)
+		assert.False(t, ok, "message %d within the interval", i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	ok, err = filters.allow("thing", telemetryMatch, []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, ok, "the first message after the interval is a sample")
+
+	// after the interval the next sample still waits for every second message
+	time.Sleep(20 * time.Millisecond)
+	ok, err = filters.allow("thing", telemetryMatch, []byte("1"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = filters.allow("thing", telemetryMatch, []byte("1"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	filters := newFilter()
+	telemetryMatch := &mapperconfig.TelemetryMappingMatch{
+		MessageType:    1,
+		MessageSubType: "refill",
+		Mapping: &mapperconfig.TelemetryMessageMapping{
+			RateLimit: &mapperconfig.TelemetryRateLimit{Messages: 1, Interval: "10ms", Burst: 2},
+		},
+	}
+
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		ok, err := filters.allow("thing", telemetryMatch, []byte("1"))
+		require.NoError(t, err)
+		if ok {
+			allowed++
+		}
+	}
+	assert.Equal(t, 2, allowed, "the burst is sent at once")
+	assert.Eventually(t, func() bool {
+		ok, err := filters.allow("thing", telemetryMatch, []byte("1"))
+		return err == nil && ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func createFilterDittoMessage(thing, subType, value string) *message.Message {
+	return createWatermillMessageForD2C([]byte(fmt.Sprintf(filterDittoMessage, thing, subType, value)))
+}
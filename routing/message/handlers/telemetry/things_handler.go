@@ -14,7 +14,9 @@ package telemetry
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eclipse-kanto/suite-connector/connector"
@@ -24,8 +26,12 @@ import (
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 
 	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
 	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
-	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/expression"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -38,29 +44,71 @@ const (
 	payloadVersion       = "1.0"
 	localTopics          = "event/#,e/#,telemetry/#,t/#"
 	telemetryHandlerName = "things_telemetry_handler"
+
+	remoteTelemetryTopicFmt = "devices/%s/messages/events/%s"
+	propertyMessageID       = "$.mid"
+	propertyContentType     = "$.ct"
+	contentTypeProtobuf     = "application/x-protobuf"
 )
 
 const (
-	ignoreValue             = "_"
-	funcTimestamp           = "timestamp()"
-	fieldMappingKeyDefault  = "default"
-	serializationJSONString = "jsonString"
+	ignoreValue                   = "_"
+	funcTimestamp                 = "timestamp()"
+	fieldMappingKeyDefault        = "default"
+	refMatchPrefix                = "$match."
+	templateEach                  = "$each"
+	templateValue                 = "$template"
+	serializationJSONString       = "jsonString"
+	serializationProtobufEnvelope = "protobufEnvelope"
+	serializationProtobufJSON     = "protobufJSON"
+	protoJSONFieldNamesProto      = "protoName"
 )
 
+// thingsTelemetryHandler is safe for concurrent use, each message is handled with the current snapshot of the mapper
+// configuration, the value mappings are applied to deep copies and the counters, compiled expressions, batches, filters and aggregates
+// are synchronized.
 type thingsTelemetryHandler struct {
-	connInfo     *kantocfg.RemoteConnectionInfo
-	mapperConfig *mapperconfig.MessageMapperConfig
-	marshaller   protobuf.Marshaller
-	incrementors map[string]int
+	connInfo    *kantocfg.RemoteConnectionInfo
+	snapshots   *mapper.Holder
+	counters    *sequence.Counters
+	expressions sync.Map
+	batches     *batcher
+	filters     *filter
+	aggregates  *aggregator
 }
 
-// CreateThingsTelemetryHandler instantiates a things telemetry message handler
-func CreateThingsTelemetryHandler(mapperConfig *mapperconfig.MessageMapperConfig, marshaller protobuf.Marshaller) handlers.TelemetryHandler {
-	return &thingsTelemetryHandler{
-		mapperConfig: mapperConfig,
-		marshaller:   marshaller,
-		incrementors: map[string]int{},
+// CreateThingsTelemetryHandler instantiates a things telemetry message handler, which encodes the mapped values with
+// the codecs of the mappings and takes the values of the "++counter" value mappings from the provided counters.
+// The batches and aggregates that cannot be sent at the end of their window are logged with the provided logger.
+func CreateThingsTelemetryHandler(snapshots *mapper.Holder, counters *sequence.Counters, logger watermill.LoggerAdapter) handlers.TelemetryHandler {
+	handler := &thingsTelemetryHandler{
+		snapshots: snapshots,
+		counters:  counters,
+		batches:   newBatcher(logger),
+		filters:   newFilter(),
 	}
+	handler.aggregates = newAggregator(logger, handler.serializeAggregate)
+	return handler
+}
+
+// SetCloudPublisher sets the publisher of the batches and aggregates of telemetry messages sent at the end of their
+// window.
+func (h *thingsTelemetryHandler) SetCloudPublisher(publisher message.Publisher) {
+	h.batches.setPublisher(publisher)
+	h.aggregates.setPublisher(publisher)
+}
+
+// Flush sends the open batches and aggregates of telemetry messages right away, without waiting for the end of their
+// window, e.g. before the cloud publisher is closed on shutdown.
+func (h *thingsTelemetryHandler) Flush() {
+	h.batches.flushAll()
+	h.aggregates.flushAll()
+}
+
+// BufferOffline returns true, the D2C messages of the handler are stored in the offline buffer, if enabled, while
+// the Azure IoT Hub is not reachable.
+func (h *thingsTelemetryHandler) BufferOffline() bool {
+	return true
 }
 
 func (h *thingsTelemetryHandler) Init(connInfo *kantocfg.RemoteConnectionInfo) error {
@@ -74,24 +122,74 @@ func (h *thingsTelemetryHandler) HandleMessage(msg *message.Message) ([]*message
 		return nil, errors.Wrap(err, "cannot deserialize Ditto message!")
 	}
 
-	messageType, messageSubType, telemetryMapping, err := h.getTelemetryMapping(dittoMessage, h.mapperConfig)
+	snapshot := h.snapshots.Load()
+	mapperConfig := snapshot.Config
+	// the Ditto twin events of the reported properties of the device twin are sent as telemetry only on request
+	if mapperConfig != nil && dittoMessage.Topic != nil && mapperConfig.IsReportedOnly(dittoMessage.Topic.String(), dittoMessage.Path) {
+		return nil, nil
+	}
+	telemetryMatches, err := h.getTelemetryMappings(dittoMessage, mapperConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	var outgoingMessages []*message.Message
+	for _, telemetryMatch := range telemetryMatches {
+		outgoingMessage, err := h.createTelemetryMessage(snapshot, dittoMessage, telemetryMatch)
+		if err != nil {
+			if len(telemetryMatches) > 1 {
+				return nil, errors.Wrap(err, fmt.Sprintf("cannot map Ditto message with %s", telemetryMatch))
+			}
+			return nil, err
+		}
+		if outgoingMessage == nil {
+			continue
+		}
+		if telemetryMatch.Mapping.Batch != nil {
+			batchMessages, err := h.batches.add(h.connInfo.DeviceID, telemetryMatch, outgoingMessage.Payload)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("cannot batch Ditto message with %s", telemetryMatch))
+			}
+			outgoingMessages = append(outgoingMessages, batchMessages...)
+			continue
+		}
+		outgoingMessages = append(outgoingMessages, outgoingMessage)
+	}
+	return outgoingMessages, nil
+}
+
+func (h *thingsTelemetryHandler) createTelemetryMessage(snapshot *mapper.Snapshot, dittoMessage *protocol.Envelope, telemetryMatch *mapperconfig.TelemetryMappingMatch) (*message.Message, error) {
+	telemetryMapping := telemetryMatch.Mapping
+
 	dittoByteValue, err := json.Marshal(dittoMessage.Value)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot deserialize Ditto value")
 	}
 
-	var payload interface{}
 	var correlationID string
 
+	// the filters compare the mapped value without the generated fields, which change with every message, and run
+	// before the counters are incremented, so the suppressed messages take no sequence numbers
+	filterValue := dittoByteValue
+	if telemetryMapping.ValueMapping != nil && (telemetryMapping.IsChangeFiltered() || telemetryMapping.RateLimit != nil) {
+		filterValue, _, err = h.convertDittoValue(telemetryMatch, dittoByteValue, false)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cannot convert Ditto value '%v'", dittoMessage.Value))
+		}
+		if filterValue == nil {
+			return nil, nil
+		}
+	}
+	thingID := dittoMessage.Topic.Namespace + ":" + dittoMessage.Topic.EntityName
+	if ok, err := h.filters.allow(thingID, telemetryMatch, filterValue); err != nil || !ok {
+		return nil, err
+	}
+
 	isConverted := false
 	dittoValue := dittoByteValue
 	if telemetryMapping.ValueMapping != nil {
 		isConverted = true
-		dittoValue, correlationID, err = h.convertDittoValue(telemetryMapping, dittoValue)
+		dittoValue, correlationID, err = h.convertDittoValue(telemetryMatch, dittoValue, true)
 		if err != nil {
 			return nil, errors.Wrap(err, fmt.Sprintf("cannot convert Ditto value '%v'", dittoMessage.Value))
 		}
@@ -99,9 +197,40 @@ func (h *thingsTelemetryHandler) HandleMessage(msg *message.Message) ([]*message
 			return nil, nil
 		}
 	}
-	payload = dittoValue
-	if telemetryMapping.ProtoFile != "" {
-		payload, err = h.marshaller.Marshal(messageType, messageSubType, dittoValue)
+	if len(correlationID) == 0 && dittoMessage.Headers != nil {
+		correlationID = dittoMessage.Headers.CorrelationID()
+	}
+	if telemetryMapping.Aggregation != nil {
+		return nil, h.aggregates.add(thingID, telemetryMatch, dittoValue, correlationID)
+	}
+	return h.serializeTelemetryMessage(snapshot, telemetryMatch, dittoValue, isConverted, dittoMessage.Value, correlationID)
+}
+
+// serializeAggregate creates the D2C message of an aggregate at the end of its window with the current snapshot.
+func (h *thingsTelemetryHandler) serializeAggregate(telemetryMatch *mapperconfig.TelemetryMappingMatch, dittoValue []byte, isConverted bool, value interface{}, correlationID string) (*message.Message, error) {
+	return h.serializeTelemetryMessage(h.snapshots.Load(), telemetryMatch, dittoValue, isConverted, value, correlationID)
+}
+
+// serializeTelemetryMessage creates the D2C message with the mapped value, which is the converted value if there is
+// a value mapping and the Ditto value otherwise.
+func (h *thingsTelemetryHandler) serializeTelemetryMessage(snapshot *mapper.Snapshot, telemetryMatch *mapperconfig.TelemetryMappingMatch, dittoValue []byte, isConverted bool, value interface{}, correlationID string) (*message.Message, error) {
+	messageType, messageSubType, telemetryMapping := telemetryMatch.MessageType, telemetryMatch.MessageSubType, telemetryMatch.Mapping
+
+	var payload interface{} = dittoValue
+	if telemetryMapping.IsProtobuf() && telemetryMapping.Serialization == serializationProtobufJSON {
+		protoNames := telemetryMapping.ProtoJSONFieldNames == protoJSONFieldNamesProto
+		protoJSONPayload, err := snapshot.Marshaller.MarshalProtoJSON(messageType, messageSubType, dittoValue, protoNames)
+		if err != nil {
+			return nil, err
+		}
+		payload = json.RawMessage(protoJSONPayload)
+	} else if codecName := telemetryMapping.CodecName(); codecName != "" {
+		payloadCodec, err := snapshot.Codecs.Get(codecName)
+		if err != nil {
+			return nil, err
+		}
+		target := &codec.Target{MessageType: messageType, MessageSubType: messageSubType, SchemaFile: telemetryMapping.SchemaFile}
+		payload, err = payloadCodec.Encode(target, dittoValue)
 		if err != nil {
 			return nil, err
 		}
@@ -114,7 +243,7 @@ func (h *thingsTelemetryHandler) HandleMessage(msg *message.Message) ([]*message
 		}
 		payload = mapValue
 	} else {
-		payload = dittoMessage.Value
+		payload = value
 	}
 
 	d2cMessage := &routingmessage.TelemetryMessage{
@@ -124,14 +253,16 @@ func (h *thingsTelemetryHandler) HandleMessage(msg *message.Message) ([]*message
 		EnvelopeVersion: envelopeVersion,
 		PayloadVersion:  payloadVersion,
 		Payload:         payload,
+		CorrelationID:   correlationID,
 	}
 
-	if len(correlationID) == 0 {
-		correlationID = dittoMessage.Headers.CorrelationID()
+	var err error
+	var outgoingPayload []byte
+	if telemetryMapping.Serialization == serializationProtobufEnvelope {
+		outgoingPayload, err = d2cMessage.MarshalProtobuf()
+	} else {
+		outgoingPayload, err = json.Marshal(d2cMessage)
 	}
-	d2cMessage.CorrelationID = correlationID
-
-	outgoingPayload, err := json.Marshal(d2cMessage)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot serialize D2C message")
 	}
@@ -139,46 +270,53 @@ func (h *thingsTelemetryHandler) HandleMessage(msg *message.Message) ([]*message
 	msgID := watermill.NewUUID()
 	outgoingMessage := message.NewMessage(msgID, outgoingPayload)
 	outgoingTopic := routing.CreateTelemetryTopic(h.connInfo.DeviceID, msgID)
+	if telemetryMapping.Serialization == serializationProtobufEnvelope {
+		outgoingTopic = createProtobufTelemetryTopic(h.connInfo.DeviceID, msgID)
+	}
 	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
-	return []*message.Message{outgoingMessage}, nil
+	setDeliveryToCtx(outgoingMessage, telemetryMapping)
+	return outgoingMessage, nil
+}
+
+// setDeliveryToCtx adds the delivery options of the telemetry mapping to the context of the D2C message, i.e. the QoS,
+// the priority in the offline buffer and the expiry time after which the message is discarded as stale.
+func setDeliveryToCtx(outgoingMessage *message.Message, telemetryMapping *mapperconfig.TelemetryMessageMapping) {
+	ctx := outgoingMessage.Context()
+	switch telemetryMapping.Delivery {
+	case mapperconfig.DeliveryAtMostOnce:
+		ctx = connector.SetQosToCtx(ctx, connector.QosAtMostOnce)
+	case mapperconfig.DeliveryAtLeastOnce:
+		ctx = connector.SetQosToCtx(ctx, connector.QosAtLeastOnce)
+	}
+	if telemetryMapping.DeliveryPriority != 0 {
+		ctx = store.SetPriorityToCtx(ctx, telemetryMapping.DeliveryPriority)
+	}
+	if ttl, _ := telemetryMapping.GetTTL(); ttl > 0 {
+		ctx = store.SetExpiryToCtx(ctx, time.Now().Add(ttl))
+	}
+	outgoingMessage.SetContext(ctx)
 }
 
-func (h *thingsTelemetryHandler) getTelemetryMapping(dittoMessage *protocol.Envelope, mapperConfig *mapperconfig.MessageMapperConfig) (int, string, *mapperconfig.TelemetryMessageMapping, error) {
+func (h *thingsTelemetryHandler) getTelemetryMappings(dittoMessage *protocol.Envelope, mapperConfig *mapperconfig.MessageMapperConfig) ([]*mapperconfig.TelemetryMappingMatch, error) {
 	if dittoMessage.Topic == nil {
-		return -1, "", nil, errors.New("missing Ditto topic in message")
+		return nil, errors.New("missing Ditto topic in message")
 	}
 
 	topic := dittoMessage.Topic.String()
 	path := dittoMessage.Path
-	telemetryMappings, err := mapperConfig.GetTelemetryMessageMappings()
+	if mapperConfig == nil {
+		return nil, fmt.Errorf("cannot map Ditto topic '%s' & Ditto path '%s' to D2C message sub type, no message mapper config", topic, path)
+	}
+	telemetryMatches, err := mapperConfig.MatchTelemetryMessageMappings(topic, path)
 	if err != nil {
-		return -1, "", nil, errors.Wrap(err, fmt.Sprintf("cannot map Ditto topic '%s' & Ditto path '%s' to D2C message sub type", topic, path))
-	}
-
-	for messageType, telemetryMessageTypeMappings := range telemetryMappings {
-		for messageSubType, messageMapping := range telemetryMessageTypeMappings {
-			mappingProperties := messageMapping.MappingProperties
-			if mappingProperties.Topic != "" {
-				if mappingProperties.Path != "" {
-					if strings.Contains(topic, mappingProperties.Topic) && strings.Contains(path, mappingProperties.Path) {
-						return messageType, messageSubType, messageMapping, nil
-					}
-				} else {
-					if strings.Contains(topic, mappingProperties.Topic) {
-						return messageType, messageSubType, messageMapping, nil
-					}
-				}
-			} else if mappingProperties.Path != "" {
-				if strings.Contains(path, mappingProperties.Path) {
-					return messageType, messageSubType, messageMapping, nil
-				}
-			}
-		}
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot map Ditto topic '%s' & Ditto path '%s' to D2C message sub type", topic, path))
 	}
-	return -1, "", nil, fmt.Errorf("cannot map Ditto topic '%s' & Ditto path '%s' to D2C message sub type", topic, path)
+	return telemetryMatches, nil
 }
 
-func (h *thingsTelemetryHandler) convertDittoValue(telemetryMapping *mapperconfig.TelemetryMessageMapping, dittoValue []byte) ([]byte, string, error) {
+// convertDittoValue applies the value mapping of the telemetry mapping to the Ditto value. The generated values, i.e.
+// the timestamps and the counters, are left out unless generate is set, in which case the counters are incremented.
+func (h *thingsTelemetryHandler) convertDittoValue(telemetryMatch *mapperconfig.TelemetryMappingMatch, dittoValue []byte, generate bool) ([]byte, string, error) {
 	var err error
 	valueMap := map[string]interface{}{}
 	if err = json.Unmarshal(dittoValue, &valueMap); err != nil {
@@ -188,47 +326,147 @@ func (h *thingsTelemetryHandler) convertDittoValue(telemetryMapping *mapperconfi
 	if cID, ok := valueMap["correlationId"]; ok {
 		correlationID = cID.(string)
 	}
-	valueMapping := deepCopyMap(telemetryMapping.ValueMapping)
-	if ok := h.convertDittoValueInternal(telemetryMapping, valueMapping, valueMap); !ok {
+	valueMapping := deepCopyMap(telemetryMatch.Mapping.ValueMapping)
+	ok, err := h.convertDittoValueInternal(telemetryMatch, valueMapping, valueMap, generate)
+	if err != nil {
+		return nil, correlationID, err
+	}
+	if !ok {
 		return nil, correlationID, nil
 	}
 	convertedValue, err := json.Marshal(valueMapping)
 	return convertedValue, correlationID, err
 }
 
-func (h *thingsTelemetryHandler) convertDittoValueInternal(telemetryMapping *mapperconfig.TelemetryMessageMapping, valueMapping, valueMap map[string]interface{}) bool {
+// convertDittoValueInternal converts the value mapping in place, resolving the references against the scope, which is
+// the Ditto value or an array element inside a template. It returns false if the Ditto message has to be ignored.
+func (h *thingsTelemetryHandler) convertDittoValueInternal(telemetryMatch *mapperconfig.TelemetryMappingMatch, valueMapping map[string]interface{}, scope interface{}, generate bool) (bool, error) {
 	for key, value := range valueMapping {
-		switch convertedValue := value.(type) {
-		case string:
-			if strings.HasPrefix(convertedValue, "$") {
-				refPath := strings.Split(convertedValue[1:], ".")
-				refValue := h.getRefValue(refPath, valueMap)
-				if refValue == nil {
-					delete(valueMapping, key)
-					continue
-				}
-				fieldValue := h.getFieldMappingValue(telemetryMapping, convertedValue, refValue)
-				if fieldValue == ignoreValue {
-					return false
-				}
-				valueMapping[key] = fieldValue
-			} else if convertedValue == funcTimestamp {
-				valueMapping[key] = getUnixTimestampMs()
-			} else if strings.HasPrefix(convertedValue, "++") {
-				incrementKey := convertedValue[2:]
-				increment := h.incrementors[incrementKey] + 1
-				h.incrementors[incrementKey] = increment
-				valueMapping[key] = increment
-			} else {
-				valueMapping[key] = convertedValue
+		convertedValue, ok, err := h.convertMappingValue(telemetryMatch, value, scope, generate)
+		if err != nil {
+			return false, errors.Wrap(err, fmt.Sprintf("cannot map value '%s'", key))
+		}
+		if !ok {
+			return false, nil
+		}
+		if convertedValue == nil {
+			delete(valueMapping, key)
+			continue
+		}
+		valueMapping[key] = convertedValue
+	}
+	return true, nil
+}
+
+// convertMappingValue converts a single value mapping value. It returns nil if a referenced value is missing
+// and false if the Ditto message has to be ignored.
+func (h *thingsTelemetryHandler) convertMappingValue(telemetryMatch *mapperconfig.TelemetryMappingMatch, value interface{}, scope interface{}, generate bool) (interface{}, bool, error) {
+	telemetryMapping := telemetryMatch.Mapping
+	switch convertedValue := value.(type) {
+	case string:
+		var refValue interface{}
+		if expression.IsExpression(convertedValue) {
+			compiled, err := h.compileExpression(convertedValue)
+			if err != nil {
+				return nil, false, err
+			}
+			if !generate && compiled.UsesTimestamp() {
+				return nil, true, nil
 			}
-		case map[string]interface{}:
-			if ok := h.convertDittoValueInternal(telemetryMapping, convertedValue, valueMap); !ok {
-				return false
+			result, err := compiled.Evaluate(&expression.Environment{Value: scope, Captures: telemetryMatch.Captures})
+			if err != nil {
+				return nil, false, err
 			}
+			refValue = result
+		} else if strings.HasPrefix(convertedValue, refMatchPrefix) {
+			if capture, ok := telemetryMatch.Captures[convertedValue[len(refMatchPrefix):]]; ok {
+				refValue = capture
+			}
+		} else if strings.HasPrefix(convertedValue, "$") {
+			reference, err := expression.ParseReference(convertedValue)
+			if err != nil {
+				return nil, false, err
+			}
+			refValue = reference.Resolve(scope)
+		} else if convertedValue == funcTimestamp {
+			if !generate {
+				return nil, true, nil
+			}
+			return getUnixTimestampMs(), true, nil
+		} else if strings.HasPrefix(convertedValue, "++") {
+			if !generate {
+				return nil, true, nil
+			}
+			increment, err := h.counters.Next(convertedValue[2:])
+			if err != nil {
+				return nil, false, errors.Wrap(err, fmt.Sprintf("cannot increment counter '%s'", convertedValue[2:]))
+			}
+			return increment, true, nil
+		} else {
+			return convertedValue, true, nil
+		}
+		if refValue == nil {
+			return nil, true, nil
+		}
+		fieldValue := h.getFieldMappingValue(telemetryMapping, convertedValue, refValue)
+		return fieldValue, fieldValue != ignoreValue, nil
+	case map[string]interface{}:
+		if _, ok := convertedValue[templateEach]; ok {
+			return h.convertTemplate(telemetryMatch, convertedValue, scope, generate)
 		}
+		ok, err := h.convertDittoValueInternal(telemetryMatch, convertedValue, scope, generate)
+		return convertedValue, ok, err
+	case []interface{}:
+		convertedArray := make([]interface{}, 0, len(convertedValue))
+		for _, element := range convertedValue {
+			convertedElement, ok, err := h.convertMappingValue(telemetryMatch, element, scope, generate)
+			if err != nil || !ok {
+				return nil, ok, err
+			}
+			if convertedElement != nil {
+				convertedArray = append(convertedArray, convertedElement)
+			}
+		}
+		return convertedArray, true, nil
+	default:
+		return value, true, nil
 	}
-	return true
+}
+
+// convertTemplate maps each element of the array referenced by "$each" with the "$template" value mapping,
+// in which the references are resolved against the array element.
+func (h *thingsTelemetryHandler) convertTemplate(telemetryMatch *mapperconfig.TelemetryMappingMatch, template map[string]interface{}, scope interface{}, generate bool) (interface{}, bool, error) {
+	elements, ok, err := h.convertMappingValue(telemetryMatch, template[templateEach], scope, generate)
+	if err != nil || !ok || elements == nil {
+		return nil, ok, err
+	}
+	array, isArray := elements.([]interface{})
+	if !isArray {
+		return nil, false, fmt.Errorf("'%s' value '%v' is not an array", templateEach, elements)
+	}
+	convertedArray := make([]interface{}, 0, len(array))
+	for _, element := range array {
+		convertedElement, ok, err := h.convertMappingValue(telemetryMatch, deepCopyValue(template[templateValue]), element, generate)
+		if err != nil || !ok {
+			return nil, ok, err
+		}
+		if convertedElement != nil {
+			convertedArray = append(convertedArray, convertedElement)
+		}
+	}
+	return convertedArray, true, nil
+}
+
+func (h *thingsTelemetryHandler) compileExpression(source string) (*expression.Expression, error) {
+	if cached, ok := h.expressions.Load(source); ok {
+		return cached.(*expression.Expression), nil
+	}
+	compiled, err := expression.Compile(source)
+	if err != nil {
+		return nil, err
+	}
+	h.expressions.Store(source, compiled)
+	return compiled, nil
 }
 
 func (h *thingsTelemetryHandler) getFieldMappingValue(telemetryMapping *mapperconfig.TelemetryMessageMapping, fieldKey string, value interface{}) interface{} {
@@ -239,6 +477,13 @@ func (h *thingsTelemetryHandler) getFieldMappingValue(telemetryMapping *mapperco
 	if fieldMapping == nil {
 		return value
 	}
+	if values, ok := value.([]interface{}); ok {
+		fieldValues := make([]interface{}, len(values))
+		for i, element := range values {
+			fieldValues[i] = h.getFieldMappingValue(telemetryMapping, fieldKey, element)
+		}
+		return fieldValues
+	}
 	for fieldKey, fieldValue := range fieldMapping {
 		if fieldKey == value {
 			return fieldValue
@@ -247,33 +492,38 @@ func (h *thingsTelemetryHandler) getFieldMappingValue(telemetryMapping *mapperco
 	return fieldMapping[fieldMappingKeyDefault]
 }
 
-func (h *thingsTelemetryHandler) getRefValue(path []string, value map[string]interface{}) interface{} {
-	return h.getRefValueInternal(path, 0, value)
+func deepCopyMap(originMap map[string]interface{}) map[string]interface{} {
+	copyMap := make(map[string]interface{})
+	for key, value := range originMap {
+		copyMap[key] = deepCopyValue(value)
+	}
+	return copyMap
 }
 
-func (h *thingsTelemetryHandler) getRefValueInternal(path []string, index int, value map[string]interface{}) interface{} {
-	if index == len(path)-1 {
-		return value[path[index]]
-	}
-	var ok bool
-	var valueMap map[string]interface{}
-	if valueMap, ok = value[path[index]].(map[string]interface{}); !ok {
-		return nil
+func deepCopyValue(value interface{}) interface{} {
+	switch valueType := value.(type) {
+	case map[string]interface{}:
+		return deepCopyMap(valueType)
+	case []interface{}:
+		copyArray := make([]interface{}, len(valueType))
+		for i, element := range valueType {
+			copyArray[i] = deepCopyValue(element)
+		}
+		return copyArray
+	default:
+		return value
 	}
-	return h.getRefValueInternal(path, index+1, valueMap)
 }
 
-func deepCopyMap(originMap map[string]interface{}) map[string]interface{} {
-	copyMap := make(map[string]interface{})
-	for key, value := range originMap {
-		switch valueType := value.(type) {
-		case map[string]interface{}:
-			copyMap[key] = deepCopyMap(valueType)
-		default:
-			copyMap[key] = value
-		}
+// createProtobufTelemetryTopic constructs the MQTT topic for sending a protobuf D2C message to an Azure IoT Hub device,
+// the content type of the message is set to protobuf and there is no content encoding.
+func createProtobufTelemetryTopic(deviceID, msgID string) string {
+	msgProps := url.Values{}
+	msgProps.Set(propertyContentType, contentTypeProtobuf)
+	if msgID != "" {
+		msgProps.Set(propertyMessageID, msgID)
 	}
-	return copyMap
+	return fmt.Sprintf(remoteTelemetryTopicFmt, deviceID, msgProps.Encode())
 }
 
 func getUnixTimestampMs() int64 {
@@ -12,16 +12,29 @@
 package telemetry
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
 
 	"github.com/eclipse-kanto/azure-connector/config"
 	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
 
 	routingmessage "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
 	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
 
+	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -659,6 +672,306 @@ func TestErrorConvertDittoValue(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestConvertDittoValueWithMatchCaptures(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/twin/events/modified",
+			"path": "/features/Container/properties/status",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"value": "running"
+			}
+	}`
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	err = json.Unmarshal(convertedMessages[0].Payload, d2cMessage)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, d2cMessage.MessageType)
+	assert.Equal(t, "regex.capture.mapping", d2cMessage.MessageSubType)
+	assert.Equal(t, map[string]interface{}{"feature": "Container", "property": "status", "value": "running"}, d2cMessage.Payload)
+}
+
+func TestFanOutDittoMessage(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/fan.out",
+			"path": "/features/ContainerOrchestator/outbox/messages/fan.out",
+			"headers": {
+				"content-type": "application/json",
+				"correlation-id": "fan-out-correlation-id"
+			},
+			"value": {
+				"message_id": "some-message-id-1234",
+				"text": "simple text added"
+			}
+	}`
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+	require.Len(t, convertedMessages, 2)
+
+	jsonMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(convertedMessages[0].Payload, jsonMessage))
+	assert.Equal(t, "fan.out.json.string", jsonMessage.MessageSubType)
+	assert.Equal(t, "fan-out-correlation-id", jsonMessage.CorrelationID)
+	assert.JSONEq(t, `{"message_id":"some-message-id-1234","text":"simple text added"}`, jsonMessage.Payload.(string))
+
+	protobufMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(convertedMessages[1].Payload, protobufMessage))
+	assert.Equal(t, "fan.out.bfb", protobufMessage.MessageSubType)
+	assert.Equal(t, "fan-out-correlation-id", protobufMessage.CorrelationID)
+	assert.Equal(t, "ChRzb21lLW1lc3NhZ2UtaWQtMTIzNBIRc2ltcGxlIHRleHQgYWRkZWQ=", protobufMessage.Payload)
+
+	assert.NotEqual(t, convertedMessages[0].UUID, convertedMessages[1].UUID)
+}
+
+func TestConvertDittoValueWithExpressions(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/expression.mapping",
+			"path": "/features/ContainerOrchestator/outbox/messages/expression.mapping",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"celsius": 21.5,
+				"namespace": "edge",
+				"name": "container",
+				"ports": [8080, 8443]
+			}
+	}`
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	err = json.Unmarshal(convertedMessages[0].Payload, d2cMessage)
+	require.NoError(t, err)
+
+	expectedValue := map[string]interface{}{
+		"fahrenheit": 70.7,
+		"name":       "edge:container",
+		"state":      "UNKNOWN",
+		"level":      "NORMAL",
+		"firstPort":  float64(8080),
+		"nested": map[string]interface{}{
+			"portCount": float64(2),
+		},
+	}
+	assert.Equal(t, "expression.mapping", d2cMessage.MessageSubType)
+	assert.Equal(t, expectedValue, d2cMessage.Payload)
+}
+
+func TestErrorEvaluatingExpression(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/expression.mapping",
+			"path": "/features/ContainerOrchestator/outbox/messages/expression.mapping",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"celsius": "warm",
+				"namespace": "edge",
+				"name": "container",
+				"ports": []
+			}
+	}`
+	_, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "to string and number")
+}
+
+func TestConvertDittoValueWithArrays(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/array.mapping",
+			"path": "/features/ContainerOrchestator/outbox/messages/array.mapping",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"actions": [
+					{"id": "a1", "status": "DONE"},
+					{"id": "a2"},
+					{"id": "a3", "status": "FAILED"}
+				]
+			}
+	}`
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	err = json.Unmarshal(convertedMessages[0].Payload, d2cMessage)
+	require.NoError(t, err)
+
+	expectedValue := map[string]interface{}{
+		"firstStatus": "DONE",
+		"ids":         []interface{}{"a1", "a2", "a3"},
+		"states":      []interface{}{"OK", "NOK"},
+		"pairs":       []interface{}{"a1", "a2", "a3"},
+		"actions": []interface{}{
+			map[string]interface{}{"action": "a1", "status": "DONE", "label": "a1:DONE"},
+			map[string]interface{}{"action": "a2", "label": "a2:PENDING"},
+			map[string]interface{}{"action": "a3", "status": "FAILED", "label": "a3:FAILED"},
+		},
+	}
+	assert.Equal(t, "array.mapping", d2cMessage.MessageSubType)
+	assert.Equal(t, expectedValue, d2cMessage.Payload)
+}
+
+func TestConvertDittoValueWithTemplateToRepeatedField(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/template.bfb",
+			"path": "/features/ContainerOrchestator/outbox/messages/template.bfb",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"messages": [
+					{"id": "m1", "text": "first"},
+					{"id": "m2", "text": "second", "version": "2.0"}
+				]
+			}
+	}`
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	err = json.Unmarshal(convertedMessages[0].Payload, d2cMessage)
+	require.NoError(t, err)
+	assert.Equal(t, "template.bfb", d2cMessage.MessageSubType)
+	assert.Equal(t, "ChAKAm0xEgVmaXJzdBoDMS4wChEKAm0yEgZzZWNvbmQaAzIuMA==", d2cMessage.Payload)
+}
+
+func TestErrorConvertingTemplate(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/template.bfb",
+			"path": "/features/ContainerOrchestator/outbox/messages/template.bfb",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"messages": {"id": "m1"}
+			}
+	}`
+	_, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot map value 'data': '$each' value 'map[id:m1]' is not an array")
+}
+
+func TestIncrementPersistentCounter(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/increment.mapping",
+			"path": "/features/ContainerOrchestator/outbox/messages/increment.mapping",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"message": "dummy_message"
+			}
+	}`
+	for _, expectedValue := range []string{`{"counter":1}`, `{"counter":2}`} {
+		// a new handler with counters restored from the state file behaves like a restarted cloud connector
+		counters, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+		require.NoError(t, err)
+		handler := createTelemetryMessageHandlerWithCounters(t, convertDittoValueMessageMapperConfig, counters)
+
+		convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+		require.NoError(t, err)
+		d2cMessage := &routingmessage.TelemetryMessage{}
+		require.NoError(t, json.Unmarshal(convertedMessages[0].Payload, d2cMessage))
+		convertedValue, err := json.Marshal(d2cMessage.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, expectedValue, string(convertedValue))
+	}
+}
+
+func TestConcurrentHandleMessage(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	snapshots := handler.(*thingsTelemetryHandler).snapshots
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(convertDittoValueMessageMapperConfig)
+	require.NoError(t, err)
+
+	incrementPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/increment.mapping",
+			"path": "/features/ContainerOrchestator/outbox/messages/increment.mapping",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"message": "dummy_message"
+			}
+	}`
+	templatePayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/template.bfb",
+			"path": "/features/ContainerOrchestator/outbox/messages/template.bfb",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"messages": [
+					{"id": "m1", "text": "first"},
+					{"id": "m2", "text": "second", "version": "2.0"}
+				]
+			}
+	}`
+	const goroutines, iterations = 20, 25
+	counterValues := make(chan float64, goroutines*iterations)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(incrementPayload)))
+				if !assert.NoError(t, err) {
+					return
+				}
+				d2cMessage := &routingmessage.TelemetryMessage{}
+				if assert.NoError(t, json.Unmarshal(convertedMessages[0].Payload, d2cMessage)) {
+					counterValues <- d2cMessage.Payload.(map[string]interface{})["counter"].(float64)
+				}
+
+				convertedMessages, err = handler.HandleMessage(createWatermillMessageForD2C([]byte(templatePayload)))
+				if !assert.NoError(t, err) {
+					return
+				}
+				d2cMessage = &routingmessage.TelemetryMessage{}
+				if assert.NoError(t, json.Unmarshal(convertedMessages[0].Payload, d2cMessage)) {
+					assert.Equal(t, "ChAKAm0xEgVmaXJzdBoDMS4wChEKAm0yEgZzZWNvbmQaAzIuMA==", d2cMessage.Payload)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			snapshots.Reload(mapperConfig)
+		}
+	}()
+	wg.Wait()
+	close(counterValues)
+
+	// every message gets its own counter value
+	seen := map[float64]bool{}
+	for value := range counterValues {
+		assert.False(t, seen[value], "duplicate counter value %v", value)
+		seen[value] = true
+	}
+	assert.Equal(t, goroutines*iterations, len(seen))
+	for i := 1; i <= goroutines*iterations; i++ {
+		assert.True(t, seen[float64(i)], "missing counter value %d", i)
+	}
+}
+
 func TestSerializeJSON(t *testing.T) {
 	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
 	jsonPayload := `{
@@ -688,6 +1001,43 @@ func TestSerializeJSON(t *testing.T) {
 	assert.Equal(t, map[string]interface{}{"x": "y"}, convertedValue)
 }
 
+func TestDeliveryOptions(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	jsonPayload := `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/%s",
+			"path": "/features/ContainerOrchestator/outbox/messages/%s",
+			"headers": {
+				"content-type": "application/json"
+			},
+			"value": {
+				"x": "y"
+			}
+	}`
+	start := time.Now()
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(fmt.Sprintf(jsonPayload, "delivery.options", "delivery.options"))))
+	require.NoError(t, err)
+	require.Len(t, convertedMessages, 1)
+	ctx := convertedMessages[0].Context()
+	qos, ok := connector.QosFromCtx(ctx)
+	require.True(t, ok)
+	assert.Equal(t, connector.QosAtMostOnce, qos)
+	assert.Equal(t, 2, store.PriorityFromCtx(ctx))
+	expiry, ok := store.ExpiryFromCtx(ctx)
+	require.True(t, ok)
+	assert.WithinDuration(t, start.Add(10*time.Minute), expiry, time.Second)
+
+	// the messages of the mappings without delivery options are sent with the QoS of the publisher
+	convertedMessages, err = handler.HandleMessage(createWatermillMessageForD2C([]byte(fmt.Sprintf(jsonPayload, "serialize.json.object", "serialize.json.object"))))
+	require.NoError(t, err)
+	require.Len(t, convertedMessages, 1)
+	ctx = convertedMessages[0].Context()
+	_, ok = connector.QosFromCtx(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, 0, store.PriorityFromCtx(ctx))
+	_, ok = store.ExpiryFromCtx(ctx)
+	assert.False(t, ok)
+}
+
 func TestSerializeToJsonString(t *testing.T) {
 	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
 	jsonPayload := `{
@@ -747,6 +1097,110 @@ func TestConvertDittoValueAndSerializeToBfb(t *testing.T) {
 	assert.Equal(t, "CgE3EgpkdW1teV90ZXh0GgUxLjAuMA==", convertedValue)
 }
 
+func TestSerializeProtobufBase64(t *testing.T) {
+	d2cMessage := handleProtobufSerialization(t, "serialize.protobuf.base64")
+	assert.Equal(t, "CgE3EgpkdW1teV90ZXh0GgUxLjAuMA==", d2cMessage.Payload)
+}
+
+func TestSerializeProtobufJSON(t *testing.T) {
+	d2cMessage := handleProtobufSerialization(t, "serialize.protobuf.json")
+	assert.Equal(t, map[string]interface{}{"messageId": "7", "text": "dummy_text", "version": "1.0.0"}, d2cMessage.Payload)
+
+	d2cMessage = handleProtobufSerialization(t, "serialize.protobuf.json.proto.names")
+	assert.Equal(t, map[string]interface{}{"message_id": "7", "text": "dummy_text", "version": "1.0.0"}, d2cMessage.Payload)
+}
+
+func TestSerializeProtobufEnvelope(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(protobufSerializationPayload("serialize.protobuf.envelope"))))
+	require.NoError(t, err)
+
+	topic, ok := connector.TopicFromCtx(convertedMessages[0].Context())
+	require.True(t, ok)
+	assert.True(t, strings.HasPrefix(topic, "devices/dummy-device/messages/events/"))
+	assert.Contains(t, topic, "%24.ct=application%2Fx-protobuf")
+	assert.NotContains(t, topic, "%24.ce=")
+
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, d2cMessage.UnmarshalProtobuf(convertedMessages[0].Payload))
+	assert.Equal(t, 1, d2cMessage.MessageType)
+	assert.Equal(t, "serialize.protobuf.envelope", d2cMessage.MessageSubType)
+	assert.Equal(t, "protobuf-correlation-id", d2cMessage.CorrelationID)
+	assert.Equal(t, "2.0", d2cMessage.EnvelopeVersion)
+	assert.Equal(t, "1.0", d2cMessage.PayloadVersion)
+	assert.NotZero(t, d2cMessage.Timestamp)
+	assert.Equal(t, "CgE3EgpkdW1teV90ZXh0GgUxLjAuMA==", base64.StdEncoding.EncodeToString(d2cMessage.Payload.([]byte)))
+}
+
+func TestSerializeCodecs(t *testing.T) {
+	registry := codec.NewRegistry(nil)
+	tests := []struct {
+		messageSubType string
+		codecName      string
+		schemaFile     string
+		payload        string
+	}{
+		{"serialize.cbor", codec.CBOR, "", "o2R0ZXh0amR1bW15X3RleHRndmVyc2lvbmUxLjAuMGptZXNzYWdlX2lkYTc="},
+		{"serialize.avro", codec.Avro, "../internal/testdata/messages/simple_message.avsc", "AjcUZHVtbXlfdGV4dAoxLjAuMA=="},
+	}
+	for _, test := range tests {
+		t.Run(test.messageSubType, func(t *testing.T) {
+			d2cMessage := handleProtobufSerialization(t, test.messageSubType)
+			assert.Equal(t, test.payload, d2cMessage.Payload)
+
+			payload, err := base64.StdEncoding.DecodeString(test.payload)
+			require.NoError(t, err)
+			payloadCodec, err := registry.Get(test.codecName)
+			require.NoError(t, err)
+			decoded, err := payloadCodec.Decode(&codec.Target{SchemaFile: test.schemaFile}, payload)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"message_id": "7", "text": "dummy_text", "version": "1.0.0"}`, string(decoded))
+		})
+	}
+}
+
+func TestSerializeCodecEnvelope(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(protobufSerializationPayload("serialize.msgpack.envelope"))))
+	require.NoError(t, err)
+
+	topic, _ := connector.TopicFromCtx(convertedMessages[0].Context())
+	assert.Contains(t, topic, "%24.ct=application%2Fx-protobuf")
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, d2cMessage.UnmarshalProtobuf(convertedMessages[0].Payload))
+	assert.Equal(t, "serialize.msgpack.envelope", d2cMessage.MessageSubType)
+	assert.Equal(t, "g6ptZXNzYWdlX2lkoTekdGV4dKpkdW1teV90ZXh0p3ZlcnNpb26lMS4wLjA=", base64.StdEncoding.EncodeToString(d2cMessage.Payload.([]byte)))
+}
+
+func handleProtobufSerialization(t *testing.T, messageSubType string) *routingmessage.TelemetryMessage {
+	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(protobufSerializationPayload(messageSubType))))
+	require.NoError(t, err)
+
+	topic, _ := connector.TopicFromCtx(convertedMessages[0].Context())
+	assert.Contains(t, topic, "%24.ct=application%2Fjson")
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(convertedMessages[0].Payload, d2cMessage))
+	assert.Equal(t, messageSubType, d2cMessage.MessageSubType)
+	return d2cMessage
+}
+
+func protobufSerializationPayload(messageSubType string) string {
+	return `{
+			"topic": "tenant1/dummy-device:edge:containers/things/live/messages/` + messageSubType + `",
+			"path": "/features/ContainerOrchestator/outbox/messages/` + messageSubType + `",
+			"headers": {
+				"content-type": "application/json",
+				"correlation-id": "protobuf-correlation-id"
+			},
+			"value": {
+				"message_id": "7",
+				"version": "1.0.0",
+				"text": "dummy_text"
+			}
+	}`
+}
+
 func TestSerializeConvertedValueToJsonString(t *testing.T) {
 	handler := createTelemetryMessageHandler(t, convertDittoValueMessageMapperConfig)
 	jsonPayload := `{
@@ -970,9 +1424,70 @@ func TestMissingDittoTopic(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestReloadMessageMapperConfig(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, commonMessageMapperConfig)
+	jsonPayload := `{
+		"topic": "tenant1/dummy-device:edge:containers/things/live/messages/serialize.json.object",
+		"path": "/features/ContainerOrchestator/outbox/messages/serialize.json.object",
+		"headers": {
+			"content-type": "application/json"
+		},
+		"value": {
+			"x": "y"
+		}
+	}`
+	_, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.Error(t, err)
+
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(convertDittoValueMessageMapperConfig)
+	require.NoError(t, err)
+	handler.(*thingsTelemetryHandler).snapshots.Reload(mapperConfig)
+
+	convertedMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(convertedMessages[0].Payload, d2cMessage))
+	assert.Equal(t, "serialize.json.object", d2cMessage.MessageSubType)
+}
+
+func TestReportedPropertyTwinEvents(t *testing.T) {
+	handler := createTelemetryMessageHandler(t, "../internal/testdata/twin-mapper-config.json")
+
+	// the twin events of the reported properties are sent as telemetry only if requested by the twin mapping
+	jsonPayload := `{
+		"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/modified",
+		"headers": {"correlation-id": "twin-event"},
+		"path": "/features/UpdateOrchestrator/properties/status",
+		"value": {"state": "IDLE"}
+	}`
+	telemetryMessages, err := handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+	assert.Empty(t, telemetryMessages)
+
+	jsonPayload = `{
+		"topic": "azure.edge/dummy-hub:dummy-device:edge:containers/things/twin/events/modified",
+		"headers": {"correlation-id": "twin-event"},
+		"path": "/features/ContainerOrchestrator/properties/status",
+		"value": {"running": 2}
+	}`
+	telemetryMessages, err = handler.HandleMessage(createWatermillMessageForD2C([]byte(jsonPayload)))
+	require.NoError(t, err)
+	require.Len(t, telemetryMessages, 1)
+	d2cMessage := &routingmessage.TelemetryMessage{}
+	require.NoError(t, json.Unmarshal(telemetryMessages[0].Payload, d2cMessage))
+	assert.Equal(t, "container.status", d2cMessage.MessageSubType)
+}
+
 func createTelemetryMessageHandler(t *testing.T, messageMapperConfig string) handlers.TelemetryHandler {
+	counters, err := sequence.NewCounters("", sequence.DefaultWidth, 0, 0)
+	require.NoError(t, err)
+	return createTelemetryMessageHandlerWithCounters(t, messageMapperConfig, counters)
+}
+
+func createTelemetryMessageHandlerWithCounters(t *testing.T, messageMapperConfig string, counters *sequence.Counters) handlers.TelemetryHandler {
 	mapperConfig, _ := mapperconfig.LoadMessageMapperConfig(messageMapperConfig)
-	messageHandler := CreateThingsTelemetryHandler(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig))
+	snapshots := mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false)
+	messageHandler := CreateThingsTelemetryHandler(snapshots, counters, watermill.NopLogger{})
 	messageHandler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"})
 	return messageHandler
 }
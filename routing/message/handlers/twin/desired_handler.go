@@ -0,0 +1,138 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package twin synchronizes the properties of the Azure IoT Hub device twin with the properties of the Ditto twins.
+package twin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+	"github.com/pkg/errors"
+)
+
+const (
+	desiredHandlerName = "twin_desired_handler"
+	// desiredTopics are the Azure IoT Hub topics of the desired property patches, e.g.
+	// $iothub/twin/PATCH/properties/desired/?$version={version}
+	desiredTopics = "$iothub/twin/PATCH/properties/desired/#"
+	// propertyVersion is the version of the device twin in the desired property patches
+	propertyVersion = "$version"
+
+	dittoNamespace          = "azure.edge"
+	twinCommandTopicPattern = "command//%s:%s:%s/req/%s/%s"
+	dittoTopicPattern       = `"%s/%s:%s/things/twin/commands/%s"`
+)
+
+type desiredPropertiesHandler struct {
+	connInfo  *config.RemoteConnectionInfo
+	snapshots *mapper.Holder
+}
+
+// CreateDesiredPropertiesHandler instantiates a handler of the desired property patches of the device twin, which
+// modifies the mapped Ditto twin properties, or deletes them if the desired property is removed
+func CreateDesiredPropertiesHandler(snapshots *mapper.Holder) bus.CloudHandler {
+	return &desiredPropertiesHandler{snapshots: snapshots}
+}
+
+func (h *desiredPropertiesHandler) getDesiredMappings() map[string]*mapperconfig.TwinPropertyMapping {
+	mapperConfig := h.snapshots.Load().Config
+	if mapperConfig == nil || mapperConfig.MessageMappings == nil || mapperConfig.MessageMappings.Twin == nil {
+		return nil
+	}
+	return mapperConfig.MessageMappings.Twin.Desired
+}
+
+func (h *desiredPropertiesHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	h.connInfo = connInfo
+	return nil
+}
+
+// HandleMessage converts the mapped properties of a desired property patch to Ditto twin commands, the properties
+// without mapping are skipped.
+func (h *desiredPropertiesHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(msg.Payload, &patch); err != nil {
+		return nil, errors.Wrap(err, "cannot deserialize desired properties")
+	}
+	desiredMappings := h.getDesiredMappings()
+	properties := make([]string, 0, len(patch))
+	for property := range patch {
+		if property != propertyVersion && desiredMappings[property] != nil {
+			properties = append(properties, property)
+		}
+	}
+	sort.Strings(properties)
+
+	var outgoingMessages []*message.Message
+	for _, property := range properties {
+		mappingProperties := desiredMappings[property].MappingProperties
+		if mappingProperties == nil {
+			return nil, fmt.Errorf("no Ditto mapping for desired property '%s'", property)
+		}
+		outgoingMessage, err := h.createTwinCommand(mappingProperties, patch[property])
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("cannot map desired property '%s'", property))
+		}
+		outgoingMessages = append(outgoingMessages, outgoingMessage)
+	}
+	return outgoingMessages, nil
+}
+
+// createTwinCommand returns the Ditto twin command setting a property to the desired value, a removed desired
+// property, i.e. a null value, deletes the property.
+func (h *desiredPropertiesHandler) createTwinCommand(mappingProperties *mapperconfig.TwinMappingProperties, value interface{}) (*message.Message, error) {
+	action := protocol.ActionModify
+	if value == nil {
+		action = protocol.ActionDelete
+	}
+	deviceID := h.connInfo.HubName + ":" + h.connInfo.DeviceID
+	topic := &protocol.Topic{}
+	if err := topic.UnmarshalJSON([]byte(fmt.Sprintf(dittoTopicPattern, dittoNamespace, deviceID, mappingProperties.Thing, action))); err != nil {
+		return nil, err
+	}
+	correlationID := watermill.NewUUID()
+	dittoMessage := &protocol.Envelope{
+		Topic:   topic,
+		Headers: protocol.NewHeaders(protocol.WithContentType("application/json"), protocol.WithCorrelationID(correlationID), protocol.WithResponseRequired(false)),
+		Path:    mappingProperties.Path,
+		Value:   value,
+	}
+	outgoingPayload, err := json.Marshal(dittoMessage)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize Ditto twin command")
+	}
+	outgoingMessage := message.NewMessage(watermill.NewUUID(), outgoingPayload)
+	outgoingTopic := fmt.Sprintf(twinCommandTopicPattern, dittoNamespace, deviceID, mappingProperties.Thing, correlationID, action)
+	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
+	return outgoingMessage, nil
+}
+
+func (h *desiredPropertiesHandler) Name() string {
+	return desiredHandlerName
+}
+
+func (h *desiredPropertiesHandler) Topics() string {
+	return desiredTopics
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package twin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/bus"
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const twinMapperConfig = "../internal/testdata/twin-mapper-config.json"
+
+func TestDesiredPropertiesHandler(t *testing.T) {
+	handler := createDesiredPropertiesHandler(t, twinMapperConfig)
+	assert.Equal(t, desiredHandlerName, handler.Name())
+	assert.Equal(t, "$iothub/twin/PATCH/properties/desired/#", handler.Topics())
+}
+
+func TestDesiredPropertiesPatch(t *testing.T) {
+	handler := createDesiredPropertiesHandler(t, twinMapperConfig)
+
+	dittoMessages, err := handler.HandleMessage(createDesiredPatch(`{
+		"updateDesiredState": {"domains": [{"id": "containers"}]},
+		"containerConfig": null,
+		"unmapped": 1,
+		"$version": 4
+	}`))
+	require.NoError(t, err)
+	require.Len(t, dittoMessages, 2)
+
+	// the commands are sorted by the property name
+	dittoMessage := assertTwinCommand(t, dittoMessages[0], "edge:containers", "delete")
+	assert.Equal(t, "/features/ContainerOrchestrator/properties/config", dittoMessage.Path)
+	assert.Nil(t, dittoMessage.Value)
+
+	dittoMessage = assertTwinCommand(t, dittoMessages[1], "edge:update", "modify")
+	assert.Equal(t, "/features/UpdateOrchestrator/properties/desiredState", dittoMessage.Path)
+	assert.Equal(t, map[string]interface{}{"domains": []interface{}{map[string]interface{}{"id": "containers"}}}, dittoMessage.Value)
+	assert.False(t, dittoMessage.Headers.IsResponseRequired())
+}
+
+func TestDesiredPropertiesWithoutMappings(t *testing.T) {
+	handler := createDesiredPropertiesHandler(t, "../internal/testdata/handlers-mapper-config.json")
+	dittoMessages, err := handler.HandleMessage(createDesiredPatch(`{"updateDesiredState": {}, "$version": 2}`))
+	require.NoError(t, err)
+	assert.Empty(t, dittoMessages)
+
+	_, err = handler.HandleMessage(createDesiredPatch(`[1]`))
+	assert.Error(t, err)
+}
+
+func TestDesiredPropertiesReload(t *testing.T) {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig("../internal/testdata/handlers-mapper-config.json")
+	require.NoError(t, err)
+	snapshots := mapper.NewHolder(mapperConfig, nil, false)
+	handler := CreateDesiredPropertiesHandler(snapshots)
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+
+	mapperConfig, err = mapperconfig.LoadMessageMapperConfig(twinMapperConfig)
+	require.NoError(t, err)
+	snapshots.Reload(mapperConfig)
+
+	dittoMessages, err := handler.HandleMessage(createDesiredPatch(`{"updateDesiredState": {}, "$version": 3}`))
+	require.NoError(t, err)
+	assert.Len(t, dittoMessages, 1)
+}
+
+func assertTwinCommand(t *testing.T, msg *message.Message, thing string, action string) *protocol.Envelope {
+	dittoMessage := &protocol.Envelope{}
+	require.NoError(t, json.Unmarshal(msg.Payload, dittoMessage))
+	assert.Equal(t, "azure.edge/dummy-hub:dummy-device:"+thing+"/things/twin/commands/"+action, dittoMessage.Topic.String())
+	topic, _ := connector.TopicFromCtx(msg.Context())
+	assert.Equal(t, "command//azure.edge:dummy-hub:dummy-device:"+thing+"/req/"+dittoMessage.Headers.CorrelationID()+"/"+action, topic)
+	return dittoMessage
+}
+
+func createDesiredPatch(payload string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	msg.SetContext(connector.SetTopicToCtx(msg.Context(), "$iothub/twin/PATCH/properties/desired/?$version=4"))
+	return msg
+}
+
+func createDesiredPropertiesHandler(t *testing.T, messageMapperConfig string) bus.CloudHandler {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(messageMapperConfig)
+	require.NoError(t, err)
+	handler := CreateDesiredPropertiesHandler(mapper.NewHolder(mapperConfig, nil, false))
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+	return handler
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package twin
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse/ditto-clients-golang/protocol"
+	"github.com/pkg/errors"
+)
+
+const (
+	reportedHandlerName = "twin_reported_handler"
+	// eventTopics are the local topics of the Ditto twin events
+	eventTopics = "event/#,e/#"
+	// reportedTopicPattern is the Azure IoT Hub topic of the reported property patches, the request ID correlates
+	// the patches with the responses of the Azure IoT Hub
+	reportedTopicPattern = "$iothub/twin/PATCH/properties/reported/?$rid=%s"
+)
+
+type reportedPropertiesHandler struct {
+	connInfo  *config.RemoteConnectionInfo
+	snapshots *mapper.Holder
+}
+
+// CreateReportedPropertiesHandler instantiates a handler of the Ditto twin events, which updates the mapped reported
+// properties of the device twin
+func CreateReportedPropertiesHandler(snapshots *mapper.Holder) handlers.TelemetryHandler {
+	return &reportedPropertiesHandler{snapshots: snapshots}
+}
+
+func (h *reportedPropertiesHandler) Init(connInfo *config.RemoteConnectionInfo) error {
+	h.connInfo = connInfo
+	return nil
+}
+
+// HandleMessage converts a Ditto twin event to a reported property patch of the mapped properties, the other Ditto
+// messages are skipped.
+func (h *reportedPropertiesHandler) HandleMessage(msg *message.Message) ([]*message.Message, error) {
+	dittoMessage := &protocol.Envelope{}
+	if err := json.Unmarshal(msg.Payload, dittoMessage); err != nil {
+		return nil, errors.Wrap(err, "cannot deserialize Ditto message")
+	}
+	mapperConfig := h.snapshots.Load().Config
+	if mapperConfig == nil || dittoMessage.Topic == nil {
+		return nil, nil
+	}
+	matches := mapperConfig.MatchReportedProperties(dittoMessage.Topic.String(), dittoMessage.Path)
+	patch := map[string]interface{}{}
+	for _, match := range matches {
+		if value, ok := reportedValue(dittoMessage, match); ok {
+			patch[match.Property] = value
+		}
+	}
+	if len(patch) == 0 {
+		return nil, nil
+	}
+
+	outgoingPayload, err := json.Marshal(patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize reported properties")
+	}
+	msgID := watermill.NewUUID()
+	outgoingMessage := message.NewMessage(msgID, outgoingPayload)
+	outgoingTopic := fmt.Sprintf(reportedTopicPattern, msgID)
+	outgoingMessage.SetContext(connector.SetTopicToCtx(outgoingMessage.Context(), outgoingTopic))
+	return []*message.Message{outgoingMessage}, nil
+}
+
+// reportedValue returns the value of a reported property updated by a Ditto twin event, a deleted Ditto property is
+// a null value, which removes the reported property. A property missing in the value of an event on a parent path
+// is removed too, unless the event is a merge, which leaves the missing properties unchanged.
+func reportedValue(dittoMessage *protocol.Envelope, match *mapperconfig.ReportedPropertyMatch) (interface{}, bool) {
+	if dittoMessage.Topic.Action == protocol.ActionDeleted {
+		return wrapValue(nil, match.PatchPath), true
+	}
+	value := dittoMessage.Value
+	for _, key := range match.ValuePath {
+		object, _ := value.(map[string]interface{})
+		child, ok := object[key]
+		if !ok {
+			return nil, dittoMessage.Topic.Action != protocol.ActionMerged
+		}
+		value = child
+	}
+	return wrapValue(value, match.PatchPath), true
+}
+
+// wrapValue returns the patch of a property setting a value at the keys of the patch path, since the reported
+// property patches are merged with the device twin.
+func wrapValue(value interface{}, patchPath []string) interface{} {
+	for i := len(patchPath) - 1; i >= 0; i-- {
+		value = map[string]interface{}{patchPath[i]: value}
+	}
+	return value
+}
+
+func (h *reportedPropertiesHandler) Name() string {
+	return reportedHandlerName
+}
+
+func (h *reportedPropertiesHandler) Topics() string {
+	return eventTopics
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package twin
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-kanto/azure-connector/config"
+	"github.com/eclipse-kanto/azure-connector/routing/message/handlers"
+
+	mapperconfig "github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportedPropertiesHandler(t *testing.T) {
+	handler := createReportedPropertiesHandler(t)
+	assert.Equal(t, reportedHandlerName, handler.Name())
+	assert.Equal(t, "event/#,e/#", handler.Topics())
+}
+
+func TestReportedPropertiesPatch(t *testing.T) {
+	handler := createReportedPropertiesHandler(t)
+	tests := []struct {
+		event string
+		patch string
+	}{
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/modified",
+			"path": "/features/UpdateOrchestrator/properties/status",
+			"value": {"state": "IDLE"}
+		}`, `{"updateStatus": {"state": "IDLE"}}`},
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/modified",
+			"path": "/features/UpdateOrchestrator/properties/status/state",
+			"value": "RUNNING"
+		}`, `{"updateStatus": {"state": "RUNNING"}}`},
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/created",
+			"path": "/features/UpdateOrchestrator",
+			"value": {"properties": {"status": {"state": "IDLE"}, "other": 1}}
+		}`, `{"updateStatus": {"state": "IDLE"}}`},
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/modified",
+			"path": "/features/UpdateOrchestrator/properties",
+			"value": {"other": 1}
+		}`, `{"updateStatus": null}`},
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/deleted",
+			"path": "/features/UpdateOrchestrator/properties/status/progress"
+		}`, `{"updateStatus": {"progress": null}}`},
+		{`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:containers/things/twin/events/merged",
+			"path": "/",
+			"value": {"features": {"ContainerOrchestrator": {"properties": {"status": {"running": 2}}}}}
+		}`, `{"containerStatus": {"running": 2}}`},
+	}
+	for _, test := range tests {
+		reportedMessages, err := handler.HandleMessage(createDittoEvent(test.event))
+		require.NoError(t, err, test.event)
+		require.Len(t, reportedMessages, 1, test.event)
+		assert.JSONEq(t, test.patch, string(reportedMessages[0].Payload), test.event)
+		topic, _ := connector.TopicFromCtx(reportedMessages[0].Context())
+		assert.Equal(t, "$iothub/twin/PATCH/properties/reported/?$rid="+reportedMessages[0].UUID, topic)
+	}
+}
+
+func TestReportedPropertiesSkipped(t *testing.T) {
+	handler := createReportedPropertiesHandler(t)
+	for _, event := range []string{
+		// a merge leaves the properties missing in its value unchanged
+		`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/twin/events/merged",
+			"path": "/features/UpdateOrchestrator/properties",
+			"value": {"other": 1}
+		}`,
+		`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:update/things/live/messages/status",
+			"path": "/features/UpdateOrchestrator/properties/status",
+			"value": {"state": "IDLE"}
+		}`,
+		`{
+			"topic": "azure.edge/dummy-hub:dummy-device:edge:other/things/twin/events/modified",
+			"path": "/features/UpdateOrchestrator/properties/status",
+			"value": {"state": "IDLE"}
+		}`,
+		`{"value": 1}`,
+	} {
+		reportedMessages, err := handler.HandleMessage(createDittoEvent(event))
+		require.NoError(t, err, event)
+		assert.Empty(t, reportedMessages, event)
+	}
+
+	_, err := handler.HandleMessage(createDittoEvent(`{"topic": `))
+	assert.Error(t, err)
+}
+
+func createDittoEvent(payload string) *message.Message {
+	return message.NewMessage(watermill.NewUUID(), []byte(payload))
+}
+
+func createReportedPropertiesHandler(t *testing.T) handlers.TelemetryHandler {
+	mapperConfig, err := mapperconfig.LoadMessageMapperConfig(twinMapperConfig)
+	require.NoError(t, err)
+	handler := CreateReportedPropertiesHandler(mapper.NewHolder(mapperConfig, nil, false))
+	require.NoError(t, handler.Init(&config.RemoteConnectionInfo{DeviceID: "dummy-device", HubName: "dummy-hub"}))
+	return handler
+}
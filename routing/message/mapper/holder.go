@@ -0,0 +1,80 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mapper
+
+import (
+	"sync/atomic"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+)
+
+// Snapshot is a message mapper configuration together with the marshaller and the codecs created for it.
+// A snapshot is never changed, a reload switches to a new one.
+type Snapshot struct {
+	Config     *config.MessageMapperConfig
+	Marshaller protobuf.Marshaller
+	Codecs     *codec.Registry
+}
+
+// Holder holds the current snapshot of the message mapper configuration, which is shared by all message handlers.
+// The handlers load the snapshot once per message, so a message is always handled with the mappings, the marshaller
+// and the codecs of the same configuration, even if a reload switches to a new configuration in the meantime.
+type Holder struct {
+	current atomic.Value
+	preload bool
+}
+
+// NewHolder creates a holder with the snapshot of the provided message mapper configuration and marshaller. A reload
+// creates the marshaller of the new snapshot with NewPreloadedProtobufJSONMarshaller, if preload is set, and with
+// NewProtobufJSONMarshaller otherwise.
+func NewHolder(mapperConfig *config.MessageMapperConfig, marshaller protobuf.Marshaller, preload bool) *Holder {
+	h := &Holder{preload: preload}
+	h.current.Store(newSnapshot(mapperConfig, marshaller))
+	return h
+}
+
+func newSnapshot(mapperConfig *config.MessageMapperConfig, marshaller protobuf.Marshaller) *Snapshot {
+	return &Snapshot{
+		Config:     mapperConfig,
+		Marshaller: marshaller,
+		Codecs:     codec.NewRegistry(marshaller),
+	}
+}
+
+// Load returns the current snapshot.
+func (h *Holder) Load() *Snapshot {
+	return h.current.Load().(*Snapshot)
+}
+
+// Validate checks that the codecs of a new message mapper configuration are available and can encode the values of
+// its mappings, the schema files are read again.
+func (h *Holder) Validate(mapperConfig *config.MessageMapperConfig) error {
+	return codec.NewRegistry(nil).Validate(mapperConfig)
+}
+
+// Reload creates a new snapshot with a marshaller and codecs of its own for the new message mapper configuration and
+// switches all message handlers to it at once.
+func (h *Holder) Reload(mapperConfig *config.MessageMapperConfig) {
+	if mapperConfig == nil {
+		return
+	}
+	var marshaller protobuf.Marshaller
+	if h.preload {
+		// the proto messages of a reloaded configuration are loaded by its validation, the preload cannot fail
+		marshaller, _ = protobuf.NewPreloadedProtobufJSONMarshaller(mapperConfig)
+	} else {
+		marshaller = protobuf.NewProtobufJSONMarshaller(mapperConfig)
+	}
+	h.current.Store(newSnapshot(mapperConfig, marshaller))
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mapper_test
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/codec"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/mapper"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadSwitchesSnapshot(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "value.avsc")
+	require.NoError(t, ioutil.WriteFile(schemaFile, []byte(`"int"`), 0644))
+	mapperConfig := createMapperConfig(&config.TelemetryMessageMapping{Codec: codec.Avro, SchemaFile: schemaFile})
+	snapshots := mapper.NewHolder(mapperConfig, protobuf.NewProtobufJSONMarshaller(mapperConfig), false)
+	current := snapshots.Load()
+	assert.Same(t, mapperConfig, current.Config)
+	assert.Equal(t, []byte{0x0a}, encode(t, current, `5`))
+
+	require.NoError(t, ioutil.WriteFile(schemaFile, []byte(`"string"`), 0644))
+	reloadedConfig := createMapperConfig(&config.TelemetryMessageMapping{Codec: codec.Avro, SchemaFile: schemaFile})
+	snapshots.Reload(reloadedConfig)
+	reloaded := snapshots.Load()
+	assert.Same(t, reloadedConfig, reloaded.Config)
+	assert.NotSame(t, current.Marshaller, reloaded.Marshaller)
+	assert.NotSame(t, current.Codecs, reloaded.Codecs)
+	assert.Equal(t, []byte{0x08, 'f', 'i', 'v', 'e'}, encode(t, reloaded, `"five"`))
+
+	// a message that has loaded the previous snapshot is handled with its configuration and codecs to the end
+	assert.Same(t, mapperConfig, current.Config)
+	assert.Equal(t, []byte{0x0a}, encode(t, current, `5`))
+
+	snapshots.Reload(nil)
+	assert.Same(t, reloaded, snapshots.Load())
+}
+
+func TestReloadPreloadsProtoMessages(t *testing.T) {
+	mapping := &config.TelemetryMessageMapping{
+		ProtoFile:    "../protobuf/testdata/proto/simple_message.proto",
+		ProtoMessage: "SimpleMessage",
+	}
+	snapshots := mapper.NewHolder(&config.MessageMapperConfig{}, protobuf.NewProtobufJSONMarshaller(nil), true)
+	snapshots.Reload(createMapperConfig(mapping))
+
+	// the preloaded message descriptors are used without parsing the proto file again
+	mapping.ProtoFile = "../protobuf/testdata/proto/missing.proto"
+	protobufPayload, err := snapshots.Load().Marshaller.Marshal(1, "value", []byte(`{"name": "dummy_name"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "CgpkdW1teV9uYW1l", base64.StdEncoding.EncodeToString(protobufPayload))
+}
+
+func TestValidate(t *testing.T) {
+	snapshots := mapper.NewHolder(&config.MessageMapperConfig{}, nil, false)
+	assert.NoError(t, snapshots.Validate(createMapperConfig(&config.TelemetryMessageMapping{Codec: codec.CBOR})))
+
+	err := snapshots.Validate(createMapperConfig(&config.TelemetryMessageMapping{Codec: "xml"}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `messageMappings.telemetry["1"]["value"].codec: unsupported codec 'xml'`)
+}
+
+func createMapperConfig(mapping *config.TelemetryMessageMapping) *config.MessageMapperConfig {
+	return &config.MessageMapperConfig{
+		MessageMappings: &config.MessageMappings{
+			Telemetry: map[int]map[string]*config.TelemetryMessageMapping{1: {"value": mapping}},
+		},
+	}
+}
+
+func encode(t *testing.T, snapshot *mapper.Snapshot, value string) []byte {
+	avroCodec, err := snapshot.Codecs.Get(codec.Avro)
+	require.NoError(t, err)
+	payload, err := avroCodec.Encode(&codec.Target{MessageType: 1, MessageSubType: "value", SchemaFile: snapshot.Config.MessageMappings.Telemetry[1]["value"].SchemaFile}, []byte(value))
+	require.NoError(t, err)
+	return payload
+}
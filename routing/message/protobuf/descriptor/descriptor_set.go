@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package descriptor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dpb "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/pkg/errors"
+)
+
+const wellKnownTypePrefix = "google.protobuf."
+
+// LoadMessageDescriptorFromSets returns the descriptor of the fully qualified proto message, e.g. 'my.package.Status',
+// from the first descriptor set file that contains it. The descriptor set files are FileDescriptorSet messages as
+// produced by 'protoc --descriptor_set_out'. The well-known types like 'google.protobuf.Timestamp' are resolved even if
+// they are not part of the descriptor sets, so are the imports of the well-known proto files if the descriptor sets
+// are produced without '--include_imports'.
+func LoadMessageDescriptorFromSets(protoMessage string, descriptorSetFiles ...string) (*desc.MessageDescriptor, error) {
+	if protoMessage == "" {
+		return nil, errors.New("missing fully qualified proto message name for the descriptor sets")
+	}
+	for _, descriptorSetFile := range descriptorSetFiles {
+		fileDescriptors, err := loadDescriptorSet(descriptorSetFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileDescriptor := range fileDescriptors {
+			if messageDescriptor := fileDescriptor.FindMessage(protoMessage); messageDescriptor != nil {
+				return messageDescriptor, nil
+			}
+		}
+	}
+	if strings.HasPrefix(protoMessage, wellKnownTypePrefix) {
+		if messageDescriptor, err := desc.LoadMessageDescriptor(protoMessage); err == nil && messageDescriptor != nil {
+			return messageDescriptor, nil
+		}
+	}
+	if len(descriptorSetFiles) == 0 {
+		return nil, errors.New(fmt.Sprintf("no well-known proto message '%s'", protoMessage))
+	}
+	return nil, errors.New(fmt.Sprintf("no proto message '%s' in descriptor sets '%s'", protoMessage, strings.Join(descriptorSetFiles, "', '")))
+}
+
+// IsWellKnownType returns true if the message is one of the well-known types, e.g. google.protobuf.Timestamp.
+func IsWellKnownType(messageDescriptor *desc.MessageDescriptor) bool {
+	return strings.HasPrefix(messageDescriptor.GetFullyQualifiedName(), wellKnownTypePrefix)
+}
+
+func loadDescriptorSet(descriptorSetFile string) (map[string]*desc.FileDescriptor, error) {
+	data, err := ioutil.ReadFile(descriptorSetFile)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot read descriptor set file '%s'", descriptorSetFile))
+	}
+	descriptorSet := &dpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, descriptorSet); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot parse descriptor set file '%s'", descriptorSetFile))
+	}
+	addStandardImports(descriptorSet)
+	fileDescriptors, err := desc.CreateFileDescriptorsFromSet(descriptorSet)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid descriptor set file '%s'", descriptorSetFile))
+	}
+	return fileDescriptors, nil
+}
+
+// addStandardImports adds the well-known proto files that are imported but missing in the descriptor set.
+func addStandardImports(descriptorSet *dpb.FileDescriptorSet) {
+	files := map[string]bool{}
+	for _, file := range descriptorSet.GetFile() {
+		files[file.GetName()] = true
+	}
+	for i := 0; i < len(descriptorSet.File); i++ {
+		for _, dependency := range descriptorSet.File[i].GetDependency() {
+			if files[dependency] {
+				continue
+			}
+			if fileDescriptor, err := desc.LoadFileDescriptor(dependency); err == nil && fileDescriptor != nil {
+				descriptorSet.File = append(descriptorSet.File, fileDescriptor.AsFileDescriptorProto())
+				files[dependency] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package descriptor
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/pkg/errors"
+)
+
+// IncludePaths are the directories where the imports of the proto files are searched, after the directory of the
+// loaded proto file. They are set once at startup, before any proto file is loaded.
+var IncludePaths []string
+
+// LoadMessageDescriptor parses a proto file and returns the descriptor of the provided proto message.
+// The proto message is either the name of a top-level message of the proto file or a fully qualified message name,
+// e.g. 'my.package.Outer.Inner', that is looked up in the proto file and in all files it imports. A message name
+// without the package, e.g. 'Outer.Inner', is looked up in the package of the proto file.
+// The proto message can be omitted if the proto file contains a single message.
+func LoadMessageDescriptor(protoMessage, protoFile string) (*desc.MessageDescriptor, error) {
+	fileName, importPaths := resolveProtoFile(protoFile)
+	parser := protoparse.Parser{ImportPaths: importPaths}
+	fileDescriptors, err := parser.ParseFiles(fileName)
+	if err != nil {
+		return nil, err
+	}
+	fileDescriptor := fileDescriptors[0]
+	if strings.Contains(protoMessage, ".") {
+		if messageDescriptor := findMessage(fileDescriptor, protoMessage); messageDescriptor != nil {
+			return messageDescriptor, nil
+		}
+		if packageName := fileDescriptor.GetPackage(); packageName != "" {
+			if messageDescriptor := fileDescriptor.FindMessage(packageName + "." + protoMessage); messageDescriptor != nil {
+				return messageDescriptor, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("no proto message '%s' in proto file '%s'", protoMessage, protoFile))
+	}
+	messageDescriptors := fileDescriptor.GetMessageTypes()
+	if len(messageDescriptors) == 1 {
+		if protoMessage == "" || messageDescriptors[0].GetName() == protoMessage {
+			return messageDescriptors[0], nil
+		}
+		return nil, errors.New(fmt.Sprintf("no proto message '%s' in proto file '%s'", protoMessage, protoFile))
+	}
+	for _, messageDescriptor := range messageDescriptors {
+		if messageDescriptor.GetName() == protoMessage {
+			return messageDescriptor, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no proto message '%s' in proto file '%s'", protoMessage, protoFile))
+}
+
+// resolveProtoFile returns the name of the proto file to parse and the import paths to parse it with. A proto file
+// located in one of the include paths is named relative to it, so it is not parsed twice when it is also imported
+// by another proto file. Otherwise, the directory of the proto file comes first in the import paths.
+func resolveProtoFile(protoFile string) (string, []string) {
+	for _, includePath := range IncludePaths {
+		if relPath, err := filepath.Rel(includePath, protoFile); err == nil && !strings.HasPrefix(relPath, "..") {
+			return filepath.ToSlash(relPath), IncludePaths
+		}
+	}
+	return filepath.Base(protoFile), append([]string{filepath.Dir(protoFile)}, IncludePaths...)
+}
+
+// findMessage looks up the fully qualified message name in the file and in all files it imports.
+func findMessage(fileDescriptor *desc.FileDescriptor, protoMessage string) *desc.MessageDescriptor {
+	visited := map[string]bool{}
+	files := []*desc.FileDescriptor{fileDescriptor}
+	for len(files) > 0 {
+		file := files[0]
+		files = files[1:]
+		if visited[file.GetName()] {
+			continue
+		}
+		visited[file.GetName()] = true
+		if messageDescriptor := file.FindMessage(protoMessage); messageDescriptor != nil {
+			return messageDescriptor
+		}
+		files = append(files, file.GetDependencies()...)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package descriptor_test
+
+import (
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSingleMessageDescriptor(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("", "../testdata/proto/dummy_message.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "DummyMessage", messageDescriptor.GetName())
+}
+
+func TestLoadMessageDescriptorFromMultipleMessages(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("Message2", "../testdata/proto/multiple_messages.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "Message2", messageDescriptor.GetName())
+
+	_, err = descriptor.LoadMessageDescriptor("", "../testdata/proto/multiple_messages.proto")
+	require.Error(t, err)
+}
+
+func TestLoadMessageDescriptorWithImports(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("CompositeMessage", "../testdata/proto/composite_message.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "CompositeMessage", messageDescriptor.GetName())
+}
+
+func TestLoadMissingMessageDescriptor(t *testing.T) {
+	_, err := descriptor.LoadMessageDescriptor("UnsupportedMessage", "../testdata/proto/dummy_message.proto")
+	require.Error(t, err)
+	_, err = descriptor.LoadMessageDescriptor("", "../testdata/proto/missing_messages_file.proto")
+	require.Error(t, err)
+	_, err = descriptor.LoadMessageDescriptor("", "../testdata/proto/invalid_message.proto")
+	require.Error(t, err)
+}
+
+func TestLoadMessageDescriptorWithFullyQualifiedName(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("test.proto.Message2", "../testdata/proto/multiple_messages.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "Message2", messageDescriptor.GetName())
+
+	_, err = descriptor.LoadMessageDescriptor("other.proto.Message2", "../testdata/proto/multiple_messages.proto")
+	require.Error(t, err)
+}
+
+func TestLoadMessageDescriptorWithWellKnownImport(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("", "../testdata/proto/timestamped_message.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "google.protobuf.Timestamp", messageDescriptor.FindFieldByName("time").GetMessageType().GetFullyQualifiedName())
+}
+
+func TestLoadMessageDescriptorFromSets(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptorFromSets("test.proto.CompositeMessage", "../testdata/messages.protoset")
+	require.NoError(t, err)
+	assert.Equal(t, "test.proto.SimpleMessage", messageDescriptor.FindFieldByName("composite").GetMessageType().FindFieldByName("composite").GetMessageType().GetFullyQualifiedName())
+
+	// the descriptor set is produced without the imported well-known proto files
+	messageDescriptor, err = descriptor.LoadMessageDescriptorFromSets("test.proto.TimestampedMessage", "../testdata/messages.protoset")
+	require.NoError(t, err)
+	assert.Equal(t, "google.protobuf.Timestamp", messageDescriptor.FindFieldByName("time").GetMessageType().GetFullyQualifiedName())
+}
+
+func TestLoadWellKnownMessageDescriptor(t *testing.T) {
+	messageDescriptor, err := descriptor.LoadMessageDescriptorFromSets("google.protobuf.Timestamp")
+	require.NoError(t, err)
+	assert.Equal(t, "Timestamp", messageDescriptor.GetName())
+
+	messageDescriptor, err = descriptor.LoadMessageDescriptorFromSets("google.protobuf.Duration", "../testdata/messages.protoset")
+	require.NoError(t, err)
+	assert.Equal(t, "Duration", messageDescriptor.GetName())
+}
+
+func TestLoadMissingMessageDescriptorFromSets(t *testing.T) {
+	_, err := descriptor.LoadMessageDescriptorFromSets("CompositeMessage", "../testdata/messages.protoset")
+	assert.EqualError(t, err, "no proto message 'CompositeMessage' in descriptor sets '../testdata/messages.protoset'")
+	_, err = descriptor.LoadMessageDescriptorFromSets("", "../testdata/messages.protoset")
+	require.Error(t, err)
+	_, err = descriptor.LoadMessageDescriptorFromSets("test.proto.CompositeMessage", "../testdata/missing.protoset")
+	require.Error(t, err)
+	_, err = descriptor.LoadMessageDescriptorFromSets("test.proto.CompositeMessage", "../testdata/proto/simple_message.proto")
+	require.Error(t, err)
+}
+
+func TestLoadMessageDescriptorWithIncludePaths(t *testing.T) {
+	_, err := descriptor.LoadMessageDescriptor("", "../testdata/proto/event_message.proto")
+	require.Error(t, err)
+
+	descriptor.IncludePaths = []string{"../testdata/include"}
+	defer func() { descriptor.IncludePaths = nil }()
+
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("", "../testdata/proto/event_message.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "test.proto.EventMessage", messageDescriptor.GetFullyQualifiedName())
+
+	messageDescriptor, err = descriptor.LoadMessageDescriptor("test.common.Header", "../testdata/include/test/common/header.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "test.common.Header", messageDescriptor.GetFullyQualifiedName())
+}
+
+func TestLoadNestedAndImportedMessageDescriptors(t *testing.T) {
+	descriptor.IncludePaths = []string{"../testdata/include"}
+	defer func() { descriptor.IncludePaths = nil }()
+
+	for _, protoMessage := range []string{"test.proto.EventMessage.Detail", "EventMessage.Detail"} {
+		messageDescriptor, err := descriptor.LoadMessageDescriptor(protoMessage, "../testdata/proto/event_message.proto")
+		require.NoError(t, err)
+		assert.Equal(t, "test.proto.EventMessage.Detail", messageDescriptor.GetFullyQualifiedName())
+	}
+	messageDescriptor, err := descriptor.LoadMessageDescriptor("test.common.Header.Source", "../testdata/proto/event_message.proto")
+	require.NoError(t, err)
+	assert.Equal(t, "test.common.Header.Source", messageDescriptor.GetFullyQualifiedName())
+
+	_, err = descriptor.LoadMessageDescriptor("Header.Source", "../testdata/proto/event_message.proto")
+	assert.EqualError(t, err, "no proto message 'Header.Source' in proto file '../testdata/proto/event_message.proto'")
+}
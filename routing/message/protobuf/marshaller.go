@@ -15,80 +15,276 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
-	"io"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/protobuf/descriptor"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/jhump/protoreflect/desc"
-	"github.com/jhump/protoreflect/desc/protoparse"
 	"github.com/jhump/protoreflect/dynamic"
 	"github.com/pkg/errors"
 )
 
+const (
+	marshalErrorMsg             = "cannot serialize D2C message payload to protobuf format for message type '%v' and message subtype '%s'"
+	unmarshalErrorMsg           = "Cannot deserialize C2D message protobuf payload format to JSON for message type '%s'!"
+	marshalCommandErrorMsg      = "cannot serialize C2D message payload to protobuf format for message type '%s'"
+	marshalCommandReplyErrorMsg = "cannot serialize command reply payload to protobuf format for message type '%s'"
+	unmarshalTelemetryErrorMsg  = "cannot deserialize D2C message protobuf payload to JSON for message type '%v' and message subtype '%s'"
+)
+
 // Marshaller is an interface for marshalling/unmarshalling C2D & D2C messages to/from protobuf message payload.
+// The telemetry messages are encoded with Marshal and decoded with UnmarshalTelemetry, the commands are decoded with
+// Unmarshal and encoded with MarshalCommand and the replies of the commands are encoded with MarshalCommandReply.
 type Marshaller interface {
 	Marshal(messageType int, messageSubType string, payload []byte) ([]byte, error)
+	MarshalProtoJSON(messageType int, messageSubType string, payload []byte, protoNames bool) ([]byte, error)
+	UnmarshalTelemetry(messageType int, messageSubType string, protobufPayload []byte) ([]byte, error)
 	Unmarshal(messageType string, protobufPayload string) ([]byte, error)
+	UnmarshalBinary(messageType string, protobufPayload []byte) ([]byte, error)
+	MarshalCommand(messageType string, payload []byte) ([]byte, error)
+	MarshalCommandReply(messageType string, payload []byte) ([]byte, error)
+}
+
+// PreloadError contains all problems found while preloading the message descriptors of a message mapper
+// configuration, each one prefixed with the JSON path of the mapping.
+type PreloadError struct {
+	Problems []string
 }
 
+func (e *PreloadError) Error() string {
+	return fmt.Sprintf("cannot load proto messages: %s", strings.Join(e.Problems, "; "))
+}
+
+// jsonProtobufMarshaller is safe for concurrent use, the lock guards the mapper configuration and the descriptor caches.
+// A preloading marshaller also keeps the load errors, so the messages of the broken mappings fail without parsing the
+// proto files again.
 type jsonProtobufMarshaller struct {
-	mapperConfig                *config.MessageMapperConfig
-	commandMessageDescriptors   map[string]*desc.MessageDescriptor
-	telemetryMessageDescriptors map[int]map[string]*desc.MessageDescriptor
+	lock                           sync.RWMutex
+	mapperConfig                   *config.MessageMapperConfig
+	preload                        bool
+	commandMessageDescriptors      map[string]*desc.MessageDescriptor
+	commandReplyMessageDescriptors map[string]*desc.MessageDescriptor
+	telemetryMessageDescriptors    map[int]map[string]*desc.MessageDescriptor
+	commandDescriptorErrors        map[string]error
+	commandReplyDescriptorErrors   map[string]error
+	telemetryDescriptorErrors      map[int]map[string]error
 }
 
-// NewProtobufJSONMarshaller creates a protobuf marshaller instance.
+// NewProtobufJSONMarshaller creates a protobuf marshaller instance, which loads the message descriptors on first use.
 func NewProtobufJSONMarshaller(mapperConfig *config.MessageMapperConfig) Marshaller {
-	return &jsonProtobufMarshaller{
-		mapperConfig:                mapperConfig,
-		commandMessageDescriptors:   make(map[string]*desc.MessageDescriptor),
-		telemetryMessageDescriptors: make(map[int]map[string]*desc.MessageDescriptor),
+	m := &jsonProtobufMarshaller{}
+	m.switchConfig(mapperConfig)
+	return m
+}
+
+// NewPreloadedProtobufJSONMarshaller creates a protobuf marshaller instance that loads the message descriptors of all
+// mappings with a proto message upfront. The mappings whose message descriptors cannot be loaded are reported at once
+// in a PreloadError, together with the marshaller, which fails the messages of these mappings and serves all others.
+func NewPreloadedProtobufJSONMarshaller(mapperConfig *config.MessageMapperConfig) (Marshaller, error) {
+	m := &jsonProtobufMarshaller{preload: true}
+	if problems := m.switchConfig(mapperConfig); len(problems) > 0 {
+		return m, &PreloadError{Problems: problems}
+	}
+	return m, nil
+}
+
+// Reload switches the marshaller to a new message mapper configuration and drops all cached message descriptors.
+// A preloading marshaller loads the message descriptors of the new configuration before switching to it.
+func (m *jsonProtobufMarshaller) Reload(mapperConfig *config.MessageMapperConfig) {
+	m.switchConfig(mapperConfig)
+}
+
+func (m *jsonProtobufMarshaller) switchConfig(mapperConfig *config.MessageMapperConfig) []string {
+	commandMessageDescriptors := make(map[string]*desc.MessageDescriptor)
+	commandReplyMessageDescriptors := make(map[string]*desc.MessageDescriptor)
+	telemetryMessageDescriptors := make(map[int]map[string]*desc.MessageDescriptor)
+	commandDescriptorErrors := make(map[string]error)
+	commandReplyDescriptorErrors := make(map[string]error)
+	telemetryDescriptorErrors := make(map[int]map[string]error)
+	problems := []string{}
+	if m.preload && mapperConfig != nil && mapperConfig.MessageMappings != nil {
+		for commandName, mapping := range mapperConfig.MessageMappings.Command {
+			if mapping == nil {
+				continue
+			}
+			if mapping.IsProtobuf() {
+				messageDescriptor, err := mapperConfig.LoadMessageDescriptor(mapping.ProtoFile, mapping.DescriptorSet, mapping.ProtoMessage)
+				if err != nil {
+					commandDescriptorErrors[commandName] = err
+					problems = append(problems, fmt.Sprintf("messageMappings.command[%q]: %v", commandName, err))
+				} else {
+					commandMessageDescriptors[commandName] = messageDescriptor
+				}
+			}
+			if mapping.ReplyProtoMessage != "" {
+				messageDescriptor, err := mapperConfig.LoadMessageDescriptor(mapping.ProtoFile, mapping.DescriptorSet, mapping.ReplyProtoMessage)
+				if err != nil {
+					commandReplyDescriptorErrors[commandName] = err
+					problems = append(problems, fmt.Sprintf("messageMappings.command[%q].replyProtoMessage: %v", commandName, err))
+				} else {
+					commandReplyMessageDescriptors[commandName] = messageDescriptor
+				}
+			}
+		}
+		for messageType, telemetryMappings := range mapperConfig.MessageMappings.Telemetry {
+			telemetryMessageDescriptors[messageType] = make(map[string]*desc.MessageDescriptor)
+			telemetryDescriptorErrors[messageType] = make(map[string]error)
+			for messageSubType, mapping := range telemetryMappings {
+				if mapping == nil || !mapping.IsProtobuf() {
+					continue
+				}
+				messageDescriptor, err := mapperConfig.LoadMessageDescriptor(mapping.ProtoFile, mapping.DescriptorSet, mapping.ProtoMessage)
+				if err != nil {
+					telemetryDescriptorErrors[messageType][messageSubType] = err
+					problems = append(problems, fmt.Sprintf("messageMappings.telemetry[\"%d\"][%q]: %v", messageType, messageSubType, err))
+					continue
+				}
+				telemetryMessageDescriptors[messageType][messageSubType] = messageDescriptor
+			}
+		}
+		sort.Strings(problems)
 	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.mapperConfig = mapperConfig
+	m.commandMessageDescriptors = commandMessageDescriptors
+	m.commandReplyMessageDescriptors = commandReplyMessageDescriptors
+	m.telemetryMessageDescriptors = telemetryMessageDescriptors
+	m.commandDescriptorErrors = commandDescriptorErrors
+	m.commandReplyDescriptorErrors = commandReplyDescriptorErrors
+	m.telemetryDescriptorErrors = telemetryDescriptorErrors
+	return problems
 }
 
 func (m *jsonProtobufMarshaller) Marshal(messageType int, messageSubType string, jsonPayload []byte) ([]byte, error) {
-	errorMsg := "cannot serialize D2C message payload to protobuf format for message type '%v' and message subtype '%s'"
+	dynamicMessage, err := m.toD2CProtoMessage(messageType, messageSubType, jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+	protobufPayload, err := dynamicMessage.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalErrorMsg, messageType, messageSubType))
+	}
+	return protobufPayload, nil
+}
+
+// MarshalProtoJSON converts a JSON payload to the JSON representation of the protobuf message, with the lower camel
+// case field names of the protobuf JSON mapping or the original field names of the proto file.
+func (m *jsonProtobufMarshaller) MarshalProtoJSON(messageType int, messageSubType string, jsonPayload []byte, protoNames bool) ([]byte, error) {
+	dynamicMessage, err := m.toD2CProtoMessage(messageType, messageSubType, jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+	protoJSONPayload, err := dynamicMessage.MarshalJSONPB(&jsonpb.Marshaler{OrigName: protoNames})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalErrorMsg, messageType, messageSubType))
+	}
+	return protoJSONPayload, nil
+}
+
+func (m *jsonProtobufMarshaller) toD2CProtoMessage(messageType int, messageSubType string, jsonPayload []byte) (*dynamic.Message, error) {
+	dynamicMessage, err := m.getD2CProtoMessage(messageType, messageSubType)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalErrorMsg, messageType, messageSubType))
+	}
+	if err := unmarshalJSONPayload(dynamicMessage, jsonPayload); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalErrorMsg, messageType, messageSubType))
+	}
+	return dynamicMessage, nil
+}
+
+// UnmarshalTelemetry converts a raw protobuf payload of a telemetry message to JSON.
+func (m *jsonProtobufMarshaller) UnmarshalTelemetry(messageType int, messageSubType string, payload []byte) ([]byte, error) {
 	dynamicMessage, err := m.getD2CProtoMessage(messageType, messageSubType)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType, messageSubType))
+		return nil, errors.Wrap(err, fmt.Sprintf(unmarshalTelemetryErrorMsg, messageType, messageSubType))
+	}
+	jsonPayload, err := marshalJSONPayload(dynamicMessage, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(unmarshalTelemetryErrorMsg, messageType, messageSubType))
+	}
+	return jsonPayload, nil
+}
+
+// MarshalCommand converts a JSON payload of a command to protobuf.
+func (m *jsonProtobufMarshaller) MarshalCommand(messageType string, jsonPayload []byte) ([]byte, error) {
+	messageDescriptor, err := m.getCommandMessageDescriptor(messageType, false)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalCommandErrorMsg, messageType))
+	}
+	protobufPayload, err := marshalProtobufPayload(dynamic.NewMessage(messageDescriptor), jsonPayload)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalCommandErrorMsg, messageType))
+	}
+	return protobufPayload, nil
+}
+
+// MarshalCommandReply converts a JSON payload of a command reply to protobuf, using the reply proto message of the
+// command mapping.
+func (m *jsonProtobufMarshaller) MarshalCommandReply(messageType string, jsonPayload []byte) ([]byte, error) {
+	messageDescriptor, err := m.getCommandMessageDescriptor(messageType, true)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalCommandReplyErrorMsg, messageType))
+	}
+	protobufPayload, err := marshalProtobufPayload(dynamic.NewMessage(messageDescriptor), jsonPayload)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf(marshalCommandReplyErrorMsg, messageType))
 	}
+	return protobufPayload, nil
+}
+
+// unmarshalJSONPayload sets the fields of the protobuf message from a JSON payload. A JSON value that is not an object
+// is set to the first field of the message.
+func unmarshalJSONPayload(dynamicMessage *dynamic.Message, jsonPayload []byte) error {
 	x := bytes.TrimLeft(jsonPayload, " \t\r\n")
 	isObject := len(x) > 0 && x[0] == '{'
-	if !isObject {
+	// the well-known types have their own JSON representation, e.g. a string for google.protobuf.Timestamp
+	if !isObject && !descriptor.IsWellKnownType(dynamicMessage.GetMessageDescriptor()) {
 		fieldName := dynamicMessage.GetKnownFields()[0].GetName()
 		strPayload := string(jsonPayload)
 		wrappedPayload := "{\"" + fieldName + "\":" + strPayload + "}"
 		jsonPayload = []byte(wrappedPayload)
 	}
-	err = dynamicMessage.UnmarshalJSON(jsonPayload)
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType, messageSubType))
+	return dynamicMessage.UnmarshalJSON(jsonPayload)
+}
+
+func marshalProtobufPayload(dynamicMessage *dynamic.Message, jsonPayload []byte) ([]byte, error) {
+	if err := unmarshalJSONPayload(dynamicMessage, jsonPayload); err != nil {
+		return nil, err
 	}
-	protobufPayload, err := dynamicMessage.Marshal()
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType, messageSubType))
+	return dynamicMessage.Marshal()
+}
+
+func marshalJSONPayload(dynamicMessage *dynamic.Message, protobufPayload []byte) ([]byte, error) {
+	if err := dynamicMessage.Unmarshal(protobufPayload); err != nil {
+		return nil, err
 	}
-	return protobufPayload, nil
+	return dynamicMessage.MarshalJSON()
 }
 
+// Unmarshal converts a base64 encoded protobuf payload to JSON.
 func (m *jsonProtobufMarshaller) Unmarshal(messageType string, payload string) ([]byte, error) {
-	errorMsg := "Cannot deserialize C2D message protobuf payload format to JSON for message type '%s'!"
-	dynamicMessage, err := m.getC2DProtoMessage(messageType)
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType))
-	}
 	decodedPayload, err := base64.StdEncoding.DecodeString(payload)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType))
+		return nil, errors.Wrap(err, fmt.Sprintf(unmarshalErrorMsg, messageType))
 	}
-	err = dynamicMessage.Unmarshal(decodedPayload)
+	return m.UnmarshalBinary(messageType, decodedPayload)
+}
+
+// UnmarshalBinary converts a raw protobuf payload to JSON.
+func (m *jsonProtobufMarshaller) UnmarshalBinary(messageType string, payload []byte) ([]byte, error) {
+	dynamicMessage, err := m.getC2DProtoMessage(messageType)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType))
+		return nil, errors.Wrap(err, fmt.Sprintf(unmarshalErrorMsg, messageType))
 	}
-	jsonPayload, err := dynamicMessage.MarshalJSON()
+	jsonPayload, err := marshalJSONPayload(dynamicMessage, payload)
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf(errorMsg, messageType))
+		return nil, errors.Wrap(err, fmt.Sprintf(unmarshalErrorMsg, messageType))
 	}
 	return jsonPayload, nil
 }
@@ -102,90 +298,104 @@ func (m *jsonProtobufMarshaller) getD2CProtoMessage(messageType int, messageSubT
 }
 
 func (m *jsonProtobufMarshaller) getC2DProtoMessage(messageType string) (*dynamic.Message, error) {
-	messageDescriptor, err := m.getCommandMessageDescriptor(messageType)
+	messageDescriptor, err := m.getCommandMessageDescriptor(messageType, false)
 	if err != nil {
 		return nil, err
 	}
 	return dynamic.NewMessage(messageDescriptor), nil
 }
 
+// getTelemetryMessageDescriptor returns the cached message descriptor or loads it outside of the lock, so the
+// messages with already loaded descriptors are not blocked while a proto file is parsed.
 func (m *jsonProtobufMarshaller) getTelemetryMessageDescriptor(messageType int, messageSubType string) (*desc.MessageDescriptor, error) {
-	messageSubTypeDescriptors, ok := m.telemetryMessageDescriptors[messageType]
+	m.lock.RLock()
+	mapperConfig := m.mapperConfig
+	messageDescriptor, ok := m.telemetryMessageDescriptors[messageType][messageSubType]
+	err, failed := m.telemetryDescriptorErrors[messageType][messageSubType]
+	m.lock.RUnlock()
 	if ok {
-		if messageDescriptor, ok := messageSubTypeDescriptors[messageSubType]; ok {
-			return messageDescriptor, nil
-		}
-		messageMapping, err := m.mapperConfig.GetTelemetryMessageMapping(messageType, messageSubType)
-		if messageMapping == nil {
-			return nil, err
-		}
-		messageDescriptor, err := m.loadMessageDescriptor(messageMapping.ProtoMessage, messageMapping.ProtoFile)
-		if err != nil {
-			return nil, err
-		}
-		messageSubTypeDescriptors[messageSubType] = messageDescriptor
 		return messageDescriptor, nil
 	}
-	messageMapping, err := m.mapperConfig.GetTelemetryMessageMapping(messageType, messageSubType)
+	if failed {
+		return nil, err
+	}
+
+	messageMapping, err := mapperConfig.GetTelemetryMessageMapping(messageType, messageSubType)
 	if messageMapping == nil {
 		return nil, err
 	}
-	messageDescriptor, err := m.loadMessageDescriptor(messageMapping.ProtoMessage, messageMapping.ProtoFile)
+	messageDescriptor, err = mapperConfig.LoadMessageDescriptor(messageMapping.ProtoFile, messageMapping.DescriptorSet, messageMapping.ProtoMessage)
 	if err != nil {
 		return nil, err
 	}
-	messageSubTypeDescriptors = make(map[string]*desc.MessageDescriptor)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// a descriptor loaded from a configuration that was replaced in the meantime is not cached
+	if m.mapperConfig != mapperConfig {
+		return messageDescriptor, nil
+	}
+	messageSubTypeDescriptors, ok := m.telemetryMessageDescriptors[messageType]
+	if !ok {
+		messageSubTypeDescriptors = make(map[string]*desc.MessageDescriptor)
+		m.telemetryMessageDescriptors[messageType] = messageSubTypeDescriptors
+	}
+	if cachedDescriptor, ok := messageSubTypeDescriptors[messageSubType]; ok {
+		return cachedDescriptor, nil
+	}
 	messageSubTypeDescriptors[messageSubType] = messageDescriptor
-	m.telemetryMessageDescriptors[messageType] = messageSubTypeDescriptors
 	return messageDescriptor, nil
 }
 
-func (m *jsonProtobufMarshaller) getCommandMessageDescriptor(messageType string) (*desc.MessageDescriptor, error) {
-	if messageDescriptor, ok := m.commandMessageDescriptors[messageType]; ok {
+// getCommandMessageDescriptor returns the cached message descriptor of the command or of its reply or loads it
+// outside of the lock.
+func (m *jsonProtobufMarshaller) getCommandMessageDescriptor(messageType string, reply bool) (*desc.MessageDescriptor, error) {
+	m.lock.RLock()
+	mapperConfig := m.mapperConfig
+	messageDescriptors, descriptorErrors := m.commandDescriptorCaches(reply)
+	messageDescriptor, ok := messageDescriptors[messageType]
+	err, failed := descriptorErrors[messageType]
+	m.lock.RUnlock()
+	if ok {
 		return messageDescriptor, nil
 	}
-	messageMapping, err := m.mapperConfig.GetCommandMessageMapping(messageType)
-	if messageMapping == nil {
-		return nil, err
-	}
-	messageDescriptor, err := m.loadMessageDescriptor(messageMapping.ProtoMessage, messageMapping.ProtoFile)
-	if err != nil {
+	if failed {
 		return nil, err
 	}
-	m.commandMessageDescriptors[messageType] = messageDescriptor
-	return messageDescriptor, nil
-}
 
-func (m *jsonProtobufMarshaller) loadMessageDescriptor(protoMessage, protoFile string) (*desc.MessageDescriptor, error) {
-	index := strings.LastIndex(protoFile, "/")
-	var protoFilesPath string
-	if index == -1 {
-		protoFilesPath = protoFile
-	} else {
-		protoFilesPath = protoFile[:index]
+	messageMapping, err := mapperConfig.GetCommandMessageMapping(messageType)
+	if messageMapping == nil {
+		return nil, err
 	}
-	fileAccessor := func(fileName string) (io.ReadCloser, error) {
-		if !strings.HasPrefix(fileName, protoFilesPath) {
-			fileName = protoFilesPath + "/" + fileName
+	protoMessage := messageMapping.ProtoMessage
+	if reply {
+		if messageMapping.ReplyProtoMessage == "" {
+			return nil, errors.New(fmt.Sprintf("no reply proto message for message type '%s'", messageType))
 		}
-		return os.Open(fileName)
+		protoMessage = messageMapping.ReplyProtoMessage
 	}
-	parser := protoparse.Parser{Accessor: fileAccessor}
-	fileDescriptors, err := parser.ParseFiles(protoFile)
+	messageDescriptor, err = mapperConfig.LoadMessageDescriptor(messageMapping.ProtoFile, messageMapping.DescriptorSet, protoMessage)
 	if err != nil {
 		return nil, err
 	}
-	messageDescriptors := fileDescriptors[0].GetMessageTypes()
-	if len(messageDescriptors) == 1 {
-		if protoMessage == "" || messageDescriptors[0].GetName() == protoMessage {
-			return messageDescriptors[0], nil
-		}
-		return nil, errors.New(fmt.Sprintf("no proto message '%s' in proto file '%s'", protoMessage, protoFile))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.mapperConfig != mapperConfig {
+		return messageDescriptor, nil
 	}
-	for _, messageDescriptor := range messageDescriptors {
-		if messageDescriptor.GetName() == protoMessage {
-			return messageDescriptor, nil
-		}
+	messageDescriptors, _ = m.commandDescriptorCaches(reply)
+	if cachedDescriptor, ok := messageDescriptors[messageType]; ok {
+		return cachedDescriptor, nil
+	}
+	messageDescriptors[messageType] = messageDescriptor
+	return messageDescriptor, nil
+}
+
+// commandDescriptorCaches returns the caches of the command or reply message descriptors, the lock must be held.
+func (m *jsonProtobufMarshaller) commandDescriptorCaches(reply bool) (map[string]*desc.MessageDescriptor, map[string]error) {
+	if reply {
+		return m.commandReplyMessageDescriptors, m.commandReplyDescriptorErrors
 	}
-	return nil, errors.New(fmt.Sprintf("no proto message '%s' in proto file '%s'", protoMessage, protoFile))
+	return m.commandMessageDescriptors, m.commandDescriptorErrors
 }
@@ -12,6 +12,7 @@ package protobuf_test
 
 import (
 	"encoding/base64"
+	"sync"
 	"testing"
 
 	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/config"
@@ -278,6 +279,37 @@ func TestMarshalPayloadForCachedMessageSubType(t *testing.T) {
 	assert.Equal(t, "CgtkdW1teV92YWx1ZQ==", encodedPayload)
 }
 
+func TestMarshalPayloadAfterReload(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	json := `{
+		"value" : "dummy_value"
+	}`
+	protobufPayload, err := marshaller.Marshal(1, "dummy-message", []byte(json))
+	require.NoError(t, err)
+	assert.Equal(t, "CgtkdW1teV92YWx1ZQ==", base64.StdEncoding.EncodeToString(protobufPayload))
+
+	reloadable, ok := marshaller.(config.Reloadable)
+	require.True(t, ok)
+	reloadable.Reload(&config.MessageMapperConfig{
+		MessageMappings: &config.MessageMappings{
+			Telemetry: map[int]map[string]*config.TelemetryMessageMapping{
+				1: {
+					"dummy-message": {
+						ProtoFile:    "testdata/proto/simple_message.proto",
+						ProtoMessage: "SimpleMessage",
+					},
+				},
+			},
+		},
+	})
+	protobufPayload, err = marshaller.Marshal(1, "dummy-message", []byte(json))
+	require.NoError(t, err)
+	assert.Equal(t, "EgtkdW1teV92YWx1ZQ==", base64.StdEncoding.EncodeToString(protobufPayload))
+
+	_, err = marshaller.Marshal(1, "simple-message", []byte(json))
+	require.Error(t, err)
+}
+
 func TestMarshalValidPayloadAndMessageSubType(t *testing.T) {
 	marshaller := createProtobufMarshaller(t)
 	for _, testValues := range testData {
@@ -290,6 +322,34 @@ func TestMarshalValidPayloadAndMessageSubType(t *testing.T) {
 	}
 }
 
+func TestMarshalProtoJSON(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	json := `{"value_string": "dummy_string", "rep_value_int": [1, 2], "value_bool": false}`
+
+	protoJSON, err := marshaller.MarshalProtoJSON(1, "multiple-types-message", []byte(json), false)
+	require.NoError(t, err)
+	assert.Equal(t, `{"valueString":"dummy_string","repValueInt":[1,2]}`, string(protoJSON))
+
+	protoJSON, err = marshaller.MarshalProtoJSON(1, "multiple-types-message", []byte(json), true)
+	require.NoError(t, err)
+	assert.Equal(t, `{"value_string":"dummy_string","rep_value_int":[1,2]}`, string(protoJSON))
+
+	_, err = marshaller.MarshalProtoJSON(1, "multiple-types-message", []byte(`{"value_int": "x"}`), false)
+	require.Error(t, err)
+}
+
+func TestMarshalPayloadFromDescriptorSet(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	json := `{"value": "dummy_value", "time": "2022-06-01T10:00:00Z"}`
+	protobufPayload, err := marshaller.Marshal(1, "descriptor-set-message", []byte(json))
+	require.NoError(t, err)
+	assert.Equal(t, "CgtkdW1teV92YWx1ZRIGCKDx3JQG", base64.StdEncoding.EncodeToString(protobufPayload))
+
+	protobufPayload, err = marshaller.Marshal(1, "well-known-message", []byte(`"2022-06-01T10:00:00Z"`))
+	require.NoError(t, err)
+	assert.Equal(t, "CKDx3JQG", base64.StdEncoding.EncodeToString(protobufPayload))
+}
+
 func TestUnmarshalPayloadEmptyProtoMessage(t *testing.T) {
 	marshaller := createProtobufMarshaller(t)
 	_, err := marshaller.Unmarshal("empty-messages", "CghpbmZsdXhkYg==")
@@ -356,6 +416,22 @@ func TestUnmarshalPayloadForCachedMessageSubType(t *testing.T) {
 	assert.Equal(t, jsonString, string(jsonPayload))
 }
 
+func TestUnmarshalBinaryPayload(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	for _, testValues := range testData {
+		t.Run(testValues.messageSubType, func(t *testing.T) {
+			protobufPayload, err := base64.StdEncoding.DecodeString(testValues.encodedPayload)
+			require.NoError(t, err)
+			jsonPayload, err := marshaller.UnmarshalBinary(testValues.messageSubType, protobufPayload)
+			require.NoError(t, err)
+			assert.Equal(t, testValues.jsonString, string(jsonPayload))
+		})
+	}
+
+	_, err := marshaller.UnmarshalBinary("dummy-message", []byte{0x0a, 0x7f})
+	require.Error(t, err)
+}
+
 func TestUnmarshalValidPayloadAndMessageSubType(t *testing.T) {
 	marshaller := createProtobufMarshaller(t)
 	for _, testValues := range testData {
@@ -367,6 +443,143 @@ func TestUnmarshalValidPayloadAndMessageSubType(t *testing.T) {
 	}
 }
 
+func TestUnmarshalTelemetry(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	for _, testValues := range testData {
+		t.Run(testValues.messageSubType, func(t *testing.T) {
+			protobufPayload, err := base64.StdEncoding.DecodeString(testValues.encodedPayload)
+			require.NoError(t, err)
+			jsonPayload, err := marshaller.UnmarshalTelemetry(1, testValues.messageSubType, protobufPayload)
+			require.NoError(t, err)
+			assert.Equal(t, testValues.jsonString, string(jsonPayload))
+		})
+	}
+
+	_, err := marshaller.UnmarshalTelemetry(1, "dummy-message", []byte{0x0a, 0x7f})
+	require.Error(t, err)
+	_, err = marshaller.UnmarshalTelemetry(1, "dummy-message-unsupported", []byte{})
+	require.Error(t, err)
+}
+
+func TestMarshalCommand(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	for _, testValues := range testData {
+		t.Run(testValues.messageSubType, func(t *testing.T) {
+			protobufPayload, err := marshaller.MarshalCommand(testValues.messageSubType, []byte(testValues.jsonPayload))
+			require.NoError(t, err)
+			assert.Equal(t, testValues.encodedPayload, base64.StdEncoding.EncodeToString(protobufPayload))
+
+			jsonPayload, err := marshaller.UnmarshalBinary(testValues.messageSubType, protobufPayload)
+			require.NoError(t, err)
+			assert.Equal(t, testValues.jsonString, string(jsonPayload))
+		})
+	}
+
+	_, err := marshaller.MarshalCommand("simple-message", []byte(`{"unknown": "dummy_value"}`))
+	require.Error(t, err)
+	_, err = marshaller.MarshalCommand("missing-command", []byte(`{}`))
+	require.Error(t, err)
+}
+
+func TestMarshalCommandReply(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	protobufPayload, err := marshaller.MarshalCommandReply("message-with-reply", []byte(`{"value": "dummy_value"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "CgtkdW1teV92YWx1ZQ==", base64.StdEncoding.EncodeToString(protobufPayload))
+
+	protobufPayload, err = marshaller.MarshalCommand("message-with-reply", []byte(`{"value": "dummy_value"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "EgtkdW1teV92YWx1ZQ==", base64.StdEncoding.EncodeToString(protobufPayload))
+
+	_, err = marshaller.MarshalCommandReply("simple-message", []byte(`{"value": "dummy_value"}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no reply proto message for message type 'simple-message'")
+}
+
+func TestConcurrentMarshalAndUnmarshal(t *testing.T) {
+	marshaller := createProtobufMarshaller(t)
+	reloadable, ok := marshaller.(config.Reloadable)
+	require.True(t, ok)
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/message-mappings.json")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for _, testValues := range testData {
+					protobufPayload, err := marshaller.Marshal(1, testValues.messageSubType, []byte(testValues.jsonPayload))
+					if assert.NoError(t, err) {
+						assert.Equal(t, testValues.encodedPayload, base64.StdEncoding.EncodeToString(protobufPayload))
+					}
+					jsonPayload, err := marshaller.Unmarshal(testValues.messageSubType, testValues.encodedPayload)
+					if assert.NoError(t, err) {
+						assert.Equal(t, testValues.jsonString, string(jsonPayload))
+					}
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			reloadable.Reload(mapperConfig)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestPreloadedMarshaller(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/message-mappings.json")
+	require.NoError(t, err)
+	marshaller, err := protobuf.NewPreloadedProtobufJSONMarshaller(mapperConfig)
+	require.Error(t, err)
+	require.NotNil(t, marshaller)
+	preloadErr, ok := err.(*protobuf.PreloadError)
+	require.True(t, ok)
+	assert.Contains(t, preloadErr.Problems, `messageMappings.command["dummy-message-unsupported"]: no proto message 'UnsupportedMessage' in proto file 'testdata/proto/dummy_message.proto'`)
+	assert.Contains(t, preloadErr.Problems, `messageMappings.telemetry["1"]["dummy-message-unsupported"]: no proto message 'UnsupportedMessage' in proto file 'testdata/proto/dummy_message.proto'`)
+	assert.NotContains(t, err.Error(), "simple-message")
+
+	// the preloaded descriptors are used without parsing the proto files again
+	mapperConfig.MessageMappings.Telemetry[1]["simple-message"].ProtoFile = "testdata/proto/missing.proto"
+	mapperConfig.MessageMappings.Command["simple-message"].ProtoFile = "testdata/proto/missing.proto"
+	protobufPayload, err := marshaller.Marshal(1, "simple-message", []byte(`{"name": "dummy_name", "value": "dummy_value"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "CgpkdW1teV9uYW1lEgtkdW1teV92YWx1ZQ==", base64.StdEncoding.EncodeToString(protobufPayload))
+	jsonPayload, err := marshaller.Unmarshal("simple-message", "CgpkdW1teV9uYW1lEgtkdW1teV92YWx1ZQ==")
+	require.NoError(t, err)
+	assert.Equal(t, `{"name":"dummy_name","value":"dummy_value"}`, string(jsonPayload))
+
+	_, err = marshaller.Marshal(1, "dummy-message-unsupported", []byte(`{"value": "dummy_value"}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no proto message 'UnsupportedMessage'")
+	_, err = marshaller.Unmarshal("dummy-message-unsupported", "CgtkdW1teV92YWx1ZQ==")
+	require.Error(t, err)
+}
+
+func TestPreloadedMarshallerReload(t *testing.T) {
+	mapperConfig, err := config.LoadMessageMapperConfig("testdata/message-mappings.json")
+	require.NoError(t, err)
+	simpleMessageMapping := mapperConfig.MessageMappings.Telemetry[1]["simple-message"]
+	marshaller, err := protobuf.NewPreloadedProtobufJSONMarshaller(&config.MessageMapperConfig{
+		MessageMappings: &config.MessageMappings{
+			Telemetry: map[int]map[string]*config.TelemetryMessageMapping{1: {"simple-message": simpleMessageMapping}},
+		},
+	})
+	require.NoError(t, err)
+
+	reloadable, ok := marshaller.(config.Reloadable)
+	require.True(t, ok)
+	reloadable.Reload(mapperConfig)
+	simpleMessageMapping.ProtoFile = "testdata/proto/missing.proto"
+	_, err = marshaller.Marshal(1, "simple-message", []byte(`{"name": "dummy_name"}`))
+	require.NoError(t, err)
+}
+
 func createProtobufMarshaller(t *testing.T) protobuf.Marshaller {
 	mapperConfig, err := config.LoadMessageMapperConfig("testdata/message-mappings.json")
 	require.NoError(t, err)
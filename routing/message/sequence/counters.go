@@ -0,0 +1,192 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package sequence implements the named sequence counters behind the "++counter" value mappings.
+package sequence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultWidth is the width in bits of the counters, matching the uint32 sequence fields of the protobuf messages.
+	DefaultWidth = 32
+	// MaxWidth is the maximal width in bits of the counters.
+	MaxWidth = 64
+	// DefaultReserve is the number of counter values reserved with each write of the state file.
+	DefaultReserve = 100
+)
+
+// Counters is a set of named sequence counters. The counters are incremented up to the maximal value that fits in
+// the configured width and then wrap around. If a state file is set, a block of values of a counter is reserved in it
+// before the first value of the block is returned, so the counters continue after the reserved values after a restart
+// and never repeat a value, while the state file is written once per block instead of on every increment.
+type Counters struct {
+	stateFile string
+	reserve   uint64
+	max       uint64
+	wrapValue uint64
+	values    map[string]uint64
+	reserved  map[string]uint64
+	mu        sync.Mutex
+}
+
+// NewCounters creates a set of counters with the provided width in bits, restarting at the wrap value after the
+// maximal value. The counters are restored from the state file, if it exists, and reserve the provided number of
+// values with each write of it, zero or one writes it on every increment. An empty state file keeps the counters in
+// memory only.
+func NewCounters(stateFile string, width uint, wrapValue uint64, reserve uint64) (*Counters, error) {
+	if width == 0 || width > MaxWidth {
+		return nil, errors.New(fmt.Sprintf("counter width %d is not between 1 and %d", width, MaxWidth))
+	}
+	max := uint64(math.MaxUint64)
+	if width < MaxWidth {
+		max = uint64(1)<<width - 1
+	}
+	if wrapValue > max {
+		return nil, errors.New(fmt.Sprintf("counter wrap value %d exceeds the maximal value %d", wrapValue, max))
+	}
+	counters := &Counters{
+		stateFile: stateFile,
+		reserve:   reserve,
+		max:       max,
+		wrapValue: wrapValue,
+		values:    map[string]uint64{},
+		reserved:  map[string]uint64{},
+	}
+	if err := counters.restore(); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// Next increments the named counter and returns its new value. The first value of a counter is 1.
+// If the new value is not reserved yet and the reservation cannot be persisted, the counter is left unchanged.
+func (c *Counters) Next(name string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := c.values[name]
+	next := current + 1
+	wrapped := current >= c.max
+	if wrapped {
+		next = c.wrapValue
+	}
+	if reserved, ok := c.reserved[name]; c.stateFile != "" && (!ok || wrapped || next > reserved) {
+		c.reserved[name] = c.reservation(next)
+		if err := c.persist(); err != nil {
+			if ok {
+				c.reserved[name] = reserved
+			} else {
+				delete(c.reserved, name)
+			}
+			return 0, err
+		}
+	}
+	c.values[name] = next
+	return next, nil
+}
+
+// reservation returns the last value of the block of values reserved from the provided one on, which ends at the
+// maximal value at the latest.
+func (c *Counters) reservation(value uint64) uint64 {
+	if c.reserve <= 1 {
+		return value
+	}
+	if c.max-value < c.reserve-1 {
+		return c.max
+	}
+	return value + c.reserve - 1
+}
+
+// Value returns the current value of the named counter.
+func (c *Counters) Value(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[name]
+}
+
+func (c *Counters) restore() error {
+	if c.stateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, fmt.Sprintf("cannot read counters state file '%s'", c.stateFile))
+	}
+	if err := json.Unmarshal(data, &c.reserved); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot parse counters state file '%s'", c.stateFile))
+	}
+	// the counters continue after their reserved values, some of which may have been unused before the restart
+	for name, value := range c.reserved {
+		if value > c.max {
+			c.reserved[name] = c.wrapValue
+		}
+		c.values[name] = c.reserved[name]
+	}
+	return nil
+}
+
+// persist writes the reserved values of the counters to a temporary file in the directory of the state file and
+// renames it, so the state file is either the old or the new one, but never a partially written one.
+func (c *Counters) persist() error {
+	if c.stateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.reserved)
+	if err != nil {
+		return errors.Wrap(err, "cannot serialize counters")
+	}
+	dir := filepath.Dir(c.stateFile)
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(c.stateFile)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot create temporary counters state file in '%s'", dir))
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, fmt.Sprintf("cannot write counters state file '%s'", c.stateFile))
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, fmt.Sprintf("cannot sync counters state file '%s'", c.stateFile))
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot write counters state file '%s'", c.stateFile))
+	}
+	if err := os.Rename(tmpFile.Name(), c.stateFile); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot replace counters state file '%s'", c.stateFile))
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes the rename of the state file durable. Not all platforms support syncing a directory,
+// so the errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package sequence_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/sequence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextInMemory(t *testing.T) {
+	counters, err := sequence.NewCounters("", sequence.DefaultWidth, 0, 0)
+	require.NoError(t, err)
+
+	for _, expected := range []uint64{1, 2, 3} {
+		value, err := counters.Next("first")
+		require.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+	value, err := counters.Next("second")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), value)
+	assert.Equal(t, uint64(3), counters.Value("first"))
+	assert.Equal(t, uint64(0), counters.Value("missing"))
+}
+
+func TestConcurrentNext(t *testing.T) {
+	counters, err := sequence.NewCounters(filepath.Join(t.TempDir(), "counters.json"), sequence.DefaultWidth, 0, 1)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, err := counters.Next("counter")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(100), counters.Value("counter"))
+}
+
+func TestRestoreCounters(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	counters, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := counters.Next("deviceSequenceCounter")
+		require.NoError(t, err)
+	}
+
+	restored, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), restored.Value("deviceSequenceCounter"))
+	value, err := restored.Next("deviceSequenceCounter")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), value)
+
+	files, err := ioutil.ReadDir(filepath.Dir(stateFile))
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files), "no temporary files are left")
+}
+
+func TestReserveCounters(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	counters, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 10)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := counters.Next("counter")
+		require.NoError(t, err)
+	}
+	// the state file is written once per block of reserved values
+	info, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	assertStateFile(t, stateFile, `{"counter": 10}`)
+	for i := 0; i < 5; i++ {
+		_, err := counters.Next("counter")
+		require.NoError(t, err)
+	}
+	unchanged, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, info.ModTime(), unchanged.ModTime())
+	value, err := counters.Next("counter")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), value)
+	assertStateFile(t, stateFile, `{"counter": 20}`)
+
+	// a restarted counter continues after its reserved values
+	restored, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 10)
+	require.NoError(t, err)
+	value, err = restored.Next("counter")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), value)
+}
+
+func TestReserveWrapAround(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	counters, err := sequence.NewCounters(stateFile, 2, 1, 2)
+	require.NoError(t, err)
+	values := []uint64{}
+	for i := 0; i < 4; i++ {
+		value, err := counters.Next("counter")
+		require.NoError(t, err)
+		values = append(values, value)
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 1}, values)
+	// the reservation restarts with the wrap around and ends at the maximal value at the latest
+	assertStateFile(t, stateFile, `{"counter": 2}`)
+}
+
+func TestWrapAround(t *testing.T) {
+	counters, err := sequence.NewCounters("", 2, 1, 0)
+	require.NoError(t, err)
+	values := []uint64{}
+	for i := 0; i < 5; i++ {
+		value, err := counters.Next("counter")
+		require.NoError(t, err)
+		values = append(values, value)
+	}
+	assert.Equal(t, []uint64{1, 2, 3, 1, 2}, values)
+}
+
+func TestWrapAroundMaxWidth(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	require.NoError(t, ioutil.WriteFile(stateFile, []byte(`{"counter": 18446744073709551615}`), 0644))
+	counters, err := sequence.NewCounters(stateFile, sequence.MaxWidth, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), counters.Value("counter"))
+	value, err := counters.Next("counter")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), value)
+}
+
+func TestRestoreCounterExceedingWidth(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	require.NoError(t, ioutil.WriteFile(stateFile, []byte(`{"counter": 4294967296, "other": 7}`), 0644))
+	counters, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), counters.Value("counter"))
+	assert.Equal(t, uint64(7), counters.Value("other"))
+}
+
+func TestInvalidCounters(t *testing.T) {
+	_, err := sequence.NewCounters("", 0, 0, 0)
+	assert.EqualError(t, err, "counter width 0 is not between 1 and 64")
+	_, err = sequence.NewCounters("", 65, 0, 0)
+	assert.EqualError(t, err, "counter width 65 is not between 1 and 64")
+	_, err = sequence.NewCounters("", 8, 256, 0)
+	assert.EqualError(t, err, "counter wrap value 256 exceeds the maximal value 255")
+
+	stateFile := filepath.Join(t.TempDir(), "counters.json")
+	require.NoError(t, ioutil.WriteFile(stateFile, []byte(`{"counter": -1}`), 0644))
+	_, err = sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot parse counters state file")
+}
+
+func TestPersistError(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "missing", "counters.json")
+	counters, err := sequence.NewCounters(stateFile, sequence.DefaultWidth, 0, 1)
+	require.NoError(t, err)
+
+	_, err = counters.Next("counter")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot create temporary counters state file")
+	assert.Equal(t, uint64(0), counters.Value("counter"))
+
+	require.NoError(t, os.Mkdir(filepath.Dir(stateFile), 0755))
+	value, err := counters.Next("counter")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), value)
+}
+
+func assertStateFile(t *testing.T, stateFile string, expected string) {
+	data, err := ioutil.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.JSONEq(t, expected, string(data))
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+)
+
+// RetryInterval is the interval of the retries to send the queued messages while connected.
+var RetryInterval = 5 * time.Second
+
+type (
+	priorityContextKey struct{}
+	expiryContextKey   struct{}
+)
+
+// SetPriorityToCtx adds the priority of a message to the context, the queued messages with a higher priority are sent
+// first and the messages with a lower priority are dropped first by the DropPriority policy.
+func SetPriorityToCtx(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// PriorityFromCtx returns the priority of a message, 0 if the context does not have one.
+func PriorityFromCtx(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityContextKey{}).(int)
+	return priority
+}
+
+// SetExpiryToCtx adds the expiry time of a message to the context, an expired message is dropped instead of sent.
+func SetExpiryToCtx(ctx context.Context, expiry time.Time) context.Context {
+	return context.WithValue(ctx, expiryContextKey{}, expiry)
+}
+
+// ExpiryFromCtx returns the expiry time of a message, false if the message does not expire.
+func ExpiryFromCtx(ctx context.Context) (time.Time, bool) {
+	expiry, ok := ctx.Value(expiryContextKey{}).(time.Time)
+	return expiry, ok
+}
+
+// ForwardingPublisher is a store-and-forward publisher, it publishes the messages with the wrapped publisher while
+// connected and queues them when disconnected or when the publishing fails. The queued messages are published in
+// the order of the queue when the connection is established again, and the new messages are queued until the queue
+// is drained. The messages with QoS 0 are never queued, they are published while connected and dropped otherwise.
+// The wrapped publisher is expected to fail when disconnected and to wait for the acknowledgement of the messages,
+// e.g. a connector online publisher. It is added as a connection listener of the connection of the wrapped publisher.
+type ForwardingPublisher struct {
+	pub       message.Publisher
+	queue     *Queue
+	logger    watermill.LoggerAdapter
+	connected int32
+	wakeup    chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+}
+
+// NewForwardingPublisher creates a store-and-forward publisher, which starts disconnected.
+func NewForwardingPublisher(pub message.Publisher, queue *Queue, logger watermill.LoggerAdapter) *ForwardingPublisher {
+	p := &ForwardingPublisher{
+		pub:     pub,
+		queue:   queue,
+		logger:  logger,
+		wakeup:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+	p.stopped.Add(1)
+	go p.forward()
+	return p
+}
+
+// Publish publishes the messages, or queues them if they cannot be published or older messages are still queued.
+// An error is returned only if a message can neither be published nor queued.
+func (p *ForwardingPublisher) Publish(topic string, msgs ...*message.Message) error {
+	queued := false
+	for _, msg := range msgs {
+		if expiry, ok := ExpiryFromCtx(msg.Context()); ok && time.Now().After(expiry) {
+			p.logger.Debug("Dropping expired message", watermill.LogFields{"message_uuid": msg.UUID})
+			continue
+		}
+		if qos, ok := connector.QosFromCtx(msg.Context()); ok && qos == connector.QosAtMostOnce {
+			p.publishAtMostOnce(topic, msg)
+			continue
+		}
+		if p.isConnected() && !queued && p.queue.Len() == 0 {
+			err := p.pub.Publish(topic, msg)
+			if err == nil {
+				continue
+			}
+			p.logger.Debug("Queuing message that cannot be published", watermill.LogFields{
+				"message_uuid": msg.UUID,
+				"error":        err.Error(),
+			})
+		}
+		if err := p.queue.Push(createEntry(topic, msg)); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		p.notify()
+	}
+	return nil
+}
+
+func (p *ForwardingPublisher) publishAtMostOnce(topic string, msg *message.Message) {
+	err := connector.ErrNotConnected
+	if p.isConnected() {
+		err = p.pub.Publish(topic, msg)
+	}
+	if err != nil {
+		p.logger.Debug("Dropping message that cannot be published", watermill.LogFields{
+			"message_uuid": msg.UUID,
+			"error":        err.Error(),
+		})
+	}
+}
+
+// Connected starts the forwarding of the queued messages when the connection is established.
+func (p *ForwardingPublisher) Connected(connected bool, err error) {
+	if connected {
+		atomic.StoreInt32(&p.connected, 1)
+		p.notify()
+	} else {
+		atomic.StoreInt32(&p.connected, 0)
+	}
+}
+
+// Close stops the forwarding and closes the wrapped publisher, the queued messages are kept. It can be called
+// multiple times, e.g. by each router handler of the publisher.
+func (p *ForwardingPublisher) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.stopped.Wait()
+		err = p.pub.Close()
+	})
+	return err
+}
+
+func (p *ForwardingPublisher) isConnected() bool {
+	return atomic.LoadInt32(&p.connected) == 1
+}
+
+func (p *ForwardingPublisher) notify() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (p *ForwardingPublisher) forward() {
+	defer p.stopped.Done()
+
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closing:
+			return
+		case <-p.wakeup:
+		case <-ticker.C:
+		}
+		p.drain()
+	}
+}
+
+// drain publishes the queued messages in order until the queue is empty, the connection is lost or a message
+// cannot be published, which is retried later.
+func (p *ForwardingPublisher) drain() {
+	for p.isConnected() {
+		select {
+		case <-p.closing:
+			return
+		default:
+		}
+		entry, ok := p.queue.Front()
+		if !ok {
+			return
+		}
+		if err := p.pub.Publish(entry.Topic, entry.message()); err != nil {
+			p.logger.Error("Failed to publish queued message", err, watermill.LogFields{"message_uuid": entry.UUID})
+			return
+		}
+		p.queue.Remove(entry)
+	}
+}
+
+func createEntry(topic string, msg *message.Message) *Entry {
+	if msgTopic, ok := connector.TopicFromCtx(msg.Context()); ok && len(msgTopic) > 0 {
+		topic = msgTopic
+	}
+	entry := &Entry{
+		UUID:     msg.UUID,
+		Topic:    topic,
+		Metadata: msg.Metadata,
+		Payload:  msg.Payload,
+		Priority: PriorityFromCtx(msg.Context()),
+	}
+	if qos, ok := connector.QosFromCtx(msg.Context()); ok {
+		value := byte(qos)
+		entry.Qos = &value
+	}
+	if expiry, ok := ExpiryFromCtx(msg.Context()); ok {
+		entry.Expires = &expiry
+	}
+	return entry
+}
+
+// message restores a queued message, it keeps the QoS of the message but not the other context values.
+func (entry *Entry) message() *message.Message {
+	msg := message.NewMessage(entry.UUID, entry.Payload)
+	msg.Metadata = entry.Metadata
+	if msg.Metadata == nil {
+		msg.Metadata = message.Metadata{}
+	}
+	if entry.Qos != nil {
+		msg.SetContext(connector.SetQosToCtx(msg.Context(), connector.Qos(*entry.Qos)))
+	}
+	return msg
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/eclipse-kanto/suite-connector/connector"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type publishedMessage struct {
+	topic   string
+	payload string
+	qos     connector.Qos
+}
+
+// onlinePublisher fails while offline, like a connector online publisher
+type onlinePublisher struct {
+	online    bool
+	published []publishedMessage
+	closed    int
+	mu        sync.Mutex
+}
+
+func (p *onlinePublisher) Publish(topic string, msgs ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.online {
+		return connector.ErrNotConnected
+	}
+	for _, msg := range msgs {
+		if msgTopic, ok := connector.TopicFromCtx(msg.Context()); ok && len(msgTopic) > 0 {
+			topic = msgTopic
+		}
+		qos, _ := connector.QosFromCtx(msg.Context())
+		p.published = append(p.published, publishedMessage{topic, string(msg.Payload), qos})
+	}
+	return nil
+}
+
+func (p *onlinePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed++
+	return nil
+}
+
+func (p *onlinePublisher) setOnline(online bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.online = online
+}
+
+func (p *onlinePublisher) payloads() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payloads := []string{}
+	for _, published := range p.published {
+		payloads = append(payloads, published.payload)
+	}
+	return payloads
+}
+
+func TestForwardingPublisher(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	pub := &onlinePublisher{online: true}
+	forwarder := store.NewForwardingPublisher(pub, queue, watermill.NopLogger{})
+	defer forwarder.Close()
+
+	forwarder.Connected(true, nil)
+	require.NoError(t, forwarder.Publish(connector.TopicEmpty, createMessage("1", "devices/dummy/messages/events/")))
+	assert.Equal(t, []string{"1"}, pub.payloads())
+	assert.Equal(t, 0, queue.Len())
+
+	pub.setOnline(false)
+	forwarder.Connected(false, nil)
+	require.NoError(t, forwarder.Publish(connector.TopicEmpty, createMessage("2", "devices/dummy/messages/events/"), createMessage("3", "")))
+	assert.Equal(t, 2, queue.Len())
+
+	pub.setOnline(true)
+	forwarder.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return queue.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1", "2", "3"}, pub.payloads())
+	assert.Equal(t, publishedMessage{"devices/dummy/messages/events/", "2", connector.QosAtLeastOnce}, pub.published[1])
+	assert.Equal(t, "", pub.published[2].topic)
+}
+
+func TestForwardingPublisherKeepsOrder(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{})
+	require.NoError(t, err)
+	pub := &onlinePublisher{}
+	forwarder := store.NewForwardingPublisher(pub, queue, watermill.NopLogger{})
+	defer forwarder.Close()
+
+	// the publishing fails although connected, the queued message is not overtaken by the next ones
+	forwarder.Connected(true, nil)
+	require.NoError(t, forwarder.Publish("topic", createMessage("1", "")))
+	pub.setOnline(true)
+	require.NoError(t, forwarder.Publish("topic", createMessage("2", "")))
+	require.Eventually(t, func() bool {
+		return queue.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1", "2"}, pub.payloads())
+}
+
+func TestForwardingPublisherRestart(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	forwarder := store.NewForwardingPublisher(&onlinePublisher{}, queue, watermill.NopLogger{})
+	require.NoError(t, forwarder.Publish("topic", createMessage("1", ""), createMessage("2", "")))
+	require.NoError(t, forwarder.Close())
+	require.NoError(t, forwarder.Close())
+
+	queue, err = store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	pub := &onlinePublisher{online: true}
+	forwarder = store.NewForwardingPublisher(pub, queue, watermill.NopLogger{})
+	forwarder.Connected(true, nil)
+	require.Eventually(t, func() bool {
+		return queue.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, forwarder.Close())
+	assert.Equal(t, []string{"1", "2"}, pub.payloads())
+	assert.Equal(t, 1, pub.closed)
+}
+
+func TestMessagePriority(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{MaxMessages: 1, DropPolicy: store.DropPriority})
+	require.NoError(t, err)
+	forwarder := store.NewForwardingPublisher(&onlinePublisher{}, queue, watermill.NopLogger{})
+	defer forwarder.Close()
+
+	important := createMessage("important", "")
+	important.SetContext(store.SetPriorityToCtx(important.Context(), 1))
+	require.NoError(t, forwarder.Publish("topic", important, createMessage("periodic", "")))
+	entry, ok := queue.Front()
+	require.True(t, ok)
+	assert.Equal(t, "important", string(entry.Payload))
+	assert.Equal(t, 1, entry.Priority)
+}
+
+func TestAtMostOnceAndExpiredMessages(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{})
+	require.NoError(t, err)
+	pub := &onlinePublisher{}
+	forwarder := store.NewForwardingPublisher(pub, queue, watermill.NopLogger{})
+	defer forwarder.Close()
+
+	atMostOnce := createMessage("atMostOnce", "")
+	atMostOnce.SetContext(connector.SetQosToCtx(atMostOnce.Context(), connector.QosAtMostOnce))
+	expired := createMessage("expired", "")
+	expired.SetContext(store.SetExpiryToCtx(expired.Context(), time.Now().Add(-time.Second)))
+	expiring := createMessage("expiring", "")
+	expiring.SetContext(store.SetExpiryToCtx(expiring.Context(), time.Now().Add(time.Hour)))
+	require.NoError(t, forwarder.Publish("topic", atMostOnce, expired, expiring))
+	assert.Equal(t, 1, queue.Len())
+
+	pub.setOnline(true)
+	forwarder.Connected(true, nil)
+	require.NoError(t, forwarder.Publish("topic", atMostOnce))
+	require.Eventually(t, func() bool {
+		return queue.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"expiring", "atMostOnce"}, pub.payloads())
+}
+
+func createMessage(payload string, topic string) *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(payload))
+	if len(topic) > 0 {
+		msg.SetContext(connector.SetTopicToCtx(msg.Context(), topic))
+		msg.SetContext(connector.SetQosToCtx(msg.Context(), connector.QosAtLeastOnce))
+	}
+	return msg
+}
@@ -0,0 +1,328 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package store implements the store-and-forward buffering of the messages to the Azure IoT Hub, which keeps the
+// messages that cannot be sent while the connection is lost on the disk and sends them when it is established again.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DropOldest drops the oldest messages when the queue is full.
+	DropOldest = "oldest"
+	// DropPriority drops the messages with the lowest priority when the queue is full, the oldest first among the
+	// messages with the same priority.
+	DropPriority = "priority"
+
+	entryExtension = ".msg"
+	tmpExtension   = ".tmp"
+)
+
+// Limits are the bounds of a queue, a zero value is no limit.
+type Limits struct {
+	// MaxMessages is the maximal number of queued messages.
+	MaxMessages int
+	// MaxSize is the maximal total size in bytes of the payloads of the queued messages.
+	MaxSize int64
+	// MaxAge is the maximal time a message is queued, older messages are dropped instead of sent.
+	MaxAge time.Duration
+	// DropPolicy selects the messages that are dropped when the queue is full, DropOldest by default.
+	DropPolicy string
+}
+
+// Validate checks the drop policy and the limits.
+func (limits Limits) Validate() error {
+	switch limits.DropPolicy {
+	case "", DropOldest, DropPriority:
+	default:
+		return errors.New(fmt.Sprintf("unsupported drop policy '%s'", limits.DropPolicy))
+	}
+	if limits.MaxMessages < 0 || limits.MaxSize < 0 || limits.MaxAge < 0 {
+		return errors.New("the queue limits cannot be negative")
+	}
+	return nil
+}
+
+// Entry is a queued message with the MQTT topic it is published to. A message that expires is dropped instead of sent
+// after its expiry time.
+type Entry struct {
+	UUID     string           `json:"uuid"`
+	Topic    string           `json:"topic"`
+	Metadata message.Metadata `json:"metadata,omitempty"`
+	Payload  []byte           `json:"payload"`
+	Qos      *byte            `json:"qos,omitempty"`
+	Priority int              `json:"priority,omitempty"`
+	Created  time.Time        `json:"created"`
+	Expires  *time.Time       `json:"expires,omitempty"`
+	seq      uint64
+	size     int64
+}
+
+// Queue is a bounded priority queue of messages, which persists each message in a file of its own in the queue
+// directory, so the queued messages survive a restart. The messages with the highest priority are sent first and the
+// messages with the same priority in the order they were queued. The files are named after the sequence number of the
+// message, which keeps the order of the messages.
+type Queue struct {
+	dir     string
+	limits  Limits
+	entries []*Entry
+	size    int64
+	nextSeq uint64
+	dropped uint64
+	closed  bool
+	mu      sync.Mutex
+}
+
+// NewQueue opens the queue in the provided directory, creating the directory if it does not exist, and restores the
+// messages queued in it. The files that cannot be read are removed.
+func NewQueue(dir string, limits Limits) (*Queue, error) {
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("cannot create queue directory '%s'", dir))
+	}
+	queue := &Queue{
+		dir:     dir,
+		limits:  limits,
+		nextSeq: 1,
+	}
+	if err := queue.restore(); err != nil {
+		return nil, err
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.evict(time.Now())
+	return queue, nil
+}
+
+// Push persists a message at the end of the queue and drops messages according to the drop policy if the queue
+// limits are exceeded, which can be the pushed message itself.
+func (q *Queue) Push(entry *Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errors.New(fmt.Sprintf("queue '%s' is closed", q.dir))
+	}
+	entry.seq = q.nextSeq
+	entry.size = int64(len(entry.Payload))
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot serialize queued message")
+	}
+	if err := q.write(entry.seq, data); err != nil {
+		return err
+	}
+	q.nextSeq++
+	q.entries = append(q.entries, entry)
+	q.size += entry.size
+	q.evict(time.Now())
+	return nil
+}
+
+// Front returns the oldest queued message with the highest priority, the expired messages and the messages older
+// than the maximal age are dropped.
+func (q *Queue) Front() (*Entry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, false
+	}
+	q.evict(time.Now())
+	if len(q.entries) == 0 {
+		return nil, false
+	}
+	front := q.entries[0]
+	for _, entry := range q.entries[1:] {
+		if entry.Priority > front.Priority {
+			front = entry
+		}
+	}
+	return front, true
+}
+
+// Remove removes a message from the queue, e.g. after it is sent.
+func (q *Queue) Remove(entry *Entry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.entries {
+		if queued == entry {
+			q.removeAt(i)
+			return
+		}
+	}
+}
+
+// Close closes the queue, the queued messages are kept in the queue directory for the next start. The messages pushed
+// after the queue is closed are rejected and no more messages are returned by Front, so the forwarding stops, while
+// the sent messages can still be removed. It can be called multiple times.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	return nil
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.entries)
+}
+
+// Dropped returns the number of messages dropped because of the queue limits since the queue was opened.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
+
+// evict drops the expired messages and then the messages selected by the drop policy until the queue is within its
+// limits.
+func (q *Queue) evict(now time.Time) {
+	for i := 0; i < len(q.entries); {
+		if q.expired(q.entries[i], now) {
+			q.removeAt(i)
+			q.dropped++
+		} else {
+			i++
+		}
+	}
+	for len(q.entries) > 0 && q.exceeded() {
+		q.removeAt(q.dropIndex())
+		q.dropped++
+	}
+}
+
+func (q *Queue) expired(entry *Entry, now time.Time) bool {
+	if entry.Expires != nil && now.After(*entry.Expires) {
+		return true
+	}
+	return q.limits.MaxAge > 0 && now.Sub(entry.Created) > q.limits.MaxAge
+}
+
+func (q *Queue) exceeded() bool {
+	return (q.limits.MaxMessages > 0 && len(q.entries) > q.limits.MaxMessages) ||
+		(q.limits.MaxSize > 0 && q.size > q.limits.MaxSize)
+}
+
+// dropIndex returns the index of the next message to drop, the entries are ordered from the oldest to the newest.
+func (q *Queue) dropIndex() int {
+	if q.limits.DropPolicy != DropPriority {
+		return 0
+	}
+	index := 0
+	for i, entry := range q.entries {
+		if entry.Priority < q.entries[index].Priority {
+			index = i
+		}
+	}
+	return index
+}
+
+func (q *Queue) removeAt(index int) {
+	entry := q.entries[index]
+	os.Remove(q.entryFile(entry.seq))
+	q.size -= entry.size
+	q.entries = append(q.entries[:index], q.entries[index+1:]...)
+}
+
+func (q *Queue) entryFile(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, entryExtension))
+}
+
+func (q *Queue) restore() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot read queue directory '%s'", q.dir))
+	}
+	for _, file := range files {
+		name := file.Name()
+		// a temporary file is left by a write interrupted by a crash, its message was never queued
+		if !file.IsDir() && strings.Contains(name, entryExtension+tmpExtension) {
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, entryExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, entryExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		entry := &Entry{}
+		data, err := ioutil.ReadFile(filepath.Join(q.dir, name))
+		if err != nil || json.Unmarshal(data, entry) != nil {
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		entry.seq = seq
+		entry.size = int64(len(entry.Payload))
+		q.entries = append(q.entries, entry)
+		q.size += entry.size
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool {
+		return q.entries[i].seq < q.entries[j].seq
+	})
+	return nil
+}
+
+// write writes a message to a temporary file in the queue directory and renames it, so a message file is never a
+// partially written one.
+func (q *Queue) write(seq uint64, data []byte) error {
+	entryFile := q.entryFile(seq)
+	tmpFile, err := ioutil.TempFile(q.dir, filepath.Base(entryFile)+tmpExtension)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot create temporary message file in '%s'", q.dir))
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, fmt.Sprintf("cannot write message file '%s'", entryFile))
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, fmt.Sprintf("cannot sync message file '%s'", entryFile))
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot write message file '%s'", entryFile))
+	}
+	if err := os.Rename(tmpFile.Name(), entryFile); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("cannot rename message file '%s'", entryFile))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Contributors to the Eclipse Foundation
+//
+// See the NOTICE file(s) distributed with this work for additional
+// information regarding copyright ownership.
+//
+// This program and the accompanying materials are made available under the
+// terms of the Apache License 2.0 which is available at
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eclipse-leda/leda-contrib-cloud-connector/routing/message/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueOrder(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "2", "3")
+	assert.Equal(t, []string{"1", "2", "3"}, drainEntries(queue))
+	_, ok := queue.Front()
+	assert.False(t, ok)
+}
+
+func TestQueueRestore(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "2")
+	entry, _ := queue.Front()
+	queue.Remove(entry)
+	pushEntries(t, queue, 0, "3")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000099.msg"), []byte("{"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000005.msg.tmp123456"), []byte(`{"topic":`), 0600))
+
+	restored, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, restored.Len())
+	pushEntries(t, restored, 0, "4")
+	entry, ok := restored.Front()
+	require.True(t, ok)
+	assert.Equal(t, "topic/2", entry.Topic)
+	assert.Equal(t, []byte("2"), entry.Payload)
+	assert.Equal(t, "2", entry.Metadata.Get("id"))
+	assert.Equal(t, []string{"2", "3", "4"}, drainEntries(restored))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "the sent and the corrupted messages and the temporary files are removed")
+}
+
+func TestQueueClose(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "2")
+	entry, ok := queue.Front()
+	require.True(t, ok)
+
+	require.NoError(t, queue.Close())
+	require.NoError(t, queue.Close())
+	assert.Error(t, queue.Push(&store.Entry{Topic: "topic/3", Payload: []byte("3")}))
+	_, ok = queue.Front()
+	assert.False(t, ok, "no messages are forwarded after the queue is closed")
+	queue.Remove(entry)
+
+	restored, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, drainEntries(restored))
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{MaxMessages: 2})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "2", "3")
+	assert.Equal(t, uint64(1), queue.Dropped())
+	assert.Equal(t, []string{"2", "3"}, drainEntries(queue))
+
+	queue, err = store.NewQueue(t.TempDir(), store.Limits{MaxSize: 3})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "22", "3")
+	assert.Equal(t, []string{"22", "3"}, drainEntries(queue))
+}
+
+func TestQueueDropPriority(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{MaxMessages: 3, DropPolicy: store.DropPriority})
+	require.NoError(t, err)
+	pushEntries(t, queue, 1, "1")
+	pushEntries(t, queue, 0, "2", "3")
+	pushEntries(t, queue, 2, "4")
+	pushEntries(t, queue, 0, "5")
+	assert.Equal(t, []string{"4", "1", "5"}, drainEntries(queue))
+
+	// a message with a lower priority than all queued messages is dropped itself
+	pushEntries(t, queue, 1, "6", "7", "8")
+	pushEntries(t, queue, 0, "9")
+	assert.Equal(t, []string{"6", "7", "8"}, drainEntries(queue))
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{MaxAge: time.Hour})
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(&store.Entry{UUID: "old", Payload: []byte("old"), Created: time.Now().Add(-2 * time.Hour)}))
+	pushEntries(t, queue, 0, "new")
+	assert.Equal(t, []string{"new"}, drainEntries(queue))
+	assert.Equal(t, uint64(1), queue.Dropped())
+}
+
+func TestQueueFrontByPriority(t *testing.T) {
+	queue, err := store.NewQueue(t.TempDir(), store.Limits{})
+	require.NoError(t, err)
+	pushEntries(t, queue, 0, "1", "2")
+	pushEntries(t, queue, 1, "3", "4")
+	pushEntries(t, queue, -1, "5")
+	pushEntries(t, queue, 0, "6")
+	assert.Equal(t, []string{"3", "4", "1", "2", "6", "5"}, drainEntries(queue))
+}
+
+func TestQueueExpiry(t *testing.T) {
+	dir := t.TempDir()
+	queue, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	expired := time.Now().Add(-time.Second)
+	valid := time.Now().Add(time.Hour)
+	require.NoError(t, queue.Push(&store.Entry{UUID: "expired", Payload: []byte("expired"), Expires: &expired}))
+	require.NoError(t, queue.Push(&store.Entry{UUID: "valid", Payload: []byte("valid"), Expires: &valid}))
+
+	restored, err := store.NewQueue(dir, store.Limits{})
+	require.NoError(t, err)
+	entry, ok := restored.Front()
+	require.True(t, ok)
+	assert.True(t, valid.Equal(*entry.Expires))
+	assert.Equal(t, []string{"valid"}, drainEntries(restored))
+}
+
+func TestInvalidQueueLimits(t *testing.T) {
+	_, err := store.NewQueue(t.TempDir(), store.Limits{DropPolicy: "newest"})
+	assert.Error(t, err)
+	_, err = store.NewQueue(t.TempDir(), store.Limits{MaxMessages: -1})
+	assert.Error(t, err)
+}
+
+func pushEntries(t *testing.T, queue *store.Queue, priority int, payloads ...string) {
+	for _, payload := range payloads {
+		entry := &store.Entry{
+			UUID:     payload,
+			Topic:    "topic/" + payload,
+			Metadata: map[string]string{"id": payload},
+			Payload:  []byte(payload),
+			Priority: priority,
+		}
+		require.NoError(t, queue.Push(entry))
+	}
+}
+
+func drainEntries(queue *store.Queue) []string {
+	payloads := []string{}
+	for entry, ok := queue.Front(); ok; entry, ok = queue.Front() {
+		payloads = append(payloads, string(entry.Payload))
+		queue.Remove(entry)
+	}
+	return payloads
+}